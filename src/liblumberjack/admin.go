@@ -0,0 +1,65 @@
+package liblumberjack
+
+import (
+  "encoding/json"
+  "log"
+  "net/http"
+  "sync"
+)
+
+// The admin http server exposes:
+//   /metrics - all metrics, in the Prometheus text format
+//   /status - a JSON object of the registered status providers
+//   POST /harvesters/disable?path=... - stop shipping a file
+//   POST /harvesters/enable?path=... - resume shipping a file
+//   POST /prospector/scan - look for new files now
+
+var status_lock sync.Mutex
+var status_providers = make(map[string]func() interface{})
+
+// Register a function whose result, marshaled as JSON, is reported under
+// name in /status. Registering a name again replaces the old provider.
+func RegisterStatus(name string, provider func() interface{}) {
+  status_lock.Lock()
+  defer status_lock.Unlock()
+  status_providers[name] = provider
+}
+
+func status() map[string]interface{} {
+  status_lock.Lock()
+  defer status_lock.Unlock()
+  result := make(map[string]interface{})
+  for name, provider := range status_providers {
+    result[name] = provider()
+  }
+  return result
+}
+
+// Handlers for the admin http server. Other files add to this in init().
+var admin_mux = http.NewServeMux()
+
+func init() {
+  admin_mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    WriteMetrics(w)
+  })
+  admin_mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    data, err := json.MarshalIndent(status(), "", "  ")
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    w.Write(data)
+  })
+}
+
+// Serve the admin http endpoints on the given address. This blocks, so run
+// it in a goroutine.
+func ServeAdmin(addr string) {
+  log.Printf("Serving admin endpoints on %s\n", addr)
+  err := http.ListenAndServe(addr, admin_mux)
+  if err != nil {
+    log.Printf("Admin http server on %s failed: %s\n", addr, err)
+  }
+}
@@ -0,0 +1,91 @@
+package liblumberjack
+
+import (
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// A Backfill limits how fast harvesters far behind the end of their file
+// ship, so a restart with a large backlog (many files read from their
+// beginning, say) doesn't overwhelm the collector. A harvester is
+// backfilling from when it starts more than Distance bytes from the end of
+// its file until it first gets within Distance of it; from then on it
+// ships as fast as lines are written. Rate is shared by all the harvesters
+// backfilling at once.
+type Backfill struct {
+  Rate float64 // events per second
+  Distance int64 // bytes
+
+  lock sync.Mutex
+  next time.Time // when the next event may be shipped
+}
+
+var backfilling_harvesters int64
+var backfilling_gauge = NewGauge("lumberjack_backfilling_harvesters",
+  "Harvesters more than -backfill-distance behind the end of their file, limited to -backfill-rate.")
+
+// Wait for the next event's turn under Rate.
+func (b *Backfill) wait() {
+  b.lock.Lock()
+  now := time.Now()
+  if b.next.Before(now) {
+    b.next = now
+  }
+  delay := b.next.Sub(now)
+  b.next = b.next.Add(time.Duration(float64(time.Second) / b.Rate))
+  b.lock.Unlock()
+  time.Sleep(delay)
+}
+
+// One harvester's place in its backfill.
+type backfill_state struct {
+  backfill *Backfill
+  progress *progress
+  size int64 // the file's size when last looked at
+}
+
+// The backfill of a harvester starting at offset, or nil if there is none
+// or it starts close enough to the end.
+func (h *Harvester) start_backfill(file harvest_file, offset int64, p *progress) *backfill_state {
+  if h.Backfill == nil || h.Backfill.Rate <= 0 {
+    return nil
+  }
+  info, err := file.Stat()
+  if err != nil || info.Size() - offset <= h.Backfill.Distance {
+    return nil
+  }
+  set_backfilling(p, true)
+  return &backfill_state{backfill: h.Backfill, progress: p, size: info.Size()}
+}
+
+func set_backfilling(p *progress, backfilling bool) {
+  if backfilling {
+    atomic.StoreInt32(&p.backfilling, 1)
+    backfilling_gauge.Set(float64(atomic.AddInt64(&backfilling_harvesters, 1)))
+  } else {
+    atomic.StoreInt32(&p.backfilling, 0)
+    backfilling_gauge.Set(float64(atomic.AddInt64(&backfilling_harvesters, -1)))
+  }
+}
+
+// Before shipping the event at offset: wait its turn, or return false once
+// caught up, when the backfill is over. The file is only stat'd again when
+// the harvester is within Distance of where the end last was.
+func (s *backfill_state) throttle(file harvest_file, offset int64) bool {
+  if s.size - offset <= s.backfill.Distance {
+    if info, err := file.Stat(); err == nil {
+      s.size = info.Size()
+    }
+    if s.size - offset <= s.backfill.Distance {
+      s.stop()
+      return false
+    }
+  }
+  s.backfill.wait()
+  return true
+}
+
+func (s *backfill_state) stop() {
+  set_backfilling(s.progress, false)
+}
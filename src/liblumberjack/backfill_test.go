@@ -0,0 +1,57 @@
+package liblumberjack
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func TestBackfillRate(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "backlog.log")
+  backlog := ""
+  for i := 0; i < 200; i++ {
+    backlog += fmt.Sprintf("%09d\n", i) // 10 bytes a line
+  }
+  append_file(t, path, backlog)
+
+  // The first 150 lines are more than 500 bytes from the end.
+  output := make(chan *FileEvent, 300)
+  harvester := Harvester{Path: path, from_beginning: true,
+                         Backfill: &Backfill{Rate: 200, Distance: 500}}
+  go harvester.Harvest(output)
+
+  receive := func(count int) time.Duration {
+    start := time.Now()
+    for i := 0; i < count; i++ {
+      select {
+        case <-output:
+        case <-time.After(3 * time.Second):
+          t.Fatalf("Timed out after %d of %d events", i, count)
+      }
+    }
+    return time.Since(start)
+  }
+  if took := receive(140); took < 500 * time.Millisecond {
+    t.Fatalf("Expected the backfill limited to 200 events/s, shipped 140 in %s", took)
+  }
+  if backfilling_gauge.Value() != 1 {
+    t.Fatalf("Expected 1 harvester backfilling, got %v", backfilling_gauge.Value())
+  }
+
+  // Caught up; the rest, and lines written from now on, are not limited.
+  if took := receive(60); took > 200 * time.Millisecond {
+    t.Fatalf("Expected the end of the backlog unlimited, took %s", took)
+  }
+  if backfilling_gauge.Value() != 0 {
+    t.Fatalf("Expected no harvester backfilling once caught up, got %v", backfilling_gauge.Value())
+  }
+  // Harvesters at EOF check for more every second; 200 limited events would
+  // take another second on top of that.
+  append_file(t, path, backlog)
+  if took := receive(200); took > 1500 * time.Millisecond {
+    t.Fatalf("Expected new lines unlimited once caught up, took %s", took)
+  }
+}
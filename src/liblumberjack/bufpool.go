@@ -0,0 +1,78 @@
+package liblumberjack
+
+import (
+  "bytes"
+  "compress/flate"
+  "compress/gzip"
+  "compress/zlib"
+  "io"
+  "sync"
+)
+
+// With Publisher.ReuseBuffers, the buffer each payload is compressed into,
+// and the zlib or gzip writer compressing it, come from pools shared by
+// every encoder (see CompressWorkers) rather than being allocated for each
+// batch: a writer's compression state alone is hundreds of KB, most of the
+// garbage a busy publisher makes.
+//
+// encode checks a buffer out; ship_batch returns it once the batch has been
+// boxed for every socket and shipped or given up on, and nothing refers to
+// it after that (ciphertexts are copies). Buffers are Reset when checked
+// out, writers Reset onto their new buffer, so nothing of one batch can
+// reach another. Buffers grown past max_pooled_buffer, by an unusually
+// large batch, are left to the garbage collector rather than kept.
+
+const max_pooled_buffer = 16 << 20
+
+var payload_buffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// By level, from HuffmanOnly (-2) to BestCompression (9).
+var zlib_writers [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+var gzip_writers [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+func (p *Publisher) new_buffer() *bytes.Buffer {
+  if !p.ReuseBuffers {
+    return new(bytes.Buffer)
+  }
+  buffer := payload_buffers.Get().(*bytes.Buffer)
+  buffer.Reset()
+  return buffer
+}
+
+// Return a shipped batch's buffer to the pool.
+func (p *Publisher) release(batch *encoded_batch) {
+  if !p.ReuseBuffers || batch.buffer == nil {
+    return
+  }
+  buffer := batch.buffer
+  batch.buffer = nil
+  batch.plaintext = nil
+  if buffer.Cap() <= max_pooled_buffer {
+    payload_buffers.Put(buffer)
+  }
+}
+
+// A zlib writer at level onto w; with pooled, from zlib_writers, to be Put
+// back there once closed.
+func zlib_writer(w io.Writer, level int, pooled bool) *zlib.Writer {
+  if pooled {
+    if compressor, ok := zlib_writers[level - zlib.HuffmanOnly].Get().(*zlib.Writer); ok {
+      compressor.Reset(w)
+      return compressor
+    }
+  }
+  compressor, _ := zlib.NewWriterLevel(w, level)
+  return compressor
+}
+
+// As zlib_writer, for gzip_writers.
+func gzip_writer(w io.Writer, level int, pooled bool) *gzip.Writer {
+  if pooled {
+    if compressor, ok := gzip_writers[level - gzip.HuffmanOnly].Get().(*gzip.Writer); ok {
+      compressor.Reset(w)
+      return compressor
+    }
+  }
+  compressor, _ := gzip.NewWriterLevel(w, level)
+  return compressor
+}
@@ -0,0 +1,72 @@
+package liblumberjack
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "sodium"
+import "testing"
+
+func TestReuseBuffers(t *testing.T) {
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+
+  for _, compression := range []string{"zlib", "gzip"} {
+    publisher := Publisher{CompressWorkers: 4, ReuseBuffers: true, Compression: compression,
+                           Ordering: ORDERING_RELAXED}
+    input := make(chan []*FileEvent, 200)
+    for i := 0; i < 200; i++ {
+      // Sizes vary, so a reused buffer is often left with more in it than
+      // the next batch writes.
+      input <- sized_batch(i, 1 + (i * 37) % 300)
+    }
+    close(input)
+
+    // Released as ship_batch would, as soon as each is shipped; ciphertexts
+    // kept from earlier batches must be untouched by later ones.
+    var shipped []*encoded_batch
+    for batch := range publisher.encode_parallel(session, input) {
+      if batch.buffer == nil {
+        t.Fatal("Expected the batch to hold a pooled buffer")
+      }
+      publisher.release(batch)
+      if batch.buffer != nil || batch.plaintext != nil {
+        t.Fatal("Expected the released batch to no longer refer to its buffer")
+      }
+      shipped = append(shipped, batch)
+    }
+    if len(shipped) != 200 {
+      t.Fatalf("%s: expected 200 batches, got %d", compression, len(shipped))
+    }
+    for _, batch := range shipped {
+      decoded, err := DecodePayload(session.Open(batch.nonce, batch.ciphertext))
+      expected, _ := json.Marshal(batch.events)
+      if err != nil || !bytes.Equal(decoded, expected) {
+        t.Fatalf("%s: batch at %d does not hold its own events (%v)",
+                 compression, batch.events[0].Offset, err)
+      }
+    }
+  }
+}
+
+func BenchmarkReuseBuffers(b *testing.B) {
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  batch := sized_batch(0, 512)
+
+  for _, reuse := range []bool{false, true} {
+    b.Run(fmt.Sprintf("reuse=%v", reuse), func(b *testing.B) {
+      b.ReportAllocs()
+      publisher := Publisher{CompressWorkers: 4, ReuseBuffers: reuse}
+      input := make(chan []*FileEvent)
+      go func() {
+        for i := 0; i < b.N; i++ {
+          input <- batch
+        }
+        close(input)
+      }()
+      for encoded := range publisher.encode_parallel(session, input) {
+        publisher.release(encoded)
+      }
+    })
+  }
+}
@@ -0,0 +1,87 @@
+package liblumberjack
+
+import (
+  "encoding/json"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "sodium"
+)
+
+// A Bundle is lumberjack's flags, paths and keys in one JSON file, for
+// images where every extra file is a nuisance:
+//
+//   {
+//     "flags": {"servers": "logs.example.com:5005", "spool-size": "512"},
+//     "paths": ["/var/log/*.log"],
+//     "their_public_key": "<base64>",
+//     "my_secret_key": "<base64>"
+//   }
+//
+// Keys are the raw key bytes, base64 encoded as encoding/json does for
+// []byte. The secret key is optional, as with -my-secret-key.
+type Bundle struct {
+  Flags map[string]string `json:"flags"`
+  Paths []string `json:"paths"`
+  TheirPublicKey []byte `json:"their_public_key"`
+  MySecretKey []byte `json:"my_secret_key"`
+}
+
+func LoadBundle(path string) (*Bundle, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  bundle := &Bundle{}
+  if err = json.Unmarshal(data, bundle); err != nil {
+    return nil, fmt.Errorf("%s: %s", path, err)
+  }
+
+  if len(bundle.TheirPublicKey) != sodium.PUBLICKEYBYTES {
+    return nil, fmt.Errorf("%s: their_public_key must be %d bytes, got %d",
+                           path, sodium.PUBLICKEYBYTES, len(bundle.TheirPublicKey))
+  }
+  if bundle.MySecretKey != nil && len(bundle.MySecretKey) != sodium.SECRETKEYBYTES {
+    return nil, fmt.Errorf("%s: my_secret_key must be %d bytes, got %d",
+                           path, sodium.SECRETKEYBYTES, len(bundle.MySecretKey))
+  }
+  return bundle, nil
+}
+
+// Set each flag in the bundle that wasn't given on the command line, so
+// flags given there win.
+func (b *Bundle) Apply(flags *flag.FlagSet) error {
+  given := make(map[string]bool)
+  flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+  for name, value := range b.Flags {
+    if flags.Lookup(name) == nil {
+      return fmt.Errorf("unknown flag in bundle: %s", name)
+    }
+    if given[name] {
+      continue
+    }
+    if err := flags.Set(name, value); err != nil {
+      return fmt.Errorf("bad value for %s in bundle: %s", name, err)
+    }
+  }
+  return nil
+}
+
+// The bundle with its keys redacted, for logs and the admin /status.
+func (b *Bundle) Redacted() interface{} {
+  redacted := map[string]interface{}{
+    "flags": b.Flags,
+    "paths": b.Paths,
+    "their_public_key": "REDACTED",
+  }
+  if b.MySecretKey != nil {
+    redacted["my_secret_key"] = "REDACTED"
+  }
+  return redacted
+}
+
+func (b *Bundle) String() string {
+  data, _ := json.Marshal(b.Redacted())
+  return string(data)
+}
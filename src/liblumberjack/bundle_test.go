@@ -0,0 +1,81 @@
+package liblumberjack
+
+import "encoding/base64"
+import "encoding/json"
+import "flag"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sodium"
+import "strings"
+import "testing"
+
+func TestBundle(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "bundle.json")
+
+  public, secret := sodium.CryptoBoxKeypair()
+  data, _ := json.Marshal(map[string]interface{}{
+    "flags": map[string]string{"servers": "logs.example.com", "spool-size": "512"},
+    "paths": []string{"/var/log/*.log"},
+    "their_public_key": public[:],
+    "my_secret_key": secret[:],
+  })
+  ioutil.WriteFile(path, data, 0600)
+
+  bundle, err := LoadBundle(path)
+  if err != nil {
+    t.Fatalf("LoadBundle failed: %s", err)
+  }
+  if string(bundle.TheirPublicKey) != string(public[:]) ||
+     string(bundle.MySecretKey) != string(secret[:]) {
+    t.Fatalf("Keys were not loaded from the bundle")
+  }
+  if len(bundle.Paths) != 1 || bundle.Paths[0] != "/var/log/*.log" {
+    t.Fatalf("Unexpected paths: %v", bundle.Paths)
+  }
+
+  // Flags given on the command line win over the bundle.
+  flags := flag.NewFlagSet("lumberjack", flag.ContinueOnError)
+  servers := flags.String("servers", "", "")
+  spool_size := flags.Int("spool-size", 1024, "")
+  flags.Parse([]string{"-spool-size", "64"})
+  if err := bundle.Apply(flags); err != nil {
+    t.Fatalf("Apply failed: %s", err)
+  }
+  if *servers != "logs.example.com" || *spool_size != 64 {
+    t.Fatalf("Expected servers from the bundle and spool-size from the command line, got %q and %d",
+             *servers, *spool_size)
+  }
+
+  encoded := base64.StdEncoding.EncodeToString(secret[:])
+  if dump := bundle.String(); strings.Contains(dump, encoded) || !strings.Contains(dump, "REDACTED") {
+    t.Fatalf("Expected keys to be redacted: %s", dump)
+  }
+}
+
+func TestBundleValidation(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "bundle.json")
+
+  ioutil.WriteFile(path, []byte(`{"their_public_key": "c2hvcnQ="}`), 0600)
+  if _, err := LoadBundle(path); err == nil {
+    t.Fatalf("Expected a short public key to be rejected")
+  }
+
+  public, _ := sodium.CryptoBoxKeypair()
+  data, _ := json.Marshal(map[string]interface{}{
+    "flags": map[string]string{"no-such-flag": "1"},
+    "their_public_key": public[:],
+  })
+  ioutil.WriteFile(path, data, 0600)
+  bundle, err := LoadBundle(path)
+  if err != nil {
+    t.Fatalf("LoadBundle failed: %s", err)
+  }
+  if err := bundle.Apply(flag.NewFlagSet("lumberjack", flag.ContinueOnError)); err == nil {
+    t.Fatalf("Expected an unknown flag to be rejected")
+  }
+}
@@ -0,0 +1,87 @@
+package liblumberjack
+
+import (
+  "log"
+  "os"
+  "sync/atomic"
+  "time"
+)
+
+// With Harvester.CaughtUpBehind, a harvester that starts more than that
+// many bytes from the end of its file (after a restart with files read from
+// their beginning, say) is catching up. When it first reaches the end, and
+// is tailing live from then on, it logs so once, counts in
+// lumberjack_harvesters_caught_up_total and, with CaughtUpEvents, ships a
+// control event after the last of the events it caught up on, with Source
+// "lumberjack:caught_up" and fields:
+//   {"caught_up": true, "path": ..., "offset": ..., "behind_bytes": ...,
+//    "seconds": ..., "node": ..., "timestamp": "<RFC3339>"}
+// lumberjack_harvesters_catching_up going to 0 says a backfill is done.
+
+// The source of caught-up events, so collectors can filter them out.
+const caught_up_source = "lumberjack:caught_up"
+
+var catching_up_harvesters int64
+var catching_up_gauge = NewGauge("lumberjack_harvesters_catching_up",
+  "Harvesters that started more than -caught-up-behind from the end of their file and have yet to reach it.")
+var caught_up = NewCounter("lumberjack_harvesters_caught_up_total",
+  "Harvesters that reached the end of a file they started more than -caught-up-behind from.")
+
+type catch_up struct {
+  output chan *FileEvent
+  progress *progress
+  behind int64 // bytes to the end of the file, at the start
+  started time.Time
+}
+
+// Start catching up, if the harvester is far enough behind.
+func (h *Harvester) start_catch_up(output chan *FileEvent, offset int64,
+                                   info os.FileInfo, progress *progress) {
+  if h.CaughtUpBehind <= 0 || info == nil || info.Size() - offset <= h.CaughtUpBehind {
+    return
+  }
+  h.catching_up = &catch_up{output: output, progress: progress,
+                            behind: info.Size() - offset, started: time.Now()}
+  catching_up_gauge.Set(float64(atomic.AddInt64(&catching_up_harvesters, 1)))
+}
+
+// At the end of the file: caught up, if catching up.
+func (h *Harvester) reached_eof() {
+  c := h.catching_up
+  if c == nil {
+    return
+  }
+  h.stop_catch_up()
+  caught_up.Inc()
+  offset := atomic.LoadInt64(&c.progress.offset)
+  elapsed := time.Since(c.started)
+  log.Printf("%s caught up at offset %d, %d bytes in %s; tailing it live\n",
+             h.Path, offset, c.behind, elapsed)
+  if !h.CaughtUpEvents {
+    return
+  }
+
+  node := h.Node
+  if node == "" {
+    node, _ = os.Hostname()
+  }
+  source := caught_up_source
+  now := time.Now()
+  c.output <- &FileEvent{Source: &source, harvested: now, Fields: map[string]interface{}{
+    "caught_up": true,
+    "path": h.Path,
+    "offset": offset,
+    "behind_bytes": c.behind,
+    "seconds": elapsed.Seconds(),
+    "node": node,
+    "timestamp": now.UTC().Format(time.RFC3339),
+  }}
+} /* Harvester#reached_eof */
+
+// Stop catching up, whether or not the end was reached.
+func (h *Harvester) stop_catch_up() {
+  if h.catching_up != nil {
+    h.catching_up = nil
+    catching_up_gauge.Set(float64(atomic.AddInt64(&catching_up_harvesters, -1)))
+  }
+}
@@ -0,0 +1,76 @@
+package liblumberjack
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func TestHarvesterCaughtUp(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "backlog.log")
+  lines := write_lines(t, path, 5000)
+
+  output := make(chan *FileEvent, 6000)
+  harvester := Harvester{Path: path, from_beginning: true,
+                         CaughtUpBehind: 1024, CaughtUpEvents: true}
+  before := caught_up.Value()
+  go harvester.Harvest(output)
+
+  next := func() *FileEvent {
+    select {
+      case event := <-output:
+        return event
+      case <-time.After(3 * time.Second):
+        t.Fatal("Timed out waiting for an event")
+    }
+    return nil
+  }
+  for i := range lines {
+    if event := next(); *event.Source != path {
+      t.Fatalf("Expected line %d before catching up, got %v", i, event.Fields)
+    }
+  }
+  event := next()
+  if *event.Source != caught_up_source || event.Fields["caught_up"] != true ||
+     event.Fields["path"] != path || event.Fields["behind_bytes"].(int64) < 5000 {
+    t.Fatalf("Expected the caught-up event after the backlog, got %v", event.Fields)
+  }
+  if caught_up.Value() != before + 1 || catching_up_gauge.Value() != 0 {
+    t.Fatalf("Expected the caught-up metrics updated, got %d and %v",
+             caught_up.Value() - before, catching_up_gauge.Value())
+  }
+
+  // Tailing live from now on: new lines, and more EOFs, but no second
+  // caught-up event.
+  append_file(t, path, "one\n")
+  time.Sleep(1500 * time.Millisecond)
+  append_file(t, path, "two\n")
+  for _, expected := range []string{"one", "two"} {
+    if event := next(); event.Text == nil || *event.Text != expected {
+      t.Fatalf("Expected %q, got %v", expected, event.Fields)
+    }
+  }
+  time.Sleep(1500 * time.Millisecond)
+  select {
+    case event := <-output:
+      t.Fatalf("Expected nothing more, got %v", event.Fields)
+    default:
+  }
+  if caught_up.Value() != before + 1 {
+    t.Fatalf("Expected caught up once, got %d", caught_up.Value() - before)
+  }
+
+  // A harvester starting near the end isn't catching up.
+  near := Harvester{Path: path, from_beginning: true, stop_at_eof: true,
+                    CaughtUpBehind: 1 << 30, CaughtUpEvents: true}
+  quiet := make(chan *FileEvent, 6000)
+  near.Harvest(quiet)
+  close(quiet)
+  for event := range quiet {
+    if *event.Source == caught_up_source {
+      t.Fatal("Expected no caught-up event from a harvester that wasn't behind")
+    }
+  }
+}
@@ -0,0 +1,211 @@
+package liblumberjack
+
+import (
+  "encoding/json"
+  "strconv"
+  "strings"
+)
+
+// A Codec turns the text of an event into structured fields.
+type Codec interface {
+  Decode(event *FileEvent)
+}
+
+// JSONCodec parses each line as a JSON object.
+//
+// Include and Exclude take field paths, with dots separating nested object
+// keys (eg "request.headers.cookie"). If Include is non-empty, only those
+// fields are shipped. Fields in Exclude are never shipped, even if included.
+//
+// If MaxDepth is set, objects nested deeper than that (the line's object
+// being depth 1, and each object or array in it one more) are cut down to
+// it as DepthPolicy says. This is after Include and Exclude, so a deep
+// field that is excluded doesn't count.
+//
+// Lines that are not JSON objects are shipped as plain text.
+type JSONCodec struct {
+  Include []string
+  Exclude []string
+  MaxDepth int
+  DepthPolicy string
+}
+
+// Policies for JSONCodec.MaxDepth.
+const (
+  // The objects and arrays deeper than MaxDepth are replaced with
+  // depth_marker. The default.
+  DEPTH_TRUNCATE = "truncate"
+  // The objects and arrays deeper than MaxDepth are folded into the
+  // object at MaxDepth, with dotted keys: {"a":{"b":{"c":1}}} at a MaxDepth
+  // of 2 is {"a":{"b.c":1}}, and arrays are keyed by index ("b.0"). An
+  // array at MaxDepth has no keys to fold into; too deep objects and arrays
+  // in it are truncated.
+  DEPTH_FLATTEN = "flatten"
+  // The line is shipped as plain text.
+  DEPTH_RAW = "raw"
+)
+
+const depth_marker = "[nested too deeply]"
+
+func (c *JSONCodec) Decode(event *FileEvent) {
+  var fields map[string]interface{}
+  err := json.Unmarshal([]byte(*event.Text), &fields)
+  if err != nil || fields == nil {
+    return // not json, ship the raw line.
+  }
+
+  if len(c.Include) > 0 {
+    included := make(map[string]interface{})
+    for _, path := range c.Include {
+      if value, ok := lookup_field(fields, path); ok {
+        set_field(included, path, value)
+      }
+    }
+    fields = included
+  }
+  for _, path := range c.Exclude {
+    delete_field(fields, path)
+  }
+  if c.MaxDepth > 0 && json_depth(fields) > c.MaxDepth {
+    switch c.DepthPolicy {
+      case DEPTH_RAW:
+        return
+      case DEPTH_FLATTEN:
+        fields = flatten_depth(fields, c.MaxDepth).(map[string]interface{})
+      default:
+        fields = truncate_depth(fields, c.MaxDepth).(map[string]interface{})
+    }
+  }
+
+  event.Fields = fields
+  event.Text = nil
+} /* JSONCodec#Decode */
+
+// Find the value at a dotted path, descending through nested objects.
+func lookup_field(fields map[string]interface{}, path string) (interface{}, bool) {
+  keys := strings.Split(path, ".")
+  for _, key := range keys[:len(keys) - 1] {
+    child, ok := fields[key].(map[string]interface{})
+    if !ok {
+      return nil, false
+    }
+    fields = child
+  }
+  value, ok := fields[keys[len(keys) - 1]]
+  return value, ok
+}
+
+// Set the value at a dotted path, creating nested objects as needed.
+func set_field(fields map[string]interface{}, path string, value interface{}) {
+  keys := strings.Split(path, ".")
+  for _, key := range keys[:len(keys) - 1] {
+    child, ok := fields[key].(map[string]interface{})
+    if !ok {
+      child = make(map[string]interface{})
+      fields[key] = child
+    }
+    fields = child
+  }
+  fields[keys[len(keys) - 1]] = value
+}
+
+// Remove the value at a dotted path, if present.
+func delete_field(fields map[string]interface{}, path string) {
+  keys := strings.Split(path, ".")
+  for _, key := range keys[:len(keys) - 1] {
+    child, ok := fields[key].(map[string]interface{})
+    if !ok {
+      return
+    }
+    fields = child
+  }
+  delete(fields, keys[len(keys) - 1])
+}
+
+// How deeply objects and arrays nest in a decoded json value; 0 for a
+// scalar.
+func json_depth(value interface{}) int {
+  deepest := 0
+  switch value := value.(type) {
+    case map[string]interface{}:
+      for _, child := range value {
+        if depth := json_depth(child); depth > deepest {
+          deepest = depth
+        }
+      }
+    case []interface{}:
+      for _, child := range value {
+        if depth := json_depth(child); depth > deepest {
+          deepest = depth
+        }
+      }
+    default:
+      return 0
+  }
+  return deepest + 1
+}
+
+// The value with objects and arrays more than depth deep replaced with
+// depth_marker.
+func truncate_depth(value interface{}, depth int) interface{} {
+  switch value := value.(type) {
+    case map[string]interface{}:
+      if depth == 0 {
+        return depth_marker
+      }
+      for key, child := range value {
+        value[key] = truncate_depth(child, depth - 1)
+      }
+    case []interface{}:
+      if depth == 0 {
+        return depth_marker
+      }
+      for i, child := range value {
+        value[i] = truncate_depth(child, depth - 1)
+      }
+  }
+  return value
+}
+
+// The value with objects and arrays more than depth deep folded into
+// dotted keys of the object at depth; see DEPTH_FLATTEN.
+func flatten_depth(value interface{}, depth int) interface{} {
+  if depth == 1 {
+    if object, ok := value.(map[string]interface{}); ok {
+      flat := make(map[string]interface{}, len(object))
+      for key, child := range object {
+        flatten_into(flat, key, child)
+      }
+      return flat
+    }
+    return truncate_depth(value, 1)
+  }
+  switch value := value.(type) {
+    case map[string]interface{}:
+      for key, child := range value {
+        value[key] = flatten_depth(child, depth - 1)
+      }
+    case []interface{}:
+      for i, child := range value {
+        value[i] = flatten_depth(child, depth - 1)
+      }
+  }
+  return value
+}
+
+// Set flat[prefix] to value, or for an object or array, flat[prefix.key]
+// to each of its values, recursively.
+func flatten_into(flat map[string]interface{}, prefix string, value interface{}) {
+  switch value := value.(type) {
+    case map[string]interface{}:
+      for key, child := range value {
+        flatten_into(flat, prefix + "." + key, child)
+      }
+    case []interface{}:
+      for i, child := range value {
+        flatten_into(flat, prefix + "." + strconv.Itoa(i), child)
+      }
+    default:
+      flat[prefix] = value
+  }
+}
@@ -0,0 +1,94 @@
+package liblumberjack
+
+import "encoding/json"
+import "testing"
+
+func decode_json(t *testing.T, codec *JSONCodec, line string) *FileEvent {
+  source := "test"
+  event := &FileEvent{Source: &source, Text: &line}
+  codec.Decode(event)
+  return event
+}
+
+func assert_fields(t *testing.T, event *FileEvent, expected string) {
+  if event.Text != nil {
+    t.Fatalf("Expected the text to be replaced by fields, got %q", *event.Text)
+  }
+  actual, _ := json.Marshal(event.Fields)
+  if string(actual) != expected {
+    t.Fatalf("Expected fields %s, got %s", expected, actual)
+  }
+}
+
+const codec_test_line = `{"message":"login","user":{"name":"bob","password":"hunter2"},"token":"abc"}`
+
+func TestJSONCodecInclude(t *testing.T) {
+  codec := &JSONCodec{Include: []string{"message", "token"}}
+  assert_fields(t, decode_json(t, codec, codec_test_line),
+                `{"message":"login","token":"abc"}`)
+}
+
+func TestJSONCodecExclude(t *testing.T) {
+  codec := &JSONCodec{Exclude: []string{"token"}}
+  assert_fields(t, decode_json(t, codec, codec_test_line),
+                `{"message":"login","user":{"name":"bob","password":"hunter2"}}`)
+}
+
+func TestJSONCodecNestedFields(t *testing.T) {
+  codec := &JSONCodec{
+    Include: []string{"message", "user", "missing.field"},
+    Exclude: []string{"user.password"},
+  }
+  assert_fields(t, decode_json(t, codec, codec_test_line),
+                `{"message":"login","user":{"name":"bob"}}`)
+
+  codec = &JSONCodec{Include: []string{"user.name"}}
+  assert_fields(t, decode_json(t, codec, codec_test_line),
+                `{"user":{"name":"bob"}}`)
+}
+
+func TestJSONCodecNotJSON(t *testing.T) {
+  codec := &JSONCodec{Exclude: []string{"token"}}
+  for _, line := range []string{"plain text token=abc", `["an", "array"]`, `{"truncated": `} {
+    event := decode_json(t, codec, line)
+    if event.Text == nil || *event.Text != line || event.Fields != nil {
+      t.Fatalf("Expected %q to be shipped as plain text", line)
+    }
+  }
+}
+
+const deep_line = `{"level":"info","request":{"headers":{"cookie":{"session":"abc"}},"path":"/"},"tags":[["a",{"b":1}]]}`
+
+func TestJSONCodecMaxDepth(t *testing.T) {
+  codec := &JSONCodec{MaxDepth: 2}
+  assert_fields(t, decode_json(t, codec, deep_line),
+    `{"level":"info","request":{"headers":"[nested too deeply]","path":"/"},"tags":["[nested too deeply]"]}`)
+
+  codec = &JSONCodec{MaxDepth: 3, DepthPolicy: DEPTH_TRUNCATE}
+  assert_fields(t, decode_json(t, codec, deep_line),
+    `{"level":"info","request":{"headers":{"cookie":"[nested too deeply]"},"path":"/"},"tags":[["a","[nested too deeply]"]]}`)
+
+  codec = &JSONCodec{MaxDepth: 2, DepthPolicy: DEPTH_FLATTEN}
+  assert_fields(t, decode_json(t, codec, deep_line),
+    `{"level":"info","request":{"headers.cookie.session":"abc","path":"/"},"tags":["[nested too deeply]"]}`)
+
+  codec = &JSONCodec{MaxDepth: 1, DepthPolicy: DEPTH_FLATTEN}
+  assert_fields(t, decode_json(t, codec, deep_line),
+    `{"level":"info","request.headers.cookie.session":"abc","request.path":"/","tags.0.0":"a","tags.0.1.b":1}`)
+
+  codec = &JSONCodec{MaxDepth: 3, DepthPolicy: DEPTH_RAW}
+  if event := decode_json(t, codec, deep_line); event.Text == nil || *event.Text != deep_line {
+    t.Fatal("Expected a line nested too deeply shipped as plain text")
+  }
+
+  // Within the limit, or once deep fields are excluded, nothing changes.
+  for _, codec := range []*JSONCodec{
+    &JSONCodec{MaxDepth: 4, DepthPolicy: DEPTH_RAW},
+    &JSONCodec{MaxDepth: 2, DepthPolicy: DEPTH_RAW, Exclude: []string{"request.headers", "tags"}},
+  } {
+    event := decode_json(t, codec, deep_line)
+    if event.Text != nil || json_depth(event.Fields) > codec.MaxDepth {
+      t.Fatalf("Expected fields within a MaxDepth of %d, got %v", codec.MaxDepth, event.Fields)
+    }
+  }
+}
@@ -0,0 +1,109 @@
+package liblumberjack
+
+import (
+  "sodium"
+  "sync"
+)
+
+// With Publisher.CompressWorkers, batches are encoded (serialized,
+// compressed and boxed) by a pool of goroutines while earlier batches are
+// shipped, so one publisher can use more than one core. Batches still come
+// out, and are shipped and acknowledged, in the order they went in: each
+// batch gets its own result channel, queued in order, and the shipping side
+// waits on each in turn.
+//
+// That order can be given up for throughput with Publisher.Ordering, so a
+// batch that is slow to encode holds back only itself:
+//
+// ORDERING_STRICT (the default): batches are shipped in the order the
+// spooler flushed them, so a file's events reach the servers in the order
+// they were read.
+//
+// ORDERING_RELAXED: batches are shipped as soon as they are encoded, so a
+// later batch, and the events of a file in it, may reach the servers before
+// an earlier one. What is kept: the events within a batch stay in order; a
+// Barrier still returns only once every batch before it is shipped; and
+// every event still has its Source, Offset and Line (and ID, with
+// Harvester.IDScheme), so a collector can put a file's events back in
+// order itself. Without CompressWorkers there is only one encoder, and
+// relaxed ordering changes nothing.
+const (
+  ORDERING_STRICT = "strict"
+  ORDERING_RELAXED = "relaxed"
+)
+
+type compress_job struct {
+  events []*FileEvent
+  result chan *encoded_batch
+}
+
+// Encode batches from input on CompressWorkers goroutines, returning them
+// in order. The returned channel is closed once input is.
+func (p *Publisher) encode_parallel(session *sodium.Session,
+                                    input chan []*FileEvent) chan *encoded_batch {
+  if p.Ordering == ORDERING_RELAXED {
+    return p.encode_unordered(session, input)
+  }
+  jobs := make(chan *compress_job)
+  for i := 0; i < p.CompressWorkers; i++ {
+    go func() {
+      for job := range jobs {
+        job.result <- p.encode(session, job.events)
+      }
+    }()
+  }
+
+  // At most CompressWorkers batches are encoded ahead of shipping.
+  pending := make(chan chan *encoded_batch, p.CompressWorkers)
+  go func() {
+    for events := range input {
+      job := &compress_job{events, make(chan *encoded_batch, 1)}
+      pending <- job.result
+      jobs <- job
+    }
+    close(jobs)
+    close(pending)
+  }()
+
+  output := make(chan *encoded_batch)
+  go func() {
+    for result := range pending {
+      output <- <-result
+    }
+    close(output)
+  }()
+  return output
+}
+
+// Encode batches from input on CompressWorkers goroutines, returning each
+// as soon as it is encoded; a barrier waits for the batches before it.
+func (p *Publisher) encode_unordered(session *sodium.Session,
+                                     input chan []*FileEvent) chan *encoded_batch {
+  output := make(chan *encoded_batch)
+  jobs := make(chan []*FileEvent)
+  var in_flight sync.WaitGroup
+  for i := 0; i < p.CompressWorkers; i++ {
+    go func() {
+      for events := range jobs {
+        output <- p.encode(session, events)
+        in_flight.Done()
+      }
+    }()
+  }
+
+  go func() {
+    for events := range input {
+      if len(events) == 1 && events[0].barrier != nil {
+        in_flight.Wait()
+        output <- p.encode(session, events)
+        continue
+      }
+      in_flight.Add(1)
+      jobs <- events
+    }
+    close(jobs)
+    in_flight.Wait()
+    close(output)
+  }()
+  return output
+}
@@ -0,0 +1,115 @@
+package liblumberjack
+
+import "fmt"
+import "sodium"
+import "strings"
+import "testing"
+import "time"
+
+// A batch of size events, all at the given offset.
+func sized_batch(offset int, size int) []*FileEvent {
+  source := "/var/log/test"
+  var events []*FileEvent
+  for i := 0; i < size; i++ {
+    text := fmt.Sprintf("event %d of a batch at %d %s", i, offset, strings.Repeat("x", i % 50))
+    events = append(events, &FileEvent{Source: &source, Offset: uint64(offset),
+                                       Text: &text})
+  }
+  return events
+}
+
+func TestCompressWorkersPreserveOrder(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47366"
+  public, secret := sodium.CryptoBoxKeypair()
+  received := make(chan []*FileEvent, 20)
+  defer stub_server(t, endpoint, sodium.NewSession(public, secret), received).Close()
+
+  publisher := Publisher{Servers: []string{endpoint}, PublicKey: public,
+                         SecretKey: secret, Timeout: time.Second,
+                         CompressWorkers: 4}
+  input := make(chan []*FileEvent, 20)
+  for i := 0; i < 20; i++ {
+    // Vary the sizes so batches take different times to compress.
+    input <- sized_batch(i, 1 + (i * 37) % 500)
+  }
+  close(input)
+  publisher.Publish(input, nil)
+
+  for i := 0; i < 20; i++ {
+    batch := <-received
+    if batch[0].Offset != uint64(i) {
+      t.Fatalf("Expected batch %d, got batch %d", i, batch[0].Offset)
+    }
+  }
+}
+
+// The offsets of the batches encode_parallel returns, -1 for a barrier.
+func encoded_order(publisher *Publisher, batches [][]*FileEvent) []int {
+  public, secret := sodium.CryptoBoxKeypair()
+  input := make(chan []*FileEvent, len(batches))
+  for _, batch := range batches {
+    input <- batch
+  }
+  close(input)
+  var order []int
+  for batch := range publisher.encode_parallel(sodium.NewSession(public, secret), input) {
+    if batch.events[0].barrier != nil {
+      order = append(order, -1)
+    } else {
+      order = append(order, int(batch.events[0].Offset))
+    }
+  }
+  return order
+}
+
+func TestOrdering(t *testing.T) {
+  // A batch slow to encode, then quick ones.
+  slow := func(events []*FileEvent) []*FileEvent {
+    if events[0].Offset == 0 {
+      time.Sleep(100 * time.Millisecond)
+    }
+    return events
+  }
+  batches := [][]*FileEvent{sized_batch(0, 1)}
+  for i := 1; i <= 5; i++ {
+    batches = append(batches, sized_batch(i, 1))
+  }
+
+  strict := Publisher{CompressWorkers: 2, Transform: slow}
+  if order := encoded_order(&strict, batches); fmt.Sprint(order) != "[0 1 2 3 4 5]" {
+    t.Fatalf("Expected strict ordering to keep batches in order, got %v", order)
+  }
+
+  relaxed := Publisher{CompressWorkers: 2, Transform: slow, Ordering: ORDERING_RELAXED}
+  if order := encoded_order(&relaxed, batches); fmt.Sprint(order) != "[1 2 3 4 5 0]" {
+    t.Fatalf("Expected the quick batches to overtake the slow one, got %v", order)
+  }
+
+  // A barrier still waits for every batch before it.
+  barrier := []*FileEvent{&FileEvent{barrier: make(chan bool)}}
+  batches = [][]*FileEvent{batches[0], batches[1], barrier, batches[2]}
+  if order := encoded_order(&relaxed, batches); fmt.Sprint(order) != "[1 0 -1 2]" {
+    t.Fatalf("Expected the barrier after batches 0 and 1, got %v", order)
+  }
+}
+
+func BenchmarkCompressWorkers(b *testing.B) {
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  batch := sized_batch(0, 2048)
+
+  for _, workers := range []int{1, 2, 4} {
+    b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+      publisher := Publisher{CompressWorkers: workers}
+      input := make(chan []*FileEvent)
+      go func() {
+        for i := 0; i < b.N; i++ {
+          input <- batch
+        }
+        close(input)
+      }()
+      for _ = range publisher.encode_parallel(session, input) {
+      }
+    })
+  }
+}
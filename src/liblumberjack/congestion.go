@@ -0,0 +1,92 @@
+package liblumberjack
+
+import (
+  "log"
+  "sync"
+  "time"
+)
+
+// A LatencyLimit pauses all harvesting (keeping every harvester's place)
+// while the servers are slow to acknowledge batches, so an overloaded
+// collector isn't sent more than it can keep up with. The replies of the
+// required pools feed a moving average; once it passes High, harvesting
+// pauses until it is back under Low. The events already read are still
+// shipped meanwhile, and their replies can end the pause early; but a pause
+// lasts at most MaxPause, after which harvesting resumes to probe the
+// collector again, pausing anew if it is still slow.
+type LatencyLimit struct {
+  High time.Duration
+  Low time.Duration // defaults to High / 2
+  MaxPause time.Duration // defaults to default_max_latency_pause
+
+  lock sync.Mutex
+  average time.Duration
+  samples int
+  pause *time.Timer // while paused, to end the pause after MaxPause
+  pauses int // how many there have been, to tell them apart
+}
+
+const default_max_latency_pause = 5 * time.Second
+
+var latency_pauses = NewCounter("lumberjack_latency_pauses_total",
+  "Times harvesting was paused for slow server acknowledgements, over -pause-latency.")
+
+// Record the latency of a reply.
+func (l *LatencyLimit) observe(sample time.Duration) {
+  l.lock.Lock()
+  defer l.lock.Unlock()
+  if l.samples++; l.samples == 1 {
+    l.average = sample
+  } else {
+    // Weighted more to recent samples than FFS's average, to react to a
+    // spike within a few batches.
+    l.average += (sample - l.average) / 4
+  }
+
+  if l.pause == nil && l.average > l.High {
+    log.Printf("Servers are taking %s on average to acknowledge, over %s; pausing harvesting\n",
+               l.average, l.High)
+    latency_pauses.Inc()
+    max_pause := l.MaxPause
+    if max_pause <= 0 {
+      max_pause = default_max_latency_pause
+    }
+    set_latency_paused(true)
+    l.pauses++
+    pause := l.pauses
+    l.pause = time.AfterFunc(max_pause, func() { l.end_pause(pause, max_pause) })
+  } else if l.pause != nil && l.average < l.low() {
+    l.pause.Stop()
+    l.pause = nil
+    log.Printf("Servers are acknowledging in %s on average again; resuming harvesting\n", l.average)
+    set_latency_paused(false)
+  }
+}
+
+// Resume harvesting after MaxPause, unless that pause already ended.
+func (l *LatencyLimit) end_pause(pause int, after time.Duration) {
+  l.lock.Lock()
+  defer l.lock.Unlock()
+  if l.pause == nil || l.pauses != pause {
+    return
+  }
+  l.pause = nil
+  log.Printf("Resuming harvesting after pausing %s for slow servers, to try them again\n", after)
+  set_latency_paused(false)
+}
+
+func (l *LatencyLimit) low() time.Duration {
+  if l.Low > 0 {
+    return l.Low
+  }
+  return l.High / 2
+}
+
+func set_latency_paused(paused bool) {
+  harvesters_lock.Lock()
+  defer harvesters_lock.Unlock()
+  latency_paused = paused
+  if !paused {
+    harvesters_cond.Broadcast()
+  }
+}
@@ -0,0 +1,107 @@
+package liblumberjack
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sync/atomic"
+import "testing"
+import "time"
+import zmq "github.com/alecthomas/gozmq"
+
+// A server acknowledging after however long delay says.
+func slow_server(t *testing.T, endpoint string, delay *int64) *zmq.Socket {
+  socket, _ := context.NewSocket(zmq.REP)
+  socket.SetSockOptInt(zmq.LINGER, 0)
+  if err := socket.Bind(endpoint); err != nil {
+    t.Fatalf("Failed to bind to %s: %s", endpoint, err)
+  }
+  go func() {
+    for {
+      if _, err := socket.Recv(0); err != nil {
+        return
+      }
+      socket.Recv(0)
+      time.Sleep(time.Duration(atomic.LoadInt64(delay)))
+      socket.Send([]byte(""), 0)
+    }
+  }()
+  return socket
+}
+
+func TestLatencyLimit(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47387"
+  var delay int64
+  defer slow_server(t, endpoint, &delay).Close()
+  defer set_latency_paused(false)
+
+  limit := &LatencyLimit{High: 50 * time.Millisecond, Low: 20 * time.Millisecond,
+                         MaxPause: time.Minute}
+  socket := FFS{Endpoints: []string{endpoint}, SocketType: zmq.REQ,
+                SendTimeout: time.Second, RecvTimeout: time.Second, Congestion: limit}
+  defer socket.Shutdown()
+  request := func(count int) {
+    for i := 0; i < count; i++ {
+      socket.Send([]byte("nonce"), zmq.SNDMORE)
+      socket.Send([]byte("payload"), 0)
+      if _, err := socket.Recv(0); err != nil {
+        t.Fatalf("Recv() failed: %s", err)
+      }
+    }
+  }
+
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "app.log")
+  append_file(t, path, "")
+  output := make(chan *FileEvent, 10)
+  harvester := Harvester{Path: path}
+  go harvester.Harvest(output)
+  time.Sleep(100 * time.Millisecond)
+
+  paused := func() bool {
+    harvesters_lock.Lock()
+    defer harvesters_lock.Unlock()
+    return latency_paused
+  }
+
+  request(3)
+  if paused() {
+    t.Fatal("Expected harvesting to go on while the server is fast")
+  }
+
+  // The server slows down; harvesting pauses after a few slow replies.
+  atomic.StoreInt64(&delay, int64(100 * time.Millisecond))
+  request(4)
+  if !paused() {
+    t.Fatal("Expected harvesting paused once the server slowed down")
+  }
+  append_file(t, path, "held back\n")
+  select {
+    case event := <-output:
+      t.Fatalf("Harvested %q while paused", *event.Text)
+    case <-time.After(1500 * time.Millisecond):
+  }
+
+  // It recovers, and harvesting resumes.
+  atomic.StoreInt64(&delay, 0)
+  request(6)
+  select {
+    case event := <-output:
+      if *event.Text != "held back" {
+        t.Fatalf("Unexpected event %q", *event.Text)
+      }
+    case <-time.After(2 * time.Second):
+      t.Fatal("Harvesting did not resume once the server sped up")
+  }
+
+  // A pause lasts at most MaxPause, even with no more replies.
+  short := &LatencyLimit{High: 50 * time.Millisecond, MaxPause: 100 * time.Millisecond}
+  short.observe(time.Second)
+  if !paused() {
+    t.Fatal("Expected harvesting paused")
+  }
+  time.Sleep(300 * time.Millisecond)
+  if paused() {
+    t.Fatal("Expected harvesting to resume after MaxPause")
+  }
+}
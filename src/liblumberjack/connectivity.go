@@ -0,0 +1,57 @@
+package liblumberjack
+
+import (
+  "log"
+  "strings"
+  "sync/atomic"
+)
+
+// An FFS reconnects, forever, whenever its servers fail or stop replying,
+// and with LogInterval an outage soon goes quiet in the log. With
+// ReconnectAlert set, a socket that has connected that many times without
+// a reply in between escalates once, so a sustained outage can be told from
+// a blip: an ERROR in the log, ERR_CONNECTIVITY_LOST in the error stream,
+// the lumberjack_connectivity_lost gauge and OnOutage. It keeps retrying
+// all the while, and the first reply after that reports the recovery the
+// same ways.
+
+var connectivity_lost = NewGauge("lumberjack_connectivity_lost",
+  "Sockets that have reconnected -reconnect-alert times in a row without a reply.")
+var connectivity_alerts = NewCounter("lumberjack_connectivity_alerts_total",
+  "Times a socket reconnected -reconnect-alert times in a row without a reply.")
+var outages int64 // sockets in an outage, for connectivity_lost
+
+// Count a connection attempt, escalating if there have been ReconnectAlert
+// of them since the last reply.
+func (s *FFS) count_reconnect() {
+  s.reconnects++
+  if s.ReconnectAlert <= 0 || s.reconnects != s.ReconnectAlert {
+    return
+  }
+  endpoints := strings.Join(s.Endpoints, ",")
+  log.Printf("ERROR: no reply from %s after %d connection attempts; still retrying\n",
+             endpoints, s.reconnects)
+  connectivity_alerts.Inc()
+  connectivity_lost.Set(float64(atomic.AddInt64(&outages, 1)))
+  ReportError(ERR_CONNECTIVITY_LOST, "No reply from " + endpoints + " in a sustained outage",
+              map[string]interface{}{"endpoints": s.Endpoints, "reconnects": s.reconnects})
+  if s.OnOutage != nil {
+    s.OnOutage(true, s.reconnects)
+  }
+} /* FFS#count_reconnect */
+
+// A reply: the end of an outage, if one was reported.
+func (s *FFS) count_reply() {
+  reconnects := s.reconnects
+  s.reconnects = 0
+  if s.ReconnectAlert <= 0 || reconnects < s.ReconnectAlert {
+    return
+  }
+  log.Printf("%s replying again after %d connection attempts\n", s.endpoint, reconnects)
+  connectivity_lost.Set(float64(atomic.AddInt64(&outages, -1)))
+  ReportError(ERR_CONNECTIVITY_RESTORED, s.endpoint + " is replying again",
+              map[string]interface{}{"endpoints": s.Endpoints, "reconnects": reconnects})
+  if s.OnOutage != nil {
+    s.OnOutage(false, reconnects)
+  }
+} /* FFS#count_reply */
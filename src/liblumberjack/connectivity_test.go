@@ -0,0 +1,81 @@
+package liblumberjack
+
+import "bytes"
+import "log"
+import "os"
+import "strings"
+import "syscall"
+import "testing"
+import zmq "github.com/alecthomas/gozmq"
+
+func TestReconnectAlert(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47388"
+  var count int32
+  defer ack_server(t, endpoint, 0, &count).Close()
+
+  var stream bytes.Buffer
+  SetErrorStream(&stream)
+  defer SetErrorStream(nil)
+  var logged bytes.Buffer
+  log.SetOutput(&logged)
+  defer log.SetOutput(os.Stderr)
+
+  // Every send fails while failures is above 0.
+  failures := 0
+  defer func(send func(*zmq.Socket, []byte, zmq.SendRecvOption) error) { socket_send = send }(socket_send)
+  send := socket_send
+  socket_send = func(s *zmq.Socket, data []byte, flags zmq.SendRecvOption) error {
+    if failures > 0 {
+      failures--
+      return syscall.ECONNREFUSED
+    }
+    return send(s, data, flags)
+  }
+
+  var alerts []bool
+  socket := FFS{Endpoints: []string{endpoint}, SocketType: zmq.REQ, ReconnectAlert: 4}
+  socket.OnOutage = func(outage bool, reconnects int) {
+    alerts = append(alerts, outage)
+    if outage && (reconnects != 4 || connectivity_lost.Value() != 1) {
+      t.Fatalf("Expected an outage after 4 attempts, got %d (gauge %v)",
+               reconnects, connectivity_lost.Value())
+    }
+  }
+  round_trip := func() {
+    socket.Send([]byte("nonce"), zmq.SNDMORE)
+    socket.Send([]byte("payload"), 0)
+    if _, err := socket.Recv(0); err != nil {
+      t.Fatalf("Recv() failed: %s", err)
+    }
+  }
+
+  // A blip: the first connection and two more, then a reply.
+  failures = 2
+  round_trip()
+  if len(alerts) != 0 || strings.Contains(logged.String(), "ERROR") {
+    t.Fatalf("Expected no alert for a blip, got %v", alerts)
+  }
+
+  // A prolonged one: escalated once, at the 4th attempt since the last
+  // reply, and recovered from at the next reply.
+  failures = 8
+  round_trip()
+  if len(alerts) != 2 || !alerts[0] || alerts[1] {
+    t.Fatalf("Expected an outage and a recovery, got %v", alerts)
+  }
+  if strings.Count(logged.String(), "ERROR: no reply from " + endpoint) != 1 {
+    t.Fatalf("Expected one ERROR logged, got %q", logged.String())
+  }
+  if connectivity_lost.Value() != 0 {
+    t.Fatalf("Expected the gauge cleared on recovery, got %v", connectivity_lost.Value())
+  }
+  var codes []string
+  for _, record := range error_records(t, &stream) {
+    if record.Code != ERR_SEND_FAILED {
+      codes = append(codes, record.Code)
+    }
+  }
+  if len(codes) != 2 || codes[0] != ERR_CONNECTIVITY_LOST || codes[1] != ERR_CONNECTIVITY_RESTORED {
+    t.Fatalf("Expected lost and restored records, got %v", codes)
+  }
+}
@@ -0,0 +1,57 @@
+package liblumberjack
+
+import (
+  "regexp"
+)
+
+// A ContextBefore gives each event whose line matches Pattern (an error,
+// say) the Lines lines read before it in its file, oldest first, as a list
+// in the field named Field, so an alert on the event has what led up to
+// it. Each harvester keeps the recent lines in a ring of at most Lines
+// lines and MaxBytes bytes of text; past MaxBytes, the oldest are left out.
+type ContextBefore struct {
+  Lines int
+  Pattern *regexp.Regexp
+  Field string // defaults to default_context_field
+  MaxBytes int // zero means default_context_max_bytes
+}
+
+const default_context_field = "context_before"
+const default_context_max_bytes = 64 << 10
+
+// Does the line get the lines before it?
+func (c *ContextBefore) matches(text string) bool {
+  return c.Pattern.MatchString(text)
+}
+
+func (c *ContextBefore) field() string {
+  if c.Field != "" {
+    return c.Field
+  }
+  return default_context_field
+}
+
+// One harvester's recent lines, for a ContextBefore.
+type line_ring struct {
+  lines []string // oldest first
+  bytes int
+}
+
+func (r *line_ring) push(c *ContextBefore, text string) {
+  max_bytes := c.MaxBytes
+  if max_bytes <= 0 {
+    max_bytes = default_context_max_bytes
+  }
+  r.lines = append(r.lines, text)
+  r.bytes += len(text)
+  for len(r.lines) > c.Lines || r.bytes > max_bytes {
+    r.bytes -= len(r.lines[0])
+    r.lines[0] = ""
+    r.lines = r.lines[1:]
+  }
+}
+
+// A copy of the lines in the ring, oldest first.
+func (r *line_ring) context() []string {
+  return append([]string{}, r.lines...)
+}
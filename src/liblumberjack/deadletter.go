@@ -0,0 +1,52 @@
+package liblumberjack
+
+import (
+  "bufio"
+  "encoding/json"
+  "io"
+  "os"
+)
+
+// The dead letter file holds batches that could not be delivered. Each line
+// is one batch: the same JSON array of events that would have been
+// compressed and shipped, so replaying it produces an identical payload.
+
+func write_dead_letter(path string, data []byte) (err error) {
+  file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0600)
+  if err != nil {
+    return
+  }
+  defer file.Close()
+
+  // encoding/json escapes newlines, so a batch always fits on one line.
+  _, err = file.Write(append(data, '\n'))
+  return
+}
+
+// Replay reads each batch stored in a dead letter file and sends it to
+// output, the input of a publisher. Output is not closed.
+func Replay(path string, output chan []*FileEvent) (err error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return
+  }
+  defer file.Close()
+
+  reader := bufio.NewReader(file)
+  for {
+    line, read_err := reader.ReadBytes('\n')
+    if len(line) > 1 {
+      var events []*FileEvent
+      err = json.Unmarshal(line, &events)
+      if err != nil {
+        return
+      }
+      output <- events
+    }
+    if read_err == io.EOF {
+      return nil
+    } else if read_err != nil {
+      return read_err
+    }
+  }
+} /* Replay */
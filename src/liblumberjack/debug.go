@@ -0,0 +1,63 @@
+package liblumberjack
+
+import (
+  "encoding/json"
+  "net/http"
+  "reflect"
+  "runtime"
+  "sync"
+)
+
+// With EnableDebug, the admin http server also exposes:
+//   /debug/pipeline - the depth of each registered channel, the number of
+//     running harvesters and the number of goroutines, to see whether a
+//     stall is in harvesting, spooling or publishing.
+
+var channels_lock sync.Mutex
+var channels = make(map[string]reflect.Value)
+var debug_once sync.Once
+
+// Report the depth of a channel, of any type, under name in
+// /debug/pipeline. Registering a name again replaces the old channel.
+func RegisterChannel(name string, channel interface{}) {
+  value := reflect.ValueOf(channel)
+  if value.Kind() != reflect.Chan {
+    panic("RegisterChannel of a " + value.Kind().String())
+  }
+  channels_lock.Lock()
+  defer channels_lock.Unlock()
+  channels[name] = value
+}
+
+// Add the debug endpoints to the admin http server.
+func EnableDebug() {
+  debug_once.Do(func() {
+    admin_mux.HandleFunc("/debug/pipeline", func(w http.ResponseWriter, r *http.Request) {
+      w.Header().Set("Content-Type", "application/json")
+      data, _ := json.MarshalIndent(pipeline_status(), "", "  ")
+      w.Write(data)
+    })
+  })
+}
+
+func pipeline_status() map[string]interface{} {
+  channels_lock.Lock()
+  depths := make(map[string]interface{})
+  for name, channel := range channels {
+    depths[name] = map[string]int{"depth": channel.Len(), "capacity": channel.Cap()}
+  }
+  channels_lock.Unlock()
+
+  harvesters_lock.Lock()
+  running := 0
+  for _, count := range active_harvesters {
+    running += count
+  }
+  harvesters_lock.Unlock()
+
+  return map[string]interface{}{
+    "channels": depths,
+    "harvesters": running,
+    "goroutines": runtime.NumGoroutine(),
+  }
+}
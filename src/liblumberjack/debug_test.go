@@ -0,0 +1,45 @@
+package liblumberjack
+
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "testing"
+import "time"
+
+func TestDebugPipeline(t *testing.T) {
+  EnableDebug()
+  events := make(chan *FileEvent, 16)
+  batches := make(chan []*FileEvent, 4)
+  RegisterChannel("test_events", events)
+  RegisterChannel("test_batches", batches)
+
+  // A backlog of 3 events and 1 batch.
+  for i := 0; i < 3; i++ {
+    events <- spool_event("backlog", time.Now())
+  }
+  batches <- []*FileEvent{}
+
+  request, _ := http.NewRequest("GET", "/debug/pipeline", nil)
+  response := httptest.NewRecorder()
+  admin_mux.ServeHTTP(response, request)
+  if response.Code != http.StatusOK {
+    t.Fatalf("/debug/pipeline failed: %d %s", response.Code, response.Body)
+  }
+
+  var status struct {
+    Channels map[string]struct{ Depth, Capacity int }
+    Goroutines int
+  }
+  if err := json.Unmarshal(response.Body.Bytes(), &status); err != nil {
+    t.Fatalf("Bad /debug/pipeline json: %s", err)
+  }
+  if c := status.Channels["test_events"]; c.Depth != 3 || c.Capacity != 16 {
+    t.Fatalf("Expected test_events at 3 of 16, got %+v", c)
+  }
+  if c := status.Channels["test_batches"]; c.Depth != 1 || c.Capacity != 4 {
+    t.Fatalf("Expected test_batches at 1 of 4, got %+v", c)
+  }
+  if status.Goroutines == 0 {
+    t.Fatalf("Expected a goroutine count")
+  }
+}
@@ -0,0 +1,90 @@
+package liblumberjack
+
+import (
+  "encoding/json"
+  "hash/fnv"
+  "time"
+)
+
+// Deduper remembers the content hashes of recently spooled events so that
+// repeated lines can be dropped.
+//
+// An event is a duplicate if an event with identical text was seen within
+// the last Window events or, when MaxAge is set, no longer than MaxAge ago.
+// Whichever limit is hit first expires a remembered hash. Window bounds the
+// memory used and must be at least 1.
+type Deduper struct {
+  Window int
+  MaxAge time.Duration
+
+  // Number of events suppressed as duplicates so far.
+  Suppressed uint64
+
+  ring []dedup_entry // remembered hashes, oldest at ring[head]
+  head int
+  count int
+  seen map[uint64]bool // hashes currently in ring
+}
+
+type dedup_entry struct {
+  hash uint64
+  when time.Time
+}
+
+func NewDeduper(window int, max_age time.Duration) *Deduper {
+  if window < 1 {
+    window = 1
+  }
+  return &Deduper{
+    Window: window,
+    MaxAge: max_age,
+    ring: make([]dedup_entry, window),
+    seen: make(map[uint64]bool),
+  }
+}
+
+// Duplicate reports whether the event was already seen inside the window.
+// Events that are not duplicates are remembered.
+func (d *Deduper) Duplicate(event *FileEvent, now time.Time) bool {
+  d.expire(now)
+
+  hasher := fnv.New64a()
+  if event.Text != nil {
+    hasher.Write([]byte(*event.Text))
+  } else {
+    // Decoded by a codec; json sorts map keys, so this is stable.
+    data, _ := json.Marshal(event.Fields)
+    hasher.Write(data)
+  }
+  hash := hasher.Sum64()
+
+  if d.seen[hash] {
+    d.Suppressed++
+    return true
+  }
+
+  if d.count == len(d.ring) {
+    d.pop()
+  }
+  d.ring[(d.head + d.count) % len(d.ring)] = dedup_entry{hash: hash, when: now}
+  d.count++
+  d.seen[hash] = true
+  return false
+} /* Deduper#Duplicate */
+
+// Forget hashes older than MaxAge.
+func (d *Deduper) expire(now time.Time) {
+  if d.MaxAge <= 0 {
+    return
+  }
+  for d.count > 0 && now.Sub(d.ring[d.head].when) > d.MaxAge {
+    d.pop()
+  }
+}
+
+// Drop the oldest remembered hash.
+func (d *Deduper) pop() {
+  delete(d.seen, d.ring[d.head].hash)
+  d.head = (d.head + 1) % len(d.ring)
+  d.count--
+}
@@ -0,0 +1,53 @@
+package liblumberjack
+
+import "testing"
+import "time"
+
+func dedup_event(text string) *FileEvent {
+  source := "test"
+  return &FileEvent{Source: &source, Text: &text}
+}
+
+func TestDeduperWindowExpiry(t *testing.T) {
+  d := NewDeduper(2, 0)
+  now := time.Now()
+
+  if d.Duplicate(dedup_event("a"), now) {
+    t.Fatal("First 'a' was reported as a duplicate")
+  }
+  if !d.Duplicate(dedup_event("a"), now) {
+    t.Fatal("Second 'a' was not reported as a duplicate")
+  }
+
+  // Push 'a' out of the 2-event window.
+  d.Duplicate(dedup_event("b"), now)
+  d.Duplicate(dedup_event("c"), now)
+  if d.Duplicate(dedup_event("a"), now) {
+    t.Fatal("'a' was still reported as a duplicate after leaving the window")
+  }
+}
+
+func TestDeduperAgeExpiry(t *testing.T) {
+  d := NewDeduper(100, 10 * time.Second)
+  now := time.Now()
+
+  d.Duplicate(dedup_event("a"), now)
+  if !d.Duplicate(dedup_event("a"), now.Add(5 * time.Second)) {
+    t.Fatal("'a' was not reported as a duplicate within the max age")
+  }
+  if d.Duplicate(dedup_event("a"), now.Add(11 * time.Second)) {
+    t.Fatal("'a' was still reported as a duplicate after the max age")
+  }
+}
+
+func TestDeduperSuppressedCount(t *testing.T) {
+  d := NewDeduper(10, 0)
+  now := time.Now()
+
+  for _, text := range []string{"a", "b", "a", "a", "c", "b"} {
+    d.Duplicate(dedup_event(text), now)
+  }
+  if d.Suppressed != 3 {
+    t.Fatalf("Expected 3 suppressed duplicates, got %d", d.Suppressed)
+  }
+}
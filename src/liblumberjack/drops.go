@@ -0,0 +1,62 @@
+package liblumberjack
+
+import (
+  "fmt"
+  "log"
+  "sort"
+  "strings"
+  "time"
+)
+
+// Every event dropped on purpose, rather than shipped, is counted in
+// lumberjack_events_dropped_total by reason:
+//
+//   empty             a nil event, or one with neither text nor fields
+//   duplicate         dropped by the spooler's Dedup
+//   header            a header line skipped by Harvester.SkipHeaderLines
+//   before_since      a line timestamped before Harvester.Since's cutoff
+//   no_timestamp      a line without a timestamp, with Since.DropUnparsed
+//   transform         filtered out by Publisher.Transform
+//   send_failed       given up on after MaxAttempts, with no dead letter file
+//   unrouted          taken by no routed pool, with nowhere else to go; see routing.go
+//   corrupt           failed Publisher.VerifyCompression, with no dead letter file
+//   best_effort_pool  not shipped to a best-effort pool; see fanout.go
+//   seen_before       acknowledged before a restart, by Spooler.Seen
+//   unserializable    with a field protobuf.go can't encode, with -serialization protobuf
+//
+// Binary files skipped by Harvester.SkipBinary are never read, so they
+// can't be counted in events; the harvester logs each one.
+var events_dropped = NewLabeledCounter("lumberjack_events_dropped_total",
+  "Events dropped rather than shipped, by reason.", "reason")
+
+func dropped(reason string, count int) {
+  if count > 0 {
+    events_dropped.Add(reason, uint64(count))
+  }
+}
+
+// LogDrops logs how many events were dropped for each reason every
+// interval, if any were. It never returns.
+func LogDrops(interval time.Duration) {
+  last := events_dropped.Values()
+  for _ = range time.Tick(interval) {
+    current := events_dropped.Values()
+    if summary := drop_summary(last, current); summary != "" {
+      log.Printf("Dropped events in the last %s: %s\n", interval, summary)
+    }
+    last = current
+  }
+}
+
+// The drops between two readings of events_dropped, as "reason=N ...", or
+// "" if there were none.
+func drop_summary(last map[string]uint64, current map[string]uint64) string {
+  var parts []string
+  for reason, count := range current {
+    if count > last[reason] {
+      parts = append(parts, fmt.Sprintf("%s=%d", reason, count - last[reason]))
+    }
+  }
+  sort.Strings(parts)
+  return strings.Join(parts, " ")
+}
@@ -0,0 +1,143 @@
+package liblumberjack
+
+import "bytes"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sodium"
+import zmq "github.com/alecthomas/gozmq"
+import "testing"
+import "time"
+
+// Runs f, returning how many events it dropped for reason.
+func drops(reason string, f func()) uint64 {
+  before := events_dropped.Value(reason)
+  f()
+  return events_dropped.Value(reason) - before
+}
+
+func TestDroppedDuplicate(t *testing.T) {
+  input := make(chan *FileEvent)
+  output := make(chan []*FileEvent, 1)
+  spooler := Spooler{MaxSize: 2, IdleTimeout: time.Hour, Dedup: NewDeduper(10, time.Hour)}
+  go spooler.Spool(input, output)
+
+  count := drops("duplicate", func() {
+    input <- spool_event("same", time.Now())
+    input <- spool_event("same", time.Now())
+    input <- spool_event("other", time.Now())
+    <-output
+  })
+  if count != 1 {
+    t.Fatalf("Expected 1 duplicate dropped, got %d", count)
+  }
+}
+
+func TestDroppedHeader(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "data.csv")
+  append_file(t, path, "name,count\nfoo,1\n")
+
+  output := make(chan *FileEvent, 10)
+  harvester := Harvester{Path: path, SkipHeaderLines: 1, from_beginning: true}
+  count := drops("header", func() {
+    go harvester.Harvest(output)
+    <-output
+  })
+  if count != 1 {
+    t.Fatalf("Expected 1 header line dropped, got %d", count)
+  }
+}
+
+func TestDroppedTransform(t *testing.T) {
+  public, secret := sodium.CryptoBoxKeypair()
+  publisher := Publisher{Transform: func(events []*FileEvent) []*FileEvent {
+    return events[:1]
+  }}
+  count := drops("transform", func() {
+    publisher.encode(sodium.NewSession(public, secret), test_batch())
+  })
+  if count != 2 {
+    t.Fatalf("Expected 2 events filtered out, got %d", count)
+  }
+}
+
+func TestDroppedUnrouted(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47397"
+  public, secret := sodium.CryptoBoxKeypair()
+  received := make(chan []*FileEvent, 2)
+  defer stub_server(t, endpoint, sodium.NewSession(public, secret), received).Close()
+
+  // Only a routed pool: the info event has nowhere to go.
+  event := func(text string, severity string) *FileEvent {
+    source := "/var/log/app.log"
+    return &FileEvent{Source: &source, Text: &text,
+                      Fields: map[string]interface{}{"severity": severity}}
+  }
+  publisher := Publisher{PublicKey: public, SecretKey: secret, Timeout: time.Second,
+                         RouteField: "severity",
+                         Pools: []Pool{{Servers: []string{endpoint}, Route: []string{"error"}}}}
+  input := make(chan []*FileEvent, 1)
+  input <- []*FileEvent{event("one", "info"), event("two", "error")}
+  close(input)
+  count := drops("unrouted", func() { publisher.Publish(input, nil) })
+  if count != 1 {
+    t.Fatalf("Expected 1 unrouted event dropped, got %d", count)
+  }
+  if batch := <-received; len(batch) != 1 || *batch[0].Text != "two" {
+    t.Fatalf("Expected the routed event shipped, got %v", batch)
+  }
+}
+
+func TestDroppedSendFailed(t *testing.T) {
+  publisher := Publisher{MaxAttempts: 1}
+  if count := drops("send_failed", func() { publisher.give_up(nil, 3, "send_failed") }); count != 3 {
+    t.Fatalf("Expected 3 events given up on, got %d", count)
+  }
+}
+
+func TestDroppedBestEffortPool(t *testing.T) {
+  // Nothing is listening on either, and the best-effort pool's queue is
+  // already full.
+  required := &FFS{Endpoints: []string{"tcp://127.0.0.1:47373"}, SocketType: zmq.REQ,
+                   SendTimeout: 10 * time.Millisecond, RecvTimeout: 10 * time.Millisecond}
+  defer required.Shutdown()
+  publisher := Publisher{MaxAttempts: 1, required: []*FFS{required},
+                         best_effort_sockets: []*FFS{{Endpoints: []string{"tcp://127.0.0.1:47374"}}},
+                         best_effort: []chan *payload{make(chan *payload)}}
+
+  count := drops("best_effort_pool", func() {
+    publisher.ship_all(&encoded_batch{events: make([]*FileEvent, 3),
+                                      nonce: []byte("nonce"), ciphertext: []byte("ciphertext")})
+  })
+  if count != 3 {
+    t.Fatalf("Expected 3 events dropped for the pool, got %d", count)
+  }
+}
+
+func TestDropSummary(t *testing.T) {
+  last := map[string]uint64{"duplicate": 2, "header": 1}
+  current := map[string]uint64{"duplicate": 5, "header": 1, "transform": 4}
+  if summary := drop_summary(last, current); summary != "duplicate=3 transform=4" {
+    t.Fatalf("Unexpected summary: %q", summary)
+  }
+  if summary := drop_summary(current, current); summary != "" {
+    t.Fatalf("Expected no summary without drops, got %q", summary)
+  }
+}
+
+func TestEncodeSkipsNilEvents(t *testing.T) {
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  publisher := Publisher{Compression: "none"}
+
+  events := append(test_batch(), nil)
+  batch := publisher.encode(session, append([]*FileEvent{nil}, events...))
+  if len(batch.events) != 3 || bytes.Contains(batch.data, []byte("null")) {
+    t.Fatalf("Expected nils to be left out, got %d events: %s", len(batch.events), batch.data)
+  }
+  if batch := publisher.encode(session, []*FileEvent{nil}); len(batch.events) != 0 || batch.data != nil {
+    t.Fatalf("Expected a batch of only nils to ship nothing")
+  }
+}
@@ -0,0 +1,128 @@
+package liblumberjack
+
+import (
+  "crypto/rand"
+  "fmt"
+  "math/big"
+  "os"
+  "time"
+)
+
+// How an FFS picks which of its endpoints to connect to.
+type EndpointStrategy int
+
+const (
+  // Pick any endpoint at random.
+  RandomEndpoint EndpointStrategy = iota
+
+  // Prefer the endpoint with the lowest average time from send to reply.
+  // Endpoints without a measurement yet are tried first, and a fraction of
+  // choices still go to a random endpoint so that the measurements of the
+  // others stay current.
+  LatencyAware
+)
+
+// Percent of LatencyAware choices that probe a random endpoint.
+const latency_probe_percent = 10
+
+// Default FFS.Reselect
+const default_reselect = 100
+
+// A random int in [0, n)
+func random_int(n int) int {
+  i, _ := rand.Int(rand.Reader, big.NewInt(int64(n)))
+  return int(i.Int64())
+}
+
+// The hostname plus a random suffix, so that two lumberjacks on one host
+// don't collide.
+func default_identity() string {
+  hostname, err := os.Hostname()
+  if err != nil {
+    hostname = "lumberjack"
+  }
+  return fmt.Sprintf("%s-%08x", hostname, random_int(1 << 32))
+}
+
+func (s *FFS) choose_endpoint() string {
+  endpoints := s.usable_endpoints()
+  if s.Strategy == LatencyAware && random_int(100) >= latency_probe_percent {
+    s.latency_lock.Lock()
+    defer s.latency_lock.Unlock()
+
+    var best string
+    var best_latency time.Duration
+    for _, endpoint := range endpoints {
+      latency, known := s.latency[endpoint]
+      if !known {
+        return endpoint
+      }
+      if best == "" || latency < best_latency {
+        best = endpoint
+        best_latency = latency
+      }
+    }
+    return best
+  }
+
+  return endpoints[random_int(len(endpoints))]
+}
+
+// Record the latency of a successful request, and with LatencyAware, drop
+// the connection every Reselect replies so the next request picks again.
+func (s *FFS) record_reply() {
+  sample := time.Since(s.sent_at)
+
+  s.latency_lock.Lock()
+  if s.latency == nil {
+    s.latency = make(map[string]time.Duration)
+  }
+  if old, known := s.latency[s.endpoint]; known {
+    // Exponentially weighted moving average, as with TCP's smoothed RTT.
+    s.latency[s.endpoint] = old + (sample - old) / 8
+  } else {
+    s.latency[s.endpoint] = sample
+  }
+  s.latency_lock.Unlock()
+  if s.Congestion != nil {
+    s.Congestion.observe(sample)
+  }
+
+  if s.Strategy == LatencyAware {
+    reselect := s.Reselect
+    if reselect == 0 {
+      reselect = default_reselect
+    }
+    s.replies++
+    if s.replies % reselect == 0 {
+      s.Close()
+    }
+  }
+}
+
+// Status reports the current endpoint and each endpoint's average latency
+// and health, for the admin /status endpoint.
+func (s *FFS) Status() interface{} {
+  s.latency_lock.Lock()
+  defer s.latency_lock.Unlock()
+
+  endpoints := make(map[string]interface{})
+  for _, endpoint := range s.Endpoints {
+    info := make(map[string]interface{})
+    if latency, known := s.latency[endpoint]; known {
+      info["latency_ms"] = latency.Seconds() * 1000
+    }
+    if healthy, known := s.health[endpoint]; known {
+      info["healthy"] = healthy
+    }
+    endpoints[endpoint] = info
+  }
+  status := map[string]interface{}{
+    "endpoint": s.endpoint,
+    "endpoints": endpoints,
+  }
+  if s.Prewarm {
+    status["warm"] = s.warm_endpoints()
+  }
+  return status
+}
@@ -0,0 +1,55 @@
+package liblumberjack
+
+import (
+  "encoding/json"
+  "io"
+  "sync"
+  "time"
+)
+
+// Besides being logged, errors worth alerting on are written to the error
+// stream, if one is set, as one JSON ErrorRecord per line, so monitoring
+// can consume them without parsing the general log.
+type ErrorRecord struct {
+  Time string `json:"time"` // RFC 3339, UTC
+  Code string `json:"code"` // one of the ERR_ codes
+  Message string `json:"message"`
+  Context map[string]interface{} `json:"context,omitempty"`
+}
+
+const (
+  ERR_OPEN_FAILED = "open_failed" // a file to harvest can't be opened
+  ERR_READ_FAILED = "read_failed" // reading a file being harvested failed
+  ERR_CONNECT_FAILED = "connect_failed"
+  ERR_CONNECTIVITY_LOST = "connectivity_lost" // see FFS.ReconnectAlert
+  ERR_CONNECTIVITY_RESTORED = "connectivity_restored" // the end of an outage
+  ERR_SEND_FAILED = "send_failed" // sending to a server failed or timed out
+  ERR_RECV_FAILED = "recv_failed" // a server's reply failed or timed out
+  ERR_BATCH_DROPPED = "batch_dropped" // a batch was given up on and lost
+  ERR_DEAD_LETTER = "dead_letter" // a batch was given up on, to the dead letter file
+  ERR_FILE_SINK_FAILED = "file_sink_failed"
+  ERR_KEY = "key_error" // a key can't be read
+)
+
+var error_lock sync.Mutex
+var error_stream io.Writer
+
+// Write error records to w from now on; nil stops them.
+func SetErrorStream(w io.Writer) {
+  error_lock.Lock()
+  defer error_lock.Unlock()
+  error_stream = w
+}
+
+// Write an error record to the error stream, if there is one.
+func ReportError(code string, message string, context map[string]interface{}) {
+  error_lock.Lock()
+  defer error_lock.Unlock()
+  if error_stream == nil {
+    return
+  }
+  record := ErrorRecord{Time: time.Now().UTC().Format(time.RFC3339Nano),
+                        Code: code, Message: message, Context: context}
+  data, _ := json.Marshal(record)
+  error_stream.Write(append(data, '\n'))
+}
@@ -0,0 +1,77 @@
+package liblumberjack
+
+import "bytes"
+import "encoding/json"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "syscall"
+import "testing"
+import zmq "github.com/alecthomas/gozmq"
+
+// The records written to an error stream.
+func error_records(t *testing.T, stream *bytes.Buffer) (records []ErrorRecord) {
+  for _, line := range strings.Split(strings.TrimSpace(stream.String()), "\n") {
+    var record ErrorRecord
+    if err := json.Unmarshal([]byte(line), &record); err != nil {
+      t.Fatalf("Bad error record %q: %s", line, err)
+    }
+    records = append(records, record)
+  }
+  stream.Reset()
+  return
+}
+
+func TestErrorStream(t *testing.T) {
+  var stream bytes.Buffer
+  SetErrorStream(&stream)
+  defer SetErrorStream(nil)
+
+  // A file that can't be opened: once when first failing, and again when
+  // given up on.
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  missing := filepath.Join(dir, "missing.log")
+  harvester := Harvester{Path: missing, OpenRetries: 1}
+  harvester.open()
+  records := error_records(t, &stream)
+  if len(records) != 2 || records[0].Code != ERR_OPEN_FAILED || records[1].Code != ERR_OPEN_FAILED {
+    t.Fatalf("Expected two %s records, got %v", ERR_OPEN_FAILED, records)
+  }
+  if records[1].Context["path"] != missing || records[1].Context["attempts"] != float64(2) {
+    t.Fatalf("Unexpected context: %v", records[1].Context)
+  }
+  if records[0].Time == "" || records[0].Message == "" {
+    t.Fatalf("Expected a time and message, got %v", records[0])
+  }
+
+  // A failed send, retried on a new connection.
+  endpoint := "tcp://127.0.0.1:47383"
+  defer func(send func(*zmq.Socket, []byte, zmq.SendRecvOption) error) { socket_send = send }(socket_send)
+  send := socket_send
+  failed := false
+  socket_send = func(s *zmq.Socket, data []byte, flags zmq.SendRecvOption) error {
+    if !failed {
+      failed = true
+      return syscall.ECONNRESET
+    }
+    return send(s, data, flags)
+  }
+  socket := FFS{Endpoints: []string{endpoint}, SocketType: zmq.REQ}
+  socket.Send([]byte("payload"), 0)
+  records = error_records(t, &stream)
+  if len(records) != 1 || records[0].Code != ERR_SEND_FAILED ||
+     records[0].Context["endpoint"] != endpoint || records[0].Context["bytes"] != float64(7) {
+    t.Fatalf("Expected a %s record for %s, got %v", ERR_SEND_FAILED, endpoint, records)
+  }
+
+  // A batch given up on with nowhere to keep it.
+  publisher := Publisher{MaxAttempts: 3}
+  publisher.give_up([]byte("[]"), 5, "send_failed")
+  records = error_records(t, &stream)
+  if len(records) != 1 || records[0].Code != ERR_BATCH_DROPPED ||
+     records[0].Context["events"] != float64(5) || records[0].Context["reason"] != "send_failed" {
+    t.Fatalf("Expected a %s record for 5 events, got %v", ERR_BATCH_DROPPED, records)
+  }
+}
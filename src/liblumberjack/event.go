@@ -1,12 +1,33 @@
 package liblumberjack
 
-import "os"
+import (
+  "os"
+  "time"
+)
 
 type FileEvent struct {
   Source *string `json:"source,omitempty"`
   Offset uint64 `json:"offset,omitempty"`
   Line uint64 `json:"line,omitempty"`
   Text *string `json:"text,omitempty"`
+  ID string `json:"id,omitempty"` // optional; see ids.go
+
+  // Structured fields decoded from Text by a Codec. When set, Text is not
+  // shipped.
+  Fields map[string]interface{} `json:"fields,omitempty"`
 
   fileinfo *os.FileInfo
+  harvested time.Time // when the harvester read this event
+
+  barrier chan bool // if set, this is not an event but a Barrier
+}
+
+// Barrier blocks until every event sent on input (a Spooler's input)
+// before it has been shipped and acknowledged, or given up on. The spooler
+// flushes when it reaches the barrier rather than waiting for a full spool
+// or its idle timeout.
+func Barrier(input chan *FileEvent) {
+  done := make(chan bool)
+  input <- &FileEvent{barrier: done}
+  <-done
 }
@@ -0,0 +1,171 @@
+package liblumberjack
+
+import (
+  "fmt"
+  "log"
+  "sodium"
+)
+
+// Fan-out: every batch is shipped to Publisher.Servers and to each of
+// Publisher.Pools, such as a second cluster keeping a compliance archive.
+//
+// A batch is only acknowledged (told to the registrar, the post-ship hook,
+// etc) once Publisher.Servers and every required pool have acknowledged it.
+// Best-effort pools are fed from a small queue by their own goroutine; if
+// one falls behind or fails, batches are dropped for that pool only.
+
+// The number of batches a best-effort pool may fall behind by before
+// batches are dropped for it.
+const best_effort_queue = 16
+
+var fanout_dropped = NewCounter("lumberjack_fanout_dropped_total",
+  "Batches not shipped to a best-effort pool because it fell behind or failed.")
+
+type Pool struct {
+  Servers []string // endpoints in this pool; one is used at a time
+  BestEffort bool // don't wait for this pool before acknowledging a batch
+
+  // Optional; with Publisher.RouteField, the values of it whose events go
+  // to this pool only, rather than to every pool. See routing.go.
+  Route []string
+
+  // Optional; keys for this pool's servers, such as a collector run by
+  // another tenant, in place of Publisher.PublicKey (the servers' key) and
+  // Publisher.SecretKey (ours). Batches are boxed again for a pool with
+  // keys of its own. See Publisher.CheckKeys.
+  PublicKey []byte
+  SecretKey []byte
+}
+
+// An encrypted batch, ready to send.
+type payload struct {
+  nonce []byte
+  ciphertext []byte
+  events int // how many events it holds
+}
+
+// Are the keys given for each pool the right size for sodium?
+func (p *Publisher) CheckKeys() error {
+  for _, pool := range p.Pools {
+    if pool.PublicKey != nil && len(pool.PublicKey) != sodium.PUBLICKEYBYTES {
+      return fmt.Errorf("the public key for pool %v is %d bytes, not %d",
+                        pool.Servers, len(pool.PublicKey), sodium.PUBLICKEYBYTES)
+    }
+    if pool.SecretKey != nil && len(pool.SecretKey) != sodium.SECRETKEYBYTES {
+      return fmt.Errorf("the secret key for pool %v is %d bytes, not %d",
+                        pool.Servers, len(pool.SecretKey), sodium.SECRETKEYBYTES)
+    }
+  }
+  return nil
+}
+
+// The socket for a pool, with a session of its own if it has keys.
+func (p *Publisher) pool_socket(pool Pool) *FFS {
+  socket := p.new_socket(pool.Servers)
+  if pool.PublicKey != nil || pool.SecretKey != nil {
+    public, secret := p.PublicKey, p.SecretKey
+    if pool.PublicKey != nil {
+      copy(public[:], pool.PublicKey)
+    }
+    if pool.SecretKey != nil {
+      copy(secret[:], pool.SecretKey)
+    }
+    if p.sessions == nil {
+      p.sessions = make(map[*FFS]*sodium.Session)
+    }
+    p.sessions[socket] = sodium.NewSession(public, secret)
+  }
+  return socket
+}
+
+// The session payloads for a socket are boxed with.
+func (p *Publisher) session_for(socket *FFS, session *sodium.Session) *sodium.Session {
+  if own, ok := p.sessions[socket]; ok {
+    return own
+  }
+  return session
+}
+
+// A batch's nonce and ciphertext for a socket: as encoded, or boxed again
+// for a pool with keys of its own.
+func (p *Publisher) boxed_for(socket *FFS, batch *encoded_batch) ([]byte, []byte) {
+  session, own := p.sessions[socket]
+  if !own {
+    return batch.nonce, batch.ciphertext
+  }
+  ciphertext, nonce := session.Box(batch.plaintext)
+  return nonce, ciphertext
+}
+
+// Ship a batch to Servers and every required pool at once, returning
+// whether all of them acknowledged it. Best-effort pools are only queued to.
+func (p *Publisher) ship_all(batch *encoded_batch) bool {
+  events := len(batch.events)
+  for i, queue := range p.best_effort {
+    nonce, ciphertext := p.boxed_for(p.best_effort_sockets[i], batch)
+    select {
+      case queue <- &payload{nonce, ciphertext, events}:
+      default:
+        log.Printf("Best-effort pool %v is behind; dropping a batch for it\n",
+                   p.best_effort_sockets[i].Endpoints)
+        fanout_dropped.Inc()
+        dropped("best_effort_pool", events)
+    }
+  }
+
+  if len(p.required) == 1 {
+    nonce, ciphertext := p.boxed_for(p.required[0], batch)
+    return p.ship(p.required[0], nonce, ciphertext)
+  }
+
+  results := make(chan bool, len(p.required))
+  for _, socket := range p.required {
+    nonce, ciphertext := p.boxed_for(socket, batch)
+    go func(socket *FFS) {
+      results <- p.ship(socket, nonce, ciphertext)
+    }(socket)
+  }
+  acked := true
+  for _ = range p.required {
+    if !<-results {
+      acked = false
+    }
+  }
+  return acked
+} // ship_all
+
+// Ship each queued payload to a best-effort pool until the queue is closed.
+func (p *Publisher) ship_best_effort(socket *FFS, queue chan *payload) {
+  defer p.best_effort_running.Done()
+  for payload := range queue {
+    if !p.ship(socket, payload.nonce, payload.ciphertext) {
+      log.Printf("Dropping a batch for best-effort pool %v after %d failed send attempts\n",
+                 socket.Endpoints, p.MaxAttempts)
+      fanout_dropped.Inc()
+      dropped("best_effort_pool", payload.events)
+    }
+  }
+  socket.Shutdown()
+}
+
+// Status of every pool, for the admin /status endpoint.
+func (p *Publisher) pools_status() interface{} {
+  var pools []interface{}
+  for _, socket := range p.required {
+    pools = append(pools, map[string]interface{}{
+      "required": true, "socket": socket.Status()})
+  }
+  for i, socket := range p.best_effort_sockets {
+    pools = append(pools, map[string]interface{}{
+      "required": false, "socket": socket.Status(),
+      "queued": len(p.best_effort[i])})
+  }
+  for _, pool := range p.Pools {
+    if len(pool.Route) > 0 {
+      pools = append(pools, map[string]interface{}{
+        "required": true, "route": pool.Route,
+        "socket": p.routes[pool.Route[0]].Status()})
+    }
+  }
+  return pools
+}
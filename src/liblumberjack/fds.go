@@ -0,0 +1,161 @@
+package liblumberjack
+
+import (
+  "log"
+  "os"
+  "sync"
+  "time"
+)
+
+// A FileBudget caps how many files the harvesters sharing it hold open,
+// so lumberjack never runs into the process's file limit and fails to open
+// a file it should read. When a harvester needs a file and the budget is
+// spent, the harvester idle (at the end of its file) the longest closes its
+// file, keeping its place, until the file grows or there is room again;
+// with none idle, the new harvester waits for one to be.
+//
+// Only harvested files are counted. Sockets to servers take a few more
+// descriptors each (more with prewarming and health checks), which Max
+// should leave room for under the process limit.
+type FileBudget struct {
+  Max int
+
+  lock sync.Mutex
+  cond *sync.Cond
+  leases map[*file_lease]bool
+  peak int
+}
+
+// One harvester's hold on an open file.
+type file_lease struct {
+  path string
+  idle_since time.Time // zero while the harvester is reading
+  evict bool // asked to close the file
+}
+
+var open_files = NewGauge("lumberjack_open_files",
+  "Files held open by harvesters under -max-open-files.")
+var open_files_peak = NewGauge("lumberjack_open_files_peak",
+  "The most files held open by harvesters at once under -max-open-files.")
+
+// Wait for room to open a file, asking an idle harvester to make some.
+func (b *FileBudget) acquire(path string) *file_lease {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+  if b.leases == nil {
+    b.leases = make(map[*file_lease]bool)
+    b.cond = sync.NewCond(&b.lock)
+  }
+
+  for len(b.leases) >= b.Max {
+    var victim *file_lease
+    evicting := false
+    for lease := range b.leases {
+      if lease.evict {
+        evicting = true
+      } else if !lease.idle_since.IsZero() &&
+                (victim == nil || lease.idle_since.Before(victim.idle_since)) {
+        victim = lease
+      }
+    }
+    if victim != nil && !evicting {
+      victim.evict = true
+    }
+    b.cond.Wait()
+  }
+
+  lease := &file_lease{path: path}
+  b.leases[lease] = true
+  open_files.Set(float64(len(b.leases)))
+  if len(b.leases) > b.peak {
+    b.peak = len(b.leases)
+    open_files_peak.Set(float64(b.peak))
+  }
+  return lease
+}
+
+func (b *FileBudget) release(lease *file_lease) {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+  delete(b.leases, lease)
+  open_files.Set(float64(len(b.leases)))
+  b.cond.Broadcast()
+}
+
+// The harvester reached the end of its file, or is reading again. An idle
+// harvester may be asked to close its file; reading again means another
+// waiting harvester should look for a different one.
+func (b *FileBudget) set_idle(lease *file_lease, idle bool) {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+  if !idle {
+    lease.idle_since = time.Time{}
+  } else if lease.idle_since.IsZero() {
+    lease.idle_since = time.Now()
+    b.cond.Broadcast()
+  }
+}
+
+func (b *FileBudget) evicted(lease *file_lease) bool {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+  return lease.evict
+}
+
+// With the file closed for the budget, wait for the file known at path to
+// grow past offset, then take a lease and reopen it there. A file rotated
+// away meanwhile, after growing or not, is reopened where it was rotated
+// to if it holds more than was read, so its last lines aren't lost; the
+// harvester then stops at its end as with any rotated file. Returns nil if
+// the file was replaced or removed with nothing left to read; the
+// prospector harvests a new file at path itself.
+func (h *Harvester) reopen_when_grown(offset int64, known os.FileInfo) harvest_file {
+  last_read := time.Now()
+  path := h.Path
+  for {
+    time.Sleep(1 * time.Second)
+    info, err := h.stat(h.Path)
+    if err != nil || (known != nil && !os.SameFile(info, known)) {
+      rotated, rotated_info := h.rotated_to(known)
+      if rotated_info == nil || rotated_info.Size() <= offset {
+        log.Printf("Stopping harvest of %s; it was replaced while closed\n", h.Path)
+        return nil
+      }
+      log.Printf("%s was rotated to %s while closed; reading the rest of it\n", h.Path, rotated)
+      path = rotated
+      break
+    }
+    if info.Size() > offset {
+      break
+    }
+    if time.Since(last_read) > 24 * time.Hour {
+      log.Printf("Stopping harvest of %s; no change in 24 hours\n", h.Path)
+      return nil
+    }
+  }
+
+  h.lease = h.Files.acquire(path)
+  file, err := h.open_file(path)
+  if err != nil {
+    log.Printf("Failed reopening %s: %s\n", path, err)
+    h.Files.release(h.lease)
+    h.lease = nil
+    return nil
+  }
+  file.Seek(offset, os.SEEK_SET)
+  log.Printf("Reopened %s at offset %d\n", path, offset)
+  return file
+}
+
+// Where the file known at h.Path went, if it is among its rotations.
+func (h *Harvester) rotated_to(known os.FileInfo) (string, os.FileInfo) {
+  if known == nil {
+    return "", nil
+  }
+  for _, candidate := range rotation_candidates(h.Path) {
+    if info, err := os.Stat(candidate); err == nil && os.SameFile(info, known) {
+      return candidate, info
+    }
+  }
+  return "", nil
+}
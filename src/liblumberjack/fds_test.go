@@ -0,0 +1,119 @@
+package liblumberjack
+
+import "bufio"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "reflect"
+import "testing"
+import "time"
+
+// The paths of the files a budget has open.
+func leased(b *FileBudget) (paths []string) {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+  for lease := range b.leases {
+    paths = append(paths, lease.path)
+  }
+  sort.Strings(paths)
+  return
+}
+
+func TestFileBudget(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  idle, busy, late := filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log"), filepath.Join(dir, "c.log")
+  for _, path := range []string{idle, busy, late} {
+    append_file(t, path, "first\n")
+  }
+
+  budget := &FileBudget{Max: 2}
+  output := make(chan *FileEvent, 100)
+  harvest := func(path string) {
+    harvester := Harvester{Path: path, Files: budget, from_beginning: true}
+    go harvester.Harvest(output)
+  }
+  harvest(idle)
+  time.Sleep(200 * time.Millisecond)
+
+  // One file keeps being written to, so its harvester stays active.
+  quit := make(chan bool)
+  defer close(quit)
+  go func() {
+    for {
+      select {
+        case <-quit:
+          return
+        case <-time.After(50 * time.Millisecond):
+          append_file(t, busy, "more\n")
+      }
+    }
+  }()
+  harvest(busy)
+  time.Sleep(200 * time.Millisecond)
+
+  // Over budget: the idle harvester gives up its file; the busy one keeps it.
+  harvest(late)
+  deadline := time.Now().Add(3 * time.Second)
+  for !reflect.DeepEqual(leased(budget), []string{busy, late}) {
+    if time.Now().After(deadline) {
+      t.Fatalf("Expected %s closed for %s, got %v open", idle, late, leased(budget))
+    }
+    time.Sleep(50 * time.Millisecond)
+  }
+  if budget.peak != 2 || open_files_peak.Value() < 2 {
+    t.Fatalf("Expected a peak of 2 open files, got %d", budget.peak)
+  }
+
+  // When the closed file grows, it's reopened where it left off, in place
+  // of the file idle the longest.
+  append_file(t, idle, "second\n")
+  timeout := time.After(5 * time.Second)
+  for {
+    select {
+      case event := <-output:
+        if *event.Source == idle && *event.Text == "second" {
+          if event.Offset != 6 {
+            t.Fatalf("Expected the reopened file read from offset 6, got %d", event.Offset)
+          }
+          if open := leased(budget); !reflect.DeepEqual(open, []string{idle, busy}) {
+            t.Fatalf("Expected %s and %s open, got %v", idle, busy, open)
+          }
+          return
+        }
+      case <-timeout:
+        t.Fatalf("The closed file was not reopened when it grew; open: %v", leased(budget))
+    }
+  }
+}
+
+func TestReopenAfterRotation(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "app.log")
+  append_file(t, path, "first\n")
+  known, _ := os.Stat(path)
+
+  // Closed at offset 6, the file grows and is rotated within one check.
+  harvester := Harvester{Path: path, Files: &FileBudget{Max: 1}}
+  append_file(t, path, "second\n")
+  if err := os.Rename(path, path + ".1"); err != nil {
+    t.Fatalf("Rename failed: %s", err)
+  }
+  append_file(t, path, "new\n")
+
+  file := harvester.reopen_when_grown(6, known)
+  if file == nil {
+    t.Fatal("Expected the rotated file reopened for its last lines")
+  }
+  defer file.Close()
+  defer harvester.Files.release(harvester.lease)
+  line, _ := bufio.NewReader(file).ReadString('\n')
+  if line != "second\n" {
+    t.Fatalf("Expected the rest of the rotated file, got %q", line)
+  }
+  if open := leased(harvester.Files); !reflect.DeepEqual(open, []string{path + ".1"}) {
+    t.Fatalf("Expected the rotated file leased, got %v", open)
+  }
+}
@@ -0,0 +1,44 @@
+package liblumberjack
+
+import (
+  "bytes"
+  "encoding/json"
+)
+
+// A FileSink keeps a local copy of every batch shipped, as newline
+// delimited JSON: one FileEvent per line, appended to Path and rotated as a
+// LogFile is. It is written before the batch is shipped, and synced to disk
+// before the write counts as done.
+//
+// If Required, a batch is only acknowledged (told to the post-ship hook,
+// and in time the registrar) once it is both shipped and in the file. A
+// sink that isn't required is best effort, like a best-effort pool.
+type FileSink struct {
+  Path string
+  MaxSize int64 // see LogFile
+  MaxFiles int
+  Required bool
+
+  file *LogFile
+}
+
+func (s *FileSink) write(events []*FileEvent) error {
+  if s.file == nil {
+    s.file = &LogFile{Path: s.Path, MaxSize: s.MaxSize, MaxFiles: s.MaxFiles}
+  }
+
+  var buffer bytes.Buffer
+  for _, event := range events {
+    line, err := json.Marshal(event)
+    if err != nil {
+      return err
+    }
+    buffer.Write(line)
+    buffer.WriteByte('\n')
+  }
+  // One write per batch, so a batch is never split across rotated files.
+  if _, err := s.file.Write(buffer.Bytes()); err != nil {
+    return err
+  }
+  return s.file.Sync()
+}
@@ -0,0 +1,66 @@
+package liblumberjack
+
+import "bufio"
+import "encoding/json"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func TestFileSink(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "events.ndjson")
+
+  // Only the file sink; no servers.
+  publisher := Publisher{FileSink: &FileSink{Path: path, Required: true}}
+  publisher.hooks = make(chan *ship_summary, 2)
+  input := make(chan []*FileEvent, 1)
+  input <- test_batch()
+  close(input)
+  publisher.Publish(input, nil)
+
+  file, err := os.Open(path)
+  if err != nil {
+    t.Fatalf("The file sink wasn't written: %s", err)
+  }
+  defer file.Close()
+  scanner := bufio.NewScanner(file)
+  var events []*FileEvent
+  for scanner.Scan() {
+    event := &FileEvent{}
+    if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+      t.Fatalf("Bad NDJSON line %q: %s", scanner.Text(), err)
+    }
+    events = append(events, event)
+  }
+  if len(events) != 3 || *events[1].Text != "world" || events[2].Offset != 12 {
+    t.Fatalf("Unexpected events in the file sink: %v", events)
+  }
+
+  // The batch was acknowledged.
+  select {
+    case summary := <-publisher.hooks:
+      if summary.Events != 3 {
+        t.Fatalf("Expected 3 events acknowledged, got %d", summary.Events)
+      }
+    default:
+      t.Fatalf("Expected the batch to be acknowledged once written")
+  }
+}
+
+func TestRequiredFileSinkFailure(t *testing.T) {
+  // The sink's directory doesn't exist, so writing it fails.
+  publisher := Publisher{FileSink: &FileSink{Path: "/nonexistent/events.ndjson", Required: true}}
+  publisher.hooks = make(chan *ship_summary, 2)
+  input := make(chan []*FileEvent, 1)
+  input <- test_batch()
+  close(input)
+  publisher.Publish(input, nil)
+
+  select {
+    case <-publisher.hooks:
+      t.Fatalf("Expected a batch missing from a required sink not to be acknowledged")
+    default:
+  }
+}
@@ -0,0 +1,81 @@
+package liblumberjack
+
+import (
+  "encoding/json"
+  "os"
+  "regexp"
+  "time"
+)
+
+// With Publisher.OutputFormat "gelf", batches are shipped as a JSON array
+// of GELF 1.1 messages (see http://graylog2.org/gelf#specs) instead of
+// FileEvents, for servers feeding Graylog:
+//
+//   {"version": "1.1", "host": "<hostname>", "short_message": "<line>",
+//    "timestamp": <unix seconds>, "level": 6,
+//    "_source": "<path>", "_offset": ..., "_line": ..., "_event_id": ...,
+//    "_<field>": ...}
+//
+// Fields decoded by a codec become additional "_" fields; a "message"
+// field, if any, is used as the short_message. GELF additional fields may
+// only be strings or numbers, so other values are shipped as their JSON.
+
+const gelf_level_info = 6 // syslog severity, the GELF default being 1
+
+// GELF field names are limited to these characters, and "_id" is reserved.
+var gelf_invalid_chars = regexp.MustCompile(`[^\w\.\-]`)
+
+var gelf_host, _ = os.Hostname()
+
+func gelf_messages(events []*FileEvent) []map[string]interface{} {
+  messages := make([]map[string]interface{}, len(events))
+  for i, event := range events {
+    messages[i] = gelf_message(event)
+  }
+  return messages
+}
+
+func gelf_message(event *FileEvent) map[string]interface{} {
+  harvested := event.harvested
+  if harvested.IsZero() {
+    harvested = time.Now() // eg, replayed from a dead letter file
+  }
+  message := map[string]interface{}{
+    "version": "1.1",
+    "host": gelf_host,
+    "timestamp": float64(harvested.UnixNano() / int64(time.Millisecond)) / 1000,
+    "level": gelf_level_info,
+    "_offset": event.Offset,
+    "_line": event.Line,
+  }
+  if event.Source != nil {
+    message["_source"] = *event.Source
+  }
+  if event.ID != "" {
+    message["_event_id"] = event.ID // "_id" is reserved
+  }
+
+  short_message := ""
+  if event.Text != nil {
+    short_message = *event.Text
+  }
+  for name, value := range event.Fields {
+    if text, ok := value.(string); ok && name == "message" && short_message == "" {
+      short_message = text
+      continue
+    }
+    name = "_" + gelf_invalid_chars.ReplaceAllString(name, "_")
+    if name == "_id" {
+      name = "_id_"
+    }
+    switch value.(type) {
+      case string, float64, int, int64, uint64:
+      default:
+        encoded, _ := json.Marshal(value)
+        value = string(encoded)
+    }
+    message[name] = value
+  }
+  message["short_message"] = short_message
+  return message
+}
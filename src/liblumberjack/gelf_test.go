@@ -0,0 +1,50 @@
+package liblumberjack
+
+import "encoding/json"
+import "regexp"
+import "testing"
+import "time"
+
+func TestGELFMessage(t *testing.T) {
+  source := "/var/log/app.log"
+  text := "GET /index.html 200"
+  event := &FileEvent{Source: &source, Offset: 100, Line: 3, Text: &text,
+                      harvested: time.Unix(1373713200, 250000000),
+                      Fields: map[string]interface{}{
+                        "host ip": "10.0.0.1",
+                        "id": "abc",
+                        "request": map[string]interface{}{"path": "/index.html"},
+                      }}
+
+  data, _ := json.Marshal(gelf_messages([]*FileEvent{event}))
+  var messages []map[string]interface{}
+  json.Unmarshal(data, &messages)
+  message := messages[0]
+
+  // Required fields.
+  if message["version"] != "1.1" || message["host"] != gelf_host ||
+     message["short_message"] != text || message["timestamp"] != 1373713200.25 {
+    t.Fatalf("Missing or wrong required GELF fields: %v", message)
+  }
+
+  // Additional fields are prefixed, valid and never "_id".
+  valid := regexp.MustCompile(`^_[\w\.\-]*$`)
+  for name, value := range message {
+    switch name {
+      case "version", "host", "short_message", "full_message", "timestamp", "level":
+        continue
+    }
+    if !valid.MatchString(name) || name == "_id" {
+      t.Fatalf("Invalid GELF additional field name: %q", name)
+    }
+    switch value.(type) {
+      case string, float64:
+      default:
+        t.Fatalf("GELF field %s isn't a string or number: %v", name, value)
+    }
+  }
+  if message["_source"] != source || message["_host_ip"] != "10.0.0.1" ||
+     message["_request"] != `{"path":"/index.html"}` {
+    t.Fatalf("Unexpected additional fields: %v", message)
+  }
+}
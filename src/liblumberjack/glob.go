@@ -0,0 +1,75 @@
+package liblumberjack
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// Paths may use ** for any number of directories (including none), as in
+// /var/log/**/*.log. Only the first ** is recursive; any others are matched
+// as a plain *.
+//
+// Symlinks to directories are only descended into with FollowDirSymlinks.
+// Either way, each directory is visited once, by its real path, so a
+// symlink loop can't hang the prospector and no file is matched twice.
+func (p *Prospector) glob(pattern string) ([]string, error) {
+  i := strings.Index(pattern, "**")
+  if i < 0 {
+    return filepath.Glob(pattern)
+  }
+
+  prefix := filepath.Clean(pattern[:i])
+  rest := strings.TrimPrefix(pattern[i + 2:], string(filepath.Separator))
+  if rest == "" {
+    rest = "*"
+  }
+  bases, err := filepath.Glob(prefix)
+  if err != nil {
+    return nil, err
+  }
+
+  var dirs []string
+  visited := make(map[string]bool)
+  for _, base := range bases {
+    dirs = p.walk_dirs(base, visited, dirs)
+  }
+
+  var matches []string
+  for _, dir := range dirs {
+    found, err := filepath.Glob(filepath.Join(dir, rest))
+    if err != nil {
+      return nil, err
+    }
+    matches = append(matches, found...)
+  }
+  return matches, nil
+}
+
+// Append dir and every directory below it to dirs, skipping any already
+// visited.
+func (p *Prospector) walk_dirs(dir string, visited map[string]bool, dirs []string) []string {
+  real, err := filepath.EvalSymlinks(dir)
+  if err != nil || visited[real] {
+    return dirs
+  }
+  visited[real] = true
+  dirs = append(dirs, dir)
+
+  entries, err := ioutil.ReadDir(dir) // Lstat, so symlinks show as such
+  if err != nil {
+    return dirs
+  }
+  for _, entry := range entries {
+    path := filepath.Join(dir, entry.Name())
+    if entry.IsDir() {
+      dirs = p.walk_dirs(path, visited, dirs)
+    } else if entry.Mode() & os.ModeSymlink != 0 && p.FollowDirSymlinks {
+      if info, err := os.Stat(path); err == nil && info.IsDir() {
+        dirs = p.walk_dirs(path, visited, dirs)
+      }
+    }
+  }
+  return dirs
+}
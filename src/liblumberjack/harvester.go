@@ -6,13 +6,116 @@ import (
   "bytes"
   "io"
   "bufio"
+  "sync/atomic"
   "time"
 )
 
+// A harvester keeps reading a rotated-away file until it has been idle this
+// long, so lines written just before the rotation are not lost.
+const default_rotated_linger = time.Minute
+
+// How long, by default, to wait for the rest of a line found without its
+// terminator at the end of a file, and how often to look for it meanwhile.
+const default_partial_line_wait = time.Second
+const partial_line_poll = 10 * time.Millisecond
+
+// How much a harvester reads at a time, by default, and at least; lines
+// longer than this are still read whole, a chunk at a time.
+const default_read_chunk_size = 16 << 10
+const MinReadChunkSize = 64
+
+// Limits on the backoff between attempts to open a file.
+const open_retry_min = 100 * time.Millisecond
+const open_retry_max = 5 * time.Second
+
 type Harvester struct {
   Path string /* the file path to harvest */
 
+  Codec Codec /* optional; decodes each line into fields */
+  SkipBinary bool /* don't harvest files that look binary */
+  KeepLineEnding bool /* ship lines with their trailing \n or \r\n */
+
+  // How long to keep reading a file after it was rotated away, once it
+  // stops growing. Zero means default_rotated_linger.
+  RotatedLinger time.Duration
+
+  // How long to wait for a writer to finish a line found without its
+  // terminator at the end of the file, before shipping what there is of
+  // it. Zero means default_partial_line_wait.
+  PartialLineWait time.Duration
+
+  EOF chan bool /* optional; told when the end of the file is reached */
+
+  // Discard this many lines at the start of a file, such as a CSV header.
+  // Only applies when reading from the beginning of the file.
+  SkipHeaderLines uint64
+
+  // Optional; ship only lines timestamped at or after a cutoff; see
+  // since.go.
+  Since *Since
+
+  // Optional; give events matching a pattern the lines before them, for
+  // context; see context.go.
+  Context *ContextBefore
+
+  // Optional; fields added to every event, such as the host's IP address.
+  // These replace any fields of the same name decoded by Codec.
+  Fields map[string]interface{}
+
+  // Optional; add the file's modification time to every event as a field
+  // of this name (RFC 3339, UTC), so the collector can tell when the file
+  // was written as well as when it was read. The file is stat'd again
+  // after each read from it, so the time follows a file that is still
+  // being written.
+  MtimeField string
+
+  // How to give each event an ID, if at all; see ids.go. Node is part of
+  // derived IDs, and defaults to the hostname.
+  IDScheme string
+  Node string
+  id_fingerprint string // with FingerprintIdentity, the start of the file
+
+  // Stop after emitting this many events from the file, for sampling or
+  // throttling a backfill of big historical files rather than shipping
+  // everything. Zero means no limit.
+  MaxEvents uint64
+
+  // Optional; shared by harvesters to cap the files they hold open; see
+  // fds.go.
+  Files *FileBudget
+
+  // Optional; shared by harvesters to limit how fast those far behind the
+  // end of their file ship; see backfill.go.
+  Backfill *Backfill
+
+  // Optional; report when a harvester that started more than this many
+  // bytes from the end of its file first reaches it, with a control event
+  // if CaughtUpEvents; see caughtup.go.
+  CaughtUpBehind int64
+  CaughtUpEvents bool
+
+  // How many bytes to read from the file at a time. Larger reads cost
+  // fewer syscalls on fast storage, smaller ones less memory per file.
+  // Zero means default_read_chunk_size.
+  ReadChunkSize int
+
+  // Give up opening the file after this many failed retries. Zero means
+  // retry forever.
+  OpenRetries int
+
+  // For NFS and other remote filesystems; see nfs.go.
+  StatRefresh bool
+  FingerprintIdentity bool
+  opener func(path string) (harvest_file, error) /* for tests; see open_file */
+
+  from_beginning bool /* read the whole file rather than only new data */
+  stop_at_eof bool /* stop at the end of the file rather than wait for more */
+  start_offset int64 /* if set, where to start reading, as left by stopped_offset */
+  stopped_offset int64 /* where reading stopped, once stopped by MaxEvents */
+
   file os.File /* the file being watched */
+  lease *file_lease /* with Files, the hold on the open file */
+  catching_up *catch_up /* with CaughtUpBehind, until the end is reached */
 }
 
 func (h *Harvester) Harvest(output chan *FileEvent) {
@@ -23,33 +126,120 @@ func (h *Harvester) Harvest(output chan *FileEvent) {
   // TODO(sissel): Quit if we think the file is dead (file dev/inode changed, no data in X seconds)
 
   log.Printf("Starting harvester: %s\n", h.Path)
+  if h.IDScheme == ID_DERIVED && h.Node == "" {
+    h.Node, _ = os.Hostname()
+  }
+  progress := harvester_started(h.Path)
+  defer harvester_stopped(h.Path, progress)
 
+  if h.Files != nil && h.Path != "-" {
+    h.lease = h.Files.acquire(h.Path)
+    defer func() {
+      if h.lease != nil {
+        h.Files.release(h.lease)
+      }
+    }()
+  }
   file := h.open()
+  if file == nil {
+    return
+  }
   info, _ := file.Stat() // TODO(sissel): Check error
-  defer file.Close()
+  defer func() {
+    if file != nil { // nil if it couldn't be reopened; see fds.go
+      file.Close()
+    }
+  }()
+
+  if h.SkipBinary && file != os.Stdin && is_binary(file) {
+    log.Printf("Skipping binary file: %s\n", h.Path)
+    return
+  }
   //info, _ := file.Stat()
 
   // TODO(sissel): Ask the registrar for the start position?
   // TODO(sissel): record the current file inode/device/etc
 
   var line uint64 = 0 // Ask registrar about the line number
+  var events uint64 = 0 // emitted, for MaxEvents
 
   // get current offset in file
   offset, _ := file.Seek(0, os.SEEK_CUR)
+  atomic.StoreInt64(&progress.offset, offset)
+  if info != nil {
+    atomic.StoreInt64(&progress.size, info.Size())
+  }
 
-  // TODO(sissel): Make the buffer size tunable at start-time
-  reader := bufio.NewReaderSize(file, 16<<10) // 16kb buffer by default
+  // Header lines are only at the start of a file; a harvester starting
+  // further in has already passed them.
+  var skip_lines uint64 = 0
+  if offset == 0 {
+    skip_lines = h.SkipHeaderLines
+  }
 
+  reader := h.new_reader(file)
+  h.start_catch_up(output, offset, info, progress)
+  defer h.stop_catch_up()
+  backfill := h.start_backfill(file, offset, progress)
+  defer func() {
+    if backfill != nil {
+      backfill.stop()
+    }
+  }()
+
+  var recent line_ring // with Context
   var read_timeout = 10 * time.Second
   last_read_time := time.Now()
+  var mtime string
   for {
-    text, err := h.readline(reader, read_timeout)
+    fresh := reader.Buffered() == 0 // will this line need a new read?
+    text, length, err := h.readline(reader, read_timeout)
+    if err == nil && fresh && h.MtimeField != "" {
+      if current, err := file.Stat(); err == nil {
+        mtime = current.ModTime().UTC().Format(time.RFC3339Nano)
+      }
+    }
 
     if err != nil {
-      if err == io.EOF {
+      if is_stale(err) {
+        // The file handle went stale (NFS); reopen and carry on from here.
+        log.Printf("Reopening %s at offset %d after error: %s\n", h.Path, offset, err)
+        file.Close()
+        if file = h.open(); file == nil {
+          return
+        }
+        file.Seek(offset, os.SEEK_SET)
+        info, _ = file.Stat()
+        reader = h.new_reader(file)
+        continue
+      } else if err == io.EOF {
+        if h.stop_at_eof {
+          log.Printf("Finished harvesting %s\n", h.Path)
+          return
+        }
+        if h.lease != nil && h.Files.evicted(h.lease) {
+          log.Printf("Closing %s at offset %d to make room under -max-open-files\n", h.Path, offset)
+          file.Close()
+          h.Files.release(h.lease)
+          h.lease = nil
+          if file = h.reopen_when_grown(offset, info); file == nil {
+            return
+          }
+          reader = h.new_reader(file)
+          last_read_time = time.Now()
+          continue
+        }
         // timed out waiting for data, got eof.
+        if current, err := file.Stat(); err == nil {
+          atomic.StoreInt64(&progress.size, current.Size())
+        }
         // TODO(sissel): Check to see if the file was truncated
         // TODO(sissel): if last_read_time was more than 24 hours ago
+        if h.rotated(file, info) && time.Since(last_read_time) > h.rotated_linger() {
+          // Whatever was written before the rotation has been read by now.
+          log.Printf("Stopping harvest of %s; file was rotated away\n", h.Path)
+          return
+        }
         if age := time.Since(last_read_time); age > (24 * time.Hour) {
           // This file is idle for more than 24 hours. Give up and stop harvesting.
           log.Printf("Stopping harvest of %s; last change was %d seconds ago\n", h.Path, age.Seconds())
@@ -58,86 +248,266 @@ func (h *Harvester) Harvest(output chan *FileEvent) {
         continue
       } else {
         log.Printf("Unexpected state reading from %s; error: %s\n", h.Path, err)
+        ReportError(ERR_READ_FAILED, "Failed reading " + h.Path,
+                    map[string]interface{}{"path": h.Path, "offset": offset, "error": err.Error()})
         return
       }
     }
     last_read_time = time.Now()
+    if fresh && h.lease != nil {
+      h.Files.set_idle(h.lease, false)
+    }
 
     line++
+    if line <= skip_lines {
+      dropped("header", 1)
+      offset += int64(length)
+      continue
+    }
+    if h.Since != nil {
+      if keep, reason := h.Since.keep(*text); !keep {
+        dropped(reason, 1)
+        offset += int64(length)
+        continue
+      }
+    }
+
     event := &FileEvent{
       Source: &h.Path,
       Offset: uint64(offset),
       Line: line,
       Text: text,
       fileinfo: &info,
+      harvested: last_read_time,
+    }
+    if h.IDScheme != ID_NONE {
+      event.ID = h.id_of(file, info, offset, offset + int64(length))
+    }
+    offset += int64(length)
+    atomic.StoreInt64(&progress.offset, offset)
+
+    if h.Codec != nil {
+      h.Codec.Decode(event)
+    }
+    if len(h.Fields) > 0 {
+      if event.Fields == nil {
+        event.Fields = make(map[string]interface{}, len(h.Fields))
+      }
+      for name, value := range h.Fields {
+        event.Fields[name] = value
+      }
+    }
+    if h.MtimeField != "" {
+      if event.Fields == nil {
+        event.Fields = make(map[string]interface{}, 1)
+      }
+      event.Fields[h.MtimeField] = mtime
+    }
+    if h.Context != nil {
+      if h.Context.matches(*text) {
+        if event.Fields == nil {
+          event.Fields = make(map[string]interface{}, 1)
+        }
+        event.Fields[h.Context.field()] = recent.context()
+      }
+      recent.push(h.Context, *text)
+    }
+
+    // If harvesting is disabled, hold this event (and stop reading) until
+    // it is enabled again.
+    if wait_enabled(h.Path) {
+      // Don't count the time spent disabled as the file being idle.
+      last_read_time = time.Now()
     }
-    offset += int64(len(*event.Text)) + 1  // +1 because of the line terminator
 
+    if backfill != nil && !backfill.throttle(file, offset) {
+      log.Printf("%s caught up with its backfill at offset %d\n", h.Path, offset)
+      backfill = nil
+    }
     output <- event // ship the new event downstream
+    events_harvested.Inc()
+    bytes_harvested.Add(uint64(length))
+
+    if events++; h.MaxEvents > 0 && events >= h.MaxEvents {
+      log.Printf("Stopping harvest of %s after %d events, at offset %d\n", h.Path, events, offset)
+      h.stopped_offset = offset
+      return
+    }
   } /* forever */
 }
 
-func (h *Harvester) open() *os.File {
-  var file *os.File
+func (h *Harvester) open() harvest_file {
+  var file harvest_file
 
   // Special handling that "-" means to read from standard input
   if h.Path == "-" {
     return os.Stdin
   } 
 
-  for {
+  // A file can be briefly locked, or not there yet, so retry opening it,
+  // backing off from open_retry_min to open_retry_max between attempts.
+  delay := open_retry_min
+  for attempt := 1; ; attempt++ {
     var err error
-    file, err = os.Open(h.Path)
+    file, err = h.open_file(h.Path)
 
-    if err != nil {
-      // retry on failure.
-      log.Printf("Failed opening %s: %s\n", h.Path, err)
-      time.Sleep(5 * time.Second)
-    } else {
+    if err == nil {
       break
     }
+    if h.OpenRetries > 0 && attempt > h.OpenRetries {
+      log.Printf("Giving up opening %s after %d attempts: %s\n", h.Path, attempt, err)
+      ReportError(ERR_OPEN_FAILED, "Gave up opening " + h.Path,
+                  map[string]interface{}{"path": h.Path, "attempts": attempt, "error": err.Error()})
+      return nil
+    }
+
+    // retry on failure.
+    log.Printf("Failed opening %s: %s\n", h.Path, err)
+    if attempt == 1 {
+      // Once; a file that isn't there yet is retried forever by default.
+      ReportError(ERR_OPEN_FAILED, "Failed opening " + h.Path,
+                  map[string]interface{}{"path": h.Path, "attempts": attempt, "error": err.Error()})
+    }
+    time.Sleep(delay)
+    if delay *= 2; delay > open_retry_max {
+      delay = open_retry_max
+    }
   }
 
   // TODO(sissel): In the future, use the registrary to determine where to seek.
   // TODO(sissel): Only seek if the file is a file, not a pipe or socket.
-  file.Seek(0, os.SEEK_END)
+  if h.start_offset > 0 {
+    file.Seek(h.start_offset, os.SEEK_SET)
+  } else if !h.from_beginning {
+    file.Seek(0, os.SEEK_END)
+  }
 
   return file
 }
 
-func (h *Harvester) readline(reader *bufio.Reader, eof_timeout time.Duration) (*string, error) {
+// Has the file being harvested been renamed or removed from h.Path?
+func (h *Harvester) rotated(file harvest_file, info os.FileInfo) bool {
+  if h.Path == "-" || info == nil {
+    return false
+  }
+  current, err := h.stat(h.Path)
+  if err != nil {
+    return true
+  }
+  if os.SameFile(info, current) {
+    return false
+  }
+  return !h.FingerprintIdentity ||
+         !same_fingerprint(fingerprint(file), h.path_fingerprint(h.Path))
+}
+
+func (h *Harvester) partial_line_wait() time.Duration {
+  if h.PartialLineWait > 0 {
+    return h.PartialLineWait
+  }
+  return default_partial_line_wait
+}
+
+func (h *Harvester) rotated_linger() time.Duration {
+  if h.RotatedLinger > 0 {
+    return h.RotatedLinger
+  }
+  return default_rotated_linger
+}
+
+// A file is considered binary if its first block contains a NUL byte, which
+// text logs never do. This reads without moving the file offset.
+func is_binary(file harvest_file) bool {
+  buffer := make([]byte, 8192)
+  n, _ := file.ReadAt(buffer, 0)
+  return bytes.IndexByte(buffer[:n], 0) >= 0
+}
+
+func (h *Harvester) new_reader(file harvest_file) *bufio.Reader {
+  size := h.ReadChunkSize
+  if size == 0 {
+    size = default_read_chunk_size
+  } else if size < MinReadChunkSize {
+    size = MinReadChunkSize
+  }
+  return bufio.NewReaderSize(file, size)
+}
+
+// Read a line. Also returns the number of bytes the line took in the file,
+// including any line terminator, which is stripped unless KeepLineEnding.
+func (h *Harvester) readline(reader *bufio.Reader, eof_timeout time.Duration) (*string, int, error) {
   var buffer bytes.Buffer
   start_time := time.Now()
+  nudged := false
+  var partial_since time.Time // when the partial line last grew
   for {
-    segment, is_partial, err := reader.ReadLine()
-
-    if err != nil {
-      // TODO(sissel): if eof and line_complete is false, don't check rotation unless a very long time has passed
-      if err == io.EOF {
-        time.Sleep(1 * time.Second) // TODO(sissel): Implement backoff
+    segment, err := reader.ReadSlice('\n')
+    // TODO(sissel): if buffer exceeds a certain length, maybe report an error condition? chop it?
+    buffer.Write(segment)
 
-        // Give up waiting for data after a certain amount of time.
-        // If we time out, return the error (eof)
-        if time.Since(start_time) > eof_timeout {
-          return nil, err
+    if err == nil {
+      break // got a full line
+    } else if err == bufio.ErrBufferFull {
+      continue // line is longer than the read buffer, keep reading.
+    } else if err == io.EOF {
+      if buffer.Len() > 0 {
+        // The writer may be part way through the line; read on rather than
+        // split it in two. A file whose last line is never finished, or one
+        // read to its end only, still has it shipped as is.
+        if len(segment) > 0 || partial_since.IsZero() {
+          partial_since = time.Now()
         }
+        if h.stop_at_eof || time.Since(partial_since) >= h.partial_line_wait() {
+          break // data without a line terminator; ship what we have.
+        }
+        time.Sleep(partial_line_poll)
         continue
-      } else {
-        log.Println(err)
-        return nil, err // TODO(sissel): don't do this?
       }
-    }
 
-    // TODO(sissel): if buffer exceeds a certain length, maybe report an error condition? chop it?
-    buffer.Write(segment)
+      h.reached_eof()
+      if h.EOF != nil && !nudged {
+        // Caught up; nudge the spooler, without waiting on it.
+        select {
+          case h.EOF <- true:
+          default:
+        }
+        nudged = true
+      }
+
+      if h.lease != nil {
+        // Let the budget close this file, if another needs the room.
+        h.Files.set_idle(h.lease, true)
+        if h.Files.evicted(h.lease) {
+          return nil, 0, err
+        }
+      }
 
-    if !is_partial {
-      // If we got a full line, return the whole line.
-      str := new(string)
-      *str = buffer.String()
-      return str, nil
+      if h.stop_at_eof {
+        return nil, 0, err
+      }
+
+      // TODO(sissel): if eof and line_complete is false, don't check rotation unless a very long time has passed
+      time.Sleep(1 * time.Second) // TODO(sissel): Implement backoff
+
+      // Give up waiting for data after a certain amount of time.
+      // If we time out, return the error (eof)
+      if time.Since(start_time) > eof_timeout {
+        return nil, 0, err
+      }
+      continue
+    } else {
+      log.Println(err)
+      return nil, 0, err // TODO(sissel): don't do this?
     }
   } /* forever read chunks */
 
-  return nil, nil
+  raw := buffer.Bytes()
+  length := len(raw)
+  if !h.KeepLineEnding {
+    raw = bytes.TrimSuffix(raw, []byte("\n"))
+    raw = bytes.TrimSuffix(raw, []byte("\r"))
+  }
+  str := new(string)
+  *str = string(raw)
+  return str, length, nil
 }
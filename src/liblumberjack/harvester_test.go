@@ -0,0 +1,521 @@
+package liblumberjack
+
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "os"
+import "path/filepath"
+import "reflect"
+import "regexp"
+import "strings"
+import "sync/atomic"
+import "syscall"
+import "testing"
+import "time"
+
+// Append text to the file at path.
+func append_file(t *testing.T, path string, text string) {
+  file, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+  if err != nil {
+    t.Fatalf("Failed to open %s: %s", path, err)
+  }
+  file.WriteString(text)
+  file.Close()
+}
+
+func TestHarvesterSkipBinary(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+
+  binary := filepath.Join(dir, "wtmp")
+  append_file(t, binary, "user\x00\x00\x00pts/0\x00\x00\n")
+  text := filepath.Join(dir, "messages")
+  append_file(t, text, "an existing line\n")
+
+  output := make(chan *FileEvent, 10)
+
+  done := make(chan bool)
+  go func() {
+    harvester := Harvester{Path: binary, SkipBinary: true}
+    harvester.Harvest(output)
+    done <- true
+  }()
+  select {
+    case <- done:
+    case <- time.After(time.Second):
+      t.Fatal("The harvester did not skip a binary file")
+  }
+
+  harvester := Harvester{Path: text, SkipBinary: true}
+  go harvester.Harvest(output)
+  time.Sleep(100 * time.Millisecond)
+  append_file(t, text, "a new line\n")
+
+  select {
+    case event := <- output:
+      if *event.Source != text || *event.Text != "a new line" {
+        t.Fatalf("Unexpected event from %s: %q", *event.Source, *event.Text)
+      }
+    case <- time.After(3 * time.Second):
+      t.Fatal("The harvester did not ship lines from a text file")
+  }
+}
+
+func TestHarvesterLineEndings(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+
+  tests := []struct {
+    ending string
+    keep bool
+    expected []string
+  }{
+    {"\n", false, []string{"one", "two"}},
+    {"\n", true, []string{"one\n", "two\n"}},
+    {"\r\n", false, []string{"one", "two"}},
+    {"\r\n", true, []string{"one\r\n", "two\r\n"}},
+  }
+
+  outputs := make([]chan *FileEvent, len(tests))
+  paths := make([]string, len(tests))
+  for i, test := range tests {
+    paths[i] = filepath.Join(dir, fmt.Sprintf("test%d.log", i))
+    append_file(t, paths[i], "")
+    outputs[i] = make(chan *FileEvent, 10)
+    harvester := Harvester{Path: paths[i], KeepLineEnding: test.keep}
+    go harvester.Harvest(outputs[i])
+  }
+  time.Sleep(100 * time.Millisecond)
+  for i, test := range tests {
+    append_file(t, paths[i], "one" + test.ending + "two" + test.ending)
+  }
+
+  for i, test := range tests {
+    var offset uint64 = 0
+    for _, expected := range test.expected {
+      select {
+        case event := <- outputs[i]:
+          if *event.Text != expected {
+            t.Errorf("%q (keep: %v): expected %q, got %q", test.ending,
+                     test.keep, expected, *event.Text)
+          }
+          if event.Offset != offset {
+            t.Errorf("%q (keep: %v): expected offset %d for %q, got %d",
+                     test.ending, test.keep, offset, expected, event.Offset)
+          }
+          offset += uint64(len("one" + test.ending))
+        case <- time.After(3 * time.Second):
+          t.Fatalf("%q (keep: %v): timed out waiting for %q", test.ending,
+                   test.keep, expected)
+      }
+    }
+  }
+}
+
+func TestHarvesterDisable(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+
+  noisy := filepath.Join(dir, "noisy.log")
+  quiet := filepath.Join(dir, "quiet.log")
+  output := make(chan *FileEvent, 10)
+  for _, path := range []string{noisy, quiet} {
+    append_file(t, path, "")
+    harvester := Harvester{Path: path}
+    go harvester.Harvest(output)
+  }
+
+  admin := func(action string, path string) {
+    request, _ := http.NewRequest("POST", "/harvesters/" + action + "?path=" + url.QueryEscape(path), nil)
+    response := httptest.NewRecorder()
+    admin_mux.ServeHTTP(response, request)
+    if response.Code != http.StatusOK {
+      t.Fatalf("%s %s failed: %d %s", action, path, response.Code, response.Body)
+    }
+  }
+  admin("disable", noisy)
+  defer SetHarvesting(noisy, true)
+
+  time.Sleep(100 * time.Millisecond)
+  append_file(t, noisy, "noise\n")
+  append_file(t, quiet, "signal\n")
+
+  select {
+    case event := <- output:
+      if *event.Source != quiet {
+        t.Fatalf("Got an event from a disabled file: %q", *event.Text)
+      }
+    case <- time.After(3 * time.Second):
+      t.Fatal("Timed out waiting for the enabled file's event")
+  }
+
+  status := harvesters_status().(map[string]interface{})
+  if status[noisy].(map[string]interface{})["enabled"] != false {
+    t.Fatalf("Status doesn't show %s as disabled: %v", noisy, status)
+  }
+
+  admin("enable", noisy)
+  select {
+    case event := <- output:
+      if *event.Source != noisy || *event.Text != "noise" || event.Offset != 0 {
+        t.Fatalf("Unexpected event after enabling: %s %q @%d", *event.Source,
+                 *event.Text, event.Offset)
+      }
+    case <- time.After(3 * time.Second):
+      t.Fatal("Timed out waiting for the re-enabled file's event")
+  }
+}
+
+func TestHarvesterSkipHeaderLines(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "data.csv")
+  append_file(t, path, "name,count\n# generated\nfoo,1\n")
+
+  output := make(chan *FileEvent, 10)
+  harvester := Harvester{Path: path, SkipHeaderLines: 2, from_beginning: true,
+                         stop_at_eof: true}
+  done := make(chan bool)
+  go func() {
+    harvester.Harvest(output)
+    done <- true
+  }()
+  select {
+    case event := <- output:
+      if *event.Text != "foo,1" || event.Line != 3 || event.Offset != 23 {
+        t.Fatalf("Expected the header to be skipped, got line %d at %d: %q",
+                 event.Line, event.Offset, *event.Text)
+      }
+    case <- time.After(3 * time.Second):
+      t.Fatal("No lines were harvested")
+  }
+  <-done
+
+  // A harvester starting past the header doesn't skip anything.
+  resumed := make(chan *FileEvent, 10)
+  resumer := Harvester{Path: path, SkipHeaderLines: 2}
+  go resumer.Harvest(resumed)
+  time.Sleep(100 * time.Millisecond)
+  append_file(t, path, "bar,2\n")
+  select {
+    case event := <- resumed:
+      if *event.Text != "bar,2" {
+        t.Fatalf("Expected the first new line, got %q", *event.Text)
+      }
+    case <- time.After(3 * time.Second):
+      t.Fatal("New lines were skipped after resuming")
+  }
+}
+
+func TestHarvesterSourceIPField(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "app.log")
+  append_file(t, path, "")
+
+  // With the collector on loopback, loopback is the outbound address.
+  ip, err := OutboundIP("tcp://127.0.0.1:5005")
+  if err != nil || ip != "127.0.0.1" {
+    t.Fatalf("Expected outbound ip 127.0.0.1, got %q (%v)", ip, err)
+  }
+
+  output := make(chan *FileEvent, 10)
+  harvester := Harvester{Path: path, Fields: map[string]interface{}{"host_ip": ip}}
+  go harvester.Harvest(output)
+  time.Sleep(100 * time.Millisecond)
+  append_file(t, path, "hello\n")
+
+  select {
+    case event := <- output:
+      if event.Fields["host_ip"] != "127.0.0.1" || *event.Text != "hello" {
+        t.Fatalf("Expected the ip field on the event, got %v", event.Fields)
+      }
+    case <- time.After(3 * time.Second):
+      t.Fatal("No lines were harvested")
+  }
+}
+
+func TestHarvesterProgress(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "history.log")
+  file, _ := os.Create(path)
+  for i := 0; i < 1000; i++ {
+    file.WriteString("123456789\n")
+  }
+  file.Close()
+
+  // Nothing reads past what the test takes, plus the line being sent.
+  output := make(chan *FileEvent)
+  harvester := Harvester{Path: path, from_beginning: true}
+  go harvester.Harvest(output)
+  for i := 0; i < 249; i++ {
+    <-output
+  }
+  time.Sleep(100 * time.Millisecond)
+
+  status := harvesters_status().(map[string]interface{})[path].(map[string]interface{})
+  if status["size"] != int64(10000) || status["offset"] != int64(2500) ||
+     status["progress_percent"] != 25.0 {
+    t.Fatalf("Expected 25%% progress through 10000 bytes, got %v", status)
+  }
+}
+
+func TestHarvesterOpenRetry(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "locked.log")
+  append_file(t, path, "")
+
+  // The first few opens fail, as if the file were locked.
+  var failures int32 = 3
+  opener := func(path string) (harvest_file, error) {
+    if atomic.AddInt32(&failures, -1) >= 0 {
+      return nil, syscall.EACCES
+    }
+    return os.Open(path)
+  }
+
+  output := make(chan *FileEvent, 10)
+  harvester := Harvester{Path: path, OpenRetries: 5, opener: opener}
+  go harvester.Harvest(output)
+  time.Sleep(time.Second) // 100ms + 200ms + 400ms of backoff
+  append_file(t, path, "unlocked\n")
+
+  select {
+    case event := <- output:
+      if *event.Text != "unlocked" {
+        t.Fatalf("Unexpected event: %q", *event.Text)
+      }
+    case <- time.After(3 * time.Second):
+      t.Fatal("The harvester did not open the file once it was unlocked")
+  }
+
+  // Past OpenRetries, the harvester gives up.
+  atomic.StoreInt32(&failures, 100)
+  done := make(chan bool)
+  go func() {
+    harvester := Harvester{Path: path, OpenRetries: 2, opener: opener}
+    harvester.Harvest(output)
+    done <- true
+  }()
+  select {
+    case <- done:
+    case <- time.After(3 * time.Second):
+      t.Fatal("The harvester did not give up opening the file")
+  }
+}
+
+// A file of lines of varied lengths, some longer than a small read chunk.
+func write_lines(t testing.TB, path string, count int) []string {
+  var lines []string
+  file, err := os.Create(path)
+  if err != nil {
+    t.Fatalf("Failed to create %s: %s", path, err)
+  }
+  defer file.Close()
+  for i := 0; i < count; i++ {
+    line := fmt.Sprintf("%d %s", i, strings.Repeat("x", i * 37 % 300))
+    lines = append(lines, line)
+    file.WriteString(line + "\n")
+  }
+  return lines
+}
+
+// Harvest the whole of the file at path with the given read chunk size.
+func harvest_all(path string, chunk_size int, output chan *FileEvent) {
+  harvester := Harvester{Path: path, ReadChunkSize: chunk_size,
+                         from_beginning: true, stop_at_eof: true}
+  harvester.Harvest(output)
+  close(output)
+}
+
+func TestHarvesterReadChunkSize(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "lines")
+  lines := write_lines(t, path, 1000)
+
+  // Lines straddle the chunk boundaries, and some span several chunks.
+  for _, chunk_size := range []int{1, MinReadChunkSize, 100, 4096, 1 << 20} {
+    output := make(chan *FileEvent, len(lines))
+    go harvest_all(path, chunk_size, output)
+    i := 0
+    for event := range output {
+      if i >= len(lines) || *event.Text != lines[i] {
+        t.Fatalf("chunk size %d: unexpected line %d: %q", chunk_size, i, *event.Text)
+      }
+      i++
+    }
+    if i != len(lines) {
+      t.Fatalf("chunk size %d: expected %d lines, got %d", chunk_size, len(lines), i)
+    }
+  }
+}
+
+func BenchmarkHarvesterReadChunkSize(b *testing.B) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "lines")
+  write_lines(b, path, 100000)
+  info, _ := os.Stat(path)
+
+  for _, chunk_size := range []int{MinReadChunkSize, 4 << 10, 16 << 10, 256 << 10} {
+    b.Run(fmt.Sprintf("%d", chunk_size), func(b *testing.B) {
+      b.SetBytes(info.Size())
+      for i := 0; i < b.N; i++ {
+        output := make(chan *FileEvent, 1024)
+        go harvest_all(path, chunk_size, output)
+        for _ = range output {
+        }
+      }
+    })
+  }
+}
+
+func TestHarvesterMaxEvents(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "lines")
+  lines := write_lines(t, path, 10)
+
+  // Each harvester stops after 4 events; the next resumes where the last
+  // one stopped, until the file runs out.
+  var got []string
+  var offset int64
+  for run := 0; run < 3; run++ {
+    output := make(chan *FileEvent, len(lines))
+    harvester := Harvester{Path: path, MaxEvents: 4, from_beginning: true,
+                           stop_at_eof: true, start_offset: offset}
+    harvester.Harvest(output)
+    close(output)
+
+    count := 0
+    for event := range output {
+      got = append(got, *event.Text)
+      count++
+    }
+    if expected := []int{4, 4, 2}[run]; count != expected {
+      t.Fatalf("Run %d: expected %d events, got %d", run, expected, count)
+    }
+    offset = harvester.stopped_offset
+  }
+  if !reflect.DeepEqual(got, lines) {
+    t.Fatalf("Expected every line once across the runs, got %q", got)
+  }
+}
+
+func TestHarvesterMtimeField(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "audit.log")
+  append_file(t, path, "old\n")
+  written := time.Date(2013, 7, 13, 10, 0, 0, 0, time.UTC)
+  os.Chtimes(path, written, written)
+
+  output := make(chan *FileEvent, 10)
+  harvester := Harvester{Path: path, MtimeField: "file_mtime", from_beginning: true}
+  go harvester.Harvest(output)
+
+  expect := func(text string, mtime time.Time) {
+    select {
+      case event := <- output:
+        if *event.Text != text || event.Fields["file_mtime"] != mtime.UTC().Format(time.RFC3339Nano) {
+          t.Fatalf("Expected %q with mtime %s, got %q with %v", text, mtime, *event.Text, event.Fields)
+        }
+      case <- time.After(3 * time.Second):
+        t.Fatalf("Timed out waiting for %q", text)
+    }
+  }
+  expect("old", written)
+
+  // A later write moves the mtime along.
+  time.Sleep(100 * time.Millisecond)
+  append_file(t, path, "new\n")
+  info, _ := os.Stat(path)
+  expect("new", info.ModTime())
+}
+
+func TestHarvesterFileBeingAppended(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "busy.log")
+  append_file(t, path, "")
+
+  // Written as fast as possible, with lines split across writes, some with
+  // a pause part way; the harvester starts meanwhile.
+  const count = 3000
+  file, _ := os.OpenFile(path, os.O_WRONLY | os.O_APPEND, 0644)
+  defer file.Close()
+  written := make(chan bool)
+  go func() {
+    for i := 0; i < count; i++ {
+      file.WriteString(fmt.Sprintf("%06d-", i))
+      if i % 100 == 0 {
+        time.Sleep(40 * time.Millisecond)
+      }
+      file.WriteString(strings.Repeat("x", i % 50) + "\n")
+    }
+    close(written)
+  }()
+
+  output := make(chan *FileEvent, count)
+  harvester := Harvester{Path: path, from_beginning: true}
+  go harvester.Harvest(output)
+
+  <-written
+  for i := 0; i < count; i++ {
+    select {
+      case event := <-output:
+        if expected := fmt.Sprintf("%06d-%s", i, strings.Repeat("x", i % 50)); *event.Text != expected {
+          t.Fatalf("Expected line %d as %q, got %q", i, expected, *event.Text)
+        }
+      case <-time.After(2 * time.Second):
+        t.Fatalf("The harvester fell behind, at line %d of %d", i, count)
+    }
+  }
+}
+
+func TestHarvesterContextBefore(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "app.log")
+  append_file(t, path, "ERROR at once\none\ntwo\nthree\nERROR first\nfour\nERROR second\n" +
+                       strings.Repeat("x", 100) + "\nERROR third\n")
+
+  context := map[string][]string{}
+  for _, max_bytes := range []int{0, 50} {
+    output := make(chan *FileEvent, 20)
+    harvester := Harvester{Path: path, from_beginning: true, stop_at_eof: true,
+                           Context: &ContextBefore{Lines: 3, MaxBytes: max_bytes,
+                                                   Pattern: regexp.MustCompile("^ERROR")}}
+    harvester.Harvest(output)
+    close(output)
+    for event := range output {
+      lines, found := event.Fields[default_context_field]
+      if strings.HasPrefix(*event.Text, "ERROR") != found {
+        t.Fatalf("Expected context on the ERROR lines only, %q has %v", *event.Text, lines)
+      }
+      if found {
+        context[fmt.Sprintf("%d %s", max_bytes, *event.Text)] = lines.([]string)
+      }
+    }
+  }
+
+  expected := map[string][]string{
+    "0 ERROR at once": {},
+    "0 ERROR first": {"one", "two", "three"},
+    "0 ERROR second": {"three", "ERROR first", "four"},
+    "0 ERROR third": {"four", "ERROR second", strings.Repeat("x", 100)},
+    // Lines past MaxBytes are left out, even the one just before.
+    "50 ERROR at once": {},
+    "50 ERROR first": {"one", "two", "three"},
+    "50 ERROR second": {"three", "ERROR first", "four"},
+    "50 ERROR third": {},
+  }
+  if !reflect.DeepEqual(context, expected) {
+    t.Fatalf("Expected context %v, got %v", expected, context)
+  }
+}
@@ -0,0 +1,150 @@
+package liblumberjack
+
+import (
+  "fmt"
+  "log"
+  "net/http"
+  "sync"
+  "sync/atomic"
+)
+
+// Tracks the running harvesters, and which paths have had harvesting
+// disabled at runtime through the admin endpoints.
+
+var harvesters_lock sync.Mutex
+var harvesters_cond = sync.NewCond(&harvesters_lock)
+
+// path -> number of running harvesters. A rotated file briefly has two.
+var active_harvesters = make(map[string]int)
+
+var disabled_paths = make(map[string]bool)
+
+// path -> how far its (newest) harvester is through the file.
+var harvest_progress = make(map[string]*progress)
+
+// Updated by the harvester without taking harvesters_lock. The size is
+// refreshed whenever the harvester reaches EOF, so a file growing while it
+// is read shows as 100% until then.
+type progress struct {
+  offset int64
+  size int64
+  backfilling int32 // 1 while limited by a Backfill; see backfill.go
+}
+
+func (p *progress) percent() float64 {
+  offset, size := atomic.LoadInt64(&p.offset), atomic.LoadInt64(&p.size)
+  if offset >= size {
+    return 100
+  }
+  return float64(offset) * 100 / float64(size)
+}
+
+// Set while all harvesting is paused to stay under a MemoryLimit.
+var memory_paused bool
+
+// Set while all harvesting is paused for slow servers; see congestion.go.
+var latency_paused bool
+
+func init() {
+  RegisterStatus("harvesters", harvesters_status)
+  admin_mux.HandleFunc("/harvesters/disable", func(w http.ResponseWriter, r *http.Request) {
+    set_harvesting(w, r, false)
+  })
+  admin_mux.HandleFunc("/harvesters/enable", func(w http.ResponseWriter, r *http.Request) {
+    set_harvesting(w, r, true)
+  })
+}
+
+func harvester_started(path string) *progress {
+  harvesters_lock.Lock()
+  defer harvesters_lock.Unlock()
+  active_harvesters[path]++
+  files_harvested.Inc()
+  harvest_progress[path] = &progress{}
+  return harvest_progress[path]
+}
+
+func harvester_stopped(path string, p *progress) {
+  harvesters_lock.Lock()
+  defer harvesters_lock.Unlock()
+  if active_harvesters[path]--; active_harvesters[path] <= 0 {
+    delete(active_harvesters, path)
+  }
+  if harvest_progress[path] == p {
+    delete(harvest_progress, path)
+  }
+}
+
+// Block while harvesting of the path is disabled, or all harvesting is
+// paused for memory or slow servers. Returns true if it had to wait.
+func wait_enabled(path string) (waited bool) {
+  harvesters_lock.Lock()
+  defer harvesters_lock.Unlock()
+  for disabled_paths[path] || memory_paused || latency_paused {
+    waited = true
+    harvesters_cond.Wait()
+  }
+  return
+}
+
+// Disable or enable harvesting of a path. A disabled file's harvesters stop
+// reading, keeping their place, until it is enabled again.
+func SetHarvesting(path string, enabled bool) {
+  harvesters_lock.Lock()
+  defer harvesters_lock.Unlock()
+  if enabled {
+    delete(disabled_paths, path)
+    harvesters_cond.Broadcast()
+  } else {
+    disabled_paths[path] = true
+  }
+}
+
+func set_harvesting(w http.ResponseWriter, r *http.Request, enabled bool) {
+  if r.Method != "POST" {
+    http.Error(w, "POST required", http.StatusMethodNotAllowed)
+    return
+  }
+  path := r.FormValue("path")
+  if path == "" {
+    http.Error(w, "missing 'path' parameter", http.StatusBadRequest)
+    return
+  }
+
+  SetHarvesting(path, enabled)
+  if enabled {
+    log.Printf("Harvesting enabled for %s\n", path)
+  } else {
+    log.Printf("Harvesting disabled for %s\n", path)
+  }
+  fmt.Fprintf(w, "ok\n")
+}
+
+func harvesters_status() interface{} {
+  harvesters_lock.Lock()
+  defer harvesters_lock.Unlock()
+
+  result := make(map[string]interface{})
+  for path, count := range active_harvesters {
+    info := map[string]interface{}{
+      "harvesters": count,
+      "enabled": !disabled_paths[path],
+    }
+    if p, ok := harvest_progress[path]; ok {
+      info["offset"] = atomic.LoadInt64(&p.offset)
+      info["size"] = atomic.LoadInt64(&p.size)
+      info["progress_percent"] = p.percent()
+      info["backfilling"] = atomic.LoadInt32(&p.backfilling) == 1
+    }
+    result[path] = info
+  }
+  for path := range disabled_paths {
+    if _, active := active_harvesters[path]; !active {
+      result[path] = map[string]interface{}{
+        "harvesters": 0,
+        "enabled": false,
+      }
+    }
+  }
+  return result
+}
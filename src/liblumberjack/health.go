@@ -0,0 +1,105 @@
+package liblumberjack
+
+import (
+  zmq "github.com/alecthomas/gozmq"
+  "log"
+  "time"
+)
+
+// With FFS.HealthInterval, every endpoint is pinged that often in the
+// background, on a socket of its own, so a dead endpoint is found before a
+// batch is sent its way. A ping is an empty batch, which any server
+// acknowledges like any other. An endpoint that doesn't reply within
+// RecvTimeout is unhealthy, and choose_endpoint avoids it while any other
+// endpoint isn't; it becomes healthy again once it replies to a ping.
+//
+// The socket in use is not failed when its endpoint turns unhealthy; if the
+// endpoint is really gone, the next batch fails over as usual. Only changes
+// in health are logged.
+
+// Ping every endpoint every HealthInterval, until Shutdown.
+func (s *FFS) check_health(quit chan bool) {
+  ticker := time.NewTicker(s.HealthInterval)
+  defer ticker.Stop()
+  for {
+    s.check_all()
+    select {
+      case <-ticker.C:
+      case <-quit:
+        return
+    }
+  }
+}
+
+func (s *FFS) check_all() {
+  s.latency_lock.Lock()
+  endpoints := s.Endpoints // replaced, not changed, by SetEndpoints
+  s.latency_lock.Unlock()
+  for _, endpoint := range endpoints {
+    healthy := s.ping_endpoint(endpoint)
+
+    s.latency_lock.Lock()
+    if s.health == nil {
+      s.health = make(map[string]bool)
+    }
+    was, known := s.health[endpoint]
+    s.health[endpoint] = healthy
+    s.latency_lock.Unlock()
+
+    if !healthy && (was || !known) {
+      log.Printf("%s: no reply to a health check; avoiding it\n", endpoint)
+    } else if healthy && known && !was {
+      log.Printf("%s: healthy again\n", endpoint)
+    }
+  }
+}
+
+// Send a ping to endpoint and wait for the reply.
+func (s *FFS) ping_endpoint(endpoint string) bool {
+  // No identity: a ROUTER server would take it for the socket in use.
+  socket, err := context.NewSocket(zmq.REQ)
+  if err != nil {
+    return false
+  }
+  defer socket.Close()
+  socket.SetSockOptInt(zmq.LINGER, 0)
+  address, err := s.connect_address(endpoint)
+  if err != nil || socket.Connect(address) != nil {
+    return false
+  }
+
+  nonce, ciphertext := s.ping()
+  if socket_send(socket, nonce, zmq.SNDMORE) != nil || socket_send(socket, ciphertext, 0) != nil {
+    return false
+  }
+  timeout := s.RecvTimeout
+  if timeout == 0 {
+    timeout = 1 * time.Second
+  }
+  pi := zmq.PollItems{zmq.PollItem{Socket: socket, Events: zmq.POLLIN}}
+  if count, _ := zmq_poll(pi, timeout); count == 0 {
+    return false
+  }
+  _, err = socket_recv(socket, 0)
+  return err == nil
+}
+
+// The endpoints to choose from: those not known to be unhealthy, or all of
+// them if none are healthy.
+func (s *FFS) usable_endpoints() []string {
+  s.latency_lock.Lock()
+  defer s.latency_lock.Unlock()
+  if len(s.health) == 0 {
+    return s.Endpoints
+  }
+  var usable []string
+  for _, endpoint := range s.Endpoints {
+    if healthy, known := s.health[endpoint]; healthy || !known {
+      usable = append(usable, endpoint)
+    }
+  }
+  if len(usable) == 0 {
+    return s.Endpoints
+  }
+  return usable
+}
@@ -0,0 +1,125 @@
+package liblumberjack
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "os/exec"
+  "strings"
+  "time"
+)
+
+// The post-ship hook is told about every batch the server acknowledged.
+// It is given a JSON summary: on stdin, if it is a command, or as the body
+// of a POST, if it is an http(s) url.
+//
+// Hooks run one at a time in their own goroutine, so they never hold up
+// shipping. If hooks can't keep up, summaries are dropped; drops, failures
+// and timeouts are counted in lumberjack_hook_failures_total.
+
+type ship_summary struct {
+  Events int `json:"events"`
+  Bytes int `json:"bytes"` // size of the shipped payload
+  Files []string `json:"files"`
+
+  // With Publisher.AlertHook, instead of a batch: "connectivity_lost" or
+  // "connectivity_restored", and how many connection attempts it took.
+  Alert string `json:"alert,omitempty"`
+  Reconnects int `json:"reconnects,omitempty"`
+}
+
+// Summaries waiting for the hook beyond this many are dropped.
+const hook_queue_size = 100
+
+const default_hook_timeout = 10 * time.Second
+
+var hook_failures = NewCounter("lumberjack_hook_failures_total",
+  "Post-ship hook runs that failed, timed out or were dropped.")
+
+func (p *Publisher) start_hooks() {
+  if p.PostShipHookTimeout == 0 {
+    p.PostShipHookTimeout = default_hook_timeout
+  }
+  p.hooks = make(chan *ship_summary, hook_queue_size)
+  go func() {
+    for summary := range p.hooks {
+      err := p.run_hook(summary)
+      if err != nil {
+        hook_failures.Inc()
+        log.Printf("Post-ship hook %s failed: %s\n", p.PostShipHook, err)
+      }
+    }
+  }()
+}
+
+// Queue a summary of the batch for the hook.
+func (p *Publisher) post_ship(events []*FileEvent, size int) {
+  summary := &ship_summary{Events: len(events), Bytes: size, Files: []string{}}
+  seen := make(map[string]bool)
+  for _, event := range events {
+    if event.Source != nil && !seen[*event.Source] {
+      seen[*event.Source] = true
+      summary.Files = append(summary.Files, *event.Source)
+    }
+  }
+
+  select {
+    case p.hooks <- summary:
+    default:
+      hook_failures.Inc()
+      log.Printf("Post-ship hook is falling behind; dropped summary of %d events\n",
+                 len(events))
+  }
+}
+
+// Tell the hook about an outage, or the end of one, with AlertHook.
+func (p *Publisher) on_outage(outage bool, reconnects int) {
+  if !p.AlertHook || p.hooks == nil {
+    return
+  }
+  summary := &ship_summary{Files: []string{}, Alert: ERR_CONNECTIVITY_RESTORED,
+                           Reconnects: reconnects}
+  if outage {
+    summary.Alert = ERR_CONNECTIVITY_LOST
+  }
+  select {
+    case p.hooks <- summary:
+    default:
+      hook_failures.Inc()
+      log.Printf("Post-ship hook is falling behind; dropped %s alert\n", summary.Alert)
+  }
+}
+
+func (p *Publisher) run_hook(summary *ship_summary) error {
+  data, _ := json.Marshal(summary)
+
+  if strings.HasPrefix(p.PostShipHook, "http://") || strings.HasPrefix(p.PostShipHook, "https://") {
+    client := http.Client{Timeout: p.PostShipHookTimeout}
+    response, err := client.Post(p.PostShipHook, "application/json", bytes.NewReader(data))
+    if err != nil {
+      return err
+    }
+    response.Body.Close()
+    if response.StatusCode / 100 != 2 {
+      return fmt.Errorf("http status %s", response.Status)
+    }
+    return nil
+  }
+
+  cmd := exec.Command("sh", "-c", p.PostShipHook)
+  cmd.Stdin = bytes.NewReader(data)
+  err := cmd.Start()
+  if err != nil {
+    return err
+  }
+  timer := time.AfterFunc(p.PostShipHookTimeout, func() {
+    cmd.Process.Kill()
+  })
+  err = cmd.Wait()
+  if !timer.Stop() {
+    return fmt.Errorf("timed out after %s", p.PostShipHookTimeout)
+  }
+  return err
+}
@@ -0,0 +1,19 @@
+package liblumberjack
+
+import (
+  "net"
+  "strings"
+)
+
+// The local IP address this host would use to reach the endpoint (a zmq
+// "tcp://host:port"), which is the one that matters on a multi-homed host.
+// Connecting a udp socket picks the route without sending anything.
+func OutboundIP(endpoint string) (string, error) {
+  address := strings.TrimPrefix(endpoint, "tcp://")
+  conn, err := net.Dial("udp", address)
+  if err != nil {
+    return "", err
+  }
+  defer conn.Close()
+  return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
@@ -0,0 +1,86 @@
+package liblumberjack
+
+import (
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "os"
+  "syscall"
+)
+
+// Event IDs, so a collector can drop events it already has when a batch is
+// shipped twice (eg, retried after a lost reply, or replayed).
+//
+// "derived" IDs are a hash of the node, the path and identity of the file,
+// and the offset of the event, so an event read again (after a restart,
+// say) gets the same ID again, but one at the same offset of a new file of
+// the same name (after a rotation) does not. The identity is the file's
+// device and inode or, with FingerprintIdentity (see nfs.go), its content
+// from the start to the end of the event, at most fingerprint_size bytes of
+// it, which is as stable as the event itself. IDs repeat if a file is
+// replaced by one with the same inode or, with FingerprintIdentity, the
+// same start. Stdin has no identity, and its offsets start at 0 in every
+// run whatever is piped in, so its events get random IDs instead.
+// "random" IDs are random (v4) UUIDs: unique, but only stable across
+// retries of the same batch.
+const (
+  ID_NONE = ""
+  ID_DERIVED = "derived"
+  ID_RANDOM = "random"
+)
+
+func event_id(scheme string, node string, path string, identity string,
+              offset int64) string {
+  switch scheme {
+    case ID_DERIVED:
+      hash := sha256.New()
+      fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%d", node, path, identity, offset)
+      return hex.EncodeToString(hash.Sum(nil)[:16])
+    case ID_RANDOM:
+      var uuid [16]byte
+      rand.Read(uuid[:])
+      uuid[6] = uuid[6] & 0x0f | 0x40 // version 4
+      uuid[8] = uuid[8] & 0x3f | 0x80 // RFC 4122 variant
+      return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8],
+                         uuid[8:10], uuid[10:])
+  }
+  return ""
+}
+
+// The ID of the event from offset to end of the open file.
+func (h *Harvester) id_of(file harvest_file, info os.FileInfo, offset int64, end int64) string {
+  scheme := h.IDScheme
+  if scheme == ID_DERIVED && h.Path == "-" {
+    scheme = ID_RANDOM // see above
+  }
+  return event_id(scheme, h.Node, h.Path, h.file_identity(file, info, end), offset)
+}
+
+// The identity of the open file for derived IDs, for an event ending at
+// end; see above.
+func (h *Harvester) file_identity(file harvest_file, info os.FileInfo, end int64) string {
+  if h.IDScheme != ID_DERIVED || h.Path == "-" {
+    return ""
+  }
+  if !h.FingerprintIdentity {
+    if info == nil {
+      return ""
+    }
+    stat, ok := info.Sys().(*syscall.Stat_t)
+    if !ok {
+      return ""
+    }
+    return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+  }
+  if end > fingerprint_size {
+    end = fingerprint_size
+  }
+  if int64(len(h.id_fingerprint)) < end {
+    h.id_fingerprint = fingerprint(file) // grown since it was last read
+  }
+  if int64(len(h.id_fingerprint)) < end {
+    end = int64(len(h.id_fingerprint))
+  }
+  return h.id_fingerprint[:end]
+}
@@ -0,0 +1,100 @@
+package liblumberjack
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "regexp"
+import "syscall"
+import "testing"
+import "time"
+
+func TestDerivedEventIDs(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "app.log")
+  append_file(t, path, "one\ntwo\n")
+
+  // Two harvests of the same file, as before and after a restart.
+  var ids [2][]string
+  for run := 0; run < 2; run++ {
+    output := make(chan *FileEvent, 10)
+    harvester := Harvester{Path: path, IDScheme: ID_DERIVED, Node: "web1",
+                           from_beginning: true}
+    go harvester.Harvest(output)
+    for i := 0; i < 2; i++ {
+      select {
+        case event := <- output:
+          ids[run] = append(ids[run], event.ID)
+        case <- time.After(3 * time.Second):
+          t.Fatal("No lines were harvested")
+      }
+    }
+  }
+
+  if ids[0][0] == "" || ids[0][0] == ids[0][1] {
+    t.Fatalf("Expected distinct ids for each event, got %v", ids[0])
+  }
+  if ids[0][0] != ids[1][0] || ids[0][1] != ids[1][1] {
+    t.Fatalf("IDs changed across harvests: %v, then %v", ids[0], ids[1])
+  }
+  info, _ := os.Stat(path)
+  stat := info.Sys().(*syscall.Stat_t)
+  identity := fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+  if ids[0][0] != event_id(ID_DERIVED, "web1", path, identity, 0) {
+    t.Fatal("The id of the first event isn't derived from its offset")
+  }
+}
+
+func TestRandomEventIDs(t *testing.T) {
+  uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+  a, b := event_id(ID_RANDOM, "", "", "", 0), event_id(ID_RANDOM, "", "", "", 0)
+  if !uuid.MatchString(a) || a == b {
+    t.Fatalf("Expected distinct v4 uuids, got %q and %q", a, b)
+  }
+}
+
+// The id of the first line of path, harvested from the beginning.
+func first_id(t *testing.T, path string, fingerprint bool) string {
+  output := make(chan *FileEvent, 10)
+  harvester := Harvester{Path: path, IDScheme: ID_DERIVED, Node: "web1",
+                         FingerprintIdentity: fingerprint, from_beginning: true,
+                         stop_at_eof: true}
+  harvester.Harvest(output)
+  close(output)
+  event := <-output
+  if event == nil {
+    t.Fatal("No lines were harvested")
+  }
+  return event.ID
+}
+
+func TestDerivedEventIDsNewFile(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "app.log")
+
+  // A rotation puts a new file under the same name; its first line is at
+  // the same offset as the old one's, but is a different event.
+  append_file(t, path, "one\n")
+  before := first_id(t, path, false)
+  os.Rename(path, path + ".1")
+  append_file(t, path, "one\n")
+  if first_id(t, path, false) == before {
+    t.Fatal("Expected a new file to get new ids")
+  }
+
+  // With fingerprints, by content: the same start is the same file, a
+  // different one isn't, whatever the inode.
+  before = first_id(t, path, true)
+  os.Rename(path, path + ".2")
+  append_file(t, path, "one\n")
+  if first_id(t, path, true) != before {
+    t.Fatal("Expected the same content to keep its ids with fingerprints")
+  }
+  os.Rename(path, path + ".3")
+  append_file(t, path, "two\n")
+  if first_id(t, path, true) == before {
+    t.Fatal("Expected new content to get new ids with fingerprints")
+  }
+}
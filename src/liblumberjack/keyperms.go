@@ -0,0 +1,27 @@
+package liblumberjack
+
+import (
+  "fmt"
+  "log"
+  "os"
+)
+
+// Check that the secret key file at path is only accessible by its owner,
+// as ssh does for private keys. A key the group or others can read (or
+// write) is logged as a warning, or with strict returned as an error
+// instead. A file that can't be stat'd is left for reading it to report.
+func CheckKeyPermissions(path string, strict bool) error {
+  info, err := os.Stat(path)
+  if err != nil {
+    return nil
+  }
+  if mode := info.Mode().Perm(); mode & 0077 != 0 {
+    err = fmt.Errorf("secret key file %s is accessible by others (mode %04o); it should be 0600",
+                     path, mode)
+    if strict {
+      return err
+    }
+    log.Printf("Warning: %s\n", err)
+  }
+  return nil
+}
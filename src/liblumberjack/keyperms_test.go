@@ -0,0 +1,42 @@
+package liblumberjack
+
+import "bytes"
+import "io/ioutil"
+import "log"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+
+func TestCheckKeyPermissions(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "secret.key")
+  append_file(t, path, "key")
+
+  var logged bytes.Buffer
+  log.SetOutput(&logged)
+  defer log.SetOutput(os.Stderr)
+
+  os.Chmod(path, 0644)
+  if err := CheckKeyPermissions(path, false); err != nil {
+    t.Fatalf("Expected only a warning when not strict, got %s", err)
+  }
+  if !strings.Contains(logged.String(), "0644") {
+    t.Fatalf("Expected a warning about a 0644 key, logged %q", logged.String())
+  }
+  if err := CheckKeyPermissions(path, true); err == nil {
+    t.Fatal("Expected a 0644 key to be an error when strict")
+  }
+
+  logged.Reset()
+  os.Chmod(path, 0600)
+  for _, strict := range []bool{false, true} {
+    if err := CheckKeyPermissions(path, strict); err != nil {
+      t.Fatalf("strict=%v: expected a 0600 key accepted, got %s", strict, err)
+    }
+  }
+  if logged.Len() != 0 {
+    t.Fatalf("Expected no warning for a 0600 key, logged %q", logged.String())
+  }
+}
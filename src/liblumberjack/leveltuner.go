@@ -0,0 +1,82 @@
+package liblumberjack
+
+import (
+  "sync/atomic"
+  "time"
+)
+
+// The zlib and gzip compression level, unless a LevelTuner picks it.
+const default_compression_level = 3
+
+// Defaults for LevelTuner.
+const default_cpu_target = 0.25
+const default_tune_interval = 10 * time.Second
+
+var compression_level = NewGauge("lumberjack_compression_level",
+  "The zlib or gzip compression level in use.")
+
+// A LevelTuner adjusts the zlib (or gzip) compression level between Min
+// and Max to the CPU that compression takes: if it was busy compressing for
+// more than Target of the last Interval (in CPUs; 0.5 is half of one), the
+// level goes down one, to keep up; if for less than half of Target, it goes
+// up one, to save bandwidth with the headroom there is. Time spent
+// compressing is measured around each batch, which is CPU-bound.
+type LevelTuner struct {
+  Min, Max int
+  Target float64 // default_cpu_target if zero
+  Interval time.Duration // default_tune_interval if zero
+
+  level int64
+  busy int64 // nanoseconds spent compressing since the last adjustment
+}
+
+// Start at the default level, or the nearest allowed, and adjust every
+// Interval from then on.
+func (t *LevelTuner) start() {
+  if t.Target == 0 {
+    t.Target = default_cpu_target
+  }
+  if t.Interval == 0 {
+    t.Interval = default_tune_interval
+  }
+  level := default_compression_level
+  if level < t.Min {
+    level = t.Min
+  } else if level > t.Max {
+    level = t.Max
+  }
+  t.set(level)
+
+  go func() {
+    last := time.Now()
+    for now := range time.Tick(t.Interval) {
+      busy := time.Duration(atomic.SwapInt64(&t.busy, 0))
+      t.adjust(busy.Seconds() / now.Sub(last).Seconds())
+      last = now
+    }
+  }()
+}
+
+func (t *LevelTuner) Level() int {
+  return int(atomic.LoadInt64(&t.level))
+}
+
+func (t *LevelTuner) set(level int) {
+  atomic.StoreInt64(&t.level, int64(level))
+  compression_level.Set(float64(level))
+}
+
+// Count time spent compressing a batch.
+func (t *LevelTuner) record(d time.Duration) {
+  atomic.AddInt64(&t.busy, int64(d))
+}
+
+// Adjust the level to the CPU compression used recently.
+func (t *LevelTuner) adjust(usage float64) {
+  level := t.Level()
+  if usage > t.Target && level > t.Min {
+    t.set(level - 1)
+  } else if usage < t.Target / 2 && level < t.Max {
+    t.set(level + 1)
+  }
+}
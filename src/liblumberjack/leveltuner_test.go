@@ -0,0 +1,56 @@
+package liblumberjack
+
+import "sodium"
+import "testing"
+import "time"
+
+func TestLevelTuner(t *testing.T) {
+  tuner := LevelTuner{Min: 1, Max: 6, Target: 0.5, Interval: time.Hour}
+  tuner.start()
+  if tuner.Level() != default_compression_level {
+    t.Fatalf("Expected to start at level %d, got %d", default_compression_level, tuner.Level())
+  }
+
+  // Under CPU pressure the level drops, down to Min.
+  for _, expected := range []int{2, 1, 1} {
+    tuner.adjust(0.9)
+    if tuner.Level() != expected || compression_level.Value() != float64(expected) {
+      t.Fatalf("Expected level %d under pressure, got %d (gauge %v)", expected,
+               tuner.Level(), compression_level.Value())
+    }
+  }
+
+  // Near the target it stays put.
+  tuner.adjust(0.4)
+  if tuner.Level() != 1 {
+    t.Fatalf("Expected the level to hold near the target, got %d", tuner.Level())
+  }
+
+  // With headroom it rises, up to Max.
+  for _, expected := range []int{2, 3, 4, 5, 6, 6} {
+    tuner.adjust(0.1)
+    if tuner.Level() != expected {
+      t.Fatalf("Expected level %d with headroom, got %d", expected, tuner.Level())
+    }
+  }
+}
+
+func TestLevelTunerCompresses(t *testing.T) {
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  tuner := LevelTuner{Min: 1, Max: 9, Interval: time.Hour}
+  tuner.start()
+  publisher := Publisher{Levels: &tuner}
+
+  tuner.set(1)
+  fast := publisher.encode(session, large_batch())
+  tuner.set(9)
+  small := publisher.encode(session, large_batch())
+  if len(small.ciphertext) >= len(fast.ciphertext) {
+    t.Fatalf("Expected level 9 to compress better than level 1: %d vs %d bytes",
+             len(small.ciphertext), len(fast.ciphertext))
+  }
+  if tuner.busy == 0 {
+    t.Fatalf("Expected the time spent compressing to be recorded")
+  }
+}
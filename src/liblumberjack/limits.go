@@ -0,0 +1,57 @@
+package liblumberjack
+
+// Prospector.MaxHarvesters and friends are counting semaphores: buffered
+// channels holding a value per running harvester. A harvester takes a slot
+// in its entry's semaphore, then in the global one, and holds both until it
+// stops; always in that order, so two harvesters can't each hold a slot
+// the other is waiting on.
+
+// The semaphores a harvester of a file must hold.
+type harvest_slots []chan bool
+
+func (s harvest_slots) acquire() {
+  for _, slot := range s {
+    slot <- true
+  }
+}
+
+func (s harvest_slots) release() {
+  for i := len(s) - 1; i >= 0; i-- {
+    <-s[i]
+  }
+}
+
+// Record which entry of Paths a file was found by.
+func (p *Prospector) found(file string, entry string) {
+  if p.entry_of == nil {
+    p.entry_of = make(map[string]string)
+  }
+  p.entry_of[file] = entry
+}
+
+// The slots for a harvester of file. Only called from the prospecting
+// goroutine.
+func (p *Prospector) slots(file string) (slots harvest_slots) {
+  if entry, ok := p.entry_of[file]; ok {
+    limit, set := p.PathLimits[entry]
+    if !set {
+      limit = p.MaxHarvestersPerPath
+    }
+    if limit > 0 {
+      if p.entry_slots == nil {
+        p.entry_slots = make(map[string]chan bool)
+      }
+      if p.entry_slots[entry] == nil {
+        p.entry_slots[entry] = make(chan bool, limit)
+      }
+      slots = append(slots, p.entry_slots[entry])
+    }
+  }
+  if p.MaxHarvesters > 0 {
+    if p.all_slots == nil {
+      p.all_slots = make(chan bool, p.MaxHarvesters)
+    }
+    slots = append(slots, p.all_slots)
+  }
+  return
+}
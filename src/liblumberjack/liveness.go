@@ -0,0 +1,41 @@
+package liblumberjack
+
+import (
+  "os"
+  "time"
+)
+
+// The source of liveness events, so collectors can filter them out.
+const liveness_source = "lumberjack:liveness"
+
+// Emits a synthetic event every Interval, so a collector can alert on a
+// node that has gone quiet even while no logs are being written. This is
+// about the whole pipeline reaching the collector, not transport health.
+//
+// Each event has Source "lumberjack:liveness" and fields:
+//   {"liveness": true, "node": Node, "timestamp": "<RFC3339>", ...Fields}
+type Liveness struct {
+  Interval time.Duration
+  Node string // defaults to the hostname
+  Fields map[string]interface{} // optional; extra fields for each event
+}
+
+func (l *Liveness) Emit(output chan *FileEvent) {
+  node := l.Node
+  if node == "" {
+    node, _ = os.Hostname()
+  }
+  source := liveness_source
+
+  for now := range time.Tick(l.Interval) {
+    fields := make(map[string]interface{})
+    for name, value := range l.Fields {
+      fields[name] = value
+    }
+    fields["liveness"] = true
+    fields["node"] = node
+    fields["timestamp"] = now.UTC().Format(time.RFC3339)
+
+    output <- &FileEvent{Source: &source, Fields: fields, harvested: now}
+  }
+}
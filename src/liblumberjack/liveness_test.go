@@ -0,0 +1,28 @@
+package liblumberjack
+
+import "testing"
+import "time"
+
+func TestLivenessInterval(t *testing.T) {
+  output := make(chan *FileEvent, 10)
+  liveness := Liveness{Interval: 100 * time.Millisecond, Node: "web1",
+                       Fields: map[string]interface{}{"env": "test"}}
+  go liveness.Emit(output)
+
+  last := time.Now()
+  for i := 0; i < 3; i++ {
+    select {
+      case event := <- output:
+        if waited := time.Since(last); waited < 50 * time.Millisecond {
+          t.Fatalf("Liveness event came after only %s", waited)
+        }
+        last = time.Now()
+        if *event.Source != liveness_source || event.Fields["liveness"] != true ||
+           event.Fields["node"] != "web1" || event.Fields["env"] != "test" {
+          t.Fatalf("Unexpected liveness event: %s %v", *event.Source, event.Fields)
+        }
+      case <- time.After(time.Second):
+        t.Fatal("No liveness event while idle")
+    }
+  }
+}
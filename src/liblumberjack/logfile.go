@@ -0,0 +1,80 @@
+package liblumberjack
+
+import (
+  "fmt"
+  "os"
+  "sync"
+)
+
+// A LogFile is an io.Writer for lumberjack's own log, for use with
+// log.SetOutput. Once the file would grow past MaxSize bytes it is rotated:
+// path becomes path.1, path.1 becomes path.2, and so on, keeping at most
+// MaxFiles rotated files.
+type LogFile struct {
+  Path string
+  MaxSize int64 // zero means never rotate
+  MaxFiles int
+
+  lock sync.Mutex
+  file *os.File
+  size int64
+}
+
+func (l *LogFile) Write(data []byte) (n int, err error) {
+  l.lock.Lock()
+  defer l.lock.Unlock()
+
+  if l.file == nil {
+    if err = l.open(); err != nil {
+      return
+    }
+  }
+  if l.MaxSize > 0 && l.size > 0 && l.size + int64(len(data)) > l.MaxSize {
+    if err = l.rotate(); err != nil {
+      return
+    }
+  }
+
+  n, err = l.file.Write(data)
+  l.size += int64(n)
+  return
+}
+
+// Flush what has been written to disk.
+func (l *LogFile) Sync() error {
+  l.lock.Lock()
+  defer l.lock.Unlock()
+  if l.file == nil {
+    return nil
+  }
+  return l.file.Sync()
+}
+
+func (l *LogFile) open() (err error) {
+  l.file, err = os.OpenFile(l.Path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+  if err != nil {
+    return
+  }
+  info, err := l.file.Stat()
+  if err != nil {
+    return
+  }
+  l.size = info.Size()
+  return
+}
+
+func (l *LogFile) rotate() error {
+  l.file.Close()
+  l.file = nil
+
+  os.Remove(fmt.Sprintf("%s.%d", l.Path, l.MaxFiles))
+  for i := l.MaxFiles - 1; i > 0; i-- {
+    os.Rename(fmt.Sprintf("%s.%d", l.Path, i), fmt.Sprintf("%s.%d", l.Path, i + 1))
+  }
+  if l.MaxFiles > 0 {
+    os.Rename(l.Path, l.Path + ".1")
+  } else {
+    os.Remove(l.Path)
+  }
+  return l.open()
+}
@@ -0,0 +1,40 @@
+package liblumberjack
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+
+func TestLogFileRotates(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "lumberjack.log")
+
+  logfile := &LogFile{Path: path, MaxSize: 20, MaxFiles: 2}
+  for _, line := range []string{"first line\n", "second line\n", "third line\n", "fourth line\n"} {
+    if _, err := logfile.Write([]byte(line)); err != nil {
+      t.Fatalf("Write failed: %s", err)
+    }
+  }
+
+  // Each line pushes the file past 20 bytes, so each starts a new file;
+  // the first has been rotated out of the two kept.
+  for suffix, expected := range map[string]string{
+    "": "fourth line\n",
+    ".1": "third line\n",
+    ".2": "second line\n",
+  } {
+    data, err := ioutil.ReadFile(path + suffix)
+    if err != nil || string(data) != expected {
+      t.Fatalf("Expected %s%s to hold %q, got %q (%v)", path, suffix, expected, data, err)
+    }
+  }
+  if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+    t.Fatalf("Expected only 2 rotated files to be kept")
+  }
+  matches, _ := filepath.Glob(path + "*")
+  if len(matches) != 3 {
+    t.Fatalf("Expected 3 log files, got %s", strings.Join(matches, ", "))
+  }
+}
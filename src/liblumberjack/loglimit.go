@@ -0,0 +1,57 @@
+package liblumberjack
+
+import (
+  "fmt"
+  "log"
+  "time"
+)
+
+// A log_limiter bounds how often a repeated message is logged, for the
+// connect and failure messages of an FFS during an outage. The first of each
+// message logs at once, as does the first after reset (a state change, such
+// as the server answering again); repeats within Interval are counted, and
+// the count is logged with the next one that gets through. A zero Interval
+// logs everything.
+type log_limiter struct {
+  Interval time.Duration
+
+  last map[string]time.Time // format -> when it was last logged
+  suppressed map[string]int // format -> repeats not logged since
+}
+
+func (l *log_limiter) Printf(format string, args ...interface{}) {
+  if l.Interval <= 0 {
+    log.Printf(format, args...)
+    return
+  }
+  if l.last == nil {
+    l.last = make(map[string]time.Time)
+    l.suppressed = make(map[string]int)
+  }
+
+  if last, seen := l.last[format]; seen && time.Since(last) < l.Interval {
+    l.suppressed[format]++
+    return
+  }
+  l.last[format] = time.Now()
+  message := fmt.Sprintf(format, args...)
+  if count := l.suppressed[format]; count > 0 {
+    message = fmt.Sprintf("%s (repeated %d more times)\n", message[:len(message) - 1], count)
+  }
+  l.suppressed[format] = 0
+  log.Print(message)
+}
+
+// A state change: the next of each message logs at once. Reports how many
+// messages were held back, if any.
+func (l *log_limiter) reset(what string) {
+  total := 0
+  for _, count := range l.suppressed {
+    total += count
+  }
+  if total > 0 {
+    log.Printf("%s; %d repeated messages were not logged\n", what, total)
+  }
+  l.last = nil
+  l.suppressed = nil
+}
@@ -0,0 +1,71 @@
+package liblumberjack
+
+import (
+  "log"
+  "runtime"
+  "time"
+)
+
+// A soft limit on memory. While the heap is over Limit, all harvesters
+// pause (keeping their place in their files) so events stop piling up in
+// the spooler and publisher, say during a long outage. Harvesting resumes
+// once the heap is back under 90% of Limit. Staying alive, and able to pick
+// up where we left off, beats buffering everything and being OOM-killed.
+type MemoryLimit struct {
+  Limit uint64 // bytes of heap
+  Interval time.Duration // how often to check; defaults to 1 second
+
+  quit chan bool // if closed, Watch resumes harvesting and returns
+}
+
+var memory_pauses = NewCounter("lumberjack_memory_pauses_total",
+  "Times harvesting was paused for being over -memory-limit.")
+
+// The heap in use, in bytes; replaceable in tests.
+var heap_in_use = func() uint64 {
+  var stats runtime.MemStats
+  runtime.ReadMemStats(&stats)
+  return stats.HeapAlloc
+}
+
+func (m *MemoryLimit) Watch() {
+  interval := m.Interval
+  if interval == 0 {
+    interval = time.Second
+  }
+
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  paused := false
+  for {
+    select {
+      case <- ticker.C:
+      case <- m.quit:
+        set_memory_paused(false)
+        return
+    }
+
+    heap := heap_in_use()
+    if !paused && heap >= m.Limit {
+      log.Printf("Heap is %d bytes, over the %d byte memory limit; pausing harvesting\n",
+                 heap, m.Limit)
+      memory_pauses.Inc()
+      paused = true
+      set_memory_paused(true)
+    } else if paused && heap < m.Limit / 10 * 9 {
+      log.Printf("Heap is down to %d bytes; resuming harvesting\n", heap)
+      paused = false
+      set_memory_paused(false)
+    }
+  }
+}
+
+func set_memory_paused(paused bool) {
+  harvesters_lock.Lock()
+  defer harvesters_lock.Unlock()
+  memory_paused = paused
+  if !paused {
+    harvesters_cond.Broadcast()
+  }
+}
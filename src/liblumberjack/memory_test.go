@@ -0,0 +1,54 @@
+package liblumberjack
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sync/atomic"
+import "testing"
+import "time"
+
+func TestMemoryLimitPausesHarvesting(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "busy.log")
+  append_file(t, path, "")
+
+  var heap uint64 = 0
+  defer func(f func() uint64) { heap_in_use = f }(heap_in_use)
+  heap_in_use = func() uint64 { return atomic.LoadUint64(&heap) }
+
+  limit := MemoryLimit{Limit: 1000, Interval: 10 * time.Millisecond,
+                      quit: make(chan bool)}
+  watching := make(chan bool)
+  go func() {
+    limit.Watch()
+    close(watching)
+  }()
+  // Stopped, and waited for, before heap_in_use is put back.
+  defer func() {
+    close(limit.quit)
+    <-watching
+  }()
+
+  output := make(chan *FileEvent, 100)
+  harvester := Harvester{Path: path}
+  go harvester.Harvest(output)
+  time.Sleep(100 * time.Millisecond)
+
+  // Over the limit: lines are not read into memory.
+  atomic.StoreUint64(&heap, 2000)
+  time.Sleep(50 * time.Millisecond)
+  append_file(t, path, "one\ntwo\nthree\n")
+  time.Sleep(1500 * time.Millisecond)
+  if len(output) > 0 {
+    t.Fatalf("Harvesting continued over the memory limit (%d events)", len(output))
+  }
+
+  // Back under: everything is shipped.
+  atomic.StoreUint64(&heap, 100)
+  for start := time.Now(); len(output) < 3; time.Sleep(10 * time.Millisecond) {
+    if time.Since(start) > 3 * time.Second {
+      t.Fatalf("Harvesting did not resume under the memory limit (%d events)", len(output))
+    }
+  }
+}
@@ -0,0 +1,282 @@
+package liblumberjack
+
+import (
+  "fmt"
+  "io"
+  "math"
+  "sort"
+  "strconv"
+  "sync"
+  "sync/atomic"
+)
+
+// Metrics are exported in the Prometheus text format on /metrics of the
+// admin http server (see admin.go).
+
+type metric interface {
+  write(w io.Writer)
+}
+
+var metrics_lock sync.Mutex
+var metrics []metric
+
+func register(m metric) {
+  metrics_lock.Lock()
+  defer metrics_lock.Unlock()
+  metrics = append(metrics, m)
+}
+
+// A sink is sent every metric update as it happens, for push-based metrics
+// systems like statsd.
+type sink interface {
+  count(name string, delta uint64)
+  observe(name string, value float64)
+  gauge(name string, value float64)
+}
+
+// The sinks, a []sink replaced whole (under metrics_lock) when one is
+// added or removed, so that updates needn't lock to read it.
+var sinks atomic.Value
+
+func current_sinks() []sink {
+  current, _ := sinks.Load().([]sink)
+  return current
+}
+
+func add_sink(s sink) {
+  metrics_lock.Lock()
+  defer metrics_lock.Unlock()
+  sinks.Store(append(append([]sink{}, current_sinks()...), s))
+}
+
+func remove_sink(s sink) {
+  metrics_lock.Lock()
+  defer metrics_lock.Unlock()
+  var kept []sink
+  for _, old := range current_sinks() {
+    if old != s {
+      kept = append(kept, old)
+    }
+  }
+  sinks.Store(kept)
+}
+
+type Counter struct {
+  name string
+  help string
+  value uint64
+}
+
+func NewCounter(name string, help string) *Counter {
+  c := &Counter{name: name, help: help}
+  register(c)
+  return c
+}
+
+func (c *Counter) Inc() {
+  c.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+  atomic.AddUint64(&c.value, n)
+  for _, s := range current_sinks() {
+    s.count(c.name, n)
+  }
+}
+
+func (c *Counter) Value() uint64 {
+  return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w io.Writer) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+  fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// A counter with one label, such as a reason, counted per label value.
+type LabeledCounter struct {
+  name string
+  help string
+  label string
+
+  lock sync.Mutex
+  values map[string]uint64
+}
+
+func NewLabeledCounter(name string, help string, label string) *LabeledCounter {
+  c := &LabeledCounter{name: name, help: help, label: label,
+                       values: make(map[string]uint64)}
+  register(c)
+  return c
+}
+
+func (c *LabeledCounter) Add(value string, n uint64) {
+  c.lock.Lock()
+  c.values[value] += n
+  c.lock.Unlock()
+  for _, s := range current_sinks() {
+    s.count(c.name + "." + value, n)
+  }
+}
+
+func (c *LabeledCounter) Value(value string) uint64 {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  return c.values[value]
+}
+
+// A copy of the current count for each label value.
+func (c *LabeledCounter) Values() map[string]uint64 {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  values := make(map[string]uint64, len(c.values))
+  for value, n := range c.values {
+    values[value] = n
+  }
+  return values
+}
+
+func (c *LabeledCounter) write(w io.Writer) {
+  values := c.Values()
+  var keys []string
+  for value := range values {
+    keys = append(keys, value)
+  }
+  sort.Strings(keys)
+
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+  for _, value := range keys {
+    fmt.Fprintf(w, "%s{%s=%s} %d\n", c.name, c.label, strconv.Quote(value), values[value])
+  }
+}
+
+// A value that goes up and down, such as a current setting.
+type Gauge struct {
+  name string
+  help string
+  value uint64 // math.Float64bits of the value
+}
+
+func NewGauge(name string, help string) *Gauge {
+  g := &Gauge{name: name, help: help}
+  register(g)
+  return g
+}
+
+func (g *Gauge) Set(value float64) {
+  atomic.StoreUint64(&g.value, math.Float64bits(value))
+  for _, s := range current_sinks() {
+    s.gauge(g.name, value)
+  }
+}
+
+func (g *Gauge) Value() float64 {
+  return math.Float64frombits(atomic.LoadUint64(&g.value))
+}
+
+func (g *Gauge) write(w io.Writer) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+  fmt.Fprintf(w, "%s %s\n", g.name, strconv.FormatFloat(g.Value(), 'g', -1, 64))
+}
+
+type Histogram struct {
+  name string
+  help string
+
+  lock sync.Mutex
+  buckets []float64 // upper bounds, ascending
+  counts []uint64 // observations per bucket; the last is +Inf
+  sum float64
+  count uint64
+}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+  h := &Histogram{
+    name: name,
+    help: help,
+    buckets: buckets,
+    counts: make([]uint64, len(buckets) + 1),
+  }
+  register(h)
+  return h
+}
+
+func (h *Histogram) Observe(value float64) {
+  for _, s := range current_sinks() {
+    s.observe(h.name, value)
+  }
+
+  h.lock.Lock()
+  defer h.lock.Unlock()
+
+  i := 0
+  for i < len(h.buckets) && value > h.buckets[i] {
+    i++
+  }
+  h.counts[i]++
+  h.sum += value
+  h.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+  h.lock.Lock()
+  defer h.lock.Unlock()
+
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+  // Prometheus buckets are cumulative.
+  var cumulative uint64 = 0
+  for i, bound := range h.buckets {
+    cumulative += h.counts[i]
+    fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name,
+                strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+  }
+  fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+  fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+  fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// Write all registered metrics in the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+  metrics_lock.Lock()
+  defer metrics_lock.Unlock()
+  for _, m := range metrics {
+    m.write(w)
+  }
+}
+
+// Spooler metrics
+var dedup_suppressed = NewCounter("lumberjack_dedup_suppressed_total",
+  "Events dropped by the spooler as duplicates.")
+var seen_suppressed = NewCounter("lumberjack_seen_suppressed_total",
+  "Events dropped by the spooler because the seen-cache shows them shipped before a restart.")
+var publisher_backpressure = NewCounter("lumberjack_publisher_backpressure_total",
+  "Times the spooler waited longer than -backpressure-warn to hand a batch to the publisher.")
+
+// Publisher metrics
+var event_age_violations = NewCounter("lumberjack_event_age_violations_total",
+  "Batches shipped later than -max-event-age after harvest.")
+
+// Bucket choices: spools default to 1024 events, so event counts are bucketed
+// in powers of two up to 16384 (the largest spool we expect). Log lines are
+// typically 100-300 bytes, so a default spool is a few hundred KB of JSON;
+// byte sizes are bucketed by factors of 4 from 1KB to 16MB. Log data usually
+// compresses 5-15x with zlib; ratios below 2 suggest a batch of binary or
+// already-compressed data.
+var batch_events = NewHistogram("lumberjack_batch_events",
+  "Number of events in each published batch.",
+  []float64{1, 16, 64, 256, 512, 1024, 2048, 4096, 8192, 16384})
+var batch_raw_bytes = NewHistogram("lumberjack_batch_raw_bytes",
+  "Size in bytes of each batch before compression.",
+  []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20})
+var batch_compressed_bytes = NewHistogram("lumberjack_batch_compressed_bytes",
+  "Size in bytes of each batch after compression.",
+  []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20})
+var batch_compression_ratio = NewHistogram("lumberjack_batch_compression_ratio",
+  "Ratio of raw to compressed size for each batch.",
+  []float64{1, 1.5, 2, 3, 4, 6, 8, 10, 15, 20, 30})
+var batch_compression_gain = NewHistogram("lumberjack_batch_compression_gain_percent",
+  "How much smaller compression made each batch it was tried on, in percent; it may be negative.",
+  []float64{0, 10, 25, 50, 75, 80, 85, 90, 95})
+var batches_uncompressed = NewLabeledCounter("lumberjack_batches_uncompressed_total",
+  "Batches shipped uncompressed: too small to try (-compress-min-bytes), or compression gained too little (-min-compression-gain).",
+  "reason")
@@ -0,0 +1,101 @@
+package liblumberjack
+
+import "bytes"
+import "net"
+import "strings"
+import "testing"
+import "time"
+
+func TestHistogramBuckets(t *testing.T) {
+  h := &Histogram{
+    name: "test_histogram",
+    buckets: []float64{1, 10, 100},
+    counts: make([]uint64, 4),
+  }
+
+  for _, value := range []float64{0.5, 1, 5, 50, 50, 500} {
+    h.Observe(value)
+  }
+
+  expected := []uint64{2, 1, 2, 1}
+  for i, count := range expected {
+    if h.counts[i] != count {
+      t.Fatalf("bucket %d: expected %d observations, got %d", i, count, h.counts[i])
+    }
+  }
+
+  var buffer bytes.Buffer
+  h.write(&buffer)
+  output := buffer.String()
+  for _, line := range []string{
+    "test_histogram_bucket{le=\"1\"} 2\n",
+    "test_histogram_bucket{le=\"10\"} 3\n",
+    "test_histogram_bucket{le=\"100\"} 5\n",
+    "test_histogram_bucket{le=\"+Inf\"} 6\n",
+    "test_histogram_count 6\n",
+  } {
+    if !strings.Contains(output, line) {
+      t.Fatalf("Expected %q in output:\n%s", line, output)
+    }
+  }
+}
+
+func TestStatsdSink(t *testing.T) {
+  listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Failed to listen for udp: %s", err)
+  }
+  defer listener.Close()
+
+  sink, err := StartStatsd(listener.LocalAddr().String(), time.Hour)
+  if err != nil {
+    t.Fatalf("StartStatsd failed: %s", err)
+  }
+  defer sink.Stop()
+
+  counter := NewCounter("test_statsd_total", "A test counter.")
+  histogram := NewHistogram("test_statsd_bytes", "A test histogram.", []float64{10})
+  counter.Inc()
+  counter.Add(2)
+  histogram.Observe(5)
+  histogram.Observe(2.5)
+  sink.flush()
+
+  // Other tests' goroutines may update metrics of their own meanwhile,
+  // which can take more than a packet.
+  var lines []string
+  packet := make([]byte, statsd_packet_size)
+  listener.SetReadDeadline(time.Now().Add(time.Second))
+  for {
+    n, _, err := listener.ReadFrom(packet)
+    if err != nil {
+      break
+    }
+    for _, line := range strings.Split(string(packet[:n]), "\n") {
+      if strings.HasPrefix(line, "test_statsd_") {
+        lines = append(lines, line)
+      }
+    }
+    listener.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+  }
+  expected := []string{"test_statsd_bytes:5|h", "test_statsd_bytes:2.5|h", "test_statsd_total:3|c"}
+  if strings.Join(lines, ",") != strings.Join(expected, ",") {
+    t.Fatalf("Expected statsd lines %v, got %v", expected, lines)
+  }
+}
+
+func TestLabeledCounter(t *testing.T) {
+  c := &LabeledCounter{name: "test_total", help: "Test.", label: "reason",
+                       values: make(map[string]uint64)}
+  c.Add("b", 2)
+  c.Add("a", 1)
+  c.Add("b", 3)
+
+  var buffer bytes.Buffer
+  c.write(&buffer)
+  expected := "# HELP test_total Test.\n# TYPE test_total counter\n" +
+              "test_total{reason=\"a\"} 1\ntest_total{reason=\"b\"} 5\n"
+  if buffer.String() != expected {
+    t.Fatalf("Expected:\n%s\ngot:\n%s", expected, buffer.String())
+  }
+}
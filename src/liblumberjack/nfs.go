@@ -0,0 +1,99 @@
+package liblumberjack
+
+import (
+  "io"
+  "os"
+  "strings"
+  "syscall"
+)
+
+// Support for harvesting from NFS and other remote filesystems.
+//
+// - A read failing with ESTALE (the file handle went stale on the server)
+//   makes the harvester reopen the file by path and carry on from the same
+//   offset.
+// - With Harvester.StatRefresh, files are stat'd through a fresh open
+//   rather than stat(2), which NFS may answer from its attribute cache
+//   (close-to-open consistency guarantees fresh attributes on open). This
+//   costs an open and close per file per scan, and disables the
+//   prospector's scan cache, since directory mtimes are cached too.
+// - With Harvester.FingerprintIdentity, a file whose inode appears to have
+//   changed is still considered the same file if its first bytes are the
+//   same. Some NFS setups report new inodes for the same file. A log
+//   replaced by a new one that starts the same way (say, with a fixed
+//   header and nothing else yet) is rechecked on each scan, and harvested
+//   from its beginning once its content differs from the old file's. The
+//   catch: that takes until it has grown past what is known of the old
+//   file, which is as much of its first fingerprint_size bytes as had been
+//   written by the last scan before the change.
+//
+// None of this helps when the server has lost data or reordered writes;
+// nor can rotation be detected at all if the server reuses inodes and the
+// new file starts like the old one.
+
+// How many bytes at the start of a file identify it, with
+// FingerprintIdentity.
+const fingerprint_size = 256
+
+// What a harvester needs of an open file; an os.File, or a stand-in for
+// tests.
+type harvest_file interface {
+  io.Reader
+  io.ReaderAt
+  io.Seeker
+  io.Closer
+  Stat() (os.FileInfo, error)
+}
+
+// Open a file for harvesting, with opener if a test set one.
+func (h *Harvester) open_file(path string) (harvest_file, error) {
+  if h.opener != nil {
+    return h.opener(path)
+  }
+  return os.Open(path)
+}
+
+func is_stale(err error) bool {
+  if path_err, ok := err.(*os.PathError); ok {
+    err = path_err.Err
+  }
+  return err == syscall.ESTALE
+}
+
+// Stat the path, through a fresh open if StatRefresh is set.
+func (h *Harvester) stat(path string) (os.FileInfo, error) {
+  if !h.StatRefresh {
+    return os.Stat(path)
+  }
+  file, err := h.open_file(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  return file.Stat()
+}
+
+// The first fingerprint_size bytes of the file, or "" if unreadable.
+func fingerprint(file io.ReaderAt) string {
+  buffer := make([]byte, fingerprint_size)
+  n, _ := file.ReadAt(buffer, 0)
+  return string(buffer[:n])
+}
+
+func (h *Harvester) path_fingerprint(path string) string {
+  file, err := h.open_file(path)
+  if err != nil {
+    return ""
+  }
+  defer file.Close()
+  return fingerprint(file)
+}
+
+// Do two fingerprints identify the same file? A file shorter than
+// fingerprint_size may have grown since, so a prefix matches too.
+func same_fingerprint(a string, b string) bool {
+  if a == "" || b == "" {
+    return false
+  }
+  return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
@@ -0,0 +1,169 @@
+package liblumberjack
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sync/atomic"
+import "syscall"
+import "testing"
+import "time"
+
+// A file whose next read fails with ESTALE while stale is set.
+type stale_file struct {
+  *os.File
+  stale *int32
+}
+
+func (f stale_file) Read(p []byte) (int, error) {
+  if atomic.CompareAndSwapInt32(f.stale, 1, 0) {
+    return 0, syscall.ESTALE
+  }
+  return f.File.Read(p)
+}
+
+func TestHarvesterReopensStaleFile(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "nfs.log")
+  append_file(t, path, "")
+
+  var stale int32
+  var opens int32
+  opener := func(path string) (harvest_file, error) {
+    atomic.AddInt32(&opens, 1)
+    file, err := os.Open(path)
+    if err != nil {
+      return nil, err
+    }
+    return stale_file{file, &stale}, nil
+  }
+
+  output := make(chan *FileEvent, 10)
+  harvester := Harvester{Path: path, opener: opener}
+  go harvester.Harvest(output)
+  time.Sleep(100 * time.Millisecond)
+
+  append_file(t, path, "before\n")
+  atomic.StoreInt32(&stale, 1)
+  append_file(t, path, "after\n")
+
+  for _, expected := range []string{"before", "after"} {
+    select {
+      case event := <- output:
+        if *event.Text != expected {
+          t.Fatalf("Expected %q, got %q", expected, *event.Text)
+        }
+      case <- time.After(3 * time.Second):
+        t.Fatalf("The harvester did not recover from ESTALE to read %q", expected)
+    }
+  }
+  if atomic.LoadInt32(&opens) != 2 {
+    t.Fatalf("Expected the file to be reopened once, opened %d times", opens)
+  }
+}
+
+func harvester_count(path string) int {
+  harvesters_lock.Lock()
+  defer harvesters_lock.Unlock()
+  return active_harvesters[path]
+}
+
+func TestProspectorFingerprintIdentity(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "nfs.log")
+  append_file(t, path, "the same first line\n")
+
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{}
+  prospector.Harvester.FingerprintIdentity = true
+  fileinfo := make(map[string]os.FileInfo)
+  prospector.scan(path, fileinfo, output)
+
+  // The same content under a new inode, as stale NFS stat data can report.
+  os.Rename(path, path + ".old")
+  append_file(t, path, "the same first line\nand more\n")
+  prospector.scan(path, fileinfo, output)
+  time.Sleep(100 * time.Millisecond)
+  if count := harvester_count(path); count != 1 {
+    t.Fatalf("Expected one harvester for a file with the same content, got %d", count)
+  }
+
+  // Different content is still a rotation.
+  os.Rename(path, path + ".1")
+  append_file(t, path, "a new file\n")
+  prospector.scan(path, fileinfo, output)
+  time.Sleep(100 * time.Millisecond)
+  if count := harvester_count(path); count != 2 {
+    t.Fatalf("Expected a new harvester for a rotated file, got %d", count)
+  }
+}
+
+func TestProspectorFingerprintIdentityHeader(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "header.log")
+  append_file(t, path, "# fixed header\n")
+
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{}
+  prospector.Harvester.FingerprintIdentity = true
+  fileinfo := make(map[string]os.FileInfo)
+  prospector.scan(path, fileinfo, output)
+  append_file(t, path, "old line\n")
+  prospector.scan(path, fileinfo, output)
+
+  // Replaced by a new log that, so far, is only the same header.
+  os.Rename(path, path + ".1")
+  append_file(t, path, "# fixed header\n")
+  prospector.scan(path, fileinfo, output)
+  time.Sleep(100 * time.Millisecond)
+  if count := harvester_count(path); count != 1 {
+    t.Fatalf("Expected no new harvester while only the header is written, got %d", count)
+  }
+
+  // Once it differs, it is a new file, read from its beginning.
+  append_file(t, path, "new line\n")
+  prospector.scan(path, fileinfo, output)
+  time.Sleep(100 * time.Millisecond)
+  if count := harvester_count(path); count != 2 {
+    t.Fatalf("Expected a new harvester once the content differs, got %d", count)
+  }
+  if prospector.rechecks[path] {
+    t.Fatal("Expected the recheck to be over")
+  }
+}
+
+func TestProspectorFingerprintIdentityCachedDir(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "header.log")
+  append_file(t, path, "# fixed header\nold line\n")
+
+  // A directory settled long ago, so its scans could be cached.
+  settled := time.Now().Add(-time.Hour)
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{}
+  prospector.Harvester.FingerprintIdentity = true
+  fileinfo := make(map[string]os.FileInfo)
+  os.Chtimes(dir, settled, settled)
+  prospector.scan(path, fileinfo, output)
+
+  // A new log that, so far, is only the same header.
+  os.Rename(path, path + ".1")
+  append_file(t, path, "# fixed header\n")
+  os.Chtimes(dir, settled, settled)
+  prospector.scan(path, fileinfo, output)
+  time.Sleep(100 * time.Millisecond)
+  if count := harvester_count(path); count != 1 {
+    t.Fatalf("Expected no new harvester while only the header is written, got %d", count)
+  }
+
+  // Growing doesn't touch the directory, but is still rechecked.
+  append_file(t, path, "new line\n")
+  prospector.scan(path, fileinfo, output)
+  time.Sleep(100 * time.Millisecond)
+  if count := harvester_count(path); count != 2 {
+    t.Fatalf("Expected a new harvester once the content differs, got %d", count)
+  }
+}
@@ -0,0 +1,170 @@
+package liblumberjack
+
+import (
+  "bytes"
+  "compress/gzip"
+  "compress/zlib"
+  "encoding/binary"
+  "encoding/json"
+  "fmt"
+  "io"
+)
+
+// The plaintext of each payload (what is boxed and shipped) is a codec byte
+// followed by the JSON array of events, encoded as the codec byte says.
+const (
+  CODEC_NONE byte = 0 // the raw json
+  CODEC_ZLIB byte = 1 // the json, compressed with zlib
+  CODEC_ZSTD byte = 2 // the json, compressed with zstd; a newer codec
+  CODEC_GZIP byte = 3 // the json, as one complete gzip member
+)
+
+// Each CODEC_GZIP payload is a whole gzip member (header, deflate stream
+// and trailer), so a collector can simply append the payloads it receives
+// (less the codec byte and, with FORMAT_SIZED, the size header between it
+// and the member) to a file: the concatenation is a valid multi-member gzip
+// file, which gunzip and gzip.Reader read as one stream. A publisher with
+// gzip compression ships every batch as CODEC_GZIP, even those too small
+// or incompressible for other codecs to be worth it (see CompressMinBytes
+// and MinCompressionGain), so that this holds of everything it sends.
+
+// Set in the codec byte when the events are an EventEnvelope protobuf
+// (see protobuf.go) rather than JSON.
+const FORMAT_PROTOBUF byte = 0x80
+
+// Set in the codec byte when a size header follows it, ahead of the
+// codec's data: the length in bytes of the serialized events, then the
+// number of events, each a 4-byte big-endian unsigned int.
+const FORMAT_SIZED byte = 0x40
+
+const size_header_length = 8
+
+func size_header(size int, count int) []byte {
+  header := make([]byte, size_header_length)
+  binary.BigEndian.PutUint32(header[0:4], uint32(size))
+  binary.BigEndian.PutUint32(header[4:8], uint32(count))
+  return header
+}
+
+// PayloadSizes returns the size and event count in a payload's size header,
+// and ok false if it has none.
+func PayloadSizes(plaintext []byte) (size int, count int, ok bool) {
+  if len(plaintext) < 1 + size_header_length || plaintext[0] & FORMAT_SIZED == 0 {
+    return 0, 0, false
+  }
+  size = int(binary.BigEndian.Uint32(plaintext[1:5]))
+  count = int(binary.BigEndian.Uint32(plaintext[5:9]))
+  return size, count, true
+}
+
+// Compress a payload's json with zlib at level, onto the end of buffer;
+// with pooled, using a writer from zlib_writers. Replaceable in tests.
+var zlib_encode = func(buffer *bytes.Buffer, data []byte, level int, pooled bool) {
+  compressor := zlib_writer(buffer, level, pooled)
+  compressor.Write(data) // to a bytes.Buffer; can't fail
+  compressor.Close()
+  if pooled {
+    zlib_writers[level - zlib.HuffmanOnly].Put(compressor)
+  }
+}
+
+// zstd support is optional at build time (go build -tags zstd); these are
+// set by payload_zstd.go when it's built in.
+var zstd_encode func(data []byte) []byte
+var zstd_decode func(data []byte) ([]byte, error)
+
+// Is zstd compression built in?
+func ZstdAvailable() bool {
+  return zstd_encode != nil
+}
+
+// DecodePayload returns the serialized events held in a payload's
+// plaintext: a JSON array, unless FORMAT_PROTOBUF is set in its codec byte.
+// This is what a server does after opening the box. With a size header,
+// a payload that doesn't decompress to the size in it is an error.
+func DecodePayload(plaintext []byte) ([]byte, error) {
+  if len(plaintext) == 0 {
+    return nil, fmt.Errorf("empty payload")
+  }
+
+  data := plaintext[1:]
+  size, _, sized := PayloadSizes(plaintext)
+  if sized {
+    data = plaintext[1 + size_header_length:]
+  } else if plaintext[0] & FORMAT_SIZED != 0 {
+    return nil, fmt.Errorf("payload too short for its size header")
+  }
+
+  var decoded []byte
+  var err error
+  switch plaintext[0] &^ (FORMAT_PROTOBUF | FORMAT_SIZED) {
+    case CODEC_NONE:
+      decoded = data
+    case CODEC_ZLIB:
+      var reader io.ReadCloser
+      reader, err = zlib.NewReader(bytes.NewReader(data))
+      if err != nil {
+        return nil, err
+      }
+      defer reader.Close()
+      decoded, err = read_all(reader, size)
+    case CODEC_GZIP:
+      var reader *gzip.Reader
+      reader, err = gzip.NewReader(bytes.NewReader(data))
+      if err != nil {
+        return nil, err
+      }
+      defer reader.Close()
+      decoded, err = read_all(reader, size)
+    case CODEC_ZSTD:
+      if zstd_decode == nil {
+        return nil, fmt.Errorf("zstd payload, but zstd support is not built in")
+      }
+      decoded, err = zstd_decode(data)
+    default:
+      return nil, fmt.Errorf("unknown payload codec %d", plaintext[0])
+  }
+  if err != nil {
+    return nil, err
+  }
+  if sized && len(decoded) != size {
+    return nil, fmt.Errorf("payload decodes to %d bytes, but its size header says %d",
+                           len(decoded), size)
+  }
+  return decoded, nil
+}
+
+// The most read_all will allocate up front on a size header's word.
+const max_preallocate = 64 << 20
+
+// Read all of reader into a buffer allocated for size bytes, if known.
+func read_all(reader io.Reader, size int) ([]byte, error) {
+  if size > max_preallocate {
+    size = max_preallocate
+  }
+  var buffer bytes.Buffer
+  // One more than expected, so a payload of the expected size reads to
+  // EOF without growing the buffer.
+  buffer.Grow(size + 1)
+  _, err := buffer.ReadFrom(reader)
+  return buffer.Bytes(), err
+}
+
+// DecodeEvents returns the events held in a payload's plaintext, in either
+// format.
+func DecodeEvents(plaintext []byte) (events []*FileEvent, err error) {
+  data, err := DecodePayload(plaintext)
+  if err != nil {
+    return
+  }
+  if plaintext[0] & FORMAT_PROTOBUF != 0 {
+    events, err = unmarshal_protobuf(data)
+  } else {
+    err = json.Unmarshal(data, &events)
+  }
+  if _, count, sized := PayloadSizes(plaintext); err == nil && sized && len(events) != count {
+    return nil, fmt.Errorf("payload has %d events, but its size header says %d",
+                           len(events), count)
+  }
+  return
+}
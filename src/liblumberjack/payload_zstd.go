@@ -0,0 +1,27 @@
+// +build zstd
+
+package liblumberjack
+
+import (
+  "github.com/klauspost/compress/zstd"
+)
+
+func init() {
+  // EncodeAll and DecodeAll are safe for concurrent use, so one of each is
+  // shared.
+  encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+  if err != nil {
+    panic(err)
+  }
+  decoder, err := zstd.NewReader(nil)
+  if err != nil {
+    panic(err)
+  }
+
+  zstd_encode = func(data []byte) []byte {
+    return encoder.EncodeAll(data, nil)
+  }
+  zstd_decode = func(data []byte) ([]byte, error) {
+    return decoder.DecodeAll(data, nil)
+  }
+}
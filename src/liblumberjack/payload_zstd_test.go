@@ -0,0 +1,58 @@
+// +build zstd
+
+package liblumberjack
+
+import "bytes"
+import "compress/zlib"
+import "encoding/json"
+import "fmt"
+import "testing"
+
+// A batch that looks like typical log lines.
+func log_batch() []byte {
+  source := "/var/log/nginx/access.log"
+  var events []*FileEvent
+  for i := 0; i < 1000; i++ {
+    text := fmt.Sprintf("10.0.%d.%d - - [13/Jul/2013:10:%02d:%02d +0000] \"GET /api/items/%d HTTP/1.1\" 200 %d",
+                        i % 7, i % 250, i / 60 % 60, i % 60, i * 31, 512 + i * 17 % 4096)
+    events = append(events, &FileEvent{Source: &source, Offset: uint64(i * 100),
+                                       Line: uint64(i + 1), Text: &text})
+  }
+  data, _ := json.Marshal(events)
+  return data
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+  data := log_batch()
+  payload := append([]byte{CODEC_ZSTD}, zstd_encode(data)...)
+  decoded, err := DecodePayload(payload)
+  if err != nil {
+    t.Fatalf("DecodePayload failed: %s", err)
+  }
+  if !bytes.Equal(decoded, data) {
+    t.Fatal("zstd payload did not round-trip")
+  }
+}
+
+func BenchmarkCompressZlib(b *testing.B) {
+  data := log_batch()
+  var buffer bytes.Buffer
+  b.SetBytes(int64(len(data)))
+  for i := 0; i < b.N; i++ {
+    buffer.Truncate(0)
+    compressor, _ := zlib.NewWriterLevel(&buffer, 3)
+    compressor.Write(data)
+    compressor.Close()
+  }
+  b.ReportMetric(float64(len(data)) / float64(buffer.Len()), "ratio")
+}
+
+func BenchmarkCompressZstd(b *testing.B) {
+  data := log_batch()
+  var compressed []byte
+  b.SetBytes(int64(len(data)))
+  for i := 0; i < b.N; i++ {
+    compressed = zstd_encode(data)
+  }
+  b.ReportMetric(float64(len(data)) / float64(len(compressed)), "ratio")
+}
@@ -0,0 +1,38 @@
+package liblumberjack
+
+import (
+  "sync/atomic"
+)
+
+// A running estimate of how big a buffer needs to be, from the sizes seen
+// recently, so that buffers can be allocated once at about the right size
+// instead of grown by doubling as they fill.
+type size_hint struct {
+  average int64
+}
+
+// The size to allocate: the recent average with some headroom, so a batch
+// a little bigger than usual still fits. Zero until a size is observed.
+func (h *size_hint) size() int {
+  average := atomic.LoadInt64(&h.average)
+  return int(average + average / 4)
+}
+
+func (h *size_hint) observe(n int) {
+  // Exponentially weighted moving average, as for endpoint latency. Two
+  // encoders racing may lose a sample, which is fine for a hint.
+  old := atomic.LoadInt64(&h.average)
+  if old == 0 {
+    atomic.StoreInt64(&h.average, int64(n))
+  } else {
+    atomic.StoreInt64(&h.average, old + (int64(n) - old) / 8)
+  }
+}
+
+// A copy of the spooled events to hand off, allocated at exactly their
+// count.
+func batch_of(spool []*FileEvent) []*FileEvent {
+  batch := make([]*FileEvent, len(spool))
+  copy(batch, spool)
+  return batch
+}
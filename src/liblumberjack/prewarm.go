@@ -0,0 +1,71 @@
+package liblumberjack
+
+import (
+  zmq "github.com/alecthomas/gozmq"
+  "log"
+  "sort"
+)
+
+// With FFS.Prewarm, a socket is kept connected to every endpoint, not just
+// the one in use, so that moving to another endpoint (after a failure, or
+// a LatencyAware reselect) needn't wait for a connection to be set up.
+//
+// zmq reconnects each warm socket in the background by itself if its
+// server goes away and comes back. A socket that fails while in use is
+// closed as usual, and replaced with a fresh warm one the next time the
+// FFS connects.
+
+// Connect a warm socket to each endpoint that doesn't have one.
+func (s *FFS) warm_all() {
+  s.latency_lock.Lock()
+  defer s.latency_lock.Unlock()
+  if s.warm == nil {
+    s.warm = make(map[string]*zmq.Socket)
+  }
+
+  for _, endpoint := range s.Endpoints {
+    if s.warm[endpoint] != nil {
+      continue
+    }
+    socket := s.new_zmq_socket()
+    address, err := s.connect_address(endpoint)
+    if err == nil {
+      err = socket.Connect(address)
+    }
+    if err != nil {
+      log.Printf("%s: Error warming a connection: %s\n", endpoint, err)
+      socket.Close()
+      continue
+    }
+    s.warm[endpoint] = socket
+  }
+}
+
+// Take the warm socket for endpoint, if there is one.
+func (s *FFS) take_warm(endpoint string) (socket *zmq.Socket, ok bool) {
+  s.latency_lock.Lock()
+  defer s.latency_lock.Unlock()
+  socket, ok = s.warm[endpoint]
+  delete(s.warm, endpoint)
+  return
+}
+
+func (s *FFS) close_warm() {
+  s.latency_lock.Lock()
+  defer s.latency_lock.Unlock()
+  for endpoint, socket := range s.warm {
+    socket.Close()
+    delete(s.warm, endpoint)
+  }
+}
+
+// The endpoints with warm sockets, for Status. Called with latency_lock
+// held.
+func (s *FFS) warm_endpoints() []string {
+  endpoints := []string{}
+  for endpoint := range s.warm {
+    endpoints = append(endpoints, endpoint)
+  }
+  sort.Strings(endpoints)
+  return endpoints
+}
@@ -3,17 +3,82 @@ package liblumberjack
 import (
   "time"
   "path/filepath"
+  "strings"
   "syscall"
   "os"
   "log"
 )
 
+type Prospector struct {
+  Paths []string // paths or globs to harvest
+
+  // Settings for each harvester started; Path is filled in per file.
+  Harvester Harvester
+
+  ScanInterval time.Duration // time between scans; defaults to 10 seconds
+
+  last_scan time.Time // when the previous round of scans started
+
+  scan_cache map[string]os.FileInfo // glob -> its directory; see scancache.go
+  scan_stats int // stat calls made while scanning, for benchmarks
+  fingerprints map[string]string // path -> content fingerprint; see nfs.go
+  rechecks map[string]bool // new inodes with content yet to tell apart
+  pending map[string]pending_file // new files waiting out HarvestDelay
+
+  // Optional; wait this long after first seeing a new file before
+  // harvesting it, and skip it if it's gone or replaced by then, such as
+  // a temporary file or one created and then renamed. Files that survive
+  // are read from the beginning, so nothing written meanwhile is missed.
+  // Files there at startup are never delayed.
+  HarvestDelay time.Duration
+
+  // At startup, also read the older rotations of each file, oldest first;
+  // see rotations.go.
+  CatchUpRotations bool
+
+  // Optional; the most harvesters running at once, in all, and for the
+  // files of any one of Paths (unless PathLimits says otherwise), so one
+  // huge directory can't take every harvester. Files over a limit wait
+  // for a harvester to stop. See limits.go.
+  MaxHarvesters int
+  MaxHarvestersPerPath int
+  PathLimits map[string]int
+
+  // Optional; globs of files never to harvest, even if Paths matches them,
+  // such as "*.gz" or "*.tmp". A pattern without a / is matched against the
+  // file's name, one with a / against its whole path.
+  ExcludeFiles []string
+
+  // Descend into symlinked directories when expanding **; see glob.go.
+  FollowDirSymlinks bool
+
+  // Optional; the most files to hold state for, forgetting the least
+  // recently modified past that. See tracked.go.
+  MaxTrackedFiles int
+  forgotten_through time.Time // the latest mtime of a file forgotten
+  forgotten_entries map[string]bool // Paths entries with files forgotten
+
+  entry_of map[string]string // file -> the entry of Paths it was found by
+  all_slots chan bool
+  entry_slots map[string]chan bool
+}
+
+type pending_file struct {
+  info os.FileInfo
+  seen time.Time
+}
+
 func Prospect(paths []string, output chan *FileEvent) {
+  prospector := Prospector{Paths: paths}
+  prospector.Prospect(output)
+}
+
+func (p *Prospector) Prospect(output chan *FileEvent) {
+  paths := p.Paths
   // Scan for "-" to do stdin special handling.
   for i, path := range paths {
     if path == "-" {
-      harvester := Harvester{Path: path}
-      go harvester.Harvest(output)
+      p.harvest(path, output)
 
       // remove "-" from the paths list
       paths = append(paths[0:i], paths[i+1:]...)
@@ -21,23 +86,202 @@ func Prospect(paths []string, output chan *FileEvent) {
     }
   }
 
+  interval := p.ScanInterval
+  if interval == 0 {
+    interval = 10 * time.Second
+  }
+
+  // Scans asked for through the admin endpoint; see scannow.go.
+  requests := make(chan chan bool)
+  register_scanner(requests)
+  var requested []chan bool
+
   fileinfo := make(map[string]os.FileInfo)
   for {
+    scan_started := time.Now()
     for _, path := range paths {
-      prospector_scan(path, fileinfo, output)
+      p.scan(path, fileinfo, output)
+    }
+    p.harvest_pending(output)
+    p.forget_inactive(fileinfo)
+    p.last_scan = scan_started
+    for _, done := range requested {
+      close(done)
     }
+    requested = nil
 
-    // Defer next scan for a bit.
-    time.Sleep(10 * time.Second) // Make this tunable
+    // Defer next scan for a bit, unless one is asked for sooner.
+    select {
+      case <-time.After(interval):
+      case done := <-requests:
+        requested = append(waiting_scans(requests), done)
+    }
   }
 } /* Prospect */
 
-func prospector_scan(path string, fileinfo map[string]os.FileInfo,
-                     output chan *FileEvent) {
+// Start a harvester on the given path.
+func (p *Prospector) harvest(path string, output chan *FileEvent) {
+  p.start_harvester(path, false, output)
+}
+
+// Harvest the new files that have waited out HarvestDelay, if they are
+// still there.
+func (p *Prospector) harvest_pending(output chan *FileEvent) {
+  for path, pending := range p.pending {
+    if time.Since(pending.seen) < p.HarvestDelay {
+      continue
+    }
+    delete(p.pending, path)
+
+    info, err := p.Harvester.stat(path)
+    if err != nil || !os.SameFile(info, pending.info) {
+      log.Printf("%s is gone since it was created; not harvesting it\n", path)
+      continue
+    }
+    log.Printf("Launching harvester on new file: %s\n", path)
+    p.start_harvester(path, true, output)
+  }
+}
+
+// Start a harvester on the given path, reading the whole file if
+// from_beginning is set rather than only what is written from now on.
+func (p *Prospector) start_harvester(path string, from_beginning bool,
+                                     output chan *FileEvent) {
+  harvester := p.Harvester
+  harvester.Path = path
+  harvester.from_beginning = from_beginning
+  slots := p.slots(path)
+  go func() {
+    slots.acquire()
+    defer slots.release()
+    harvester.Harvest(output)
+  }()
+}
+
+// Does one of ExcludeFiles match file?
+func (p *Prospector) excluded(file string) bool {
+  for _, pattern := range p.ExcludeFiles {
+    name := filepath.Base(file)
+    if strings.Contains(pattern, "/") {
+      name = file
+    }
+    if matched, _ := filepath.Match(pattern, name); matched {
+      return true
+    }
+  }
+  return false
+}
+
+// With FingerprintIdentity, record the fingerprint of the file at path as
+// the content known for it. See nfs.go.
+func (p *Prospector) record_fingerprint(path string) {
+  if !p.Harvester.FingerprintIdentity {
+    return
+  }
+  if p.fingerprints == nil {
+    p.fingerprints = make(map[string]string)
+    p.rechecks = make(map[string]bool)
+  }
+  p.fingerprints[path] = p.Harvester.path_fingerprint(path)
+  delete(p.rechecks, path)
+}
+
+// With FingerprintIdentity, does the file at path have the content recorded
+// for it? If so the recorded fingerprint is kept, not replaced by this one,
+// and the file is rechecked on later scans until the match is conclusive
+// (both fingerprint_size long): a new file that so far only starts like the
+// old one (with a fixed header, say) must be told apart once it grows. If
+// not, this content is recorded.
+func (p *Prospector) same_content(path string) bool {
+  if !p.Harvester.FingerprintIdentity {
+    return false
+  }
+  last, known := p.fingerprints[path]
+  current := p.Harvester.path_fingerprint(path)
+  if !known || !same_fingerprint(last, current) {
+    p.record_fingerprint(path)
+    return false
+  }
+  if len(last) == fingerprint_size && len(current) == fingerprint_size {
+    delete(p.rechecks, path)
+  } else {
+    p.rechecks[path] = true
+  }
+  return true
+}
+
+// With FingerprintIdentity, fingerprint more of a file still short of
+// fingerprint_size, as it grows under the same inode; the more of the old
+// file is known, the sooner a replacement for it is told apart.
+// Whether path's fingerprint is as long as it gets and not pending a
+// recheck, so later scans have nothing to learn from its content.
+func (p *Prospector) fingerprint_settled(path string) bool {
+  if !p.Harvester.FingerprintIdentity {
+    return true
+  }
+  last, known := p.fingerprints[path]
+  return !known || (len(last) >= fingerprint_size && !p.rechecks[path])
+}
+
+func (p *Prospector) extend_fingerprint(path string) {
+  last, known := p.fingerprints[path]
+  if !known || len(last) >= fingerprint_size || p.rechecks[path] {
+    return
+  }
+  if current := p.Harvester.path_fingerprint(path); strings.HasPrefix(current, last) {
+    p.fingerprints[path] = current
+  }
+}
+
+// A file rotated more than once between scans leaves files behind that were
+// never harvested. Look for them under the usual rotated names (path.1,
+// path-20130102, ...) and harvest any that appeared since the last scan;
+// compressed ones are skipped, as in find_rotations. The file that was
+// rotated away is still being read by its own harvester.
+func (p *Prospector) find_missed_rotations(path string, rotated os.FileInfo,
+                                           fileinfo map[string]os.FileInfo,
+                                           output chan *FileEvent) {
+  for _, candidate := range rotation_candidates(path) {
+    if p.excluded(candidate) {
+      continue
+    }
+    info, err := os.Stat(candidate)
+    if err != nil || info.IsDir() || os.SameFile(info, rotated) {
+      continue
+    }
+    if info.ModTime().Before(p.last_scan) {
+      continue // rotated out before the last scan; nothing was missed.
+    }
+
+    known := false
+    for _, ki := range fileinfo {
+      if os.SameFile(info, ki) {
+        known = true
+        break
+      }
+    }
+    if !known {
+      log.Printf("Launching harvester on missed rotation of %s: %s\n", path, candidate)
+      fileinfo[candidate] = info
+      p.found(candidate, p.entry_of[path])
+      p.start_harvester(candidate, true, output)
+    }
+  }
+}
+
+func (p *Prospector) scan(path string, fileinfo map[string]os.FileInfo,
+                          output chan *FileEvent) {
   log.Printf("Prospecting %s\n", path)
 
-  // Evaluate the path as a wildcards/shell glob
-  matches, err := filepath.Glob(path)
+  unchanged, dir := p.scan_unchanged(path)
+  if unchanged {
+    return
+  }
+  cacheable := path != "-" && !p.forgotten_entries[path]
+  defer func() { p.remember_scan(path, dir, cacheable) }()
+
+  // Evaluate the path as a wildcards/shell glob; see glob.go for **
+  matches, err := p.glob(path)
   if err != nil {
     log.Printf("glob(%s) failed: %v\n", path, err)
     return
@@ -50,11 +294,22 @@ func prospector_scan(path string, fileinfo map[string]os.FileInfo,
 
   // Check any matched files to see if we need to start a harvester
   for _, file := range matches {
+    if p.excluded(file) {
+      continue
+    }
+
     // Stat the file, following any symlinks.
-    info, err := os.Stat(file)
+    p.scan_stats++
+    info, err := os.Lstat(file)
+    if err == nil && (info.Mode() & os.ModeSymlink != 0 || p.Harvester.StatRefresh) {
+      cacheable = false
+      p.scan_stats++
+      info, err = p.Harvester.stat(file)
+    }
     // TODO(sissel): check err
     if err != nil {
       log.Printf("stat(%s) failed: %s\n", file, err)
+      cacheable = false
       continue
     }
 
@@ -65,6 +320,10 @@ func prospector_scan(path string, fileinfo map[string]os.FileInfo,
 
     // Check the current info against fileinfo[file]
     lastinfo, is_known := fileinfo[file]
+    if !is_known && p.forgotten(info) {
+      continue // forgotten for MaxTrackedFiles, and not modified since
+    }
+    p.found(file, path)
     // Track the stat data for this file for later comparison to check for
     // rotation/etc
     fileinfo[file] = info
@@ -78,6 +337,8 @@ func prospector_scan(path string, fileinfo map[string]os.FileInfo,
       if time.Since(info.ModTime()) > 24*time.Hour {
         log.Printf("Skipping old file: %s\n", file)
       } else {
+        p.record_fingerprint(file)
+
         // Check to see if this file was simply renamed (known inode+dev)
         stat := info.Sys().(*syscall.Stat_t)
         renamed := false
@@ -92,14 +353,26 @@ func prospector_scan(path string, fileinfo map[string]os.FileInfo,
             renamed = true
             // Delete the old entry
             delete(fileinfo, kf)
+            if pending, waiting := p.pending[kf]; waiting {
+              // Renamed before it was harvested; wait on the new name.
+              delete(p.pending, kf)
+              p.pending[file] = pending
+            }
             break
           }
         }
 
-        if !renamed {
+        if !renamed && p.CatchUpRotations && p.last_scan.IsZero() {
+          p.catch_up(file, fileinfo, output)
+        } else if !renamed && p.HarvestDelay > 0 && !p.last_scan.IsZero() {
+          log.Printf("Waiting %s before harvesting new file: %s\n", p.HarvestDelay, file)
+          if p.pending == nil {
+            p.pending = make(map[string]pending_file)
+          }
+          p.pending[file] = pending_file{info, time.Now()}
+        } else if !renamed {
           log.Printf("Launching harvester on new file: %s\n", file)
-          harvester := Harvester{Path: file}
-          go harvester.Harvest(output)
+          p.harvest(file, output)
         }
       }
     } else {
@@ -108,13 +381,28 @@ func prospector_scan(path string, fileinfo map[string]os.FileInfo,
       stat := info.Sys().(*syscall.Stat_t)
       // Compare inode and device; it's a 'new file' if either have changed.
       // aka, the file was rotated/renamed/whatever
-      if stat.Dev != laststat.Dev || stat.Ino != laststat.Ino {
+      changed := stat.Dev != laststat.Dev || stat.Ino != laststat.Ino
+      if !changed && !p.rechecks[file] {
+        p.extend_fingerprint(file)
+      } else if p.same_content(file) {
+        if changed {
+          log.Printf("%s has a new inode but the same content; not a new file\n", file)
+        }
+      } else {
         log.Printf("Launching harvester on rotated file: %s\n", file)
         // TODO(sissel): log 'file rotated' or osmething
-        // Start a harvester on the path; a new file appeared with the same name.
-        harvester := Harvester{Path: file}
-        go harvester.Harvest(output)
+        // Start a harvester on the path; a new file appeared with the same
+        // name. Everything in it is new, so read it from the beginning.
+        p.start_harvester(file, true, output)
+        if changed {
+          p.find_missed_rotations(file, lastinfo, fileinfo, output)
+        }
       }
     }
+    if !p.fingerprint_settled(file) {
+      // What's left to check is content growing, which the directory's
+      // mtime doesn't show; see scancache.go.
+      cacheable = false
+    }
   } // for each file matched by the glob
 }
@@ -0,0 +1,429 @@
+package liblumberjack
+
+import "fmt"
+import "io/ioutil"
+import "log"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func TestProspectorDoubleRotation(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "app.log")
+  append_file(t, path, "")
+
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{Paths: []string{path},
+                           ScanInterval: 200 * time.Millisecond}
+  go prospector.Prospect(output)
+  time.Sleep(100 * time.Millisecond)
+
+  // Rotate twice between two scans.
+  append_file(t, path, "first\n")
+  os.Rename(path, path + ".1")
+  append_file(t, path, "second\n")
+  os.Rename(path + ".1", path + ".2")
+  os.Rename(path, path + ".1")
+  append_file(t, path, "third\n")
+
+  seen := map[string]bool{}
+  timeout := time.After(3 * time.Second)
+  for len(seen) < 3 {
+    select {
+      case event := <- output:
+        seen[*event.Text] = true
+      case <- timeout:
+        t.Fatalf("Lines were lost across rotations; got only %v", seen)
+    }
+  }
+  if !seen["first"] || !seen["second"] || !seen["third"] {
+    t.Fatalf("Unexpected lines: %v", seen)
+  }
+}
+
+// A directory of files too old to harvest, with its mtime old enough to be
+// cached.
+func TestProspectorMissedRotationsCompressed(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "app.log")
+  append_file(t, path, "first\n")
+
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{}
+  fileinfo := make(map[string]os.FileInfo)
+  prospector.scan(path, fileinfo, output)
+
+  // Rotated twice, the older rotation compressed, between two scans.
+  os.Rename(path, path + ".1")
+  append_file(t, path, "second\n")
+  append_file(t, path + ".2.gz", "\x1f\x8b compressed\n")
+  os.Rename(path + ".1", filepath.Join(dir, "compressed"))
+  os.Rename(path, path + ".1")
+  append_file(t, path, "third\n")
+  prospector.scan(path, fileinfo, output)
+  time.Sleep(100 * time.Millisecond)
+
+  if count := harvester_count(path + ".1"); count != 1 {
+    t.Fatalf("Expected the missed rotation harvested, got %d harvesters", count)
+  }
+  if count := harvester_count(path + ".2.gz"); count != 0 {
+    t.Fatal("Expected the compressed rotation skipped")
+  }
+}
+
+func many_files(b testing.TB, count int) string {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  old := time.Now().Add(-48 * time.Hour)
+  for i := 0; i < count; i++ {
+    path := filepath.Join(dir, fmt.Sprintf("file%d.log", i))
+    file, _ := os.Create(path)
+    file.Close()
+    os.Chtimes(path, old, old)
+  }
+  os.Chtimes(dir, old, old)
+  return dir
+}
+
+func TestProspectorScanCache(t *testing.T) {
+  dir := many_files(t, 10)
+  defer os.RemoveAll(dir)
+  glob := filepath.Join(dir, "*.log")
+
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{}
+  fileinfo := make(map[string]os.FileInfo)
+  prospector.scan(glob, fileinfo, output)
+  prospector.scan_stats = 0
+  prospector.scan(glob, fileinfo, output)
+  if prospector.scan_stats != 1 {
+    t.Fatalf("Expected an unchanged directory to take one stat, took %d",
+             prospector.scan_stats)
+  }
+
+  // A rotated file is still noticed.
+  rotated := filepath.Join(dir, "file3.log")
+  before := fileinfo[rotated]
+  os.Rename(rotated, rotated + ".1")
+  append_file(t, rotated, "")
+  prospector.scan(glob, fileinfo, output)
+  if os.SameFile(before, fileinfo[rotated]) {
+    t.Fatal("A file rotated in a cached directory was not noticed")
+  }
+}
+
+func BenchmarkProspectorScan(b *testing.B) {
+  dir := many_files(b, 2000)
+  defer os.RemoveAll(dir)
+  glob := filepath.Join(dir, "*.log")
+  log.SetOutput(ioutil.Discard)
+  defer log.SetOutput(os.Stderr)
+
+  for _, cached := range []bool{false, true} {
+    b.Run(fmt.Sprintf("cached=%v", cached), func(b *testing.B) {
+      output := make(chan *FileEvent, 10)
+      prospector := Prospector{}
+      fileinfo := make(map[string]os.FileInfo)
+      prospector.scan(glob, fileinfo, output)
+      prospector.scan_stats = 0
+      b.ResetTimer()
+      for i := 0; i < b.N; i++ {
+        if !cached {
+          prospector.scan_cache = nil
+        }
+        prospector.scan(glob, fileinfo, output)
+      }
+      b.ReportMetric(float64(prospector.scan_stats) / float64(b.N), "stats/scan")
+    })
+  }
+}
+
+func TestProspectorHarvestDelay(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{Paths: []string{filepath.Join(dir, "*.log")},
+                           ScanInterval: 50 * time.Millisecond,
+                           HarvestDelay: 300 * time.Millisecond}
+  go prospector.Prospect(output)
+  time.Sleep(100 * time.Millisecond)
+
+  // A temporary file, gone before the delay is up.
+  temporary := filepath.Join(dir, "temp.log")
+  append_file(t, temporary, "noise\n")
+  kept := filepath.Join(dir, "kept.log")
+  append_file(t, kept, "hello\n")
+  time.Sleep(100 * time.Millisecond)
+  os.Remove(temporary)
+
+  select {
+    case event := <- output:
+      if *event.Source != kept || *event.Text != "hello" {
+        t.Fatalf("Unexpected event from %s: %q", *event.Source, *event.Text)
+      }
+    case <- time.After(3 * time.Second):
+      t.Fatal("A file that survived the harvest delay was not harvested")
+  }
+  if harvester_count(temporary) != 0 {
+    t.Fatal("A file removed within the harvest delay was harvested")
+  }
+}
+
+func TestProspectorCatchUpRotations(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "app.log")
+
+  // Oldest to newest. The gzipped rotation can't be read, so it is left
+  // out.
+  series := []struct{ name, text string }{
+    {"app.log-20130101", "one"},
+    {"app.log.2", "two"},
+    {"app.log.1", "three"},
+    {"app.log", "four"},
+  }
+  start := time.Now().Add(-time.Hour)
+  for i, file := range series {
+    name := filepath.Join(dir, file.name)
+    append_file(t, name, file.text + "\n")
+    mtime := start.Add(time.Duration(i) * time.Minute)
+    os.Chtimes(name, mtime, mtime)
+  }
+  append_file(t, path + ".3.gz", "compressed\n")
+
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{Paths: []string{filepath.Join(dir, "*")},
+                           CatchUpRotations: true,
+                           ScanInterval: 100 * time.Millisecond}
+  go prospector.Prospect(output)
+
+  for _, file := range series {
+    select {
+      case event := <- output:
+        if *event.Text != file.text {
+          t.Fatalf("Expected %q from %s next, got %q from %s", file.text,
+                   file.name, *event.Text, *event.Source)
+        }
+      case <- time.After(5 * time.Second):
+        t.Fatalf("Timed out waiting for %q", file.text)
+    }
+  }
+  // Later scans must not harvest the rotations again.
+  select {
+    case event := <- output:
+      t.Fatalf("Unexpected event %q from %s", *event.Text, *event.Source)
+    case <- time.After(300 * time.Millisecond):
+  }
+}
+
+// How many harvesters are running on files in dir.
+func harvesters_in(dir string) (count int) {
+  harvesters_lock.Lock()
+  defer harvesters_lock.Unlock()
+  for path, n := range active_harvesters {
+    if filepath.Dir(path) == dir {
+      count += n
+    }
+  }
+  return
+}
+
+func TestProspectorHarvesterLimits(t *testing.T) {
+  var dirs []string
+  for i := 0; i < 2; i++ {
+    dir, _ := ioutil.TempDir("", "lumberjack-test")
+    defer os.RemoveAll(dir)
+    for j := 0; j < 5; j++ {
+      append_file(t, filepath.Join(dir, fmt.Sprintf("file%d.log", j)), "")
+    }
+    dirs = append(dirs, dir)
+  }
+
+  // The first entry may take 4, the second the default of 3, and only 6
+  // may run in all; so both are limited by something.
+  big, small := filepath.Join(dirs[0], "*.log"), filepath.Join(dirs[1], "*.log")
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{Paths: []string{big, small},
+                           MaxHarvesters: 6, MaxHarvestersPerPath: 3,
+                           PathLimits: map[string]int{big: 4},
+                           ScanInterval: 50 * time.Millisecond}
+  go prospector.Prospect(output)
+  time.Sleep(300 * time.Millisecond)
+
+  first, second := harvesters_in(dirs[0]), harvesters_in(dirs[1])
+  if first > 4 || second > 3 || first + second != 6 {
+    t.Fatalf("Expected at most 4 and 3 harvesters, 6 in all; got %d and %d", first, second)
+  }
+}
+
+func TestRecursiveGlobSymlinks(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  os.MkdirAll(filepath.Join(dir, "app", "nested"), 0755)
+  os.MkdirAll(filepath.Join(dir, "other"), 0755)
+  append_file(t, filepath.Join(dir, "top.log"), "")
+  append_file(t, filepath.Join(dir, "app", "nested", "deep.log"), "")
+  append_file(t, filepath.Join(dir, "other", "linked.log"), "")
+  // A link to a directory also reached directly, and a loop.
+  os.Symlink(filepath.Join(dir, "other"), filepath.Join(dir, "app", "link"))
+  os.Symlink(dir, filepath.Join(dir, "app", "nested", "loop"))
+
+  count := func(matches []string, name string) (n int) {
+    for _, match := range matches {
+      if filepath.Base(match) == name {
+        n++
+      }
+    }
+    return
+  }
+
+  for _, follow := range []bool{false, true} {
+    prospector := Prospector{FollowDirSymlinks: follow}
+    done := make(chan []string)
+    go func() {
+      matches, _ := prospector.glob(filepath.Join(dir, "**", "*.log"))
+      done <- matches
+    }()
+    select {
+      case matches := <-done:
+        for _, name := range []string{"top.log", "deep.log", "linked.log"} {
+          if count(matches, name) != 1 {
+            t.Fatalf("follow=%v: expected %s matched once, got %v", follow, name, matches)
+          }
+        }
+      case <-time.After(2 * time.Second):
+        t.Fatalf("follow=%v: globbing a symlink loop hung", follow)
+    }
+  }
+
+  // Without following, only the real directory is looked in.
+  prospector := Prospector{}
+  matches, _ := prospector.glob(filepath.Join(dir, "app", "**", "*.log"))
+  if len(matches) != 1 || filepath.Base(matches[0]) != "deep.log" {
+    t.Fatalf("Expected only app's own files without following symlinks, got %v", matches)
+  }
+  prospector.FollowDirSymlinks = true
+  matches, _ = prospector.glob(filepath.Join(dir, "app", "**", "*.log"))
+  if count(matches, "linked.log") != 1 || count(matches, "top.log") != 1 {
+    t.Fatalf("Expected linked directories' files once each when following, got %v", matches)
+  }
+}
+
+func TestProspectorExcludeFiles(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  os.MkdirAll(filepath.Join(dir, "scratch"), 0755)
+  for _, name := range []string{"app.log", "app.log.gz", "upload.tmp", "scratch/notes.log"} {
+    append_file(t, filepath.Join(dir, name), "")
+  }
+
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{Paths: []string{filepath.Join(dir, "**", "*")},
+                           ExcludeFiles: []string{"*.gz", "*.tmp",
+                                                  filepath.Join(dir, "scratch", "*")},
+                           ScanInterval: 50 * time.Millisecond}
+  go prospector.Prospect(output)
+  time.Sleep(200 * time.Millisecond)
+
+  harvesters_lock.Lock()
+  defer harvesters_lock.Unlock()
+  for _, name := range []string{"app.log.gz", "upload.tmp", "scratch/notes.log"} {
+    if active_harvesters[filepath.Join(dir, name)] != 0 {
+      t.Fatalf("Excluded file %s is being harvested", name)
+    }
+  }
+  if active_harvesters[filepath.Join(dir, "app.log")] != 1 {
+    t.Fatalf("Expected app.log to be harvested")
+  }
+}
+
+func TestScanNow(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "new.log")
+
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{Paths: []string{filepath.Join(dir, "*.log")},
+                           ScanInterval: time.Hour}
+  go prospector.Prospect(output)
+  time.Sleep(100 * time.Millisecond)
+
+  append_file(t, path, "")
+  // Asked for at once, as by several operators; each returns once a scan
+  // has run.
+  codes := make(chan int, 3)
+  for i := 0; i < 3; i++ {
+    go func() {
+      request, _ := http.NewRequest("POST", "/prospector/scan", nil)
+      response := httptest.NewRecorder()
+      admin_mux.ServeHTTP(response, request)
+      codes <- response.Code
+    }()
+  }
+  for i := 0; i < 3; i++ {
+    select {
+      case code := <-codes:
+        if code != http.StatusOK {
+          t.Fatalf("Expected the scan to succeed, got %d", code)
+        }
+      case <-time.After(2 * time.Second):
+        t.Fatal("A scan asked for was not run")
+    }
+  }
+
+  deadline := time.Now().Add(time.Second)
+  for harvester_count(path) != 1 {
+    if time.Now().After(deadline) {
+      t.Fatal("A new file was not found by the scan asked for")
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+}
+
+func TestProspectorMaxTrackedFiles(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  glob := filepath.Join(dir, "*.log")
+
+  // Too old to harvest; file0 was modified longest ago.
+  var paths []string
+  for i := 0; i < 5; i++ {
+    path := filepath.Join(dir, fmt.Sprintf("file%d.log", i))
+    append_file(t, path, "")
+    mtime := time.Now().Add(-72 * time.Hour).Add(time.Duration(i) * time.Hour)
+    os.Chtimes(path, mtime, mtime)
+    paths = append(paths, path)
+  }
+
+  output := make(chan *FileEvent, 10)
+  prospector := Prospector{MaxTrackedFiles: 3}
+  fileinfo := make(map[string]os.FileInfo)
+  tracked := func(expected ...string) {
+    prospector.scan(glob, fileinfo, output)
+    prospector.forget_inactive(fileinfo)
+    if len(fileinfo) != len(expected) {
+      t.Fatalf("Expected %d files tracked, got %v", len(expected), fileinfo)
+    }
+    for _, path := range expected {
+      if _, ok := fileinfo[path]; !ok {
+        t.Fatalf("Expected %s tracked, got %v", path, fileinfo)
+      }
+    }
+  }
+  tracked(paths[2], paths[3], paths[4])
+  if tracked_files.Value() != 3 {
+    t.Fatalf("Expected 3 files tracked in the gauge, got %v", tracked_files.Value())
+  }
+  // Unchanged, the forgotten files stay forgotten.
+  tracked(paths[2], paths[3], paths[4])
+
+  // Modified, a forgotten file is found again, and the least recently
+  // modified of the others is forgotten in its place.
+  append_file(t, paths[0], "again\n")
+  tracked(paths[0], paths[3], paths[4])
+}
@@ -0,0 +1,368 @@
+package liblumberjack
+
+import (
+  "encoding"
+  "encoding/base64"
+  "encoding/binary"
+  "fmt"
+  "log"
+  "math"
+  "reflect"
+  "sort"
+)
+
+// With Publisher.Serialization "protobuf", batches are serialized as the
+// EventEnvelope message of event.proto instead of a JSON array, and the
+// payload's codec byte has FORMAT_PROTOBUF set. That schema is small and
+// stable enough that it is encoded here by hand, rather than pulling in a
+// protobuf library and generated code.
+//
+// Fields are encoded as protobuf too (an Object of Values, like JSON's), so
+// structured events never go through JSON. Numbers are doubles, as in
+// JSON; values of any other type are encoded as their TextMarshaler text
+// if they have one, and an event with a value that can't be encoded at all
+// (a func, say) is dropped ("unserializable"), not shipped without it.
+
+const (
+  proto_varint = 0
+  proto_fixed64 = 1
+  proto_bytes = 2
+)
+
+// Field numbers, as in event.proto.
+const (
+  proto_envelope_events = 1
+
+  proto_event_source = 1
+  proto_event_offset = 2
+  proto_event_line = 3
+  proto_event_text = 4
+  proto_event_id = 5
+  proto_event_fields = 6
+
+  proto_object_fields = 1
+  proto_field_key = 1
+  proto_field_value = 2
+  proto_list_values = 1
+
+  proto_value_null = 1
+  proto_value_string = 2
+  proto_value_number = 3
+  proto_value_bool = 4
+  proto_value_object = 5
+  proto_value_list = 6
+)
+
+func proto_append_varint(buffer []byte, value uint64) []byte {
+  var scratch [binary.MaxVarintLen64]byte
+  return append(buffer, scratch[:binary.PutUvarint(scratch[:], value)]...)
+}
+
+func proto_append_bytes(buffer []byte, field int, value []byte) []byte {
+  buffer = proto_append_varint(buffer, uint64(field << 3 | proto_bytes))
+  buffer = proto_append_varint(buffer, uint64(len(value)))
+  return append(buffer, value...)
+}
+
+func proto_append_uint(buffer []byte, field int, value uint64) []byte {
+  buffer = proto_append_varint(buffer, uint64(field << 3 | proto_varint))
+  return proto_append_varint(buffer, value)
+}
+
+func proto_append_double(buffer []byte, field int, value float64) []byte {
+  buffer = proto_append_varint(buffer, uint64(field << 3 | proto_fixed64))
+  var scratch [8]byte
+  binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(value))
+  return append(buffer, scratch[:]...)
+}
+
+func marshal_protobuf(events []*FileEvent) []byte {
+  var envelope, message []byte
+  for _, event := range events {
+    var fields []byte
+    if event.Fields != nil {
+      var err error
+      if fields, err = proto_object(event.Fields); err != nil {
+        log.Printf("Dropping the event at offset %d of %s: %s\n", event.Offset,
+                   source_of(event), err)
+        dropped("unserializable", 1)
+        continue
+      }
+    }
+
+    message = message[:0]
+    // Required in event.proto, so written even when empty.
+    message = proto_append_bytes(message, proto_event_source, []byte(source_of(event)))
+    message = proto_append_uint(message, proto_event_offset, event.Offset)
+    message = proto_append_uint(message, proto_event_line, event.Line)
+    if event.Text != nil {
+      message = proto_append_bytes(message, proto_event_text, []byte(*event.Text))
+    }
+    if event.ID != "" {
+      message = proto_append_bytes(message, proto_event_id, []byte(event.ID))
+    }
+    if event.Fields != nil {
+      message = proto_append_bytes(message, proto_event_fields, fields)
+    }
+    envelope = proto_append_bytes(envelope, proto_envelope_events, message)
+  }
+  return envelope
+}
+
+func source_of(event *FileEvent) string {
+  if event.Source == nil {
+    return ""
+  }
+  return *event.Source
+}
+
+// fields as an Object message, keys sorted as encoding/json sorts them.
+func proto_object(fields map[string]interface{}) ([]byte, error) {
+  keys := make([]string, 0, len(fields))
+  for key := range fields {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+
+  var object []byte
+  for _, key := range keys {
+    value, err := proto_value(fields[key])
+    if err != nil {
+      return nil, fmt.Errorf("field %s: %s", key, err)
+    }
+    field := proto_append_bytes(nil, proto_field_key, []byte(key))
+    field = proto_append_bytes(field, proto_field_value, value)
+    object = proto_append_bytes(object, proto_object_fields, field)
+  }
+  return object, nil
+}
+
+// value as a Value message.
+func proto_value(value interface{}) ([]byte, error) {
+  switch v := value.(type) {
+    case nil:
+      return proto_append_uint(nil, proto_value_null, 1), nil
+    case string:
+      return proto_append_bytes(nil, proto_value_string, []byte(v)), nil
+    case bool:
+      var b uint64
+      if v {
+        b = 1
+      }
+      return proto_append_uint(nil, proto_value_bool, b), nil
+    case float64:
+      return proto_append_double(nil, proto_value_number, v), nil
+    case []byte:
+      return proto_value(base64.StdEncoding.EncodeToString(v)) // as encoding/json does
+    case map[string]interface{}:
+      object, err := proto_object(v)
+      if err != nil {
+        return nil, err
+      }
+      return proto_append_bytes(nil, proto_value_object, object), nil
+    case encoding.TextMarshaler: // time.Time, net.IP, ...
+      text, err := v.MarshalText()
+      if err != nil {
+        return nil, err
+      }
+      return proto_append_bytes(nil, proto_value_string, text), nil
+  }
+
+  // Other numbers, named types, lists and maps, as encoding/json takes them.
+  v := reflect.ValueOf(value)
+  switch v.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+      return proto_value(float64(v.Int()))
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+      return proto_value(float64(v.Uint()))
+    case reflect.Float32, reflect.Float64:
+      return proto_value(v.Float())
+    case reflect.String:
+      return proto_value(v.String())
+    case reflect.Bool:
+      return proto_value(v.Bool())
+    case reflect.Ptr, reflect.Interface:
+      if v.IsNil() {
+        return proto_value(nil)
+      }
+      return proto_value(v.Elem().Interface())
+    case reflect.Slice, reflect.Array:
+      if v.Kind() == reflect.Slice && v.IsNil() {
+        return proto_value(nil)
+      }
+      var list []byte
+      for i := 0; i < v.Len(); i++ {
+        item, err := proto_value(v.Index(i).Interface())
+        if err != nil {
+          return nil, err
+        }
+        list = proto_append_bytes(list, proto_list_values, item)
+      }
+      return proto_append_bytes(nil, proto_value_list, list), nil
+    case reflect.Map:
+      if v.Type().Key().Kind() != reflect.String {
+        break
+      }
+      if v.IsNil() {
+        return proto_value(nil)
+      }
+      object := make(map[string]interface{}, v.Len())
+      for _, key := range v.MapKeys() {
+        object[key.String()] = v.MapIndex(key).Interface()
+      }
+      return proto_value(object)
+  }
+  return nil, fmt.Errorf("can't encode a %T", value)
+}
+
+// Read one field: its number, and its value as either a varint (or the
+// bits of a fixed64) or bytes.
+func proto_field(data []byte) (field int, number uint64, value []byte, rest []byte, err error) {
+  tag, n := binary.Uvarint(data)
+  if n <= 0 {
+    return 0, 0, nil, nil, fmt.Errorf("bad protobuf field tag")
+  }
+  data = data[n:]
+  field = int(tag >> 3)
+
+  switch tag & 7 {
+    case proto_varint:
+      if number, n = binary.Uvarint(data); n <= 0 {
+        return 0, 0, nil, nil, fmt.Errorf("bad protobuf varint in field %d", field)
+      }
+      return field, number, nil, data[n:], nil
+    case proto_fixed64:
+      if len(data) < 8 {
+        return 0, 0, nil, nil, fmt.Errorf("bad protobuf fixed64 in field %d", field)
+      }
+      return field, binary.LittleEndian.Uint64(data), nil, data[8:], nil
+    case proto_bytes:
+      length, n := binary.Uvarint(data)
+      if n <= 0 || uint64(len(data) - n) < length {
+        return 0, 0, nil, nil, fmt.Errorf("bad protobuf length in field %d", field)
+      }
+      data = data[n:]
+      return field, 0, data[:length], data[length:], nil
+  }
+  return 0, 0, nil, nil, fmt.Errorf("unsupported protobuf wire type %d in field %d", tag & 7, field)
+}
+
+func unmarshal_protobuf(data []byte) (events []*FileEvent, err error) {
+  for len(data) > 0 {
+    var field int
+    var message []byte
+    if field, _, message, data, err = proto_field(data); err != nil {
+      return nil, err
+    }
+    if field != proto_envelope_events {
+      continue
+    }
+
+    event := &FileEvent{}
+    for len(message) > 0 {
+      var number uint64
+      var value []byte
+      if field, number, value, message, err = proto_field(message); err != nil {
+        return nil, err
+      }
+      switch field {
+        case proto_event_source:
+          source := string(value)
+          event.Source = &source
+        case proto_event_offset:
+          event.Offset = number
+        case proto_event_line:
+          event.Line = number
+        case proto_event_text:
+          text := string(value)
+          event.Text = &text
+        case proto_event_id:
+          event.ID = string(value)
+        case proto_event_fields:
+          if event.Fields, err = unmarshal_proto_object(value); err != nil {
+            return nil, err
+          }
+      }
+    }
+    events = append(events, event)
+  }
+  return
+}
+
+// An Object message, decoded as encoding/json decodes an object.
+func unmarshal_proto_object(data []byte) (map[string]interface{}, error) {
+  object := make(map[string]interface{})
+  for len(data) > 0 {
+    field, _, message, rest, err := proto_field(data)
+    if err != nil {
+      return nil, err
+    }
+    data = rest
+    if field != proto_object_fields {
+      continue
+    }
+
+    var key string
+    var value interface{}
+    for len(message) > 0 {
+      var part []byte
+      if field, _, part, message, err = proto_field(message); err != nil {
+        return nil, err
+      }
+      switch field {
+        case proto_field_key:
+          key = string(part)
+        case proto_field_value:
+          if value, err = unmarshal_proto_value(part); err != nil {
+            return nil, err
+          }
+      }
+    }
+    object[key] = value
+  }
+  return object, nil
+}
+
+// A Value message, decoded as encoding/json decodes a value.
+func unmarshal_proto_value(data []byte) (value interface{}, err error) {
+  for len(data) > 0 {
+    var field int
+    var number uint64
+    var part []byte
+    if field, number, part, data, err = proto_field(data); err != nil {
+      return nil, err
+    }
+    switch field {
+      case proto_value_null:
+        value = nil
+      case proto_value_string:
+        value = string(part)
+      case proto_value_number:
+        value = math.Float64frombits(number)
+      case proto_value_bool:
+        value = number != 0
+      case proto_value_object:
+        if value, err = unmarshal_proto_object(part); err != nil {
+          return nil, err
+        }
+      case proto_value_list:
+        list := []interface{}{}
+        for len(part) > 0 {
+          var item []byte
+          if field, _, item, part, err = proto_field(part); err != nil {
+            return nil, err
+          }
+          if field != proto_list_values {
+            continue
+          }
+          decoded, err := unmarshal_proto_value(item)
+          if err != nil {
+            return nil, err
+          }
+          list = append(list, decoded)
+        }
+        value = list
+    }
+  }
+  return
+}
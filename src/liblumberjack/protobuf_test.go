@@ -0,0 +1,102 @@
+package liblumberjack
+
+import "encoding/json"
+import "reflect"
+import "testing"
+import "time"
+
+func TestProtobufRoundTrip(t *testing.T) {
+  events := test_batch()
+  events[0].ID = "node-1"
+  events[1].Text = nil
+  events[1].Fields = map[string]interface{}{"status": "200", "bytes": 512.0}
+
+  decoded, err := unmarshal_protobuf(marshal_protobuf(events))
+  if err != nil {
+    t.Fatalf("unmarshal_protobuf failed: %s", err)
+  }
+  if !reflect.DeepEqual(decoded, events) {
+    expected, _ := json.Marshal(events)
+    got, _ := json.Marshal(decoded)
+    t.Fatalf("Expected %s, got %s", expected, got)
+  }
+
+  // And through a compressed payload, as a server would see it.
+  payload := append([]byte{CODEC_NONE | FORMAT_PROTOBUF}, marshal_protobuf(events)...)
+  if decoded, err = DecodeEvents(payload); err != nil || len(decoded) != 3 {
+    t.Fatalf("DecodeEvents failed: %d events, %v", len(decoded), err)
+  }
+}
+
+func TestProtobufFields(t *testing.T) {
+  // Whatever codecs and the harvester put in fields comes out as
+  // encoding/json would decode it.
+  events := test_batch()[:1]
+  events[0].Fields = map[string]interface{}{
+    "priority": 13, "severity": uint8(5), "ratio": 0.5, "ok": true, "none": nil,
+    "context": []string{"one", "two"}, "empty": []interface{}{},
+    "when": time.Date(2013, 1, 2, 15, 4, 5, 0, time.UTC),
+    "structured_data": map[string]map[string]string{"origin": {"ip": "10.0.0.1"}},
+  }
+  decoded, err := unmarshal_protobuf(marshal_protobuf(events))
+  if err != nil || len(decoded) != 1 {
+    t.Fatalf("unmarshal_protobuf failed: %d events, %v", len(decoded), err)
+  }
+  data, _ := json.Marshal(events[0].Fields)
+  var expected map[string]interface{}
+  json.Unmarshal(data, &expected)
+  if !reflect.DeepEqual(decoded[0].Fields, expected) {
+    got, _ := json.Marshal(decoded[0].Fields)
+    t.Fatalf("Expected %s, got %s", data, got)
+  }
+
+  // An event with a field that can't be encoded is dropped, not the batch.
+  events = test_batch()
+  events[1].Fields = map[string]interface{}{"callback": func() {}}
+  count := drops("unserializable", func() {
+    decoded, err = unmarshal_protobuf(marshal_protobuf(events))
+  })
+  if err != nil || len(decoded) != 2 || count != 1 {
+    t.Fatalf("Expected one event of 3 dropped, got %d events (%d dropped), %v",
+             len(decoded), count, err)
+  }
+}
+
+func TestProtobufSourceAlwaysSet(t *testing.T) {
+  // source is required, so an event without one still carries it, empty.
+  decoded, err := unmarshal_protobuf(marshal_protobuf([]*FileEvent{{Offset: 1, Line: 1}}))
+  if err != nil || len(decoded) != 1 {
+    t.Fatalf("unmarshal_protobuf failed: %d events, %v", len(decoded), err)
+  }
+  if decoded[0].Source == nil || *decoded[0].Source != "" {
+    t.Fatalf("Expected an empty source, got %v", decoded[0].Source)
+  }
+}
+
+func large_batch() []*FileEvent {
+  source := "/var/log/nginx/access.log"
+  events := make([]*FileEvent, 1024)
+  for i := range events {
+    text := `127.0.0.1 - - [02/Jan/2013:15:04:05 -0700] "GET /index.html HTTP/1.1" 200 5124 "-" "curl/7.29.0"`
+    events[i] = &FileEvent{Source: &source, Offset: uint64(i * 100), Line: uint64(i + 1), Text: &text}
+  }
+  return events
+}
+
+func BenchmarkMarshalJSON(b *testing.B) {
+  events := large_batch()
+  var data []byte
+  for i := 0; i < b.N; i++ {
+    data, _ = json.Marshal(events)
+  }
+  b.ReportMetric(float64(len(data)), "bytes/batch")
+}
+
+func BenchmarkMarshalProtobuf(b *testing.B) {
+  events := large_batch()
+  var data []byte
+  for i := 0; i < b.N; i++ {
+    data = marshal_protobuf(events)
+  }
+  b.ReportMetric(float64(len(data)), "bytes/batch")
+}
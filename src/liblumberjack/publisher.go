@@ -3,13 +3,14 @@ package liblumberjack
 import (
   "bytes"
   "encoding/json"
+  "fmt"
+  "io"
   zmq "github.com/alecthomas/gozmq"
   "log"
-  "math/big"
   "syscall"
+  "sync"
   "time"
-  "compress/zlib"
-  "crypto/rand"
+  "compress/gzip"
   "sodium"
 )
 
@@ -30,62 +31,193 @@ type FFS struct {
   SendTimeout time.Duration
   RecvTimeout time.Duration
 
+  // How to pick an endpoint when connecting; RandomEndpoint by default.
+  Strategy EndpointStrategy
+  // With LatencyAware, pick again after this many replies (default 100).
+  Reselect int
+
+  // The ZMQ_IDENTITY presented to servers, so a ROUTER can tell it's the
+  // same client across reconnects. Defaults to the hostname and a random
+  // suffix, chosen once.
+  Identity string
+
+  // A Send that times out waiting for the socket to be writable may just
+  // mean a busy link, so it's retried this many times before the socket,
+  // and the send, are failed. An error from the send itself always fails
+  // the socket.
+  PollRetries int
+
+  // How long Shutdown waits for unsent messages to go out. A socket failed
+  // for not responding is always abandoned at once (a linger of 0).
+  Linger time.Duration
+
+  // Only queue messages to connections that are up (ZMQ_IMMEDIATE, called
+  // DELAY_ATTACH_ON_CONNECT before zmq 4), rather than to one still
+  // connecting, where they wait until it connects or the send times out.
+  Immediate bool
+
+  // Log each kind of connect and failure message at most this often, so a
+  // long outage doesn't flood the log; see loglimit.go. Zero logs them all.
+  LogInterval time.Duration
+
+  // Keep a connection to every endpoint ready; see prewarm.go.
+  Prewarm bool
+
+  // If set, ping every endpoint this often, and avoid those that don't
+  // reply; see health.go.
+  HealthInterval time.Duration
+
+  // Optional; told the latency of every reply; see congestion.go.
+  Congestion *LatencyLimit
+
+  // Escalate after this many connection attempts without a reply, and
+  // call OnOutage, if set, then and when replies resume; see
+  // connectivity.go.
+  ReconnectAlert int
+  OnOutage func(outage bool, reconnects int)
+
+  // If set, connect to tcp:// endpoints from a local port in this range
+  // (inclusive), for firewalls that only allow a known egress range; see
+  // srcport.go.
+  SourcePortMin int
+  SourcePortMax int
+
   endpoint  string      // the current endpoint in use
   socket    *zmq.Socket // the current zmq socket
   connected bool        // are we connected?
+  partial   bool        // have frames of a message gone out, but not its last?
+
+  sent_at time.Time // when the last complete message was sent
+  poll_timeouts int // consecutive Send poll timeouts, for PollRetries
+  replies int // replies received, for Reselect
+  reconnects int // connection attempts since the last reply, for ReconnectAlert
+  latency map[string]time.Duration // moving average of send-to-reply time
+  latency_lock sync.Mutex // guards latency, endpoint and warm for Status()
+  pending_endpoints []string // from SetEndpoints, for the socket's goroutine
+  warm map[string]*zmq.Socket // endpoint -> a connected socket not in use
+  health map[string]bool // endpoint -> did it reply to its last health check?
+  ping func() (nonce []byte, ciphertext []byte) // a health check payload
+  health_quit chan bool // closed by Shutdown to stop health checks
+  log log_limiter
+}
+
+// Socket operations, replaceable in tests to inject errors.
+var zmq_poll = zmq.Poll
+var socket_send = func(socket *zmq.Socket, data []byte, flags zmq.SendRecvOption) error {
+  return socket.Send(data, flags)
+}
+var socket_recv = func(socket *zmq.Socket, flags zmq.SendRecvOption) ([]byte, error) {
+  return socket.Recv(flags)
+}
+
+// Errors that say nothing about the health of the socket, such as being
+// interrupted by a signal. The operation is simply retried.
+func is_transient(err error) bool {
+  return err == syscall.EINTR || err == syscall.EAGAIN
 }
 
-func (s *FFS) Send(data []byte, flags zmq.SendRecvOption) (err error) {
+// Send one frame of a message. Failures reconnect and retry, except that
+// once earlier frames of the message have gone out on a socket, a failure
+// returns an error instead: the rest of the message can't follow them onto
+// a new socket, which has none of the message, so the caller must start the
+// whole message over. Timing out (past PollRetries) also fails the socket
+// and returns ETIMEDOUT, for any frame, so the caller can count the
+// attempt: with Immediate, a socket is never writable while no server is
+// up, and retrying here would never return.
+func (s *FFS) Send(data []byte, flags zmq.SendRecvOption) error {
+  if !s.partial {
+    s.reconcile()
+  }
   for {
     s.ensure_connect()
 
     pi := zmq.PollItems{zmq.PollItem{Socket: s.socket, Events: zmq.POLLOUT}}
-    count, err := zmq.Poll(pi, s.SendTimeout)
-    if count == 0 {
+    count, err := zmq_poll(pi, s.SendTimeout)
+    if count == 0 && is_transient(err) {
+      continue // interrupted; poll again.
+    } else if count == 0 && s.poll_timeouts < s.PollRetries {
+      s.poll_timeouts++
+      s.log.Printf("%s: timed out waiting to Send() (%d of %d); waiting again\n",
+                 s.endpoint, s.poll_timeouts, s.PollRetries)
+    } else if count == 0 {
       // not ready in time, fail the socket and try again.
-      log.Printf("%s: timed out waiting to Send(): %s\n", s.endpoint, err)
+      s.log.Printf("%s: timed out waiting to Send(): %s\n", s.endpoint, err)
+      ReportError(ERR_SEND_FAILED, "Timed out sending to " + s.endpoint,
+                  map[string]interface{}{"endpoint": s.endpoint, "bytes": len(data)})
       s.fail_socket()
+      return syscall.ETIMEDOUT
     } else {
       //log.Printf("%s: sending %d payload\n", s.endpoint, len(data))
-      err = s.socket.Send(data, flags)
-      if err != nil {
-        log.Printf("%s: Failed to Send() %d byte message: %s\n",
+      err = socket_send(s.socket, data, flags)
+      if err != nil && is_transient(err) {
+        continue // interrupted; try again on the same socket.
+      } else if err != nil {
+        s.log.Printf("%s: Failed to Send() %d byte message: %s\n",
           s.endpoint, len(data), err)
-        s.fail_socket()
+        ReportError(ERR_SEND_FAILED, "Failed sending to " + s.endpoint,
+                    map[string]interface{}{"endpoint": s.endpoint, "bytes": len(data),
+                                           "error": err.Error()})
+        if s.fail_message() {
+          return err
+        }
       } else {
         // Success!
-        break
+        s.poll_timeouts = 0
+        s.partial = flags & zmq.SNDMORE != 0
+        if !s.partial {
+          s.sent_at = time.Now()
+        }
+        return nil
       }
     }
   }
-  return
+}
+
+// Fail the socket, returning whether a message was part way out on it.
+func (s *FFS) fail_message() bool {
+  partial := s.partial
+  s.fail_socket()
+  return partial
 }
 
 func (s *FFS) Recv(flags zmq.SendRecvOption) (data []byte, err error) {
   s.ensure_connect()
 
-  pi := zmq.PollItems{zmq.PollItem{Socket: s.socket, Events: zmq.POLLIN}}
-  count, err := zmq.Poll(pi, s.RecvTimeout)
-  if count == 0 {
-    // not ready in time, fail the socket and try again.
-    s.fail_socket()
+  for {
+    pi := zmq.PollItems{zmq.PollItem{Socket: s.socket, Events: zmq.POLLIN}}
+    count, err := zmq_poll(pi, s.RecvTimeout)
+    if count == 0 && is_transient(err) {
+      continue // interrupted; poll again.
+    } else if count == 0 {
+      // not ready in time, fail the socket and try again.
+      s.fail_socket()
+
+      err = syscall.ETIMEDOUT
+      s.log.Printf("%s: timed out waiting to Recv(): %s\n",
+        s.endpoint, err)
+      ReportError(ERR_RECV_FAILED, "Timed out waiting for a reply from " + s.endpoint,
+                  map[string]interface{}{"endpoint": s.endpoint})
+      return nil, err
+    }
 
-    err = syscall.ETIMEDOUT
-    log.Printf("%s: timed out waiting to Recv(): %s\n",
-      s.endpoint, err)
-    return nil, err
-  } else {
-    data, err = s.socket.Recv(flags)
-    if err != nil {
-      log.Printf("%s: Failed to Recv() %d byte message: %s\n",
+    data, err = socket_recv(s.socket, flags)
+    if err != nil && is_transient(err) {
+      continue // interrupted; try again on the same socket.
+    } else if err != nil {
+      s.log.Printf("%s: Failed to Recv() %d byte message: %s\n",
         s.endpoint, len(data), err)
+      ReportError(ERR_RECV_FAILED, "Failed receiving a reply from " + s.endpoint,
+                  map[string]interface{}{"endpoint": s.endpoint, "error": err.Error()})
       s.fail_socket()
       return nil, err
-    } else {
-      // Success!
     }
+
+    // Success!
+    s.record_reply()
+    s.count_reply()
+    s.log.reset(s.endpoint + ": replying again")
+    return data, nil
   }
-  return
 }
 
 func (s *FFS) Close() (err error) {
@@ -96,6 +228,7 @@ func (s *FFS) Close() (err error) {
 
   s.socket = nil
   s.connected = false
+  s.partial = false
   return nil
 }
 
@@ -119,27 +252,40 @@ func (s *FFS) ensure_connect() {
     s.socket = nil
   }
 
-  var err error
-  s.socket, err = context.NewSocket(s.SocketType)
-  if err != nil {
-    log.Panicf("zmq.NewSocket(%d) failed: %s\n", s.SocketType, err)
+  s.log.Interval = s.LogInterval
+  if s.Identity == "" {
+    s.Identity = default_identity()
+  }
+  if s.Prewarm {
+    s.warm_all()
   }
-
-  //s.socket.SetSockOptUInt64(zmq.HWM, 1)
-  //s.socket.SetSockOptInt(zmq.RCVTIMEO, int(s.RecvTimeout.Nanoseconds() / 1000000))
-  //s.socket.SetSockOptInt(zmq.SNDTIMEO, int(s.SendTimeout.Nanoseconds() / 1000000))
-
-  // Abort anything in-flight on a socket that's closed.
-  s.socket.SetSockOptInt(zmq.LINGER, 0)
 
   for !s.connected {
-    var max *big.Int = big.NewInt(int64(len(s.Endpoints)))
-    i, _ := rand.Int(rand.Reader, max)
-    s.endpoint = s.Endpoints[i.Int64()]
-    log.Printf("Connecting to %s\n", s.endpoint)
-    err := s.socket.Connect(s.endpoint)
+    s.count_reconnect()
+    endpoint := s.choose_endpoint()
+    s.latency_lock.Lock()
+    s.endpoint = endpoint
+    s.latency_lock.Unlock()
+
+    if socket, warm := s.take_warm(endpoint); warm {
+      s.log.Printf("Using warm connection to %s\n", s.endpoint)
+      s.socket = socket
+      s.connected = true
+      break
+    }
+
+    if s.socket == nil {
+      s.socket = s.new_zmq_socket()
+    }
+    s.log.Printf("Connecting to %s\n", s.endpoint)
+    address, err := s.connect_address(s.endpoint)
+    if err == nil {
+      err = s.socket.Connect(address)
+    }
     if err != nil {
-      log.Printf("%s: Error connecting: %s\n", s.endpoint, err)
+      s.log.Printf("%s: Error connecting: %s\n", s.endpoint, err)
+      ReportError(ERR_CONNECT_FAILED, "Failed connecting to " + s.endpoint,
+                  map[string]interface{}{"endpoint": s.endpoint, "error": err.Error()})
       time.Sleep(500 * time.Millisecond)
       continue
     }
@@ -149,84 +295,701 @@ func (s *FFS) ensure_connect() {
   }
 }
 
+// A new zmq socket, not yet connected.
+func (s *FFS) new_zmq_socket() *zmq.Socket {
+  socket, err := context.NewSocket(s.SocketType)
+  if err != nil {
+    log.Panicf("zmq.NewSocket(%d) failed: %s\n", s.SocketType, err)
+  }
+
+  //socket.SetSockOptUInt64(zmq.HWM, 1)
+  //socket.SetSockOptInt(zmq.RCVTIMEO, int(s.RecvTimeout.Nanoseconds() / 1000000))
+  //socket.SetSockOptInt(zmq.SNDTIMEO, int(s.SendTimeout.Nanoseconds() / 1000000))
+
+  // Abort anything in-flight on a socket that's closed; Shutdown sets
+  // Linger instead.
+  socket.SetSockOptInt(zmq.LINGER, 0)
+  if s.Immediate {
+    socket.SetSockOptInt(zmq.DELAY_ATTACH_ON_CONNECT, 1)
+  }
+
+  err = socket.SetSockOptString(zmq.IDENTITY, s.Identity)
+  if err != nil {
+    log.Printf("Failed to set zmq identity to %s: %s\n", s.Identity, err)
+  }
+  return socket
+}
+
+// Close the socket, giving unsent messages up to Linger to go out.
+func (s *FFS) Shutdown() {
+  if s.health_quit != nil {
+    close(s.health_quit)
+    s.health_quit = nil
+  }
+  s.close_warm()
+  if s.socket == nil {
+    return
+  }
+  s.socket.SetSockOptInt(zmq.LINGER, int(s.Linger / time.Millisecond))
+  s.Close()
+}
+
 func (s *FFS) fail_socket() {
   if !s.connected {
     return
   }
+  s.poll_timeouts = 0
   s.Close()
 }
 
+type Publisher struct {
+  Servers []string // endpoints to ship to
+  PublicKey [sodium.PUBLICKEYBYTES]byte // the server's public key
+  SecretKey [sodium.SECRETKEYBYTES]byte // our secret key
+  Timeout time.Duration // how long to wait on a server before trying another
+
+  // If MaxAttempts is nonzero, a batch that fails to send this many times is
+  // given up on. It is appended to the DeadLetter file, if set, so it can be
+  // replayed later; otherwise it is dropped.
+  MaxAttempts int
+  DeadLetter string
+
+  // Connect at startup rather than when the first batch is ready. While
+  // connecting, events keep accumulating in the spooler.
+  Preconnect bool
+
+  // How to pick among Servers; see FFS.Strategy.
+  Strategy EndpointStrategy
+
+  // See FFS.Identity
+  Identity string
+
+  // See FFS.PollRetries
+  SendPollRetries int
+
+  // See FFS.Linger and FFS.Immediate
+  Linger time.Duration
+  Immediate bool
+
+  // See FFS.SourcePortMin
+  SourcePortMin int
+  SourcePortMax int
+
+  // See FFS.LogInterval
+  ConnectLogInterval time.Duration
+
+  // See FFS.ReconnectAlert. With AlertHook, the post-ship hook is told of
+  // outages and recoveries too.
+  ReconnectAlert int
+  AlertHook bool
+
+  // See FFS.Prewarm
+  Prewarm bool
+
+  // See FFS.HealthInterval
+  HealthInterval time.Duration
+
+  // Optional; pause harvesting while Servers and the required and routed
+  // pools are slow to acknowledge batches. See congestion.go.
+  LatencyLimit *LatencyLimit
+
+  // Optional; batches acknowledged later than this after their oldest event
+  // was harvested are logged as violations. See Spooler.MaxEventAge.
+  MaxEventAge time.Duration
+
+  // Optional; a command (run with sh -c) or http(s) url to send a JSON
+  // summary of each acknowledged batch to. See hook.go.
+  PostShipHook string
+  PostShipHookTimeout time.Duration
+
+  // "zlib" (the default), "gzip" or "zstd". Only servers that know
+  // CODEC_ZSTD can read zstd payloads, and it needs the zstd build tag; see
+  // ZstdAvailable. gzip is for archival collectors; see CODEC_GZIP.
+  // "none" ships the json as is, for when the network already compresses
+  // (a compressing VPN or tunnel, say).
+  Compression string
+
+  // Optional; adjusts the zlib or gzip level to the CPU compression takes.
+  // See leveltuner.go.
+  Levels *LevelTuner
+
+  // Decompress each payload after compressing it, and give up on the batch
+  // (as if it couldn't be sent) if that doesn't give back what was
+  // compressed; a guard against compressor bugs or memory corruption, for
+  // the cpu it takes.
+  VerifyCompression bool
+
+  // Put a size header in each payload, so the server can allocate for the
+  // decompressed batch up front and catch one that doesn't decompress to
+  // the size it should; see FORMAT_SIZED.
+  SizeHeader bool
+
+  // Batches whose json is smaller than this are shipped uncompressed,
+  // which is cheaper than compressing to find out it didn't help. Not with
+  // gzip compression, whose payloads are always gzip; see CODEC_GZIP.
+  CompressMinBytes int
+
+  // Batches that compression shrinks by less than this percentage are
+  // shipped uncompressed, so servers needn't decompress a batch for the
+  // few bytes it saved; tiny and incompressible batches alike. At 0, the
+  // default, only batches compression didn't shrink at all are. Not with
+  // gzip compression, as for CompressMinBytes.
+  MinCompressionGain float64
+
+  // "" for FileEvents, or "gelf" for GELF messages; see gelf.go.
+  OutputFormat string
+
+  // "json" (the default) or "protobuf", for FileEvents; see protobuf.go.
+  // GELF messages are always json.
+  Serialization string
+
+  // If more than 1, encode batches on this many goroutines at once; see
+  // compress.go.
+  CompressWorkers int
+
+  // Compress into buffers, with writers, shared by every encoder rather
+  // than allocated for each batch; see bufpool.go.
+  ReuseBuffers bool
+
+  // ORDERING_STRICT (the default) or ORDERING_RELAXED, whether batches
+  // encoded by CompressWorkers must still ship in order; see compress.go.
+  Ordering string
+
+  // Optional; where to write the time each stage of shipping a batch took.
+  // See trace.go.
+  Trace io.Writer
+
+  // Optional; more pools of servers to ship every batch to. See fanout.go.
+  Pools []Pool
+
+  // Optional; the field (a dotted path into Fields) whose value routes each
+  // event to one of Pools, by its Route. See routing.go.
+  RouteField string
+
+  // Optional; where to remember the ids of acknowledged events, so the
+  // spooler can drop them if they are harvested again after a restart. See
+  // seencache.go.
+  Seen *SeenCache
+
+  // Optional; a local NDJSON copy of every batch. See filesink.go. With a
+  // FileSink, Servers may be empty, to only write the file.
+  FileSink *FileSink
+
+  // Optional; called with each batch before it is serialized, to enrich,
+  // filter or otherwise change its events. The batch shipped is the one
+  // returned; if that is empty, nothing is shipped. With CompressWorkers
+  // above 1 it may be called for several batches at once.
+  Transform func(events []*FileEvent) []*FileEvent
+
+  socket *FFS // the socket for Servers
+  required []*FFS // Servers and each required pool
+  best_effort_sockets []*FFS
+  best_effort []chan *payload
+  best_effort_running sync.WaitGroup // ship_best_effort goroutines still draining their queues
+  routes map[string]*FFS // RouteField value -> its pool's socket
+  sessions map[*FFS]*sodium.Session // for the pools with keys of their own
+  routed_sockets []*FFS
+  hooks chan *ship_summary
+  payload_size size_hint // of recent payloads, to preallocate the next
+  ready chan struct{} // if set, closed once Publish is about to take batches
+}
+
 func Publish(input chan []*FileEvent,
              registrar chan []*FileEvent,
              server_list []string,
              public_key [sodium.PUBLICKEYBYTES]byte,
              secret_key [sodium.SECRETKEYBYTES]byte,
              server_timeout time.Duration) {
-  var buffer bytes.Buffer
-  session := sodium.NewSession(public_key, secret_key)
+  publisher := Publisher{
+    Servers: server_list,
+    PublicKey: public_key,
+    SecretKey: secret_key,
+    Timeout: server_timeout,
+  }
+  publisher.Publish(input, registrar)
+}
 
-  socket := FFS{
-    Endpoints:   server_list,
-    SocketType:  zmq.REQ,
-    RecvTimeout: server_timeout,
-    SendTimeout: server_timeout,
+// Publish ships each batch of events received, returning once input is
+// closed.
+func (p *Publisher) Publish(input chan []*FileEvent,
+                            registrar chan []*FileEvent) {
+  session := sodium.NewSession(p.PublicKey, p.SecretKey)
+
+  if len(p.Servers) > 0 {
+    p.socket = p.new_socket(p.Servers)
+    p.required = []*FFS{p.socket}
+  }
+  for _, pool := range p.Pools {
+    if len(pool.Route) > 0 {
+      continue // see start_routes
+    } else if pool.BestEffort {
+      queue := make(chan *payload, best_effort_queue)
+      p.best_effort_sockets = append(p.best_effort_sockets, p.pool_socket(pool))
+      p.best_effort = append(p.best_effort, queue)
+      p.best_effort_running.Add(1)
+      go p.ship_best_effort(p.best_effort_sockets[len(p.best_effort) - 1], queue)
+    } else {
+      p.required = append(p.required, p.pool_socket(pool))
+    }
+  }
+  if p.RouteField != "" {
+    p.start_routes()
+    input = p.split_routes(input)
+  }
+  defer func() {
+    for _, socket := range append(p.required, p.routed_sockets...) {
+      socket.Shutdown()
+    }
+    for _, queue := range p.best_effort {
+      close(queue)
+    }
+  }()
+
+  if len(p.Pools) == 0 && p.socket != nil {
+    RegisterStatus("publisher", p.socket.Status)
+  } else {
+    RegisterStatus("publisher", p.pools_status)
+  }
+
+  if p.PostShipHook != "" {
+    p.start_hooks()
+  }
+  if p.Levels != nil {
+    p.Levels.start()
+  }
+
+  if p.LatencyLimit != nil {
+    for _, socket := range append(append([]*FFS{}, p.required...), p.routed_sockets...) {
+      socket.Congestion = p.LatencyLimit
+    }
+  }
+
+  all_sockets := append(append([]*FFS{}, p.required...), p.best_effort_sockets...)
+  all_sockets = append(all_sockets, p.routed_sockets...)
+  if p.Preconnect || p.Prewarm {
+    for _, socket := range all_sockets {
+      socket.ensure_connect()
+    }
+  }
+
+  if p.HealthInterval > 0 {
+    for _, socket := range all_sockets {
+      session := p.session_for(socket, session)
+      socket.ping = func() ([]byte, []byte) {
+        // An empty batch, as an uncompressed json array.
+        ciphertext, nonce := session.Box([]byte{CODEC_NONE, '[', ']'})
+        return nonce, ciphertext
+      }
+      socket.health_quit = make(chan bool)
+      go socket.check_health(socket.health_quit)
+    }
+  }
+
+  if p.ready != nil {
+    close(p.ready) // connected by now, with Preconnect
+  }
+  if p.CompressWorkers > 1 {
+    for batch := range p.encode_parallel(session, input) {
+      p.ship_batch(batch)
+    }
+  } else {
+    for events := range input {
+      p.ship_batch(p.encode(session, events))
+    }
   }
-  //defer socket.Close()
+} // Publish
+
+// A batch of events, ready to ship.
+type encoded_batch struct {
+  events []*FileEvent
+  data []byte // the json shipped
+  nonce []byte
+  ciphertext []byte
+  corrupt bool // failed VerifyCompression
+  timing *batch_timing // with Trace
+  plaintext []byte // the payload boxed, kept for pools with keys of their own
+  buffer *bytes.Buffer // holding plaintext, with ReuseBuffers; see bufpool.go
+}
 
-  for events := range input {
-    // got a bunch of events, ship them out.
-    //log.Printf("Publisher received %d events\n", len(events))
+// Serialize, compress and box a batch of events.
+func (p *Publisher) encode(session *sodium.Session, events []*FileEvent) *encoded_batch {
+  for _, event := range events {
+    if event == nil {
+      // Skip nils rather than ship a null to the server.
+      events = without_nils(events)
+      break
+    }
+  }
+  if len(events) == 0 {
+    return &encoded_batch{}
+  }
+
+  if len(events) == 1 && events[0].barrier != nil {
+    return &encoded_batch{events: events}
+  }
+
+  if p.Transform != nil {
+    count := len(events)
+    events = p.Transform(events)
+    dropped("transform", count - len(events))
+    if len(events) == 0 {
+      return &encoded_batch{}
+    }
+  }
+
+  // got a bunch of events, ship them out.
+  //log.Printf("Publisher received %d events\n", len(events))
+
+  var timing *batch_timing
+  var stage_start time.Time
+  if p.Trace != nil {
+    timing = &batch_timing{Events: len(events)}
+    stage_start = time.Now()
+  }
 
-    data, _ := json.Marshal(events)
-    // TODO(sissel): check error
+  var data []byte
+  var format byte
+  if p.OutputFormat == "gelf" {
+    data, _ = json.Marshal(gelf_messages(events))
+  } else if p.Serialization == "protobuf" {
+    data = marshal_protobuf(events)
+    format = FORMAT_PROTOBUF
+  } else {
+    data, _ = json.Marshal(events)
+  }
+  // TODO(sissel): check error
+  if timing != nil {
+    timing.MarshalMs = milliseconds(time.Since(stage_start))
+    timing.RawBytes = len(data)
+  }
 
-    // Compress it
+  // Compress it, into a buffer sized from recent payloads so it needn't
+  // grow along the way.
+  buffer := p.new_buffer()
+  buffer.Grow(p.payload_size.size() + 1)
+  var header []byte
+  if p.SizeHeader {
+    format |= FORMAT_SIZED
+    header = size_header(len(data), len(events))
+  }
+  compress_start := time.Now()
+  gzipped := p.Compression == "gzip" // always; see CODEC_GZIP
+  if p.Compression == "none" || (len(data) < p.CompressMinBytes && !gzipped) {
+    // Compression is left to the transport, which can't do better with
+    // already-compressed data; or the batch is too small to be worth it.
+    if p.Compression != "none" {
+      batches_uncompressed.Add("small", 1)
+    }
+    buffer.WriteByte(CODEC_NONE | format)
+    buffer.Write(header)
+    buffer.Write(data)
+  } else if gzipped {
+    // A complete member per payload; see CODEC_GZIP.
+    buffer.WriteByte(CODEC_GZIP | format)
+    buffer.Write(header)
+    level := p.level() // once: the tuner may change it meanwhile
+    compressor := gzip_writer(buffer, level, p.ReuseBuffers)
+    compressor.Write(data)
+    compressor.Close()
+    if p.ReuseBuffers {
+      gzip_writers[level - gzip.HuffmanOnly].Put(compressor)
+    }
+  } else if p.Compression == "zstd" {
+    // Each payload is a complete zstd frame, so it can be decompressed
+    // alone.
+    buffer.WriteByte(CODEC_ZSTD | format)
+    buffer.Write(header)
+    buffer.Write(zstd_encode(data))
+  } else {
     // A new zlib writer  is used for every payload of events so that any
     // individual payload can be decompressed alone.
-    // TODO(sissel): Make compression level tunable
-    compressor, _ := zlib.NewWriterLevel(&buffer, 3)
+    buffer.WriteByte(CODEC_ZLIB | format)
+    buffer.Write(header)
+    zlib_encode(buffer, data, p.level(), p.ReuseBuffers)
+  }
+  if p.Levels != nil {
+    p.Levels.record(time.Since(compress_start))
+  }
+  overhead := 1 + len(header) // the codec byte and size header
+
+  // Compression must never make a payload bigger; if it didn't help, or
+  // not by MinCompressionGain, ship the raw events instead. But for gzip,
+  // whose collectors rely on every payload being a gzip member.
+  compressed := buffer.Bytes()[0] != CODEC_NONE | format
+  gain := 100 * (1 - float64(buffer.Len() - overhead) / float64(len(data)))
+  if compressed {
+    batch_compression_gain.Observe(gain)
+  }
+  if compressed && !gzipped &&
+     (buffer.Len() - overhead >= len(data) || gain < p.MinCompressionGain) {
+    batches_uncompressed.Add("low_gain", 1)
     buffer.Truncate(0)
-    _, err := compressor.Write(data)
-    err = compressor.Flush()
-    compressor.Close()
+    buffer.WriteByte(CODEC_NONE | format)
+    buffer.Write(header)
+    buffer.Write(data)
+  }
 
-    //log.Printf("compressed %d bytes\n", buffer.Len())
-    // TODO(sissel): check err
-    // TODO(sissel): implement security/encryption/etc
-
-    // Send full payload over zeromq REQ/REP
-    // TODO(sissel): check error
-    //buffer.Write(data)
-    ciphertext, nonce := session.Box(buffer.Bytes())
-
-    //log.Printf("plaintext: %d\n", len(data))
-    //log.Printf("compressed: %d\n", buffer.Len())
-    //log.Printf("ciphertext: %d %v\n", len(ciphertext), ciphertext[:20])
-    //log.Printf("nonce: %d\n", len(nonce))
-
-    // TODO(sissel): figure out encoding for ciphertext + nonce
-    // TODO(sissel): figure out encoding for ciphertext + nonce
-
-    // Loop forever trying to send.
-    // This will cause reconnects/etc on failures automatically
-    for {
-      err = socket.Send(nonce, zmq.SNDMORE)
-      if err != nil {
-        continue // send failed, retry!
-      }
-      err = socket.Send(ciphertext, 0)
-      if err != nil {
-        continue // send failed, retry!
-      }
+  if timing != nil {
+    timing.CompressMs = milliseconds(time.Since(compress_start))
+    timing.CompressedBytes = buffer.Len()
+  }
 
-      data, err = socket.Recv(0)
-      // TODO(sissel): Figure out acknowledgement protocol? If any?
-      if err == nil {
-        break // success!
-      }
+  p.payload_size.observe(buffer.Len())
+  batch_events.Observe(float64(len(events)))
+  batch_raw_bytes.Observe(float64(len(data)))
+  batch_compressed_bytes.Observe(float64(buffer.Len() - overhead))
+  if buffer.Len() > overhead {
+    batch_compression_ratio.Observe(float64(len(data)) / float64(buffer.Len() - overhead))
+  }
+
+  if p.VerifyCompression {
+    if decoded, err := DecodePayload(buffer.Bytes()); err != nil || !bytes.Equal(decoded, data) {
+      log.Printf("Compressed batch of %d events does not decompress to what was compressed (%v); not shipping it\n",
+                 len(events), err)
+      return &encoded_batch{events: events, data: data, corrupt: true, timing: timing,
+                            buffer: buffer}
     }
+  }
 
-    // Tell the registrar that we've successfully sent these events
-    //registrar <- events
-  } /* for each event payload */
-} // Publish
+  //log.Printf("compressed %d bytes\n", buffer.Len())
+  // TODO(sissel): check err
+  // TODO(sissel): implement security/encryption/etc
+
+  // Send full payload over zeromq REQ/REP
+  // TODO(sissel): check error
+  //buffer.Write(data)
+  if timing != nil {
+    stage_start = time.Now()
+  }
+  ciphertext, nonce := session.Box(buffer.Bytes())
+  if timing != nil {
+    timing.EncryptMs = milliseconds(time.Since(stage_start))
+    timing.CiphertextBytes = len(ciphertext)
+  }
+
+  //log.Printf("plaintext: %d\n", len(data))
+  //log.Printf("compressed: %d\n", buffer.Len())
+  //log.Printf("ciphertext: %d %v\n", len(ciphertext), ciphertext[:20])
+  //log.Printf("nonce: %d\n", len(nonce))
+
+  // TODO(sissel): figure out encoding for ciphertext + nonce
+  // TODO(sissel): figure out encoding for ciphertext + nonce
+  batch := &encoded_batch{events: events, data: data, nonce: nonce, ciphertext: ciphertext,
+                          timing: timing, buffer: buffer}
+  if len(p.sessions) > 0 {
+    batch.plaintext = buffer.Bytes()
+  }
+  return batch
+} // encode
+
+// A copy of events without any nil elements, which are counted as dropped.
+func without_nils(events []*FileEvent) []*FileEvent {
+  kept := make([]*FileEvent, 0, len(events))
+  for _, event := range events {
+    if event != nil {
+      kept = append(kept, event)
+    }
+  }
+  dropped("empty", len(events) - len(kept))
+  return kept
+}
+
+// Ship an encoded batch, and handle its acknowledgement.
+func (p *Publisher) ship_batch(batch *encoded_batch) {
+  defer p.release(batch)
+  events := batch.events
+  if len(events) == 1 && events[0].barrier != nil {
+    // Everything before the barrier has been handled.
+    close(events[0].barrier)
+    return
+  }
+  if len(events) == 0 {
+    return // nothing left to ship, after Transform or dropping nils
+  }
+
+  data := batch.data
+  if p.OutputFormat == "gelf" || p.Serialization == "protobuf" {
+    // Dead letter files are always replayable json FileEvents.
+    data, _ = json.Marshal(events)
+  }
+  if batch.corrupt {
+    if batch.timing != nil {
+      p.trace(batch.timing)
+    }
+    p.give_up(data, len(events), "corrupt")
+    return
+  }
+
+  sunk := true
+  if p.FileSink != nil {
+    if err := p.FileSink.write(events); err != nil {
+      log.Printf("Failed writing %d events to file sink %s: %s\n", len(events), p.FileSink.Path, err)
+      ReportError(ERR_FILE_SINK_FAILED, "Failed writing to file sink " + p.FileSink.Path,
+                  map[string]interface{}{"path": p.FileSink.Path, "events": len(events),
+                                         "error": err.Error()})
+      sunk = false
+    }
+  }
+
+  pool := p.routed(events)
+  if pool == nil && p.routes != nil && p.unrouted_dropped() {
+    if batch.timing != nil {
+      p.trace(batch.timing)
+    }
+    p.give_up(data, len(events), "unrouted")
+    return
+  }
+
+  var acked bool
+  send_start := time.Now()
+  if pool != nil {
+    nonce, ciphertext := p.boxed_for(pool, batch)
+    acked = p.ship(pool, nonce, ciphertext)
+  } else {
+    acked = p.ship_all(batch)
+  }
+  if batch.timing != nil {
+    batch.timing.SendMs = milliseconds(time.Since(send_start))
+    batch.timing.Acked = acked
+    p.trace(batch.timing)
+  }
+  if !acked {
+    // A batch missing from any required pool is given up on entirely; a
+    // replay of it ships it to every pool again.
+    p.give_up(data, len(events), "send_failed")
+    return
+  }
+
+  if !sunk && p.FileSink.Required {
+    log.Printf("Not acknowledging %d events missing from the file sink\n", len(events))
+    return
+  }
+  batches_shipped.Inc()
+  events_shipped.Add(uint64(len(events)))
+  bytes_shipped.Add(uint64(len(batch.ciphertext)))
+
+  if p.MaxEventAge > 0 {
+    p.check_event_age(events)
+  }
+  if p.Seen != nil {
+    p.Seen.record(events)
+  }
+  if p.hooks != nil {
+    p.post_ship(events, len(batch.ciphertext))
+  }
+
+  // Tell the registrar that we've successfully sent these events
+  //registrar <- events
+} // ship_batch
+
+func (p *Publisher) new_socket(servers []string) *FFS {
+  return &FFS{
+    Endpoints:   servers,
+    SocketType:  zmq.REQ,
+    RecvTimeout: p.Timeout,
+    SendTimeout: p.Timeout,
+    Strategy:    p.Strategy,
+    Identity:    p.Identity,
+    PollRetries: p.SendPollRetries,
+    Linger:      p.Linger,
+    Immediate:   p.Immediate,
+    LogInterval: p.ConnectLogInterval,
+    Prewarm:     p.Prewarm,
+    HealthInterval: p.HealthInterval,
+    ReconnectAlert: p.ReconnectAlert,
+    OnOutage:    p.on_outage,
+    SourcePortMin: p.SourcePortMin,
+    SourcePortMax: p.SourcePortMax,
+  }
+}
+
+// The zlib or gzip compression level to use.
+func (p *Publisher) level() int {
+  if p.Levels != nil {
+    return p.Levels.Level()
+  }
+  return default_compression_level
+}
+
+// Send a payload on the socket, returning whether it was acknowledged.
+// Loop forever (or until MaxAttempts) trying to send. This will cause
+// reconnects/etc on failures automatically.
+func (p *Publisher) ship(socket *FFS, nonce []byte, ciphertext []byte) bool {
+  for attempt := 1; p.MaxAttempts == 0 || attempt <= p.MaxAttempts; attempt++ {
+    err := socket.Send(nonce, zmq.SNDMORE)
+    if err != nil {
+      send_failures.Inc()
+      continue // send failed, retry!
+    }
+    err = socket.Send(ciphertext, 0)
+    if err != nil {
+      // The nonce went out on a socket that has since failed; send both
+      // again, so the server never sees a ciphertext without its nonce.
+      send_failures.Inc()
+      continue
+    }
+
+    _, err = socket.Recv(0)
+    // TODO(sissel): Figure out acknowledgement protocol? If any?
+    if err == nil {
+      return true // success!
+    }
+    send_failures.Inc()
+  }
+  return false
+}
+
+// Called when a batch could not be sent within MaxAttempts ("send_failed"),
+// or failed VerifyCompression ("corrupt").
+func (p *Publisher) give_up(data []byte, count int, reason string) {
+  why := fmt.Sprintf("after %d failed send attempts", p.MaxAttempts)
+  if reason == "corrupt" {
+    why = "as its payload failed verification"
+  } else if reason == "unrouted" {
+    why = "as no pool takes them"
+  }
+
+  if p.DeadLetter == "" {
+    log.Printf("Dropping %d events %s\n", count, why)
+    ReportError(ERR_BATCH_DROPPED, fmt.Sprintf("Dropped %d events %s", count, why),
+                map[string]interface{}{"events": count, "reason": reason})
+    dropped(reason, count)
+    return
+  }
+
+  log.Printf("Writing %d events to dead letter file %s %s\n",
+             count, p.DeadLetter, why)
+  err := write_dead_letter(p.DeadLetter, data)
+  if err != nil {
+    log.Printf("Failed writing to dead letter file %s, dropping %d events: %s\n",
+               p.DeadLetter, count, err)
+    ReportError(ERR_BATCH_DROPPED, fmt.Sprintf("Dropped %d events %s", count, why),
+                map[string]interface{}{"events": count, "reason": reason,
+                                       "dead_letter": p.DeadLetter, "error": err.Error()})
+    dropped(reason, count)
+  } else {
+    ReportError(ERR_DEAD_LETTER, fmt.Sprintf("Wrote %d events to the dead letter file %s", count, why),
+                map[string]interface{}{"events": count, "reason": reason,
+                                       "dead_letter": p.DeadLetter})
+  }
+}
+
+// Log an SLA violation if any event in the batch took longer than
+// MaxEventAge to ship.
+func (p *Publisher) check_event_age(events []*FileEvent) {
+  var oldest time.Time
+  for _, event := range events {
+    if !event.harvested.IsZero() && (oldest.IsZero() || event.harvested.Before(oldest)) {
+      oldest = event.harvested
+    }
+  }
+  if oldest.IsZero() {
+    return // replayed events carry no harvest time
+  }
+
+  if age := time.Since(oldest); age > p.MaxEventAge {
+    event_age_violations.Inc()
+    log.Printf("SLA violation: shipped %d events %s after harvest, exceeding -max-event-age %s\n",
+               len(events), age, p.MaxEventAge)
+  }
+}
@@ -0,0 +1,1257 @@
+package liblumberjack
+
+import "bytes"
+import "compress/gzip"
+import "encoding/base64"
+import "encoding/json"
+import "io/ioutil"
+import "log"
+import "math/rand"
+import "os"
+import "path/filepath"
+import "reflect"
+import "sodium"
+import "sync/atomic"
+import "syscall"
+import zmq "github.com/alecthomas/gozmq"
+import "testing"
+import "time"
+
+// A stub server that acknowledges and decodes each payload it receives,
+// sending the decoded events on output.
+func stub_server(t *testing.T, endpoint string, session *sodium.Session,
+                 output chan []*FileEvent) *zmq.Socket {
+  return stub_server_payloads(t, endpoint, session, output, nil)
+}
+
+// Like stub_server, also sending each payload's plaintext on plaintexts,
+// if not nil.
+func stub_server_payloads(t *testing.T, endpoint string, session *sodium.Session,
+                          output chan []*FileEvent, plaintexts chan []byte) *zmq.Socket {
+  socket, err := context.NewSocket(zmq.REP)
+  if err != nil {
+    t.Fatalf("NewSocket failed: %s", err)
+  }
+  socket.SetSockOptInt(zmq.LINGER, 0)
+  err = socket.Bind(endpoint)
+  if err != nil {
+    t.Fatalf("Failed to bind to %s: %s", endpoint, err)
+  }
+
+  go func() {
+    for {
+      nonce, err := socket.Recv(0)
+      if err != nil {
+        return
+      }
+      ciphertext, err := socket.Recv(0)
+      if err != nil {
+        return
+      }
+      socket.Send([]byte(""), 0)
+
+      plaintext := session.Open(nonce, ciphertext)
+      if plaintexts != nil {
+        plaintexts <- plaintext
+      }
+      events, err := DecodeEvents(plaintext)
+      if err != nil {
+        t.Errorf("Failed to decode payload: %s", err)
+        return
+      }
+      output <- events
+    }
+  }()
+  return socket
+}
+
+func test_batch() []*FileEvent {
+  source := "/var/log/test"
+  var events []*FileEvent
+  for i, line := range []string{"hello", "world", "again"} {
+    text := line
+    events = append(events, &FileEvent{Source: &source, Offset: uint64(i * 6),
+                                       Line: uint64(i + 1), Text: &text})
+  }
+  return events
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  dead_letter := filepath.Join(dir, "dead-letter")
+
+  endpoint := "tcp://127.0.0.1:47351"
+  public, secret := sodium.CryptoBoxKeypair()
+
+  // Nothing is listening yet, so the batch is given up on.
+  publisher := Publisher{
+    Servers: []string{endpoint},
+    PublicKey: public,
+    SecretKey: secret,
+    Timeout: 100 * time.Millisecond,
+    MaxAttempts: 2,
+    DeadLetter: dead_letter,
+  }
+  input := make(chan []*FileEvent, 1)
+  input <- test_batch()
+  close(input)
+  publisher.Publish(input, nil)
+
+  // Now replay it to a server.
+  received := make(chan []*FileEvent, 1)
+  server := stub_server(t, endpoint, sodium.NewSession(public, secret), received)
+  defer server.Close()
+
+  input = make(chan []*FileEvent, 1)
+  err := Replay(dead_letter, input)
+  if err != nil {
+    t.Fatalf("Replay(%s) failed: %s", dead_letter, err)
+  }
+  close(input)
+  publisher.Publish(input, nil)
+
+  expected, _ := json.Marshal(test_batch())
+  actual, _ := json.Marshal(<-received)
+  if !bytes.Equal(expected, actual) {
+    t.Fatalf("Replayed batch differs.\nexpected: %s\nactual:   %s", expected, actual)
+  }
+}
+
+func TestPreconnect(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47352"
+  public, secret := sodium.CryptoBoxKeypair()
+
+  received := make(chan []*FileEvent, 1)
+  server := stub_server(t, endpoint, sodium.NewSession(public, secret), received)
+  defer server.Close()
+
+  for _, preconnect := range []bool{false, true} {
+    publisher := Publisher{
+      Servers: []string{endpoint},
+      PublicKey: public,
+      SecretKey: secret,
+      Timeout: time.Second,
+      Preconnect: preconnect,
+    }
+
+    // No batches at all; only a preconnecting publisher should connect.
+    input := make(chan []*FileEvent)
+    close(input)
+    publisher.Publish(input, nil)
+
+    // Shut down by now, so see whether it ever tried.
+    if connected := publisher.socket.reconnects > 0; connected != preconnect {
+      t.Fatalf("Preconnect: %v, but connected: %v", preconnect, connected)
+    }
+  }
+}
+
+func TestPreconnectReady(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47392"
+  public, secret := sodium.CryptoBoxKeypair()
+
+  received := make(chan []*FileEvent, 1)
+  server := stub_server(t, endpoint, sodium.NewSession(public, secret), received)
+  defer server.Close()
+
+  for _, preconnect := range []bool{false, true} {
+    publisher := Publisher{
+      Servers: []string{endpoint},
+      PublicKey: public,
+      SecretKey: secret,
+      Timeout: time.Second,
+      Preconnect: preconnect,
+      ready: make(chan struct{}),
+    }
+
+    // Connected, or not, while still waiting for the first batch.
+    input := make(chan []*FileEvent)
+    done := make(chan bool)
+    go func() {
+      publisher.Publish(input, nil)
+      close(done)
+    }()
+    <-publisher.ready
+    connected := publisher.socket.connected
+    close(input)
+    <-done
+    if connected != preconnect {
+      t.Fatalf("Preconnect: %v, but connected: %v", preconnect, connected)
+    }
+  }
+}
+
+// A stub server that acknowledges each two-frame request after the given
+// delay, counting the requests it handled.
+func ack_server(t *testing.T, endpoint string, delay time.Duration,
+                count *int32) *zmq.Socket {
+  socket, _ := context.NewSocket(zmq.REP)
+  socket.SetSockOptInt(zmq.LINGER, 0)
+  err := socket.Bind(endpoint)
+  if err != nil {
+    t.Fatalf("Failed to bind to %s: %s", endpoint, err)
+  }
+
+  go func() {
+    for {
+      _, err := socket.Recv(0)
+      if err != nil {
+        return
+      }
+      socket.Recv(0)
+      time.Sleep(delay)
+      atomic.AddInt32(count, 1)
+      socket.Send([]byte(""), 0)
+    }
+  }()
+  return socket
+}
+
+func TestLatencyAwareSelection(t *testing.T) {
+  fast, slow := "tcp://127.0.0.1:47353", "tcp://127.0.0.1:47354"
+  var fast_count, slow_count int32
+  defer ack_server(t, fast, 0, &fast_count).Close()
+  defer ack_server(t, slow, 20 * time.Millisecond, &slow_count).Close()
+
+  socket := FFS{
+    Endpoints: []string{fast, slow},
+    SocketType: zmq.REQ,
+    Strategy: LatencyAware,
+    Reselect: 3,
+  }
+  for i := 0; i < 90; i++ {
+    socket.Send([]byte("nonce"), zmq.SNDMORE)
+    socket.Send([]byte("payload"), 0)
+    socket.Recv(0)
+  }
+
+  fast_acks, slow_acks := atomic.LoadInt32(&fast_count), atomic.LoadInt32(&slow_count)
+  if fast_acks < 2 * slow_acks {
+    t.Fatalf("Expected the fast endpoint to get most requests; fast: %d, slow: %d",
+             fast_acks, slow_acks)
+  }
+  if slow_acks == 0 {
+    t.Fatal("The slow endpoint was never probed")
+  }
+}
+
+func TestTransientErrorsRetryInPlace(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47355"
+  var count int32
+  defer ack_server(t, endpoint, 0, &count).Close()
+
+  socket := FFS{Endpoints: []string{endpoint}, SocketType: zmq.REQ}
+  socket.ensure_connect()
+  original := socket.socket
+
+  // Interrupt the first poll, send and recv.
+  interrupted := map[string]bool{}
+  interrupt := func(operation string) bool {
+    if !interrupted[operation] {
+      interrupted[operation] = true
+      return true
+    }
+    return false
+  }
+  defer func(poll func([]zmq.PollItem, time.Duration) (int, error)) { zmq_poll = poll }(zmq_poll)
+  defer func(send func(*zmq.Socket, []byte, zmq.SendRecvOption) error) { socket_send = send }(socket_send)
+  defer func(recv func(*zmq.Socket, zmq.SendRecvOption) ([]byte, error)) { socket_recv = recv }(socket_recv)
+  poll := zmq_poll
+  zmq_poll = func(items []zmq.PollItem, timeout time.Duration) (int, error) {
+    if interrupt("poll") {
+      return 0, syscall.EINTR
+    }
+    return poll(items, timeout)
+  }
+  send := socket_send
+  socket_send = func(s *zmq.Socket, data []byte, flags zmq.SendRecvOption) error {
+    if interrupt("send") {
+      return syscall.EINTR
+    }
+    return send(s, data, flags)
+  }
+  recv := socket_recv
+  socket_recv = func(s *zmq.Socket, flags zmq.SendRecvOption) ([]byte, error) {
+    if interrupt("recv") {
+      return nil, syscall.EAGAIN
+    }
+    return recv(s, flags)
+  }
+
+  socket.Send([]byte("nonce"), zmq.SNDMORE)
+  socket.Send([]byte("payload"), 0)
+  _, err := socket.Recv(0)
+  if err != nil {
+    t.Fatalf("Recv() failed: %s", err)
+  }
+
+  if len(interrupted) != 3 {
+    t.Fatalf("Expected poll, send and recv to be interrupted, got %v", interrupted)
+  }
+  if socket.socket != original || atomic.LoadInt32(&count) != 1 {
+    t.Fatal("The socket was reconnected after a transient error")
+  }
+}
+
+func TestIdentity(t *testing.T) {
+  socket := FFS{Endpoints: []string{"tcp://127.0.0.1:47356"}, SocketType: zmq.REQ}
+  socket.ensure_connect()
+
+  identity, _ := socket.socket.GetSockOptString(zmq.IDENTITY)
+  if identity == "" || identity != socket.Identity {
+    t.Fatalf("Expected the socket identity to be set, got %q", identity)
+  }
+
+  // Reconnecting must present the same identity.
+  socket.fail_socket()
+  socket.ensure_connect()
+  reconnected, _ := socket.socket.GetSockOptString(zmq.IDENTITY)
+  if reconnected != identity {
+    t.Fatalf("Identity changed across reconnect: %q -> %q", identity, reconnected)
+  }
+
+  socket = FFS{Endpoints: []string{"tcp://127.0.0.1:47356"}, SocketType: zmq.REQ,
+               Identity: "configured"}
+  socket.ensure_connect()
+  identity, _ = socket.socket.GetSockOptString(zmq.IDENTITY)
+  if identity != "configured" {
+    t.Fatalf("Expected the configured identity, got %q", identity)
+  }
+}
+
+func TestIncompressiblePayloadShippedRaw(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47357"
+  public, secret := sodium.CryptoBoxKeypair()
+  received := make(chan []*FileEvent, 3)
+  plaintexts := make(chan []byte, 3)
+  server := stub_server_payloads(t, endpoint, sodium.NewSession(public, secret),
+                                 received, plaintexts)
+  defer server.Close()
+
+  // Too short for zlib to make up for its own header and checksum.
+  source := "a"
+  text := "b"
+  incompressible := []*FileEvent{&FileEvent{Source: &source, Text: &text}}
+
+  publisher := Publisher{Servers: []string{endpoint}, PublicKey: public,
+                         SecretKey: secret, Timeout: time.Second}
+  input := make(chan []*FileEvent, 3)
+  input <- incompressible
+  input <- test_batch()
+  input <- test_batch()
+  close(input)
+  publisher.Publish(input, nil)
+
+  expected, _ := json.Marshal(incompressible)
+  plaintext := <-plaintexts
+  if plaintext[0] != CODEC_NONE || !bytes.Equal(plaintext[1:], expected) {
+    t.Fatalf("Expected an incompressible batch to be shipped raw, got codec %d", plaintext[0])
+  }
+
+  // A compressible batch is still compressed.
+  <-received
+  <-received
+  <-plaintexts
+  if plaintext = <-plaintexts; plaintext[0] != CODEC_ZLIB {
+    t.Fatalf("Expected a compressible batch to be compressed, got codec %d", plaintext[0])
+  }
+}
+
+func TestMinCompressionGain(t *testing.T) {
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  codec := func(publisher *Publisher, events []*FileEvent) byte {
+    batch := publisher.encode(session, events)
+    return session.Open(batch.nonce, batch.ciphertext)[0]
+  }
+
+  // Random bytes, base64 encoded, which zlib only gets back the unused
+  // bits of: a gain of about a quarter.
+  source := "/var/log/random"
+  random := rand.New(rand.NewSource(1))
+  var incompressible []*FileEvent
+  for i := 0; i < 64; i++ {
+    raw := make([]byte, 300)
+    random.Read(raw)
+    text := base64.StdEncoding.EncodeToString(raw)
+    incompressible = append(incompressible, &FileEvent{Source: &source, Text: &text})
+  }
+  tiny_text := "b"
+  tiny := []*FileEvent{&FileEvent{Source: &source, Text: &tiny_text}}
+
+  lax := &Publisher{}
+  strict := &Publisher{MinCompressionGain: 40}
+  before := batches_uncompressed.Value("low_gain")
+  cases := []struct {
+    name string
+    publisher *Publisher
+    events []*FileEvent
+    codec byte
+  }{
+    {"compressible", lax, large_batch(), CODEC_ZLIB},
+    {"compressible", strict, large_batch(), CODEC_ZLIB},
+    {"incompressible", lax, incompressible, CODEC_ZLIB},
+    {"incompressible", strict, incompressible, CODEC_NONE},
+    {"tiny", lax, tiny, CODEC_NONE},
+    {"tiny", strict, tiny, CODEC_NONE},
+  }
+  for _, c := range cases {
+    if got := codec(c.publisher, c.events); got != c.codec {
+      t.Fatalf("%s at a minimum gain of %v%%: expected codec %d, got %d",
+               c.name, c.publisher.MinCompressionGain, c.codec, got)
+    }
+  }
+  if shipped_raw := batches_uncompressed.Value("low_gain") - before; shipped_raw != 3 {
+    t.Fatalf("Expected 3 batches counted as gaining too little, got %d", shipped_raw)
+  }
+}
+
+func TestPostShipHook(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  summary_path := filepath.Join(dir, "summary")
+
+  endpoint := "tcp://127.0.0.1:47358"
+  public, secret := sodium.CryptoBoxKeypair()
+  received := make(chan []*FileEvent, 1)
+  defer stub_server(t, endpoint, sodium.NewSession(public, secret), received).Close()
+
+  publisher := Publisher{Servers: []string{endpoint}, PublicKey: public,
+                         SecretKey: secret, Timeout: time.Second,
+                         PostShipHook: "cat > " + summary_path}
+  input := make(chan []*FileEvent, 1)
+  input <- test_batch()
+  close(input)
+  publisher.Publish(input, nil)
+
+  var summary ship_summary
+  for start := time.Now(); time.Since(start) < 3 * time.Second; {
+    data, err := ioutil.ReadFile(summary_path)
+    if err == nil && json.Unmarshal(data, &summary) == nil {
+      break
+    }
+    time.Sleep(50 * time.Millisecond)
+  }
+
+  if summary.Events != 3 || summary.Bytes == 0 ||
+     len(summary.Files) != 1 || summary.Files[0] != "/var/log/test" {
+    t.Fatalf("Unexpected hook summary: %+v", summary)
+  }
+}
+
+// Publish one batch with the given pools, returning whether it was given
+// up on (written to the dead letter file).
+func publish_fanout(t *testing.T, servers []string, pools []Pool,
+                    public [sodium.PUBLICKEYBYTES]byte,
+                    secret [sodium.SECRETKEYBYTES]byte) bool {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  dead_letter := filepath.Join(dir, "dead-letter")
+
+  publisher := Publisher{Servers: servers, Pools: pools, PublicKey: public,
+                         SecretKey: secret, Timeout: 100 * time.Millisecond,
+                         MaxAttempts: 2, DeadLetter: dead_letter}
+  input := make(chan []*FileEvent, 1)
+  input <- test_batch()
+  close(input)
+  publisher.Publish(input, nil)
+  publisher.best_effort_running.Wait() // the pools' queues are closed by now
+
+  _, err := os.Stat(dead_letter)
+  return err == nil
+}
+
+func TestFanoutAllRequired(t *testing.T) {
+  primary, archive := "tcp://127.0.0.1:47359", "tcp://127.0.0.1:47360"
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  primary_received := make(chan []*FileEvent, 2)
+  defer stub_server(t, primary, session, primary_received).Close()
+
+  // The archive pool is down, so the batch is never acknowledged.
+  pools := []Pool{Pool{Servers: []string{archive}}}
+  if !publish_fanout(t, []string{primary}, pools, public, secret) {
+    t.Fatal("A batch was acknowledged without every required pool")
+  }
+  <-primary_received
+
+  archive_received := make(chan []*FileEvent, 1)
+  defer stub_server(t, archive, session, archive_received).Close()
+  if publish_fanout(t, []string{primary}, pools, public, secret) {
+    t.Fatal("A batch acknowledged by every required pool was given up on")
+  }
+  <-primary_received
+  <-archive_received
+}
+
+func TestFanoutBestEffort(t *testing.T) {
+  primary, down := "tcp://127.0.0.1:47361", "tcp://127.0.0.1:47362"
+  archive := "tcp://127.0.0.1:47363"
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  primary_received := make(chan []*FileEvent, 1)
+  defer stub_server(t, primary, session, primary_received).Close()
+  archive_received := make(chan []*FileEvent, 1)
+  defer stub_server(t, archive, session, archive_received).Close()
+
+  // A best-effort pool that is down doesn't hold up acknowledgement.
+  pools := []Pool{Pool{Servers: []string{down}, BestEffort: true},
+                  Pool{Servers: []string{archive}, BestEffort: true}}
+  if publish_fanout(t, []string{primary}, pools, public, secret) {
+    t.Fatal("A batch was given up on because of a best-effort pool")
+  }
+  <-primary_received
+
+  select {
+    case <- archive_received:
+    case <- time.After(3 * time.Second):
+      t.Fatal("The batch was not shipped to a best-effort pool")
+  }
+}
+
+func TestPollTimeoutsRetriedBeforeReconnect(t *testing.T) {
+  socket := FFS{Endpoints: []string{"tcp://127.0.0.1:47364"}, SocketType: zmq.REQ,
+                PollRetries: 2}
+  socket.ensure_connect()
+  original := socket.socket
+
+  defer func(poll func([]zmq.PollItem, time.Duration) (int, error)) { zmq_poll = poll }(zmq_poll)
+  defer func(send func(*zmq.Socket, []byte, zmq.SendRecvOption) error) { socket_send = send }(socket_send)
+  poll := zmq_poll
+  timeouts := 0
+  zmq_poll = func(items []zmq.PollItem, timeout time.Duration) (int, error) {
+    if timeouts > 0 {
+      timeouts--
+      return 0, nil
+    }
+    return poll(items, timeout)
+  }
+
+  // Up to PollRetries timeouts keep the socket.
+  timeouts = 2
+  socket.Send([]byte("payload"), 0)
+  if socket.socket != original {
+    t.Fatal("The socket was reconnected after a retried poll timeout")
+  }
+
+  // More than that fails it, and the send.
+  timeouts = 3
+  if err := socket.Send([]byte("payload"), 0); err != syscall.ETIMEDOUT {
+    t.Fatalf("Expected the send to time out, got %v", err)
+  }
+  if socket.connected {
+    t.Fatal("The socket was not failed after too many poll timeouts")
+  }
+
+  // A send error fails it right away.
+  socket.ensure_connect()
+  original = socket.socket
+  failed := false
+  send := socket_send
+  socket_send = func(s *zmq.Socket, data []byte, flags zmq.SendRecvOption) error {
+    if !failed {
+      failed = true
+      return syscall.ENOTCONN
+    }
+    return send(s, data, flags)
+  }
+  socket.Send([]byte("payload"), 0)
+  if socket.socket == original {
+    t.Fatal("The socket was not reconnected after a send error")
+  }
+}
+
+func TestImmediateWithoutServer(t *testing.T) {
+  // Nothing listening: with Immediate, the socket never becomes writable.
+  publisher := Publisher{Servers: []string{"tcp://127.0.0.1:47398"},
+                         Timeout: 50 * time.Millisecond, Immediate: true, MaxAttempts: 2}
+  socket := publisher.new_socket(publisher.Servers)
+  defer socket.Shutdown()
+
+  shipped := make(chan bool)
+  go func() {
+    shipped <- publisher.ship(socket, []byte("nonce"), []byte("ciphertext"))
+  }()
+  select {
+    case ok := <-shipped:
+      if ok {
+        t.Fatal("Expected the batch to fail with no server")
+      }
+    case <-time.After(3 * time.Second):
+      t.Fatal("Expected the batch given up on after MaxAttempts")
+  }
+}
+
+func TestBarrierWaitsForAcks(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47365"
+  var count int32
+  defer ack_server(t, endpoint, 200 * time.Millisecond, &count).Close()
+
+  public, secret := sodium.CryptoBoxKeypair()
+  input := make(chan *FileEvent, 16)
+  batches := make(chan []*FileEvent, 1)
+  spooler := Spooler{MaxSize: 2, IdleTimeout: time.Hour}
+  go spooler.Spool(input, batches)
+  publisher := Publisher{Servers: []string{endpoint}, PublicKey: public,
+                         SecretKey: secret, Timeout: time.Second}
+  published := make(chan bool)
+  go func() {
+    publisher.Publish(batches, nil)
+    close(published)
+  }()
+
+  // Two full batches and one partial one.
+  for i := 0; i < 5; i++ {
+    input <- spool_event("event", time.Now())
+  }
+  start := time.Now()
+  Barrier(input)
+
+  if acked := atomic.LoadInt32(&count); acked != 3 {
+    t.Fatalf("Barrier returned with %d of 3 batches acknowledged", acked)
+  }
+  if waited := time.Since(start); waited < 400 * time.Millisecond {
+    t.Fatalf("Barrier returned too soon (%s)", waited)
+  }
+
+  // Nothing is left spooled, so the spooler won't hand off another batch.
+  close(batches)
+  <-published
+}
+
+func TestTransportCompressionSkipsZlib(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47367"
+  public, secret := sodium.CryptoBoxKeypair()
+  received := make(chan []*FileEvent, 1)
+  plaintexts := make(chan []byte, 1)
+  defer stub_server_payloads(t, endpoint, sodium.NewSession(public, secret),
+                             received, plaintexts).Close()
+
+  publisher := Publisher{Servers: []string{endpoint}, PublicKey: public,
+                         SecretKey: secret, Timeout: time.Second,
+                         Compression: "none"}
+  input := make(chan []*FileEvent, 1)
+  input <- test_batch()
+  close(input)
+  publisher.Publish(input, nil)
+
+  expected, _ := json.Marshal(test_batch())
+  plaintext := <-plaintexts
+  if plaintext[0] != CODEC_NONE || !bytes.Equal(plaintext[1:], expected) {
+    t.Fatalf("Expected a compressible batch to be shipped raw, got codec %d", plaintext[0])
+  }
+  <-received
+}
+
+func TestLinger(t *testing.T) {
+  socket := FFS{Endpoints: []string{"tcp://127.0.0.1:47368"}, SocketType: zmq.REQ,
+                Linger: 2 * time.Second, Immediate: true}
+  socket.ensure_connect()
+  zsocket := socket.socket
+  if immediate, _ := zsocket.GetSockOptInt(zmq.DELAY_ATTACH_ON_CONNECT); immediate != 1 {
+    t.Fatal("Immediate was not set on the socket")
+  }
+
+  // Failing a socket drops anything unsent.
+  socket.fail_socket()
+  if linger, _ := zsocket.GetSockOptInt(zmq.LINGER); linger != 0 {
+    t.Fatalf("Expected a failed socket to close with linger 0, got %d", linger)
+  }
+
+  // Shutting down gives it time to go out.
+  socket.ensure_connect()
+  zsocket = socket.socket
+  socket.Shutdown()
+  if linger, _ := zsocket.GetSockOptInt(zmq.LINGER); linger != 2000 {
+    t.Fatalf("Expected shutdown to close with linger 2000ms, got %d", linger)
+  }
+  if socket.connected {
+    t.Fatal("Shutdown left the socket connected")
+  }
+}
+
+func TestCompressMinBytes(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47369"
+  public, secret := sodium.CryptoBoxKeypair()
+  received := make(chan []*FileEvent, 2)
+  plaintexts := make(chan []byte, 2)
+  defer stub_server_payloads(t, endpoint, sodium.NewSession(public, secret),
+                             received, plaintexts).Close()
+
+  small, _ := json.Marshal(test_batch())
+  publisher := Publisher{Servers: []string{endpoint}, PublicKey: public,
+                         SecretKey: secret, Timeout: time.Second,
+                         CompressMinBytes: len(small) + 1}
+  input := make(chan []*FileEvent, 2)
+  input <- test_batch()
+  input <- append(test_batch(), test_batch()...)
+  close(input)
+  publisher.Publish(input, nil)
+
+  if plaintext := <-plaintexts; plaintext[0] != CODEC_NONE {
+    t.Fatalf("Expected a batch below the threshold to be shipped raw, got codec %d", plaintext[0])
+  }
+  if plaintext := <-plaintexts; plaintext[0] != CODEC_ZLIB {
+    t.Fatalf("Expected a batch above the threshold to be compressed, got codec %d", plaintext[0])
+  }
+  <-received
+  <-received
+}
+
+func TestTransform(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47370"
+  public, secret := sodium.CryptoBoxKeypair()
+  received := make(chan []*FileEvent, 2)
+  defer stub_server(t, endpoint, sodium.NewSession(public, secret), received).Close()
+
+  publisher := Publisher{Servers: []string{endpoint}, PublicKey: public,
+                         SecretKey: secret, Timeout: time.Second}
+  publisher.Transform = func(events []*FileEvent) []*FileEvent {
+    var kept []*FileEvent
+    for _, event := range events {
+      if *event.Text == "world" {
+        continue
+      }
+      event.Fields = map[string]interface{}{"enriched": true}
+      kept = append(kept, event)
+    }
+    return kept
+  }
+
+  filtered := "world"
+  input := make(chan []*FileEvent, 2)
+  input <- []*FileEvent{{Source: test_batch()[0].Source, Text: &filtered}}
+  input <- test_batch()
+  close(input)
+  publisher.Publish(input, nil)
+
+  // The first batch was dropped entirely, so this is the second.
+  events := <-received
+  if len(events) != 2 || *events[0].Text != "hello" || *events[1].Text != "again" {
+    t.Fatalf("Expected the filtered batch, got %d events", len(events))
+  }
+  for _, event := range events {
+    if event.Fields["enriched"] != true {
+      t.Fatalf("Expected transformed fields, got %v", event.Fields)
+    }
+  }
+  select {
+    case events := <-received:
+      t.Fatalf("Expected nothing more shipped, got %d events", len(events))
+    default:
+  }
+}
+
+func TestProtobufSerialization(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47371"
+  public, secret := sodium.CryptoBoxKeypair()
+  received := make(chan []*FileEvent, 1)
+  plaintexts := make(chan []byte, 1)
+  defer stub_server_payloads(t, endpoint, sodium.NewSession(public, secret),
+                             received, plaintexts).Close()
+
+  publisher := Publisher{Servers: []string{endpoint}, PublicKey: public,
+                         SecretKey: secret, Timeout: time.Second,
+                         Serialization: "protobuf"}
+  input := make(chan []*FileEvent, 1)
+  input <- test_batch()
+  close(input)
+  publisher.Publish(input, nil)
+
+  if plaintext := <-plaintexts; plaintext[0] & FORMAT_PROTOBUF == 0 {
+    t.Fatalf("Expected the payload to be flagged as protobuf, got codec byte %d", plaintext[0])
+  }
+  if events := <-received; len(events) != 3 || *events[2].Text != "again" {
+    t.Fatalf("Unexpected events: %v", events)
+  }
+}
+
+func TestConnectLogsBoundedInOutage(t *testing.T) {
+  var logged bytes.Buffer
+  log.SetOutput(&logged)
+  defer log.SetOutput(os.Stderr)
+
+  // Nothing is listening, so every attempt times out and reconnects.
+  socket := FFS{Endpoints: []string{"tcp://127.0.0.1:47372"}, SocketType: zmq.REQ,
+                RecvTimeout: 10 * time.Millisecond, LogInterval: time.Hour}
+  attempts := 0
+  for start := time.Now(); time.Since(start) < 500 * time.Millisecond; attempts++ {
+    socket.Send([]byte("payload"), 0)
+    socket.Recv(0)
+  }
+  log.SetOutput(os.Stderr)
+
+  // The first connect and the first timeout, and nothing more.
+  // (Other tests' prospectors may still be logging too.)
+  lines := bytes.Count(logged.Bytes(), []byte("47372"))
+  if attempts < 10 || lines != 2 {
+    t.Fatalf("Expected 2 log lines over %d attempts, got %d:\n%s", attempts, lines, logged.String())
+  }
+
+  // Once the interval passes, the next message says how many were held back.
+  logged.Reset()
+  log.SetOutput(&logged)
+  socket.LogInterval = time.Nanosecond
+  socket.Recv(0)
+  socket.Shutdown()
+  log.SetOutput(os.Stderr)
+  if !bytes.Contains(logged.Bytes(), []byte("more times)")) {
+    t.Fatalf("Expected a repeat count, got:\n%s", logged.String())
+  }
+}
+
+func TestGzipMembersConcatenate(t *testing.T) {
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  // Batches too small, or not compressible enough, to compress with other
+  // codecs are gzip all the same.
+  publisher := Publisher{Compression: "gzip", SizeHeader: true,
+                         CompressMinBytes: 1 << 20, MinCompressionGain: 99}
+  tiny_text := "b"
+  source := "/var/log/test"
+  tiny := []*FileEvent{&FileEvent{Source: &source, Text: &tiny_text}}
+
+  // What an archival collector does: append each payload to a file, less
+  // the codec byte and size header.
+  var archive, expected bytes.Buffer
+  for _, events := range [][]*FileEvent{large_batch(), tiny, large_batch()} {
+    batch := publisher.encode(session, events)
+    plaintext := session.Open(batch.nonce, batch.ciphertext)
+    if plaintext[0] != CODEC_GZIP | FORMAT_SIZED {
+      t.Fatalf("Expected a sized gzip payload, got codec %d", plaintext[0])
+    }
+    archive.Write(plaintext[1 + size_header_length:])
+    expected.Write(batch.data)
+
+    // Each member also stands alone.
+    if data, err := DecodePayload(plaintext); err != nil || !bytes.Equal(data, batch.data) {
+      t.Fatalf("A gzip payload didn't decompress alone: %v", err)
+    }
+  }
+
+  reader, err := gzip.NewReader(&archive)
+  if err != nil {
+    t.Fatalf("gzip.NewReader failed: %s", err)
+  }
+  data, err := ioutil.ReadAll(reader)
+  if err != nil || !bytes.Equal(data, expected.Bytes()) {
+    t.Fatalf("Expected the concatenated members to decompress to every batch (%v)", err)
+  }
+}
+
+func TestVerifyCompression(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  dead_letter := filepath.Join(dir, "dead-letter")
+
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  publisher := Publisher{VerifyCompression: true, DeadLetter: dead_letter}
+
+  // A sound compressor passes.
+  batch := publisher.encode(session, large_batch())
+  if batch.corrupt || batch.ciphertext == nil {
+    t.Fatalf("Expected a sound payload to pass verification")
+  }
+
+  // One that flips a bit on the way does not, and the batch is given up on
+  // rather than shipped.
+  defer func(encode func(*bytes.Buffer, []byte, int, bool)) { zlib_encode = encode }(zlib_encode)
+  encode := zlib_encode
+  zlib_encode = func(buffer *bytes.Buffer, data []byte, level int, pooled bool) {
+    corrupted := append([]byte{}, data...)
+    corrupted[len(corrupted) / 2] ^= 1
+    encode(buffer, corrupted, level, pooled)
+  }
+  batch = publisher.encode(session, large_batch())
+  if !batch.corrupt || batch.ciphertext != nil {
+    t.Fatalf("Expected a corrupted payload to fail verification")
+  }
+  publisher.ship_batch(batch)
+  if data, _ := ioutil.ReadFile(dead_letter); !bytes.Equal(data, append(batch.data, '\n')) {
+    t.Fatalf("Expected the batch in the dead letter file, got %d bytes", len(data))
+  }
+}
+
+// The endpoints an FFS has a socket connected to, in use or warm.
+func connected_endpoints(s *FFS) map[string]*zmq.Socket {
+  sockets := map[string]*zmq.Socket{s.endpoint: s.socket}
+  for endpoint, socket := range s.warm {
+    sockets[endpoint] = socket
+  }
+  return sockets
+}
+
+func TestPrewarm(t *testing.T) {
+  endpoints := []string{"tcp://127.0.0.1:47375", "tcp://127.0.0.1:47376"}
+  public, secret := sodium.CryptoBoxKeypair()
+  received := make(chan []*FileEvent, 1)
+  for _, endpoint := range endpoints {
+    defer stub_server(t, endpoint, sodium.NewSession(public, secret), received).Close()
+  }
+
+  socket := FFS{Endpoints: endpoints, SocketType: zmq.REQ, Prewarm: true}
+  defer socket.Shutdown()
+  socket.ensure_connect()
+
+  // Both endpoints are connected, not just the one in use.
+  sockets := connected_endpoints(&socket)
+  if len(sockets) != 2 || sockets[endpoints[0]] == nil || sockets[endpoints[1]] == nil {
+    t.Fatalf("Expected sockets connected to both endpoints, got %v", sockets)
+  }
+  status := socket.Status().(map[string]interface{})
+  if warm := status["warm"].([]string); len(warm) != 1 || warm[0] == socket.endpoint {
+    t.Fatalf("Expected the other endpoint to be warm, got %v (using %s)", warm, socket.endpoint)
+  }
+
+  // A failed endpoint gets a fresh socket, warm or in use, when the FFS
+  // reconnects.
+  failed, failed_socket := socket.endpoint, socket.socket
+  socket.fail_socket()
+  socket.ensure_connect()
+  sockets = connected_endpoints(&socket)
+  if len(sockets) != 2 || sockets[failed] == nil || sockets[failed] == failed_socket {
+    t.Fatalf("Expected %s to be warmed again after failing", failed)
+  }
+
+  // And the warm socket taken into use works.
+  session := sodium.NewSession(public, secret)
+  data, _ := json.Marshal(test_batch())
+  ciphertext, nonce := session.Box(append([]byte{CODEC_NONE}, data...))
+  if err := socket.Send(nonce, zmq.SNDMORE); err != nil {
+    t.Fatalf("Send failed: %s", err)
+  }
+  socket.Send(ciphertext, 0)
+  if _, err := socket.Recv(0); err != nil {
+    t.Fatalf("Recv failed on a warm socket: %s", err)
+  }
+  <-received
+}
+
+func TestEncodePreallocates(t *testing.T) {
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  events := large_batch()
+
+  // Allocations are counted across the process, so goroutines other tests
+  // left running can add to either count; the least of a few runs is this
+  // test's own.
+  allocs := func(f func()) float64 {
+    least := testing.AllocsPerRun(10, f)
+    for i := 0; i < 4; i++ {
+      if n := testing.AllocsPerRun(10, f); n < least {
+        least = n
+      }
+    }
+    return least
+  }
+
+  // A fresh publisher has no idea how big a payload will be, and grows its
+  // buffers as it goes; once it has seen a few, it sizes them up front.
+  cold := allocs(func() {
+    publisher := Publisher{}
+    publisher.encode(session, events)
+  })
+  publisher := Publisher{}
+  warm := allocs(func() {
+    publisher.encode(session, events)
+  })
+  if warm >= cold {
+    t.Fatalf("Expected fewer allocations per batch once warmed up, got %v (cold: %v)", warm, cold)
+  }
+}
+
+func BenchmarkEncode(b *testing.B) {
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  events := large_batch()
+  publisher := Publisher{}
+  b.ReportAllocs()
+  for i := 0; i < b.N; i++ {
+    publisher.encode(session, events)
+  }
+}
+
+func TestResendsWholeMessageAfterMidMessageFailure(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47377"
+  server, _ := context.NewSocket(zmq.REP)
+  defer server.Close()
+  if err := server.Bind(endpoint); err != nil {
+    t.Fatalf("Failed to bind %s: %s", endpoint, err)
+  }
+  messages := make(chan [][]byte, 4)
+  go func() {
+    for {
+      parts, err := server.RecvMultipart(0)
+      if err != nil {
+        return
+      }
+      messages <- parts
+      server.Send([]byte("ok"), 0)
+    }
+  }()
+
+  // The server goes away after the nonce, before the ciphertext.
+  defer func(send func(*zmq.Socket, []byte, zmq.SendRecvOption) error) { socket_send = send }(socket_send)
+  send := socket_send
+  failed := false
+  socket_send = func(s *zmq.Socket, data []byte, flags zmq.SendRecvOption) error {
+    if flags & zmq.SNDMORE == 0 && !failed {
+      failed = true
+      return syscall.ECONNRESET
+    }
+    return send(s, data, flags)
+  }
+
+  socket := FFS{Endpoints: []string{endpoint}, SocketType: zmq.REQ}
+  publisher := Publisher{}
+  if !publisher.ship(&socket, []byte("nonce"), []byte("ciphertext")) {
+    t.Fatalf("Expected the batch to be shipped")
+  }
+
+  select {
+    case parts := <-messages:
+      if len(parts) != 2 || string(parts[0]) != "nonce" || string(parts[1]) != "ciphertext" {
+        t.Fatalf("Expected the nonce and ciphertext together, got %q", parts)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("Timed out waiting for the batch")
+  }
+  select {
+    case parts := <-messages:
+      t.Fatalf("Expected only the whole batch, also got %q", parts)
+    default:
+  }
+}
+
+func TestSizeHeader(t *testing.T) {
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+
+  for _, compression := range []string{"zlib", "gzip", "none"} {
+    publisher := Publisher{Compression: compression, SizeHeader: true}
+    events := large_batch()
+    batch := publisher.encode(session, events)
+    plaintext := session.Open(batch.nonce, batch.ciphertext)
+
+    size, count, ok := PayloadSizes(plaintext)
+    if !ok || size != len(batch.data) || count != len(events) {
+      t.Fatalf("%s: expected a size header of %d bytes and %d events, got %d and %d (%v)",
+               compression, len(batch.data), len(events), size, count, ok)
+    }
+    if decoded, err := DecodeEvents(plaintext); err != nil || len(decoded) != len(events) {
+      t.Fatalf("%s: DecodeEvents failed: %d events, %v", compression, len(decoded), err)
+    }
+
+    // A server can tell when the batch isn't what the header says.
+    truncated := append([]byte{}, plaintext...)
+    copy(truncated[1:], size_header(size + 1, count))
+    if _, err := DecodePayload(truncated); err == nil {
+      t.Fatalf("%s: expected a size mismatch to be an error", compression)
+    }
+    miscounted := append([]byte{}, plaintext...)
+    copy(miscounted[1:], size_header(size, count - 1))
+    if _, err := DecodeEvents(miscounted); err == nil {
+      t.Fatalf("%s: expected an event count mismatch to be an error", compression)
+    }
+  }
+
+  // Payloads without the header decode as before.
+  publisher := Publisher{}
+  batch := publisher.encode(session, large_batch())
+  plaintext := session.Open(batch.nonce, batch.ciphertext)
+  if _, _, ok := PayloadSizes(plaintext); ok {
+    t.Fatalf("Expected no size header by default")
+  }
+  if data, err := DecodePayload(plaintext); err != nil || !bytes.Equal(data, batch.data) {
+    t.Fatalf("DecodePayload failed without a size header: %v", err)
+  }
+}
+
+func TestHealthChecks(t *testing.T) {
+  healthy, unhealthy := "tcp://127.0.0.1:47379", "tcp://127.0.0.1:47380"
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  received := make(chan []*FileEvent, 1)
+  server := stub_server(t, healthy, session, received)
+  defer server.Close()
+
+  socket := FFS{Endpoints: []string{healthy, unhealthy}, SocketType: zmq.REQ,
+                RecvTimeout: 100 * time.Millisecond}
+  socket.ping = func() ([]byte, []byte) {
+    ciphertext, nonce := session.Box([]byte{CODEC_NONE, '[', ']'})
+    return nonce, ciphertext
+  }
+  socket.check_all()
+
+  status := socket.Status().(map[string]interface{})["endpoints"].(map[string]interface{})
+  if status[unhealthy].(map[string]interface{})["healthy"] != false ||
+     status[healthy].(map[string]interface{})["healthy"] != true {
+    t.Fatalf("Expected %s unhealthy and %s healthy, got %v", unhealthy, healthy, status)
+  }
+  if batch := <-received; len(batch) != 0 {
+    t.Fatalf("Expected the ping to be an empty batch, got %d events", len(batch))
+  }
+
+  // Before any batch is sent, the unhealthy endpoint is already avoided.
+  for i := 0; i < 50; i++ {
+    if endpoint := socket.choose_endpoint(); endpoint != healthy {
+      t.Fatalf("Chose unhealthy endpoint %s", endpoint)
+    }
+  }
+
+  // With none healthy, any will do rather than none.
+  socket.health[healthy] = false
+  chosen := make(map[string]bool)
+  for i := 0; i < 50; i++ {
+    chosen[socket.choose_endpoint()] = true
+  }
+  if len(chosen) != 2 {
+    t.Fatalf("Expected every endpoint to be chosen when none are healthy, got %v", chosen)
+  }
+}
+
+func TestRouteField(t *testing.T) {
+  default_endpoint, errors_endpoint := "tcp://127.0.0.1:47381", "tcp://127.0.0.1:47382"
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  default_received := make(chan []*FileEvent, 4)
+  errors_received := make(chan []*FileEvent, 4)
+  defer stub_server(t, default_endpoint, session, default_received).Close()
+  defer stub_server(t, errors_endpoint, session, errors_received).Close()
+
+  event := func(text string, severity interface{}) *FileEvent {
+    source := "/var/log/app.log"
+    e := &FileEvent{Source: &source, Text: &text}
+    if severity != nil {
+      e.Fields = map[string]interface{}{"log": map[string]interface{}{"severity": severity}}
+    }
+    return e
+  }
+
+  input := make(chan []*FileEvent, 1)
+  publisher := Publisher{Servers: []string{default_endpoint}, PublicKey: public,
+                         SecretKey: secret, Timeout: time.Second,
+                         RouteField: "log.severity",
+                         Pools: []Pool{{Servers: []string{errors_endpoint},
+                                        Route: []string{"error", "fatal"}}}}
+  input <- []*FileEvent{event("one", "info"), event("two", "error"),
+                        event("three", nil), event("four", "fatal")}
+  close(input)
+  publisher.Publish(input, nil)
+
+  texts := func(received chan []*FileEvent) (result []string) {
+    select {
+      case batch := <-received:
+        for _, e := range batch {
+          result = append(result, *e.Text)
+        }
+      case <-time.After(time.Second):
+    }
+    return
+  }
+  if got := texts(errors_received); !reflect.DeepEqual(got, []string{"two", "four"}) {
+    t.Fatalf("Expected the error and fatal events in the routed pool, got %q", got)
+  }
+  if got := texts(default_received); !reflect.DeepEqual(got, []string{"one", "three"}) {
+    t.Fatalf("Expected the other events in the default pool, got %q", got)
+  }
+  if len(default_received) != 0 || len(errors_received) != 0 {
+    t.Fatalf("Expected one batch per pool")
+  }
+}
+
+func TestTraceTiming(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47384"
+  var count int32
+  defer ack_server(t, endpoint, 5 * time.Millisecond, &count).Close()
+
+  public, secret := sodium.CryptoBoxKeypair()
+  session := sodium.NewSession(public, secret)
+  var trace bytes.Buffer
+  publisher := Publisher{Servers: []string{endpoint}, Timeout: time.Second, Trace: &trace}
+  publisher.socket = publisher.new_socket(publisher.Servers)
+  publisher.required = []*FFS{publisher.socket}
+  defer publisher.socket.Shutdown()
+
+  events := large_batch()
+  publisher.ship_batch(publisher.encode(session, events))
+  var timing batch_timing
+  if err := json.Unmarshal(trace.Bytes(), &timing); err != nil {
+    t.Fatalf("Bad trace record %q: %s", trace.String(), err)
+  }
+  if timing.Events != len(events) || !timing.Acked {
+    t.Fatalf("Expected an acknowledged batch of %d events traced, got %+v", len(events), timing)
+  }
+  for stage, ms := range map[string]float64{"marshal": timing.MarshalMs, "compress": timing.CompressMs,
+                                            "encrypt": timing.EncryptMs, "send": timing.SendMs} {
+    if ms <= 0 || ms > 1000 {
+      t.Fatalf("Implausible %s time of %vms: %+v", stage, ms, timing)
+    }
+  }
+  if timing.SendMs < 5 {
+    t.Fatalf("Expected the send time to include the server's 5ms, got %vms", timing.SendMs)
+  }
+  if timing.RawBytes == 0 || timing.CompressedBytes >= timing.RawBytes ||
+     timing.CiphertextBytes < timing.CompressedBytes {
+    t.Fatalf("Implausible sizes: %+v", timing)
+  }
+
+  // Nothing is timed without a trace.
+  publisher.Trace = nil
+  if batch := publisher.encode(session, events); batch.timing != nil {
+    t.Fatalf("Expected no timing without a trace")
+  }
+}
+
+func TestPoolKeys(t *testing.T) {
+  first_endpoint, second_endpoint := "tcp://127.0.0.1:47385", "tcp://127.0.0.1:47386"
+  client_public, client_secret := sodium.CryptoBoxKeypair()
+  first_public, first_secret := sodium.CryptoBoxKeypair()
+  second_public, second_secret := sodium.CryptoBoxKeypair()
+
+  // Each collector opens what it gets with its own secret key.
+  first_received := make(chan []*FileEvent, 1)
+  second_received := make(chan []*FileEvent, 1)
+  defer stub_server(t, first_endpoint, sodium.NewSession(client_public, first_secret),
+                    first_received).Close()
+  defer stub_server(t, second_endpoint, sodium.NewSession(client_public, second_secret),
+                    second_received).Close()
+
+  input := make(chan []*FileEvent, 1)
+  publisher := Publisher{Servers: []string{first_endpoint}, PublicKey: first_public,
+                         SecretKey: client_secret, Timeout: time.Second,
+                         Pools: []Pool{{Servers: []string{second_endpoint},
+                                        PublicKey: second_public[:]}}}
+  if err := publisher.CheckKeys(); err != nil {
+    t.Fatalf("Expected the pool's key accepted, got %s", err)
+  }
+  input <- test_batch()
+  close(input)
+  publisher.Publish(input, nil)
+
+  for name, received := range map[string]chan []*FileEvent{"first": first_received,
+                                                            "second": second_received} {
+    select {
+      case events := <-received:
+        if len(events) != 3 {
+          t.Fatalf("Expected the %s collector to decrypt 3 events, got %d", name, len(events))
+        }
+      case <-time.After(time.Second):
+        t.Fatalf("The %s collector got nothing it could decrypt", name)
+    }
+  }
+  session := publisher.sessions[publisher.required[1]]
+  if session == nil || session.Public != second_public || session.Secret != client_secret {
+    t.Fatalf("Expected the second pool boxed for its own key")
+  }
+  if len(publisher.sessions) != 1 {
+    t.Fatalf("Expected only the pool with a key of its own to have a session")
+  }
+
+  publisher.Pools[0].PublicKey = second_public[:16]
+  if err := publisher.CheckKeys(); err == nil {
+    t.Fatal("Expected a short pool key to be an error")
+  }
+}
@@ -0,0 +1,67 @@
+package liblumberjack
+
+import (
+  "log"
+)
+
+// SetEndpoints replaces the endpoints an FFS ships to, say on a reload of
+// the server list, disturbing as little as it can: the connection in use is
+// kept if its endpoint is still listed, and only rebuilt (on another of the
+// new endpoints) if it isn't; removed endpoints lose their warm sockets,
+// latency and health; added ones are candidates for the next connect.
+//
+// It may be called from any goroutine. The change is made by the socket's
+// own goroutine at the start of its next message, so a message part way
+// out is never split across connections.
+func (s *FFS) SetEndpoints(endpoints []string) {
+  if len(endpoints) == 0 {
+    return // nothing to ship to; keep what we have.
+  }
+  s.latency_lock.Lock()
+  defer s.latency_lock.Unlock()
+  s.pending_endpoints = append([]string{}, endpoints...)
+}
+
+// Apply endpoints from SetEndpoints, if any.
+func (s *FFS) reconcile() {
+  s.latency_lock.Lock()
+  endpoints := s.pending_endpoints
+  s.pending_endpoints = nil
+  if endpoints == nil {
+    s.latency_lock.Unlock()
+    return
+  }
+
+  listed := make(map[string]bool, len(endpoints))
+  for _, endpoint := range endpoints {
+    listed[endpoint] = true
+  }
+  for endpoint := range s.latency {
+    if !listed[endpoint] {
+      delete(s.latency, endpoint)
+    }
+  }
+  for endpoint := range s.health {
+    if !listed[endpoint] {
+      delete(s.health, endpoint)
+    }
+  }
+  for endpoint, socket := range s.warm {
+    if !listed[endpoint] {
+      socket.Close()
+      delete(s.warm, endpoint)
+    }
+  }
+  s.Endpoints = endpoints
+  s.latency_lock.Unlock()
+
+  if !s.connected {
+    return // the next connect chooses among the new endpoints.
+  }
+  if listed[s.endpoint] {
+    log.Printf("Servers changed; keeping the connection to %s\n", s.endpoint)
+    return
+  }
+  log.Printf("Servers changed and %s was removed; reconnecting\n", s.endpoint)
+  s.fail_socket()
+} /* FFS#reconcile */
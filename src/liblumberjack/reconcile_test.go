@@ -0,0 +1,52 @@
+package liblumberjack
+
+import "sync/atomic"
+import "testing"
+import zmq "github.com/alecthomas/gozmq"
+
+func TestSetEndpoints(t *testing.T) {
+  endpoints := []string{"tcp://127.0.0.1:47389", "tcp://127.0.0.1:47390", "tcp://127.0.0.1:47391"}
+  counts := make([]int32, len(endpoints))
+  for i, endpoint := range endpoints {
+    defer ack_server(t, endpoint, 0, &counts[i]).Close()
+  }
+  round_trip := func(socket *FFS) {
+    socket.Send([]byte("nonce"), zmq.SNDMORE)
+    socket.Send([]byte("payload"), 0)
+    if _, err := socket.Recv(0); err != nil {
+      t.Fatalf("Recv() failed: %s", err)
+    }
+  }
+
+  socket := FFS{Endpoints: endpoints[:2], SocketType: zmq.REQ}
+  round_trip(&socket)
+  current, connection := socket.endpoint, socket.socket
+
+  // Overlapping: the current endpoint stays, the other goes, a new one
+  // comes.
+  socket.SetEndpoints([]string{current, endpoints[2]})
+  round_trip(&socket)
+  if socket.endpoint != current || socket.socket != connection {
+    t.Fatalf("Expected the connection to %s kept, now on %s", current, socket.endpoint)
+  }
+  if len(socket.Endpoints) != 2 || socket.Endpoints[1] != endpoints[2] {
+    t.Fatalf("Expected the new endpoints in use, got %v", socket.Endpoints)
+  }
+  if _, known := socket.latency[current]; !known {
+    t.Fatal("Expected the latency of a kept endpoint kept")
+  }
+
+  // Without the current endpoint: reconnected, to the one left.
+  socket.SetEndpoints([]string{endpoints[2]})
+  round_trip(&socket)
+  if socket.endpoint != endpoints[2] || socket.socket == connection {
+    t.Fatalf("Expected a new connection to %s, still on %s", endpoints[2], socket.endpoint)
+  }
+  if _, known := socket.latency[current]; known {
+    t.Fatal("Expected the latency of a removed endpoint forgotten")
+  }
+  kept := atomic.LoadInt32(&counts[0]) + atomic.LoadInt32(&counts[1])
+  if kept != 2 || atomic.LoadInt32(&counts[2]) != 1 {
+    t.Fatalf("Expected two messages to the kept endpoint, then one to the added one, got %v", counts)
+  }
+}
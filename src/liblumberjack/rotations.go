@@ -0,0 +1,105 @@
+package liblumberjack
+
+import (
+  "log"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+)
+
+// With Prospector.CatchUpRotations, a file found at startup is read along
+// with its older rotations (path.1, path.2, path-20130102, ...), oldest
+// first, so the whole history ships in order. Compressed rotations are
+// skipped, as harvesters only read plain text.
+//
+// TODO: Record finished rotations in the registrar, once there is
+// one, so a restart doesn't ship them again.
+
+type rotation struct {
+  path string
+  info os.FileInfo
+}
+
+// Oldest first: by mtime, then by name, so that path.2 comes before path.1
+// if they were written in the same second.
+type by_age []rotation
+
+func (r by_age) Len() int { return len(r) }
+func (r by_age) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r by_age) Less(i, j int) bool {
+  if !r[i].info.ModTime().Equal(r[j].info.ModTime()) {
+    return r[i].info.ModTime().Before(r[j].info.ModTime())
+  }
+  return r[i].path > r[j].path
+}
+
+// The files named as rotations of path, but for compressed ones.
+func rotation_candidates(path string) (candidates []string) {
+  for _, pattern := range []string{path + ".*", path + "-*"} {
+    matches, _ := filepath.Glob(pattern)
+    for _, match := range matches {
+      if strings.HasSuffix(match, ".gz") || strings.HasSuffix(match, ".bz2") ||
+         strings.HasSuffix(match, ".xz") {
+        log.Printf("Skipping compressed rotation of %s: %s\n", path, match)
+        continue
+      }
+      candidates = append(candidates, match)
+    }
+  }
+  return
+}
+
+func find_rotations(path string) (rotations []rotation) {
+  for _, match := range rotation_candidates(path) {
+    info, err := os.Stat(match)
+    if err != nil || info.IsDir() {
+      continue
+    }
+    rotations = append(rotations, rotation{match, info})
+  }
+  sort.Sort(by_age(rotations))
+  return
+}
+
+// Harvest the rotations of path to their end, oldest first, then path
+// itself from the beginning. The rotations are recorded in fileinfo so the
+// scan doesn't start harvesters of its own on them. A file without
+// rotations is harvested as usual.
+func (p *Prospector) catch_up(path string, fileinfo map[string]os.FileInfo,
+                              output chan *FileEvent) {
+  var rotations []rotation
+  for _, r := range find_rotations(path) {
+    if !p.excluded(r.path) {
+      rotations = append(rotations, r)
+    }
+  }
+  if len(rotations) == 0 {
+    log.Printf("Launching harvester on new file: %s\n", path)
+    p.harvest(path, output)
+    return
+  }
+  for _, r := range rotations {
+    fileinfo[r.path] = r.info
+  }
+
+  // The whole series is read by one harvester at a time, in one slot.
+  slots := p.slots(path)
+  go func() {
+    slots.acquire()
+    defer slots.release()
+    for _, r := range rotations {
+      log.Printf("Catching up on rotation of %s: %s\n", path, r.path)
+      harvester := p.Harvester
+      harvester.Path = r.path
+      harvester.from_beginning = true
+      harvester.stop_at_eof = true
+      harvester.Harvest(output)
+    }
+    log.Printf("Launching harvester on %s after catching up\n", path)
+    harvester := p.Harvester
+    harvester.Path = path
+    harvester.from_beginning = true
+    harvester.Harvest(output)
+  }()
+}
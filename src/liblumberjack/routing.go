@@ -0,0 +1,91 @@
+package liblumberjack
+
+import (
+  "fmt"
+)
+
+// With Publisher.RouteField, events are routed by content: each batch is
+// split by the value of that field in each event, and events with a value
+// listed in a pool's Route go to that pool alone. The rest go where every
+// batch goes without routing: to Servers and the pools without a Route.
+//
+// Each part of a batch is encoded and shipped as a batch of its own, in the
+// order its first event came in, and acknowledged once its pool has it. A
+// routed pool is always waited for, like a required pool. Routing happens
+// before Publisher.Transform, which should leave RouteField alone.
+//
+// Without Servers, a pool without a Route or a FileSink, the rest have
+// nowhere to go; they are given up on like a batch that failed to send,
+// rather than acknowledged unshipped.
+
+// The routed pool an event goes to, or nil for the default.
+func (p *Publisher) route_of(event *FileEvent) *FFS {
+  if event.Fields == nil {
+    return nil
+  }
+  value, ok := lookup_field(event.Fields, p.RouteField)
+  if !ok {
+    return nil
+  }
+  return p.routes[fmt.Sprint(value)]
+}
+
+// The routed pool a batch split by split_routes goes to, if any.
+func (p *Publisher) routed(events []*FileEvent) *FFS {
+  if p.routes == nil {
+    return nil
+  }
+  return p.route_of(events[0])
+}
+
+// Split each batch from input by route, in order.
+func (p *Publisher) split_routes(input chan []*FileEvent) chan []*FileEvent {
+  output := make(chan []*FileEvent)
+  go func() {
+    for events := range input {
+      if len(events) == 1 && events[0].barrier != nil {
+        output <- events
+        continue
+      }
+
+      var order []*FFS
+      parts := make(map[*FFS][]*FileEvent)
+      for _, event := range events {
+        if event == nil {
+          continue
+        }
+        pool := p.route_of(event)
+        if _, seen := parts[pool]; !seen {
+          order = append(order, pool)
+        }
+        parts[pool] = append(parts[pool], event)
+      }
+      for _, pool := range order {
+        output <- parts[pool]
+      }
+    }
+    close(output)
+  }()
+  return output
+}
+
+// Whether events no routed pool takes are given up on, for lack of
+// anywhere else to ship them.
+func (p *Publisher) unrouted_dropped() bool {
+  return len(p.required) == 0 && len(p.best_effort) == 0 && p.FileSink == nil
+}
+
+// Set up the sockets of the routed pools.
+func (p *Publisher) start_routes() {
+  p.routes = make(map[string]*FFS)
+  for _, pool := range p.Pools {
+    if len(pool.Route) == 0 {
+      continue
+    }
+    socket := p.pool_socket(pool)
+    p.routed_sockets = append(p.routed_sockets, socket)
+    for _, value := range pool.Route {
+      p.routes[value] = socket
+    }
+  }
+}
@@ -0,0 +1,58 @@
+package liblumberjack
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// Prospector scans of big directories stat every matching file, every scan.
+// But the prospector only looks for new files and files replaced under the
+// same name, and creating, renaming or removing a file all change its
+// directory's mtime. So a glob whose directory hasn't changed since it was
+// last scanned matches the same files as before, and can be skipped with a
+// single stat of the directory.
+//
+// This can't be relied on when symlinks are matched (their targets can be
+// replaced without touching this directory), or when the directory part of
+// the glob has wildcards; such paths are always scanned in full. Nor with
+// Harvester.FingerprintIdentity while a match's fingerprint is short or
+// pending a recheck: that waits on the file's content growing.
+
+// Directory mtimes this recent may still change within the same tick of a
+// coarse filesystem clock, so aren't trusted.
+const dir_mtime_granularity = time.Second
+
+// Can the scan of path be skipped? Returns the directory info to remember
+// with remember_scan, if the path can be cached at all.
+func (p *Prospector) scan_unchanged(path string) (bool, os.FileInfo) {
+  dir := filepath.Dir(path)
+  if strings.ContainsAny(dir, "*?[\\") {
+    return false, nil
+  }
+
+  p.scan_stats++
+  info, err := os.Stat(dir)
+  if err != nil {
+    return false, nil
+  }
+
+  cached, ok := p.scan_cache[path]
+  if ok && os.SameFile(cached, info) && cached.ModTime().Equal(info.ModTime()) {
+    return true, info
+  }
+  return false, info
+}
+
+// Remember a full scan of path, if its directory was settled at the time.
+func (p *Prospector) remember_scan(path string, dir os.FileInfo, cacheable bool) {
+  if p.scan_cache == nil {
+    p.scan_cache = make(map[string]os.FileInfo)
+  }
+  if !cacheable || dir == nil || time.Since(dir.ModTime()) < dir_mtime_granularity {
+    delete(p.scan_cache, path)
+    return
+  }
+  p.scan_cache[path] = dir
+}
@@ -0,0 +1,74 @@
+package liblumberjack
+
+import (
+  "fmt"
+  "net/http"
+  "sync"
+)
+
+// POST /prospector/scan scans every running prospector's paths at once,
+// rather than at their next ScanInterval, and returns when that's done. A
+// scan asked for during a scan is run after it, so files created before the
+// request are always seen; requests made together share one scan.
+
+var scanners_lock sync.Mutex
+
+// The running prospectors, each taking requests for a scan on its channel,
+// each request a channel to close once the scan is done.
+var scanners = make(map[chan chan bool]bool)
+
+func init() {
+  admin_mux.HandleFunc("/prospector/scan", func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+      http.Error(w, "POST required", http.StatusMethodNotAllowed)
+      return
+    }
+    if !ScanNow() {
+      http.Error(w, "no prospector running", http.StatusServiceUnavailable)
+      return
+    }
+    fmt.Fprintf(w, "ok\n")
+  })
+}
+
+func register_scanner(requests chan chan bool) {
+  scanners_lock.Lock()
+  defer scanners_lock.Unlock()
+  scanners[requests] = true
+}
+
+// Have every running prospector scan now, and wait until they have.
+// Returns false if there are none.
+func ScanNow() bool {
+  scanners_lock.Lock()
+  var all []chan chan bool
+  for requests := range scanners {
+    all = append(all, requests)
+  }
+  scanners_lock.Unlock()
+
+  var wg sync.WaitGroup
+  for _, requests := range all {
+    wg.Add(1)
+    go func(requests chan chan bool) {
+      defer wg.Done()
+      done := make(chan bool)
+      requests <- done
+      <-done
+    }(requests)
+  }
+  wg.Wait()
+  return len(all) > 0
+}
+
+// The other requests waiting for a scan, to share the one about to run.
+func waiting_scans(requests chan chan bool) (waiting []chan bool) {
+  for {
+    select {
+      case done := <-requests:
+        waiting = append(waiting, done)
+      default:
+        return
+    }
+  }
+}
@@ -0,0 +1,179 @@
+package liblumberjack
+
+import (
+  "bufio"
+  "fmt"
+  "log"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// A SeenCache remembers, in the file at Path, the ids of the events most
+// recently acknowledged by the servers. Events harvested again after a
+// crash or restart (a file read from the beginning, say) then keep the ids
+// they had before, with derived ids (ID_DERIVED), and the spooler drops
+// those it finds in the cache instead of shipping them twice. Derived ids
+// include the file's identity as well as its path and offset (see ids.go),
+// so a new file under an old name isn't taken for one already shipped.
+// Stdin, with no identity, gets random ids, so is never suppressed.
+//
+// Only ids acknowledged before this run started are suppressed; an id
+// shipped again within a run is a new event at an offset an earlier one
+// of the same file had (it was truncated, and written again), not a
+// re-read. MaxEntries bounds the ids kept, and MaxAge, if set, how long one
+// is kept for. Events without an id are never suppressed.
+//
+// The file is appended to after each acknowledged batch, without syncing:
+// it survives lumberjack crashing, not the machine.
+type SeenCache struct {
+  Path string
+  MaxEntries int
+  MaxAge time.Duration
+
+  lock sync.Mutex
+  previous map[string]bool // ids acknowledged before Open
+  recent []seen_entry // the newest MaxEntries ids, oldest first
+  file *os.File
+  lines int // entries in the file, including those no longer in recent
+}
+
+type seen_entry struct {
+  when time.Time
+  id string
+}
+
+// Open loads the ids the file holds, dropping those too old to keep, and
+// rewrites it with what is left.
+func (c *SeenCache) Open() error {
+  if c.MaxEntries < 1 {
+    c.MaxEntries = 1
+  }
+  c.lock.Lock()
+  defer c.lock.Unlock()
+
+  c.previous = make(map[string]bool)
+  c.recent = nil
+  file, err := os.Open(c.Path)
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  if err == nil {
+    now := time.Now()
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+      entry, ok := parse_seen_entry(scanner.Text())
+      if !ok || (c.MaxAge > 0 && now.Sub(entry.when) > c.MaxAge) {
+        continue // a torn last line, or expired
+      }
+      c.remember(entry)
+    }
+    file.Close()
+  }
+  for _, entry := range c.recent {
+    c.previous[entry.id] = true
+  }
+  return c.rewrite()
+} /* SeenCache#Open */
+
+// Seen reports whether id was acknowledged before the cache was opened.
+func (c *SeenCache) Seen(id string) bool {
+  if id == "" {
+    return false
+  }
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  return c.previous[id]
+}
+
+// Remember the ids of a batch the servers acknowledged.
+func (c *SeenCache) record(events []*FileEvent) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+
+  now := time.Now()
+  var lines []string
+  for _, event := range events {
+    if event.ID == "" {
+      continue
+    }
+    entry := seen_entry{when: now, id: event.ID}
+    c.remember(entry)
+    lines = append(lines, format_seen_entry(entry))
+  }
+  if len(lines) == 0 || c.file == nil {
+    return
+  }
+
+  var err error
+  if c.lines + len(lines) > 2 * c.MaxEntries {
+    // Compact, rather than let the file grow without bound.
+    err = c.rewrite()
+  } else {
+    _, err = c.file.WriteString(strings.Join(lines, ""))
+    c.lines += len(lines)
+  }
+  if err != nil {
+    log.Printf("Failed to update seen-cache %s: %s\n", c.Path, err)
+  }
+} /* SeenCache#record */
+
+func (c *SeenCache) remember(entry seen_entry) {
+  if len(c.recent) == c.MaxEntries {
+    c.recent = c.recent[1:]
+  }
+  c.recent = append(c.recent, entry)
+}
+
+// Replace the file with the entries in recent, atomically, and reopen it
+// for appending.
+func (c *SeenCache) rewrite() error {
+  if c.file != nil {
+    c.file.Close()
+    c.file = nil
+  }
+  temp := c.Path + ".new"
+  out, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+  if err != nil {
+    return err
+  }
+  writer := bufio.NewWriter(out)
+  for _, entry := range c.recent {
+    writer.WriteString(format_seen_entry(entry))
+  }
+  if err = writer.Flush(); err == nil {
+    err = out.Sync()
+  }
+  out.Close()
+  if err == nil {
+    err = os.Rename(temp, c.Path)
+  }
+  if err != nil {
+    os.Remove(temp)
+    return err
+  }
+
+  c.file, err = os.OpenFile(c.Path, os.O_WRONLY|os.O_APPEND, 0600)
+  c.lines = len(c.recent)
+  return err
+} /* SeenCache#rewrite */
+
+// One entry per line: the unix time in nanoseconds it was acknowledged,
+// then the id.
+func format_seen_entry(entry seen_entry) string {
+  return fmt.Sprintf("%d %s\n", entry.when.UnixNano(), entry.id)
+}
+
+func parse_seen_entry(line string) (entry seen_entry, ok bool) {
+  fields := strings.Fields(line)
+  if len(fields) != 2 {
+    return entry, false
+  }
+  nanos, err := strconv.ParseInt(fields[0], 10, 64)
+  if err != nil {
+    return entry, false
+  }
+  return seen_entry{when: time.Unix(0, nanos), id: fields[1]}, true
+}
@@ -0,0 +1,166 @@
+package liblumberjack
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+// Read path from the beginning, with derived ids, as a restarted
+// lumberjack reading it again would.
+func harvest_with_ids(path string) []*FileEvent {
+  output := make(chan *FileEvent, 100)
+  harvester := Harvester{Path: path, IDScheme: ID_DERIVED,
+                         from_beginning: true, stop_at_eof: true}
+  harvester.Harvest(output)
+  close(output)
+  var events []*FileEvent
+  for event := range output {
+    events = append(events, event)
+  }
+  return events
+}
+
+func TestSeenCacheAcrossRestart(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "lines")
+  write_lines(t, path, 10)
+  cache_path := filepath.Join(dir, "seen")
+
+  // Before the crash: the first 6 events were acknowledged, the rest
+  // were read but never acknowledged.
+  before := &SeenCache{Path: cache_path, MaxEntries: 100, MaxAge: time.Hour}
+  if err := before.Open(); err != nil {
+    t.Fatalf("Failed to open the seen-cache: %s", err)
+  }
+  events := harvest_with_ids(path)
+  if len(events) != 10 {
+    t.Fatalf("Expected 10 events, got %d", len(events))
+  }
+  before.record(events[:6])
+  if before.Seen(events[0].ID) {
+    t.Fatal("Ids acknowledged in this run must not be suppressed in it")
+  }
+
+  // After it, with the cache left as it was: the file is read again.
+  after := &SeenCache{Path: cache_path, MaxEntries: 100, MaxAge: time.Hour}
+  if err := after.Open(); err != nil {
+    t.Fatalf("Failed to reopen the seen-cache: %s", err)
+  }
+  input := make(chan *FileEvent, 10)
+  output := make(chan []*FileEvent, 1)
+  spooler := Spooler{MaxSize: 4, IdleTimeout: 50 * time.Millisecond, Seen: after}
+  go spooler.Spool(input, output)
+  for _, event := range harvest_with_ids(path) {
+    input <- event
+  }
+
+  var shipped []*FileEvent
+  timeout := time.After(time.Second)
+  for len(shipped) < 4 {
+    select {
+      case batch := <- output:
+        shipped = append(shipped, batch...)
+      case <- timeout:
+        t.Fatalf("Expected the 4 unacknowledged events shipped, got %d", len(shipped))
+    }
+  }
+  for i, event := range shipped {
+    if event.ID != events[6 + i].ID || *event.Text != *events[6 + i].Text {
+      t.Fatalf("Shipped event %d is %q, expected %q", i, *event.Text, *events[6 + i].Text)
+    }
+  }
+  select {
+    case batch := <- output:
+      t.Fatalf("Expected nothing more shipped, got %d events", len(batch))
+    case <- time.After(100 * time.Millisecond):
+  }
+}
+
+func TestSeenCacheNewFile(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "lines")
+  write_lines(t, path, 10)
+  cache_path := filepath.Join(dir, "seen")
+
+  before := &SeenCache{Path: cache_path, MaxEntries: 100}
+  before.Open()
+  before.record(harvest_with_ids(path))
+
+  // Rotated before the restart: the lines at the same offsets of the new
+  // file are new events.
+  os.Rename(path, path + ".1")
+  write_lines(t, path, 10)
+  after := &SeenCache{Path: cache_path, MaxEntries: 100}
+  after.Open()
+  for _, event := range harvest_with_ids(path) {
+    if after.Seen(event.ID) {
+      t.Fatalf("Event at offset %d of a new file taken for one already shipped", event.Offset)
+    }
+  }
+}
+
+func TestSeenCacheBounds(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  cache_path := filepath.Join(dir, "seen")
+
+  old := time.Now().Add(-2 * time.Hour).UnixNano()
+  append_file(t, cache_path, format_seen_entry(seen_entry{when: time.Unix(0, old), id: "expired"}))
+  cache := &SeenCache{Path: cache_path, MaxEntries: 5, MaxAge: time.Hour}
+  cache.Open()
+  var events []*FileEvent
+  for _, id := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+    events = append(events, &FileEvent{ID: id})
+  }
+  for _, event := range events {
+    cache.record([]*FileEvent{event})
+  }
+
+  reopened := &SeenCache{Path: cache_path, MaxEntries: 5, MaxAge: time.Hour}
+  reopened.Open()
+  if reopened.Seen("expired") {
+    t.Fatal("Expected an id older than MaxAge forgotten")
+  }
+  for _, id := range []string{"a", "b"} {
+    if reopened.Seen(id) {
+      t.Fatalf("Expected %s forgotten, beyond MaxEntries", id)
+    }
+  }
+  for _, id := range []string{"c", "d", "e", "f", "g"} {
+    if !reopened.Seen(id) {
+      t.Fatalf("Expected %s remembered", id)
+    }
+  }
+  if reopened.Seen("") {
+    t.Fatal("Events without an id must never be suppressed")
+  }
+  if reopened.lines != 5 {
+    t.Fatalf("Expected the file compacted to 5 entries, got %d", reopened.lines)
+  }
+}
+
+func TestSeenCacheStdin(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  cache_path := filepath.Join(dir, "seen")
+
+  // New input on stdin in each run, at the same offsets.
+  stdin := Harvester{Path: "-", IDScheme: ID_DERIVED, Node: "web1"}
+  before := &SeenCache{Path: cache_path, MaxEntries: 100}
+  if err := before.Open(); err != nil {
+    t.Fatalf("Failed to open the seen-cache: %s", err)
+  }
+  first := &FileEvent{ID: stdin.id_of(nil, nil, 0, 4)}
+  before.record([]*FileEvent{first})
+
+  after := &SeenCache{Path: cache_path, MaxEntries: 100}
+  if err := after.Open(); err != nil {
+    t.Fatalf("Failed to reopen the seen-cache: %s", err)
+  }
+  if id := stdin.id_of(nil, nil, 0, 4); id == "" || after.Seen(id) {
+    t.Fatalf("Expected a new id for new input on stdin, got %q (was %q)", id, first.ID)
+  }
+}
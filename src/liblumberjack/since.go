@@ -0,0 +1,42 @@
+package liblumberjack
+
+import (
+  "regexp"
+  "time"
+)
+
+// A Since filter ships only lines whose own timestamp (not when they were
+// read) is at or after Cutoff, for a backfill focused on a time range.
+// Lines before it are read and skipped, counted as dropped "before_since";
+// lines without a timestamp that parses are shipped, unless DropUnparsed,
+// when they are dropped as "no_timestamp".
+type Since struct {
+  Cutoff time.Time
+
+  // Finds the timestamp in a line: its first submatch, if it has a group,
+  // or else the whole match.
+  Pattern *regexp.Regexp
+
+  // How the timestamp is written, as a time.Parse layout. Timestamps
+  // without a zone are taken as UTC.
+  Layout string
+
+  DropUnparsed bool
+}
+
+// Should a line be shipped? If not, why not, as a drop reason.
+func (s *Since) keep(text string) (bool, string) {
+  match := s.Pattern.FindStringSubmatch(text)
+  if match == nil {
+    return !s.DropUnparsed, "no_timestamp"
+  }
+  timestamp := match[0]
+  if len(match) > 1 {
+    timestamp = match[1]
+  }
+  when, err := time.Parse(s.Layout, timestamp)
+  if err != nil {
+    return !s.DropUnparsed, "no_timestamp"
+  }
+  return !when.Before(s.Cutoff), "before_since"
+}
@@ -0,0 +1,63 @@
+package liblumberjack
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "reflect"
+import "regexp"
+import "testing"
+import "time"
+
+func TestHarvesterSince(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "app.log")
+  lines := []string{
+    "2013-07-13 09:59:59 before",
+    "no timestamp here",
+    "2013-07-13 10:00:00 at the cutoff",
+    "2013-07-13 25:00:00 not a real time",
+    "2013-07-13 10:00:01 after",
+  }
+  for _, line := range lines {
+    append_file(t, path, line + "\n")
+  }
+
+  harvest := func(drop_unparsed bool) (texts []string, offsets []uint64) {
+    since := &Since{Cutoff: time.Date(2013, 7, 13, 10, 0, 0, 0, time.UTC),
+                    Pattern: regexp.MustCompile(`^(\S+ \S+) `),
+                    Layout: "2006-01-02 15:04:05",
+                    DropUnparsed: drop_unparsed}
+    output := make(chan *FileEvent, len(lines))
+    harvester := Harvester{Path: path, Since: since, from_beginning: true, stop_at_eof: true}
+    harvester.Harvest(output)
+    close(output)
+    for event := range output {
+      texts = append(texts, *event.Text)
+      offsets = append(offsets, event.Offset)
+    }
+    return
+  }
+
+  var texts []string
+  var offsets []uint64
+  older := drops("before_since", func() {
+    texts, offsets = harvest(false)
+  })
+  expected := []string{lines[1], lines[2], lines[3], lines[4]}
+  if !reflect.DeepEqual(texts, expected) || older != 1 {
+    t.Fatalf("Expected lines from the cutoff on, and those without a timestamp; got %q (%d older)", texts, older)
+  }
+  // Skipped lines still move the offset along.
+  if offsets[0] != uint64(len(lines[0]) + 1) {
+    t.Fatalf("Expected the first line shipped at offset %d, got %d", len(lines[0]) + 1, offsets[0])
+  }
+
+  unparsed := drops("no_timestamp", func() {
+    texts, _ = harvest(true)
+  })
+  expected = []string{lines[2], lines[4]}
+  if !reflect.DeepEqual(texts, expected) || unparsed != 2 {
+    t.Fatalf("Expected only timestamped lines from the cutoff on; got %q (%d unparsed)", texts, unparsed)
+  }
+}
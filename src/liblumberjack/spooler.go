@@ -1,58 +1,171 @@
 package liblumberjack
 
 import (
+  "log"
   "time"
 )
 
-func Spool(input chan *FileEvent, 
+type Spooler struct {
+  MaxSize uint64 // maximum number of events to spool before a flush
+  IdleTimeout time.Duration // maximum time to hold spooled events
+
+  // Optional; if set, drop events that duplicate recently spooled ones.
+  Dedup *Deduper
+
+  // Optional; drop events whose ids were acknowledged before a restart.
+  Seen *SeenCache
+
+  // Optional; a hard bound on how long an event may take from harvest to
+  // shipping. A batch is flushed, regardless of size or idle time, once its
+  // oldest event has waited half this long, leaving the other half for the
+  // publisher.
+  MaxEventAge time.Duration
+
+  // Optional; harvesters send on EOF when they reach the end of a file, and
+  // the spool is then flushed soon after rather than at IdleTimeout. Flushes
+  // triggered this way are at least MinFlushInterval apart, so a file
+  // written a line at a time doesn't make for a batch per line.
+  EOF chan bool
+  MinFlushInterval time.Duration
+
+  // Optional; if handing a batch to the publisher blocks for longer than
+  // this, log a warning and count it in lumberjack_publisher_backpressure_total.
+  // The spooler keeps waiting either way; this only makes the stall visible.
+  BackpressureWarn time.Duration
+
+  // Optional; the most events from one source file in a batch. Reaching it
+  // flushes the batch early, so a very chatty file can't fill every batch
+  // and hold back the events of quieter ones.
+  MaxPerSource int
+}
+
+// How long after an EOF nudge to flush, at least; this lets events the
+// harvester sent just before reaching EOF be spooled first.
+const eof_flush_settle = 10 * time.Millisecond
+
+func Spool(input chan *FileEvent,
            output chan []*FileEvent,
            max_size uint64,
            idle_timeout time.Duration) {
+  spooler := Spooler{MaxSize: max_size, IdleTimeout: idle_timeout}
+  spooler.Spool(input, output)
+}
+
+func (s *Spooler) Spool(input chan *FileEvent, output chan []*FileEvent) {
   // heartbeat periodically. If the last flush was longer than
   // 'idle_timeout' time ago, then we'll force a flush to prevent us from
   // holding on to spooled events for too long.
 
-  ticker := time.NewTicker(idle_timeout / 2)
+  tick := s.IdleTimeout / 2
+  if s.MaxEventAge > 0 && s.MaxEventAge / 4 < tick {
+    tick = s.MaxEventAge / 4
+  }
+  ticker := time.NewTicker(tick)
 
   // slice for spooling into
   // TODO(sissel): use container.Ring?
-  spool := make([]*FileEvent, max_size)
+  spool := make([]*FileEvent, s.MaxSize)
 
   // Current write position in the spool
   var spool_i int = 0
 
-  next_flush_time := time.Now().Add(idle_timeout)
+  next_flush_time := time.Now().Add(s.IdleTimeout)
+  last_flush := time.Now()
+  var eof_flush <-chan time.Time // fires when a flush for EOF is due
+  var per_source map[string]int // events spooled from each source, for MaxPerSource
   for {
     select {
       case event := <- input:
+        if event == nil || (event.Text == nil && event.Fields == nil && event.barrier == nil) {
+          // Nothing to ship; a bug upstream, most likely.
+          dropped("empty", 1)
+          continue
+        }
+        if event.barrier != nil {
+          // Flush what came before the barrier, then pass it along.
+          if spool_i > 0 {
+            s.handoff(output, batch_of(spool[0:spool_i]))
+            spool_i = 0
+          }
+          s.handoff(output, []*FileEvent{event})
+          next_flush_time = time.Now().Add(s.IdleTimeout)
+          last_flush = time.Now()
+          continue
+        }
+
+        if s.Dedup != nil && s.Dedup.Duplicate(event, time.Now()) {
+          dedup_suppressed.Inc()
+          dropped("duplicate", 1)
+          continue
+        }
+
+        if s.Seen != nil && s.Seen.Seen(event.ID) {
+          seen_suppressed.Inc()
+          dropped("seen_before", 1)
+          continue
+        }
+
+        if s.MaxPerSource > 0 {
+          if spool_i == 0 {
+            per_source = make(map[string]int)
+          } else if per_source[*event.Source] >= s.MaxPerSource {
+            // Give the other files a turn.
+            s.handoff(output, batch_of(spool[0:spool_i]))
+            next_flush_time = time.Now().Add(s.IdleTimeout)
+            last_flush = time.Now()
+            spool_i = 0
+            per_source = make(map[string]int)
+          }
+          per_source[*event.Source]++
+        }
+
         //append(spool, event)
         spool[spool_i] = event
         spool_i++
 
         // Flush if full
         if spool_i == cap(spool) { 
-          //spoolcopy := make([]*FileEvent, max_size)
-          var spoolcopy []*FileEvent
-          //fmt.Println(spool[0])
-          spoolcopy = append(spoolcopy, spool[:]...)
-          output <- spoolcopy
-          next_flush_time = time.Now().Add(idle_timeout)
+          s.handoff(output, batch_of(spool))
+          next_flush_time = time.Now().Add(s.IdleTimeout)
+          last_flush = time.Now()
 
+          spool_i = 0
+        } else if s.overdue(spool[0], time.Now()) {
+          // Flush right away to stay within MaxEventAge.
+          s.handoff(output, batch_of(spool[0:spool_i]))
+          next_flush_time = time.Now().Add(s.IdleTimeout)
+          last_flush = time.Now()
+          spool_i = 0
+        }
+      case <- s.EOF:
+        if eof_flush == nil {
+          wait := s.MinFlushInterval - time.Since(last_flush)
+          if wait < eof_flush_settle {
+            wait = eof_flush_settle
+          }
+          eof_flush = time.After(wait)
+        }
+      case <- eof_flush:
+        eof_flush = nil
+        if spool_i > 0 {
+          s.handoff(output, batch_of(spool[0:spool_i]))
+          next_flush_time = time.Now().Add(s.IdleTimeout)
+          last_flush = time.Now()
           spool_i = 0
         }
       case <- ticker.C:
         //fmt.Println("tick")
-        if now := time.Now(); now.After(next_flush_time) {
+        now := time.Now()
+        if now.After(next_flush_time) || (spool_i > 0 && s.overdue(spool[0], now)) {
           // if current time is after the next_flush_time, flush! 
           //fmt.Printf("timeout: %d exceeded by %d\n", idle_timeout,
                      //now.Sub(next_flush_time))
 
           // Flush what we have, if anything
           if spool_i > 0 { 
-            var spoolcopy []*FileEvent
-            spoolcopy = append(spoolcopy, spool[0:spool_i]...)
-            output <- spoolcopy
-            next_flush_time = now.Add(idle_timeout)
+            s.handoff(output, batch_of(spool[0:spool_i]))
+            next_flush_time = now.Add(s.IdleTimeout)
+            last_flush = now
             spool_i = 0
           }
         } /* if 'now' is after 'next_flush_time' */
@@ -60,3 +173,32 @@ func Spool(input chan *FileEvent,
     } /* select */
   } /* for */
 } /* spool */
+
+// Send a batch to the publisher, warning if that stalls.
+func (s *Spooler) handoff(output chan []*FileEvent, batch []*FileEvent) {
+  if s.BackpressureWarn <= 0 {
+    output <- batch
+    return
+  }
+
+  timer := time.NewTimer(s.BackpressureWarn)
+  defer timer.Stop()
+  select {
+    case output <- batch:
+      return
+    case <- timer.C:
+  }
+
+  publisher_backpressure.Inc()
+  log.Printf("WARN: publisher has not taken a batch of %d events in %s; shipping is stalled\n",
+             len(batch), s.BackpressureWarn)
+  start := time.Now()
+  output <- batch
+  log.Printf("Publisher took the stalled batch after %s\n", time.Since(start) + s.BackpressureWarn)
+}
+
+// Has the event waited long enough in the spool that it must be flushed to
+// meet MaxEventAge?
+func (s *Spooler) overdue(event *FileEvent, now time.Time) bool {
+  return s.MaxEventAge > 0 && now.Sub(event.harvested) >= s.MaxEventAge / 2
+}
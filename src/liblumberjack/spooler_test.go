@@ -0,0 +1,193 @@
+package liblumberjack
+
+import "bytes"
+import "io/ioutil"
+import "log"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func spool_event(text string, harvested time.Time) *FileEvent {
+  source := "test"
+  return &FileEvent{Source: &source, Text: &text, harvested: harvested}
+}
+
+func TestSpoolerMaxEventAge(t *testing.T) {
+  input := make(chan *FileEvent)
+  output := make(chan []*FileEvent, 1)
+  spooler := Spooler{MaxSize: 100, IdleTimeout: time.Hour,
+                     MaxEventAge: 200 * time.Millisecond}
+  go spooler.Spool(input, output)
+
+  // An event that is already old must be flushed immediately.
+  input <- spool_event("old", time.Now().Add(-time.Minute))
+  select {
+    case batch := <- output:
+      if len(batch) != 1 || *batch[0].Text != "old" {
+        t.Fatalf("Unexpected batch: %v", batch)
+      }
+    case <- time.After(50 * time.Millisecond):
+      t.Fatal("An old event did not force a flush")
+  }
+
+  // A fresh event must be flushed within the bound, well before the
+  // idle timeout.
+  start := time.Now()
+  input <- spool_event("fresh", start)
+  select {
+    case <- output:
+      if waited := time.Since(start); waited < 100 * time.Millisecond {
+        t.Fatalf("A fresh event was flushed too early (%s)", waited)
+      }
+    case <- time.After(spooler.MaxEventAge):
+      t.Fatal("A fresh event was not flushed within the max event age")
+  }
+}
+
+func TestSpoolerFlushOnEOF(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "bursty")
+  append_file(t, path, "")
+
+  eof := make(chan bool, 1)
+  events := make(chan *FileEvent, 16)
+  output := make(chan []*FileEvent, 2)
+  harvester := Harvester{Path: path, EOF: eof}
+  go harvester.Harvest(events)
+  spooler := Spooler{MaxSize: 100, IdleTimeout: time.Hour, EOF: eof,
+                     MinFlushInterval: 500 * time.Millisecond}
+  go spooler.Spool(events, output)
+  time.Sleep(100 * time.Millisecond)
+
+  // A burst, then a pause, is shipped without waiting out the idle timeout.
+  append_file(t, path, "one\ntwo\nthree\n")
+  var flushed time.Time
+  select {
+    case batch := <- output:
+      if len(batch) != 3 {
+        t.Fatalf("Expected the whole burst in one batch, got %d events", len(batch))
+      }
+      flushed = time.Now()
+    case <- time.After(3 * time.Second):
+      t.Fatal("A burst was not flushed when the harvester reached EOF")
+  }
+
+  // Another burst right away waits for the minimum flush interval.
+  append_file(t, path, "four\n")
+  select {
+    case <- output:
+      if waited := time.Since(flushed); waited < spooler.MinFlushInterval {
+        t.Fatalf("Flushed again after only %s", waited)
+      }
+    case <- time.After(3 * time.Second):
+      t.Fatal("A second burst was not flushed")
+  }
+}
+
+func TestSpoolerBackpressure(t *testing.T) {
+  var logged bytes.Buffer
+  log.SetOutput(&logged)
+  defer log.SetOutput(os.Stderr)
+
+  input := make(chan *FileEvent)
+  output := make(chan []*FileEvent) // nobody is reading yet: a stalled publisher
+  spooler := Spooler{MaxSize: 1, IdleTimeout: time.Hour,
+                     BackpressureWarn: 50 * time.Millisecond}
+  go spooler.Spool(input, output)
+
+  before := publisher_backpressure.Value()
+  input <- spool_event("stuck", time.Now())
+  time.Sleep(150 * time.Millisecond)
+  if publisher_backpressure.Value() != before + 1 {
+    t.Fatalf("Expected the stall to be counted once, got %d", publisher_backpressure.Value() - before)
+  }
+
+  // The batch is still delivered once the publisher catches up.
+  if batch := <-output; len(batch) != 1 || *batch[0].Text != "stuck" {
+    t.Fatalf("Unexpected batch: %v", batch)
+  }
+  log.SetOutput(os.Stderr)
+  if !bytes.Contains(logged.Bytes(), []byte("WARN: publisher has not taken a batch")) {
+    t.Fatalf("Expected a backpressure warning, got log: %s", logged.String())
+  }
+}
+
+func TestSpoolerMaxPerSource(t *testing.T) {
+  input := make(chan *FileEvent)
+  output := make(chan []*FileEvent, 100)
+  spooler := Spooler{MaxSize: 100, IdleTimeout: 100 * time.Millisecond, MaxPerSource: 3}
+  go spooler.Spool(input, output)
+
+  // A chatty file writes 10 lines for each line of two quiet ones.
+  chatty, quiet := "chatty", []string{"quiet1", "quiet2"}
+  for round := 0; round < 3; round++ {
+    for i := 0; i < 10; i++ {
+      input <- &FileEvent{Source: &chatty, Text: &chatty}
+    }
+    for i := range quiet {
+      input <- &FileEvent{Source: &quiet[i], Text: &quiet[i]}
+    }
+  }
+
+  // Without the cap this would all be one batch, with the quiet files'
+  // events waiting behind all 30 of the chatty file's.
+  counts := make(map[string]int)
+  for total := 0; total < 36; {
+    select {
+      case batch := <- output:
+        per_batch := make(map[string]int)
+        for _, event := range batch {
+          per_batch[*event.Source]++
+          counts[*event.Source]++
+        }
+        if per_batch[chatty] > 3 {
+          t.Fatalf("Expected at most 3 chatty events per batch, got %d", per_batch[chatty])
+        }
+        total += len(batch)
+      case <- time.After(time.Second):
+        t.Fatalf("Timed out waiting for batches; got %v", counts)
+    }
+  }
+  if counts[chatty] != 30 || counts["quiet1"] != 3 || counts["quiet2"] != 3 {
+    t.Fatalf("Expected every event shipped, got %v", counts)
+  }
+}
+
+func TestSpoolerSkipsEmptyEvents(t *testing.T) {
+  input := make(chan *FileEvent)
+  output := make(chan []*FileEvent, 1)
+  spooler := Spooler{MaxSize: 2, IdleTimeout: time.Hour}
+  go spooler.Spool(input, output)
+
+  count := drops("empty", func() {
+    input <- nil
+    input <- spool_event("first", time.Now())
+    input <- &FileEvent{}
+    input <- spool_event("second", time.Now())
+    batch := <-output
+    if len(batch) != 2 || *batch[0].Text != "first" || *batch[1].Text != "second" {
+      t.Fatalf("Unexpected batch: %v", batch)
+    }
+  })
+  if count != 2 {
+    t.Fatalf("Expected 2 empty events dropped, got %d", count)
+  }
+}
+
+func BenchmarkSpool(b *testing.B) {
+  input := make(chan *FileEvent)
+  output := make(chan []*FileEvent, 1)
+  spooler := Spooler{MaxSize: 1024, IdleTimeout: time.Hour}
+  go spooler.Spool(input, output)
+
+  event := spool_event("hello", time.Now())
+  b.ReportAllocs()
+  for i := 0; i < b.N; i++ {
+    for j := 0; j < 1024; j++ {
+      input <- event
+    }
+    <-output
+  }
+}
@@ -0,0 +1,84 @@
+package liblumberjack
+
+import (
+  "fmt"
+  zmq "github.com/alecthomas/gozmq"
+  "net"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+// With FFS.SourcePortMin and SourcePortMax, connections to tcp:// endpoints
+// are made from a local port in that range (inclusive), so firewall rules
+// can allow a known egress range. zmq takes the source as part of the
+// endpoint (tcp://source:port;host:port), only from libzmq 4.1 on; the
+// vendored zeromq is older, so builds against it can't use a range (see
+// SourcePortsAvailable).
+//
+// zmq connects in the background and never says a port was taken, so each
+// connect picks a port that can be bound right then, trying the next one
+// in the range if not, and starting after the port last picked by any
+// socket: one connecting from a port an old connection has just left
+// could run into it in TIME_WAIT. zmq's own reconnects, after a server
+// goes away, keep the port the socket was connected from.
+//
+// Every socket holds a port of the range while connected, and warm
+// sockets (Prewarm) and health checks take ports of their own too. Ports
+// in the range are not available to other programs while in use; keep the
+// range out of the system's ephemeral ports (net.ipv4.ip_local_port_range)
+// so the two don't compete, and wide enough for every socket at once.
+
+var source_ports struct {
+  sync.Mutex
+  last int // the port last picked
+}
+
+// Does the libzmq in use take a source in endpoints?
+func SourcePortsAvailable() bool {
+  major, minor, _ := zmq.Version()
+  return major > 4 || (major == 4 && minor >= 1)
+}
+
+// The local address to connect to a tcp:// endpoint from: any of the
+// host's, in the endpoint's address family.
+func source_host(endpoint string) string {
+  if strings.HasPrefix(endpoint, "tcp://[") {
+    return "::"
+  }
+  return "0.0.0.0"
+}
+
+// endpoint, to be connected to from port.
+func source_endpoint(endpoint string, port int) string {
+  return fmt.Sprintf("tcp://%s;%s", net.JoinHostPort(source_host(endpoint), strconv.Itoa(port)),
+                     strings.TrimPrefix(endpoint, "tcp://"))
+}
+
+// The endpoint to connect to, from a source port in the range if set.
+func (s *FFS) connect_address(endpoint string) (string, error) {
+  if s.SourcePortMin <= 0 || !strings.HasPrefix(endpoint, "tcp://") {
+    return endpoint, nil
+  }
+  source := source_host(endpoint)
+
+  source_ports.Lock()
+  defer source_ports.Unlock()
+  count := s.SourcePortMax - s.SourcePortMin + 1
+  next := source_ports.last + 1
+  if next < s.SourcePortMin || next > s.SourcePortMax {
+    next = s.SourcePortMin
+  }
+  for i := 0; i < count; i++ {
+    port := s.SourcePortMin + (next - s.SourcePortMin + i) % count
+    address := net.JoinHostPort(source, strconv.Itoa(port))
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+      continue // taken
+    }
+    listener.Close()
+    source_ports.last = port
+    return source_endpoint(endpoint, port), nil
+  }
+  return "", fmt.Errorf("no free source port in %d-%d", s.SourcePortMin, s.SourcePortMax)
+} /* FFS#connect_address */
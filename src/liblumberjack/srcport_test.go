@@ -0,0 +1,39 @@
+package liblumberjack
+
+import "net"
+import "testing"
+
+func TestSourcePortRange(t *testing.T) {
+  // Take the first port of the range, so connecting has to move past it.
+  taken, err := net.Listen("tcp", "0.0.0.0:47393")
+  if err != nil {
+    t.Fatalf("Listen failed: %s", err)
+  }
+  defer taken.Close()
+
+  socket := FFS{SourcePortMin: 47393, SourcePortMax: 47395}
+  source_ports.last = 0
+
+  // Each connection from the next free port in the range, round again
+  // once it's used up.
+  for _, expected := range []string{"47394", "47395", "47394"} {
+    address, err := socket.connect_address("tcp://127.0.0.1:47396")
+    if err != nil || address != "tcp://0.0.0.0:" + expected + ";127.0.0.1:47396" {
+      t.Fatalf("Expected to connect from port %s, got %s (%v)", expected, address, err)
+    }
+  }
+  if address := source_endpoint("tcp://[::1]:5005", 47394); address != "tcp://[::]:47394;[::1]:5005" {
+    t.Fatalf("Expected an ipv6 endpoint connected to from ::, got %s", address)
+  }
+
+  // Only tcp endpoints have ports.
+  if address, _ := socket.connect_address("ipc:///tmp/lumberjack.sock"); address != "ipc:///tmp/lumberjack.sock" {
+    t.Fatalf("Expected an ipc endpoint left alone, got %s", address)
+  }
+
+  // Nothing free: an error, which ensure_connect retries.
+  busy := FFS{SourcePortMin: 47393, SourcePortMax: 47393}
+  if _, err := busy.connect_address("tcp://127.0.0.1:47396"); err == nil {
+    t.Fatal("Expected an error with every port in the range taken")
+  }
+}
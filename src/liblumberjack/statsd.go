@@ -0,0 +1,123 @@
+package liblumberjack
+
+import (
+  "bytes"
+  "fmt"
+  "log"
+  "net"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// Maximum size of a statsd packet; small enough to avoid IP fragmentation.
+const statsd_packet_size = 1400
+
+// StatsdSink pushes all metrics to a statsd (or dogstatsd) server over UDP,
+// in addition to the Prometheus /metrics endpoint. Counters are sent as
+// statsd counters ("|c"), histogram observations as histograms ("|h",
+// which plain statsd treats as timers) and gauges as gauges ("|g").
+//
+// Updates are aggregated and sent once per flush interval, so the hot path
+// never touches the network.
+type StatsdSink struct {
+  conn net.Conn
+  quit chan bool // closed by Stop
+
+  lock sync.Mutex
+  counts map[string]uint64
+  gauges map[string]float64 // the latest value of each
+  observations []string
+}
+
+// Start sending metrics to the statsd server at addr (host:port) every
+// interval, until Stop is called.
+func StartStatsd(addr string, interval time.Duration) (*StatsdSink, error) {
+  conn, err := net.Dial("udp", addr)
+  if err != nil {
+    return nil, err
+  }
+
+  s := &StatsdSink{conn: conn, quit: make(chan bool), counts: make(map[string]uint64),
+                   gauges: make(map[string]float64)}
+  add_sink(s)
+  go func() {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+      select {
+        case <-ticker.C:
+          s.flush()
+        case <-s.quit:
+          return
+      }
+    }
+  }()
+  return s, nil
+}
+
+// Stop sending metrics. Whatever wasn't flushed yet is dropped.
+func (s *StatsdSink) Stop() {
+  remove_sink(s)
+  close(s.quit)
+  s.conn.Close()
+}
+
+func (s *StatsdSink) count(name string, delta uint64) {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  s.counts[name] += delta
+}
+
+func (s *StatsdSink) observe(name string, value float64) {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  s.observations = append(s.observations,
+    fmt.Sprintf("%s:%s|h", name, strconv.FormatFloat(value, 'g', -1, 64)))
+}
+
+func (s *StatsdSink) gauge(name string, value float64) {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  s.gauges[name] = value
+}
+
+// Send everything aggregated since the last flush.
+func (s *StatsdSink) flush() {
+  s.lock.Lock()
+  lines := s.observations
+  s.observations = nil
+  for name, count := range s.counts {
+    lines = append(lines, fmt.Sprintf("%s:%d|c", name, count))
+  }
+  s.counts = make(map[string]uint64)
+  for name, value := range s.gauges {
+    lines = append(lines, fmt.Sprintf("%s:%s|g", name, strconv.FormatFloat(value, 'g', -1, 64)))
+  }
+  s.gauges = make(map[string]float64)
+  s.lock.Unlock()
+
+  // Pack as many newline-separated lines into each packet as will fit.
+  var packet bytes.Buffer
+  for _, line := range lines {
+    if packet.Len() > 0 && packet.Len() + 1 + len(line) > statsd_packet_size {
+      s.send(packet.Bytes())
+      packet.Reset()
+    }
+    if packet.Len() > 0 {
+      packet.WriteByte('\n')
+    }
+    packet.WriteString(line)
+  }
+  if packet.Len() > 0 {
+    s.send(packet.Bytes())
+  }
+}
+
+func (s *StatsdSink) send(packet []byte) {
+  _, err := s.conn.Write(packet)
+  if err != nil {
+    log.Printf("Failed sending metrics to statsd at %s: %s\n",
+               s.conn.RemoteAddr(), err)
+  }
+}
@@ -0,0 +1,57 @@
+package liblumberjack
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// CheckPaths returns an error for each of the paths (or globs) that can't
+// be read for lack of permission: the file itself, the files a glob
+// matches, or the directory a glob lists. Paths that don't exist are fine,
+// since logs may appear later.
+func CheckPaths(paths []string) (errors []error) {
+  for _, path := range paths {
+    if path == "-" {
+      continue
+    }
+
+    // The directory that has to be listed to evaluate the glob.
+    dir := path
+    for strings.ContainsAny(dir, "*?[\\") {
+      dir = filepath.Dir(dir)
+    }
+    if dir != path {
+      if err := check_readable(dir); err != nil {
+        errors = append(errors, fmt.Errorf("%s: %s", path, err))
+        continue
+      }
+    }
+
+    matches, _ := filepath.Glob(path)
+    if len(matches) == 0 && dir == path {
+      matches = []string{path}
+    }
+    for _, match := range matches {
+      if err := check_readable(match); err != nil {
+        errors = append(errors, fmt.Errorf("%s: %s", path, err))
+      }
+    }
+  }
+  return
+}
+
+// Returns an error if the path exists but can't be read. Opening a
+// directory needs the same permission as listing it.
+func check_readable(path string) error {
+  file, err := os.Open(path)
+  if err == nil {
+    file.Close()
+    return nil
+  }
+  if os.IsPermission(err) {
+    return fmt.Errorf("permission denied reading %s", path)
+  }
+  return nil // missing, or some error a harvester will retry
+}
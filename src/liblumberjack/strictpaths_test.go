@@ -0,0 +1,33 @@
+package liblumberjack
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+
+func TestCheckPaths(t *testing.T) {
+  if os.Getuid() == 0 {
+    t.Skip("root can read anything")
+  }
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+
+  locked := filepath.Join(dir, "locked")
+  os.Mkdir(locked, 0000)
+  defer os.Chmod(locked, 0755)
+  readable := filepath.Join(dir, "readable.log")
+  append_file(t, readable, "")
+
+  errors := CheckPaths([]string{
+    filepath.Join(locked, "*.log"),
+    readable,
+    filepath.Join(dir, "not-yet.log"),
+  })
+  if len(errors) != 1 {
+    t.Fatalf("Expected one error, for the unreadable directory; got %v", errors)
+  }
+  if !strings.Contains(errors[0].Error(), "permission denied reading " + locked) {
+    t.Fatalf("Unclear error: %s", errors[0])
+  }
+}
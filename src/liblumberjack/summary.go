@@ -0,0 +1,66 @@
+package liblumberjack
+
+import (
+  "fmt"
+  "time"
+)
+
+// Totals for the summary logged on exit with -exit-summary, for backfill
+// and other batch jobs. They are metrics too.
+var events_harvested = NewCounter("lumberjack_events_harvested_total",
+  "Events read from files by the harvesters.")
+var bytes_harvested = NewCounter("lumberjack_bytes_harvested_total",
+  "Bytes read from files by the harvesters, line terminators included.")
+var files_harvested = NewCounter("lumberjack_files_harvested_total",
+  "Harvesters started, about one per file, plus one per rotation.")
+var batches_shipped = NewCounter("lumberjack_batches_shipped_total",
+  "Batches acknowledged by every required pool.")
+var events_shipped = NewCounter("lumberjack_events_shipped_total",
+  "Events in the batches acknowledged by every required pool.")
+var bytes_shipped = NewCounter("lumberjack_bytes_shipped_total",
+  "Bytes of ciphertext in the batches acknowledged by every required pool.")
+var send_failures = NewCounter("lumberjack_send_failures_total",
+  "Attempts to send a batch to a pool that failed and were retried or given up on.")
+
+var started = time.Now()
+
+type summary struct {
+  runtime time.Duration
+  events_harvested, bytes_harvested, files uint64
+  events_shipped, bytes_shipped, batches uint64
+  send_failures, dropped uint64
+  drops string
+}
+
+func take_summary() (s summary) {
+  s.runtime = time.Since(started)
+  s.events_harvested = events_harvested.Value()
+  s.bytes_harvested = bytes_harvested.Value()
+  s.files = files_harvested.Value()
+  s.events_shipped = events_shipped.Value()
+  s.bytes_shipped = bytes_shipped.Value()
+  s.batches = batches_shipped.Value()
+  s.send_failures = send_failures.Value()
+  drops := events_dropped.Values()
+  for _, count := range drops {
+    s.dropped += count
+  }
+  s.drops = drop_summary(nil, drops)
+  return
+}
+
+func (s summary) String() string {
+  text := fmt.Sprintf("ran %s; harvested %d events (%d bytes) from %d files; shipped %d events in %d batches (%d bytes); %d failed send attempts; dropped %d events",
+                      s.runtime, s.events_harvested, s.bytes_harvested, s.files,
+                      s.events_shipped, s.batches, s.bytes_shipped,
+                      s.send_failures, s.dropped)
+  if s.drops != "" {
+    text += " (" + s.drops + ")"
+  }
+  return text
+}
+
+// ExitSummary describes everything done since startup, in one line.
+func ExitSummary() string {
+  return take_summary().String()
+}
@@ -0,0 +1,76 @@
+package liblumberjack
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sodium"
+import "strings"
+import "testing"
+import "time"
+
+func TestExitSummary(t *testing.T) {
+  endpoint := "tcp://127.0.0.1:47378"
+  public, secret := sodium.CryptoBoxKeypair()
+  received := make(chan []*FileEvent, 4)
+  server := stub_server(t, endpoint, sodium.NewSession(public, secret), received)
+  defer server.Close()
+
+  dir, _ := ioutil.TempDir("", "lumberjack-test")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "app.log")
+  append_file(t, path, strings.Repeat("0123456789\n", 10))
+
+  // The counters are process-wide, so compare before and after.
+  before := take_summary()
+
+  events := make(chan *FileEvent, 16)
+  batches := make(chan []*FileEvent, 1)
+  harvester := Harvester{Path: path, from_beginning: true, stop_at_eof: true}
+  spooler := Spooler{MaxSize: 4, IdleTimeout: 50 * time.Millisecond}
+  go spooler.Spool(events, batches)
+  publisher := Publisher{Servers: []string{endpoint}, PublicKey: public,
+                         SecretKey: secret, Timeout: time.Second}
+  published := make(chan bool)
+  go func() {
+    publisher.Publish(batches, nil)
+    close(published)
+  }()
+  harvester.Harvest(events)
+
+  // 10 events, in batches of 4, 4 and 2.
+  for shipped := 0; shipped < 10; {
+    select {
+      case batch := <-received:
+        shipped += len(batch)
+      case <-time.After(3 * time.Second):
+        t.Fatalf("Timed out waiting for the events to ship")
+    }
+  }
+  // Nothing is left spooled, so the spooler won't hand off another batch;
+  // once Publish returns, the last ack has been counted.
+  close(batches)
+  <-published
+
+  after := take_summary()
+  if n := after.events_harvested - before.events_harvested; n != 10 {
+    t.Fatalf("Expected 10 events harvested, got %d", n)
+  }
+  if n := after.bytes_harvested - before.bytes_harvested; n != 110 {
+    t.Fatalf("Expected 110 bytes harvested, got %d", n)
+  }
+  if n := after.files - before.files; n != 1 {
+    t.Fatalf("Expected 1 file harvested, got %d", n)
+  }
+  if n := after.events_shipped - before.events_shipped; n != 10 {
+    t.Fatalf("Expected 10 events shipped, got %d", n)
+  }
+  if n := after.batches - before.batches; n != 3 {
+    t.Fatalf("Expected 3 batches shipped, got %d", n)
+  }
+  if after.bytes_shipped <= before.bytes_shipped || after.send_failures != before.send_failures {
+    t.Fatalf("Expected bytes shipped and no failures, got %s", after)
+  }
+  if text := after.String(); !strings.Contains(text, "ran ") || !strings.Contains(text, "batches") {
+    t.Fatalf("Unexpected summary: %s", text)
+  }
+}
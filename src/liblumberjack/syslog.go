@@ -0,0 +1,242 @@
+package liblumberjack
+
+import (
+  "errors"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Syslog line formats, for SyslogCodec.Format.
+//
+// RFC3164 is the classic BSD format most syslog daemons write to files:
+// "Oct 14 10:00:00 host sshd[123]: message", with an optional <priority>
+// in front (files usually lack it). RFC5424 lines always start with the
+// priority and a version: "<34>1 2026-10-14T10:00:00Z host app 123 ID47
+// [sd@1 key="value"] message". SYSLOG_AUTO picks per line.
+const (
+  SYSLOG_AUTO = "auto"
+  SYSLOG_RFC3164 = "rfc3164"
+  SYSLOG_RFC5424 = "rfc5424"
+)
+
+// SyslogCodec parses syslog lines into fields: "priority", "facility" and
+// "severity" (if the line has a priority), "timestamp" (RFC3339),
+// "hostname", "tag" (the program, or APP-NAME in RFC5424), "pid" (or
+// PROCID), "message" and, for RFC5424 only, "msgid" and "structured_data"
+// (an object of SD-IDs, each an object of its params). Fields the line
+// leaves out, or gives as "-", are left out.
+//
+// Lines that don't parse are shipped as plain text, unless MarkMalformed
+// is set: then they are shipped as fields too, the line in "message" and
+// why it didn't parse in "syslog_error", so every event has a message
+// field to search.
+type SyslogCodec struct {
+  Format string
+  MarkMalformed bool
+}
+
+func (c *SyslogCodec) Decode(event *FileEvent) {
+  line := *event.Text
+  var fields map[string]interface{}
+  var err error
+  switch c.Format {
+    case SYSLOG_RFC3164:
+      fields, err = parse_rfc3164(line, time.Now())
+    case SYSLOG_RFC5424:
+      fields, err = parse_rfc5424(line)
+    default:
+      if is_rfc5424(line) {
+        fields, err = parse_rfc5424(line)
+      } else {
+        fields, err = parse_rfc3164(line, time.Now())
+      }
+  }
+  if err != nil {
+    if !c.MarkMalformed {
+      return // ship the raw line.
+    }
+    fields = map[string]interface{}{"message": line, "syslog_error": err.Error()}
+  }
+  event.Fields = fields
+  event.Text = nil
+} /* SyslogCodec#Decode */
+
+// RFC5424 lines have a version (only 1 so far) right after the priority.
+func is_rfc5424(line string) bool {
+  _, rest, err := parse_priority(line)
+  return err == nil && strings.HasPrefix(rest, "1 ")
+}
+
+// Parse a leading "<PRI>", 0 to 191.
+func parse_priority(line string) (priority int, rest string, err error) {
+  end := strings.IndexByte(line, '>')
+  if !strings.HasPrefix(line, "<") || end < 2 || end > 4 {
+    return 0, line, errors.New("no priority")
+  }
+  priority, err = strconv.Atoi(line[1:end])
+  if err != nil || priority < 0 || priority > 191 {
+    return 0, line, errors.New("bad priority " + line[1:end])
+  }
+  return priority, line[end + 1:], nil
+}
+
+func set_priority(fields map[string]interface{}, priority int) {
+  fields["priority"] = priority
+  fields["facility"] = priority / 8
+  fields["severity"] = priority % 8
+}
+
+// RFC3164 timestamps carry no year; assume this one, unless that puts the
+// time more than a day ahead of now, so December lines read in January
+// are last year's.
+func parse_rfc3164(line string, now time.Time) (map[string]interface{}, error) {
+  fields := make(map[string]interface{})
+  if priority, rest, err := parse_priority(line); err == nil {
+    set_priority(fields, priority)
+    line = rest
+  }
+
+  if len(line) < len(time.Stamp) + 1 || line[len(time.Stamp)] != ' ' {
+    return nil, errors.New("no timestamp")
+  }
+  stamp, err := time.ParseInLocation(time.Stamp, line[:len(time.Stamp)], now.Location())
+  if err != nil {
+    return nil, errors.New("bad timestamp " + line[:len(time.Stamp)])
+  }
+  stamp = stamp.AddDate(now.Year(), 0, 0)
+  if stamp.Sub(now) > 24 * time.Hour {
+    stamp = stamp.AddDate(-1, 0, 0)
+  }
+  fields["timestamp"] = stamp.Format(time.RFC3339)
+  line = line[len(time.Stamp) + 1:]
+
+  hostname, line := next_token(line)
+  if hostname == "" {
+    return nil, errors.New("no hostname")
+  }
+  fields["hostname"] = hostname
+
+  // "tag[pid]: message" or "tag: message"; without the colon there is no
+  // tag, only a message.
+  token, rest := next_token(line)
+  if strings.HasSuffix(token, ":") {
+    tag := token[:len(token) - 1]
+    if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+      fields["pid"] = tag[open + 1:len(tag) - 1]
+      tag = tag[:open]
+    }
+    fields["tag"] = tag
+    line = rest
+  }
+  fields["message"] = line
+  return fields, nil
+} /* parse_rfc3164 */
+
+func parse_rfc5424(line string) (map[string]interface{}, error) {
+  fields := make(map[string]interface{})
+  priority, line, err := parse_priority(line)
+  if err != nil {
+    return nil, err
+  }
+  set_priority(fields, priority)
+  version, line := next_token(line)
+  if version != "1" {
+    return nil, errors.New("unknown version " + version)
+  }
+
+  stamp, line := next_token(line)
+  if stamp != "-" {
+    parsed, err := time.Parse(time.RFC3339Nano, stamp)
+    if err != nil {
+      return nil, errors.New("bad timestamp " + stamp)
+    }
+    fields["timestamp"] = parsed.Format(time.RFC3339Nano)
+  }
+  for _, name := range []string{"hostname", "tag", "pid", "msgid"} {
+    var value string
+    value, line = next_token(line)
+    if value == "" {
+      return nil, errors.New("no " + name)
+    }
+    if value != "-" {
+      fields[name] = value
+    }
+  }
+
+  if strings.HasPrefix(line, "-") {
+    line = line[1:]
+  } else if !strings.HasPrefix(line, "[") {
+    return nil, errors.New("no structured data")
+  } else {
+    data, rest, err := parse_structured_data(line)
+    if err != nil {
+      return nil, err
+    }
+    fields["structured_data"] = data
+    line = rest
+  }
+  if line != "" {
+    if line[0] != ' ' {
+      return nil, errors.New("no space before the message")
+    }
+    // A message may start with a UTF-8 byte order mark.
+    fields["message"] = strings.TrimPrefix(line[1:], "\xef\xbb\xbf")
+  }
+  return fields, nil
+} /* parse_rfc5424 */
+
+// Parse one or more "[id name="value" ...]" elements. Values may escape
+// '"', '\' and ']' with a backslash.
+func parse_structured_data(line string) (map[string]interface{}, string, error) {
+  data := make(map[string]interface{})
+  for strings.HasPrefix(line, "[") {
+    line = line[1:]
+    end := strings.IndexAny(line, " ]")
+    if end < 1 {
+      return nil, line, errors.New("bad structured data")
+    }
+    params := make(map[string]interface{})
+    data[line[:end]] = params
+    line = line[end:]
+    for strings.HasPrefix(line, " ") {
+      line = line[1:]
+      equals := strings.Index(line, "=\"")
+      if equals < 1 {
+        return nil, line, errors.New("bad structured data param")
+      }
+      name := line[:equals]
+      line = line[equals + 2:]
+      var value []byte
+      for {
+        if line == "" {
+          return nil, line, errors.New("unterminated structured data value")
+        }
+        if line[0] == '"' {
+          line = line[1:]
+          break
+        }
+        if line[0] == '\\' && len(line) > 1 && strings.IndexByte("\"\\]", line[1]) >= 0 {
+          line = line[1:]
+        }
+        value = append(value, line[0])
+        line = line[1:]
+      }
+      params[name] = string(value)
+    }
+    if !strings.HasPrefix(line, "]") {
+      return nil, line, errors.New("unterminated structured data")
+    }
+    line = line[1:]
+  }
+  return data, line, nil
+} /* parse_structured_data */
+
+// Split at the first space; runs of spaces (as in "Oct  1") are skipped.
+func next_token(line string) (token string, rest string) {
+  line = strings.TrimLeft(line, " ")
+  if space := strings.IndexByte(line, ' '); space >= 0 {
+    return line[:space], line[space + 1:]
+  }
+  return line, ""
+}
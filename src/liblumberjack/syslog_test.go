@@ -0,0 +1,84 @@
+package liblumberjack
+
+import "testing"
+import "time"
+
+func decode_syslog(codec *SyslogCodec, line string) *FileEvent {
+  source := "test"
+  event := &FileEvent{Source: &source, Text: &line}
+  codec.Decode(event)
+  return event
+}
+
+func TestSyslogCodecRFC3164(t *testing.T) {
+  now := time.Date(2026, time.October, 14, 12, 0, 0, 0, time.UTC)
+  fields, err := parse_rfc3164("<38>Oct  9 22:14:15 mymachine sshd[4123]: Accepted publickey for bob", now)
+  if err != nil {
+    t.Fatalf("Failed to parse: %s", err)
+  }
+  expected := map[string]interface{}{
+    "priority": 38, "facility": 4, "severity": 6,
+    "timestamp": "2026-10-09T22:14:15Z",
+    "hostname": "mymachine", "tag": "sshd", "pid": "4123",
+    "message": "Accepted publickey for bob",
+  }
+  for name, value := range expected {
+    if fields[name] != value {
+      t.Fatalf("Expected %s %v, got %v (of %v)", name, value, fields[name], fields)
+    }
+  }
+
+  // As written to files: no priority, and no pid here.
+  fields, err = parse_rfc3164("Dec 31 23:59:59 host cron: job done", now)
+  if err != nil {
+    t.Fatalf("Failed to parse: %s", err)
+  }
+  if fields["tag"] != "cron" || fields["message"] != "job done" ||
+     fields["timestamp"] != "2025-12-31T23:59:59Z" {
+    t.Fatalf("Unexpected fields %v", fields)
+  }
+  for _, name := range []string{"priority", "pid"} {
+    if _, ok := fields[name]; ok {
+      t.Fatalf("Expected no %s, got %v", name, fields[name])
+    }
+  }
+
+  // Without a tag, the rest is the message.
+  fields, _ = parse_rfc3164("Oct 14 10:00:00 host kernel panic imminent", now)
+  if _, ok := fields["tag"]; ok || fields["message"] != "kernel panic imminent" {
+    t.Fatalf("Unexpected fields %v", fields)
+  }
+}
+
+func TestSyslogCodecRFC5424(t *testing.T) {
+  codec := &SyslogCodec{Format: SYSLOG_AUTO}
+  event := decode_syslog(codec, `<165>1 2026-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventID="10\"11\]"][origin ip="192.0.2.1"] An application event`)
+  assert_fields(t, event, `{"facility":20,"hostname":"mymachine.example.com",` +
+    `"message":"An application event","msgid":"ID47","priority":165,"severity":5,` +
+    `"structured_data":{"exampleSDID@32473":{"eventID":"10\"11]","iut":"3"},"origin":{"ip":"192.0.2.1"}},` +
+    `"tag":"evntslog","timestamp":"2026-10-11T22:14:15.003Z"}`)
+
+  event = decode_syslog(codec, "<34>1 - - su 123 - -")
+  assert_fields(t, event, `{"facility":4,"pid":"123","priority":34,"severity":2,"tag":"su"}`)
+}
+
+func TestSyslogCodecMalformed(t *testing.T) {
+  lines := map[string]string{
+    "not syslog at all": SYSLOG_AUTO,
+    "<999>Oct 14 10:00:00 host app: message": SYSLOG_RFC3164,
+    "<34>1 yesterday host app - - - message": SYSLOG_AUTO,
+    "<34>1 2026-10-11T22:14:15Z host app - - [unterminated": SYSLOG_RFC5424,
+    "Oct 14 10:00:00 host sshd: rfc3164": SYSLOG_RFC5424,
+  }
+  for line, format := range lines {
+    event := decode_syslog(&SyslogCodec{Format: format}, line)
+    if event.Text == nil || *event.Text != line || event.Fields != nil {
+      t.Fatalf("Expected %q shipped as plain text", line)
+    }
+
+    event = decode_syslog(&SyslogCodec{Format: format, MarkMalformed: true}, line)
+    if event.Text != nil || event.Fields["message"] != line || event.Fields["syslog_error"] == nil {
+      t.Fatalf("Expected %q shipped as a marked message, got %v", line, event.Fields)
+    }
+  }
+}
@@ -0,0 +1,31 @@
+package liblumberjack
+
+import (
+  "encoding/json"
+  "time"
+)
+
+// With Publisher.Trace, each batch shipped (or given up on) is traced: a
+// JSON batch_timing record, one per line, of the time each stage took and
+// the sizes it produced, to find which stage is the bottleneck under load.
+// Stages are only timed while tracing.
+type batch_timing struct {
+  Events int `json:"events"`
+  MarshalMs float64 `json:"marshal_ms"` // serializing the events
+  CompressMs float64 `json:"compress_ms"`
+  EncryptMs float64 `json:"encrypt_ms"`
+  SendMs float64 `json:"send_ms"` // sending to every pool, until acknowledged
+  RawBytes int `json:"raw_bytes"`
+  CompressedBytes int `json:"compressed_bytes"` // the payload, codec byte and all
+  CiphertextBytes int `json:"ciphertext_bytes"`
+  Acked bool `json:"acked"`
+}
+
+func milliseconds(d time.Duration) float64 {
+  return float64(d) / float64(time.Millisecond)
+}
+
+func (p *Publisher) trace(timing *batch_timing) {
+  data, _ := json.Marshal(timing)
+  p.Trace.Write(append(data, '\n'))
+}
@@ -0,0 +1,77 @@
+package liblumberjack
+
+import (
+  "log"
+  "os"
+  "sort"
+  "time"
+)
+
+// With Prospector.MaxTrackedFiles, the prospector forgets the files it
+// tracks past that many (their stat data, fingerprint, etc) after each
+// round of scans, least recently modified first, so a tree of millions of
+// files doesn't hold state for every one. Files with a harvester running
+// are never forgotten.
+//
+// A forgotten file is left alone by later scans until it is modified
+// again: any file not tracked whose mtime is no later than the latest
+// forgotten one is taken to be a forgotten file. When one changes it is
+// found again as a new file, and like any new file found after startup,
+// it is read from its end: nothing records where reading it stopped, so
+// what was written between it being forgotten and found again is not
+// shipped. A file that is genuinely new but has an old mtime (moved in
+// from elsewhere, say) is also left alone until modified.
+//
+// Paths entries with forgotten files are always scanned in full, since
+// modifying a file doesn't change its directory; see scancache.go.
+
+var tracked_files = NewGauge("lumberjack_tracked_files",
+  "Files the prospector holds state for.")
+
+// Forget the least recently modified files over MaxTrackedFiles.
+func (p *Prospector) forget_inactive(fileinfo map[string]os.FileInfo) {
+  defer func() { tracked_files.Set(float64(len(fileinfo))) }()
+  if p.MaxTrackedFiles <= 0 || len(fileinfo) <= p.MaxTrackedFiles {
+    return
+  }
+
+  var idle []string
+  harvesters_lock.Lock()
+  for path := range fileinfo {
+    if active_harvesters[path] == 0 {
+      idle = append(idle, path)
+    }
+  }
+  harvesters_lock.Unlock()
+  sort.Slice(idle, func(i, j int) bool {
+    return fileinfo[idle[i]].ModTime().Before(fileinfo[idle[j]].ModTime())
+  })
+
+  if p.forgotten_entries == nil {
+    p.forgotten_entries = make(map[string]bool)
+  }
+  excess := len(fileinfo) - p.MaxTrackedFiles
+  if excess > len(idle) {
+    excess = len(idle) // the rest are being harvested
+  }
+  for _, path := range idle[:excess] {
+    if mtime := fileinfo[path].ModTime(); mtime.After(p.forgotten_through) {
+      p.forgotten_through = mtime
+    }
+    if entry, ok := p.entry_of[path]; ok {
+      p.forgotten_entries[entry] = true
+    }
+    delete(fileinfo, path)
+    delete(p.fingerprints, path)
+    delete(p.rechecks, path)
+    delete(p.entry_of, path)
+  }
+  log.Printf("Forgot %d files not modified since %s, to track at most %d\n",
+             excess, p.forgotten_through.Format(time.RFC3339), p.MaxTrackedFiles)
+}
+
+// Is a file not tracked one forgotten by forget_inactive and not modified
+// since?
+func (p *Prospector) forgotten(info os.FileInfo) bool {
+  return !p.forgotten_through.IsZero() && !info.ModTime().After(p.forgotten_through)
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+  "fmt"
+  "io"
   "log"
   lumberjack "liblumberjack"
   "os"
+  "os/signal"
+  "regexp"
+  "syscall"
   "time"
   "flag"
   "strings"
@@ -12,12 +17,123 @@ import (
 )
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+var exit_summary = flag.Bool("exit-summary", false, "Log a summary of everything harvested, shipped and dropped when exiting, after -replay or on SIGINT or SIGTERM.")
+var log_file = flag.String("log-file", "", "Write lumberjack's own log to this file instead of stderr.")
+var error_file = flag.String("error-file", "", "Also write errors worth alerting on (failures to read files or ship batches, unreadable keys...) to this file (rotated like -log-file), or '-' for stdout, as one JSON record per line with a code, message and context.")
+var log_max_size = flag.Int64("log-max-size", 0, "Rotate -log-file once it would grow past this many bytes. 0 never rotates.")
+var log_max_files = flag.Int("log-max-files", 5, "Number of rotated -log-file files to keep.")
 var spool_size = flag.Uint64("spool-size", 1024, "Maximum number of events to spool before a flush is forced.")
 var idle_timeout = flag.Duration("idle-flush-time", 5 * time.Second, "Maximum time to wait for a full spool before flushing anyway")
+var eof_flush_interval = flag.Duration("eof-flush-interval", 0, "If nonzero, flush the spool soon after a harvester reaches the end of a file instead of waiting for -idle-flush-time, but at most this often. 0 disables.")
+var max_event_age = flag.Duration("max-event-age", 0, "Hard limit on the time from reading an event to shipping it. Batches are flushed early to meet it, and batches shipped later are logged as violations. 0 disables.")
+var max_per_source = flag.Int("max-per-source", 0, "Flush a batch early once it holds this many events from one file, so other files get a turn. 0 disables.")
+var publisher_buffer = flag.Int("publisher-buffer", 1, "Number of flushed batches that can wait for the publisher before the spooler blocks.")
+var backpressure_warn = flag.Duration("backpressure-warn", 0, "Log a warning if the spooler waits longer than this to hand a batch to the publisher. 0 disables.")
+var dedup_window = flag.Int("dedup-window", 0, "Drop events whose text matches one of the last N spooled events. 0 disables deduplication.")
+var dedup_max_age = flag.Duration("dedup-max-age", 0, "When deduplicating, only consider events seen within this much time. 0 means no age limit.")
+var codec = flag.String("codec", "", "How to decode each line. The default ships lines as plain text; 'json' parses each line as a JSON object; 'syslog' parses syslog lines into their priority, timestamp, hostname, tag and message.")
+var syslog_format = flag.String("syslog-format", "auto", "With -codec syslog, the format of the lines: 'rfc3164' (classic BSD syslog), 'rfc5424', or 'auto' to tell them apart line by line.")
+var syslog_mark_malformed = flag.Bool("syslog-mark-malformed", false, "With -codec syslog, ship lines that don't parse as fields too, the line in 'message' and why it didn't parse in 'syslog_error', rather than as plain text.")
+var include_fields = flag.String("include-fields", "", "With -codec json, a comma-separated list of the fields to ship (dots select nested fields, eg 'request.path'). All fields are shipped if empty.")
+var json_max_depth = flag.Int("json-max-depth", 0, "With -codec json, the deepest objects and arrays may nest, the line's object being 1. 0 means no limit.")
+var json_depth_policy = flag.String("json-depth-policy", "truncate", "With -json-max-depth, what to do with lines nested deeper: 'truncate' replaces what is too deep with a marker; 'flatten' folds it into dotted keys; 'raw' ships the line as plain text.")
+var exclude_fields = flag.String("exclude-fields", "", "With -codec json, a comma-separated list of fields to never ship, such as passwords or tokens.")
+var strict_paths = flag.Bool("strict-paths", false, "Refuse to start if any path given can't be read for lack of permission. Paths that don't exist yet are fine.")
+var skip_binary = flag.Bool("skip-binary", false, "Don't harvest files that look binary (contain NUL bytes), such as wtmp or compressed archives.")
+var keep_line_ending = flag.Bool("keep-line-ending", false, "Ship each line with its trailing newline (\\n or \\r\\n) instead of stripping it.")
+var skip_header_lines = flag.Uint64("skip-header-lines", 0, "Discard this many lines, such as a CSV header, at the start of each file read from its beginning.")
+var since = flag.String("since", "", "Only ship lines timestamped at or after this time (RFC 3339), as found by -timestamp-pattern and parsed with -timestamp-layout.")
+var timestamp_pattern = flag.String("timestamp-pattern", `^(\S+)`, "With -since, a regular expression finding each line's timestamp: its first group, or else the whole match.")
+var timestamp_layout = flag.String("timestamp-layout", time.RFC3339, "With -since, how timestamps are written, as a Go time layout. Timestamps without a zone are taken as UTC.")
+var since_unparsed = flag.String("since-unparsed", "ship", "With -since, what to do with lines without a timestamp that parses: ship or drop.")
+var context_before = flag.Int("context-before", 0, "Give each event matching -context-pattern the lines before it in its file, up to this many (and 64KB), as a list in -context-field. 0 disables.")
+var context_pattern = flag.String("context-pattern", "", "With -context-before, a regular expression for the lines, such as errors, to give context to.")
+var context_field = flag.String("context-field", "context_before", "With -context-before, the field to put the preceding lines in.")
+var mtime_field = flag.String("mtime-field", "", "If set, add the source file's modification time to every event as a field of this name.")
+var ip_field = flag.String("ip-field", "", "If set, add this host's IP address to every event as a field of this name.")
+var host_ip = flag.String("ip", "", "With -ip-field, the IP address to use. Defaults to the address used to reach the first server.")
+var stat_refresh = flag.Bool("stat-refresh", false, "Stat files by opening them, for fresh results on NFS, which may cache stat data. Costs an open per file per scan.")
+var fingerprint_identity = flag.Bool("fingerprint-identity", false, "Treat a file whose inode changed but whose first bytes didn't as the same file, for NFS setups that report changing inodes. A rotated log that starts the same as the old one isn't noticed until its content differs.")
+var max_harvesters = flag.Int("max-harvesters", 0, "The most files to harvest at once; others wait their turn. 0 is unlimited.")
+var max_harvesters_per_path = flag.Int("max-harvesters-per-path", 0, "The most files to harvest at once for any one path or glob given, so one big directory can't use up -max-harvesters. 0 is unlimited.")
+var max_tracked_files = flag.Int("max-tracked-files", 0, "The most files the prospector holds state for, to bound its memory on huge trees. Past it, the least recently modified files not being harvested are forgotten until they are modified again; then they are read from their end as new files, so what was written meanwhile is not shipped. 0 is unlimited.")
+var follow_dir_symlinks = flag.Bool("follow-dir-symlinks", false, "Descend into symlinked directories when expanding ** in paths. Each directory is still only visited once.")
+var exclude_files = flag.String("exclude-files", "", "Comma-separated globs of files never to harvest, even if a path matches them, such as *.gz,*.tmp. A glob without a / is matched against the file name, one with a / against the whole path.")
+var catch_up_rotations = flag.Bool("catch-up-rotations", false, "At startup, also ship the older rotations of each file (file.1, file-20130102, ...), oldest first, before the file itself.")
+var harvest_delay = flag.Duration("harvest-delay", 0, "Wait this long after a new file appears before harvesting it, skipping it if it's gone or renamed by then. It is then read from the beginning.")
+var seen_cache = flag.String("seen-cache", "", "Remember the ids of acknowledged events in this file, and drop events harvested again after a restart whose ids it holds. Needs -event-ids derived.")
+var seen_cache_size = flag.Int("seen-cache-size", 100000, "The most event ids the -seen-cache keeps.")
+var seen_cache_max_age = flag.Duration("seen-cache-max-age", time.Hour, "How long the -seen-cache keeps an event id. 0 means no age limit.")
+var event_ids = flag.String("event-ids", "", "Give each event an id so the collector can drop duplicates: 'derived' from the host, the file (path and inode, or content with -fingerprint-identity) and offset (the same across restarts; random for stdin), or 'random'. None by default.")
+var open_retries = flag.Int("open-retries", 0, "Stop trying to open a file (one that is locked or missing, say) after this many failed retries, backing off up to 5 seconds apart. 0 retries forever.")
+var max_events_per_file = flag.Uint64("max-events-per-file", 0, "Stop harvesting a file after this many events, to sample or throttle a backfill of big historical files. 0 means no limit.")
+var max_open_files = flag.Int("max-open-files", 0, "The most log files to hold open at once. Over it, the harvesters idle the longest close their files, keeping their place, and reopen them when they grow. Leave headroom under the process's fd limit for sockets. 0 means no limit.")
+var backfill_rate = flag.Float64("backfill-rate", 0, "Limit harvesters more than -backfill-distance behind the end of their file, such as when reading big files from the beginning after a restart, to this many events per second in all. Each ships at full speed once caught up. 0 disables.")
+var backfill_distance = flag.Int64("backfill-distance", 1 << 20, "With -backfill-rate, how many bytes behind the end of its file a harvester must be to be limited.")
+var caught_up_behind = flag.Int64("caught-up-behind", 0, "Log, and count in lumberjack_harvesters_caught_up_total, when a harvester that started more than this many bytes from the end of its file first reaches it. 0 disables.")
+var caught_up_events = flag.Bool("caught-up-events", false, "With -caught-up-behind, also ship an event with source 'lumberjack:caught_up' when a harvester catches up.")
+var partial_line_wait = flag.Duration("partial-line-wait", time.Second, "How long to wait for a writer to finish a line found without its newline at the end of a file, before shipping it as is.")
+var read_chunk_size = flag.Int("read-chunk-size", 16 << 10, "How many bytes each harvester reads from its file at a time.")
+var rotated_linger = flag.Duration("rotated-linger", time.Minute, "How long to keep reading a file after it was rotated away, once it stops growing.")
 var server_timeout = flag.Duration("server-timeout", 30 * time.Second, "Maximum time to wait for a request to a server before giving up and trying another.")
+var send_poll_retries = flag.Int("send-poll-retries", 2, "How many more times to wait -server-timeout for a busy server to accept a request before reconnecting. Errors sending always reconnect.")
+var liveness_interval = flag.Duration("liveness-interval", 0, "If nonzero, ship a synthetic liveness event this often, so the collector can alert on a node that goes quiet. 0 disables.")
+var liveness_node = flag.String("liveness-node", "", "The node name in liveness events. Defaults to the hostname.")
+var liveness_fields = flag.String("liveness-fields", "", "Extra fields for liveness events, as a comma-separated list of name=value.")
+var memory_limit = flag.Uint64("memory-limit", 0, "Soft limit on heap size, in bytes. Harvesting pauses while over it, rather than buffering until the process is killed. 0 disables.")
+var admin_addr = flag.String("admin-addr", "", "Address (host:port) to serve the admin http endpoints, such as /metrics and /status, on. Disabled if empty.")
+var admin_debug = flag.Bool("admin-debug", false, "Also serve /debug/pipeline on -admin-addr, with the depth of each internal channel and the number of harvesters and goroutines.")
+var statsd_addr = flag.String("statsd-addr", "", "Address (host:port) of a statsd or dogstatsd server to also send metrics to over udp. Disabled if empty.")
+var drop_log_interval = flag.Duration("drop-log-interval", 5 * time.Minute, "How often to log how many events were dropped (as duplicates, header lines, etc), if any were. 0 disables.")
+var statsd_interval = flag.Duration("statsd-interval", 10 * time.Second, "How often to send metrics to -statsd-addr.")
 var servers = flag.String("servers", "", "Server (or comma-separated list of servers) to send events to. Each server can be a 'host' or 'host:port'. If the port is not specified, port 5005 is assumed. One server is chosen of the list at random, and only on failure is another server used.")
+var also_servers = flag.String("also-servers", "", "More pools of servers to ship every batch to, separated by ';'; each pool is a list of servers like -servers, optionally followed by @ and the file of the public key of that pool's servers if it isn't -their-public-key. A batch is only acknowledged once every pool has it.")
+var best_effort_servers = flag.String("best-effort-servers", "", "Like -also-servers, but these pools don't hold up acknowledging a batch; batches are dropped for a pool that is down or falls behind.")
+var route_field = flag.String("route-field", "", "Route events by the value of this field (a dotted path into an event's fields), to the pools in -route-servers.")
+var route_servers = flag.String("route-servers", "", "With -route-field, pools of servers for events with given values of it, as values=servers separated by ';', such as error|fatal=alerts1:5005,alerts2:5005, each pool with an optional @keyfile as in -also-servers. Events with any other value go to -servers and -also-servers as usual.")
+var serialization = flag.String("serialization", "json", "How to serialize batches: 'json' or 'protobuf' (see event.proto). The server must understand protobuf payloads.")
+var output_format = flag.String("output-format", "", "How to shape events for the server. The default is lumberjack's own; 'gelf' ships GELF messages for Graylog.")
+var compression_codec = flag.String("compression-codec", "zlib", "How to compress batches: 'zlib'; 'gzip', where each batch is a gzip member that archival collectors can append to a file as is; or 'zstd' for a better ratio for the cpu spent. Only use zstd with servers that support it; it also needs a build with -tags zstd.")
+var compression_level_min = flag.Int("compression-level-min", 1, "With -compression-level-max, the lowest zlib or gzip level to tune down to under CPU pressure.")
+var compression_level_max = flag.Int("compression-level-max", 0, "If set, tune the zlib or gzip level between -compression-level-min and this to the CPU compression takes, rather than always using level 3.")
+var compression_cpu_target = flag.Float64("compression-cpu-target", 0.25, "With -compression-level-max, the share of one CPU compression may take; above it the level goes down, below half of it up.")
+var compress_workers = flag.Int("compress-workers", 1, "How many batches to compress at once, ahead of shipping. More than 1 lets a busy publisher use more cores; batches are still shipped in order, unless -ordering relaxed.")
+var reuse_buffers = flag.Bool("reuse-buffers", true, "Compress batches into buffers, with compressors, pooled across -compress-workers instead of allocated for each batch, for less garbage collection.")
+var ordering = flag.String("ordering", "strict", "With -compress-workers, 'strict' ships batches in the order they were spooled; 'relaxed' ships each as soon as it is compressed, so a file's events may reach the servers out of order (each carries its source, offset and line for the collector to reorder by).")
+var trace_timing = flag.Bool("trace-timing", false, "Log the time each batch took to serialize, compress, encrypt and send, and the sizes it came to, as JSON, to find the bottleneck under load.")
+var trace_file = flag.String("trace-file", "", "With -trace-timing, write the records to this file instead of the log.")
+var verify_compression = flag.Bool("verify-compression", false, "Decompress each compressed batch and check it against the original before shipping it, giving up on the batch if they differ. Costs cpu.")
+var size_header = flag.Bool("size-header", false, "Put each batch's uncompressed size and event count in its payload, for servers that check them.")
+var compress_min_bytes = flag.Int("compress-min-bytes", 0, "Ship batches smaller than this many bytes (of json) uncompressed. Not with -compression-codec gzip, which always ships gzip.")
+var min_compression_gain = flag.Float64("min-compression-gain", 0, "Ship batches that compression makes less than this many percent smaller uncompressed, be they tiny or incompressible. 0 only ships those it didn't shrink at all uncompressed. Not with -compression-codec gzip, which always ships gzip.")
+var transport_compression = flag.Bool("transport-compression", false, "The network between here and the servers already compresses (a compressing VPN, say), so ship batches uncompressed rather than compressing twice.")
+var linger = flag.Duration("linger", time.Second, "On shutdown, how long to wait for unsent data to go out to a server. Connections to servers that stopped responding are always dropped at once.")
+var connect_log_interval = flag.Duration("connect-log-interval", time.Minute, "Log each kind of repeated connect or send failure message at most this often during an outage. 0 logs every one.")
+var source_ports = flag.String("source-ports", "", "Connect to servers from a local port in this range, such as 40000-40099, for firewalls that only allow known egress ports. Keep it out of the system's ephemeral port range (net.ipv4.ip_local_port_range), and wide enough for a port per connection. Any port by default. Needs libzmq 4.1 or later, newer than the bundled zeromq.")
+var immediate = flag.Bool("immediate", false, "Only queue batches to a server connection that is up rather than one still connecting (ZMQ_IMMEDIATE).")
+var prewarm = flag.Bool("prewarm", false, "At startup, connect to every server given, not just the one in use, and keep those connections ready for failover.")
+var healthcheck_interval = flag.Duration("healthcheck-interval", 0, "If nonzero, ping every server this often with an empty batch, and avoid servers that don't reply (within -server-timeout) when choosing one. 0 disables.")
+var pause_latency = flag.Duration("pause-latency", 0, "Pause harvesting while servers take longer than this on average to acknowledge a batch, so an overloaded collector can recover. 0 disables.")
+var resume_latency = flag.Duration("resume-latency", 0, "With -pause-latency, resume harvesting once servers acknowledge within this on average. Defaults to half of -pause-latency.")
+var max_latency_pause = flag.Duration("max-latency-pause", 5 * time.Second, "With -pause-latency, resume harvesting after pausing this long, to try the servers again, even if nothing showed they recovered.")
+var preconnect = flag.Bool("preconnect", false, "Connect to a server at startup instead of waiting for the first batch of events.")
+var max_send_attempts = flag.Int("max-send-attempts", 0, "Give up on a batch after this many failed attempts to send it. 0 means retry forever.")
+var dead_letter_path = flag.String("dead-letter", "", "File to append batches to when they are given up on (see -max-send-attempts).")
+var replay_path = flag.String("replay", "", "Ship the batches stored in this dead letter file, then exit.")
+var endpoint_strategy = flag.String("endpoint-strategy", "random", "How to choose among -servers: 'random', or 'latency' to prefer the server that has been answering fastest.")
+var identity = flag.String("identity", "", "The zmq identity to present to servers, so a ROUTER server can recognize this client across reconnects. Defaults to the hostname plus a random suffix.")
+var post_ship_hook = flag.String("post-ship-hook", "", "A command (run with sh -c) or http(s) url to send a JSON summary of each acknowledged batch to. Commands get the summary on stdin; urls get it POSTed.")
+var reconnect_alert = flag.Int("reconnect-alert", 0, "After this many connection attempts in a row without a reply from the servers, log an ERROR, write a connectivity_lost record to the -error-file and set the lumberjack_connectivity_lost gauge, while still retrying. 0 disables.")
+var reconnect_alert_hook = flag.Bool("reconnect-alert-hook", false, "Also tell the -post-ship-hook when -reconnect-alert fires, and when the servers reply again.")
+var post_ship_hook_timeout = flag.Duration("post-ship-hook-timeout", 10 * time.Second, "Maximum time a -post-ship-hook may take.")
+var file_sink = flag.String("file-sink", "", "Also write every batch to this file as newline-delimited JSON. With no -servers, only write the file.")
+var file_sink_required = flag.Bool("file-sink-required", true, "Only acknowledge a batch once it is in -file-sink, as well as shipped.")
+var file_sink_max_size = flag.Int64("file-sink-max-size", 0, "Rotate -file-sink once it would grow past this many bytes. 0 never rotates.")
+var file_sink_max_files = flag.Int("file-sink-max-files", 5, "Number of rotated -file-sink files to keep.")
+var bundle_path = flag.String("bundle", "", "A JSON file holding flags, paths and keys in one; see liblumberjack/bundle.go. Flags given on the command line override it.")
 var their_public_key_path = flag.String("their-public-key", "", "the file containing the NaCl public key for the server you are talking to.")
 var our_secret_key_path = flag.String("my-secret-key", "", "the file containing the NaCl secret key for this process to encrypt with. If none is given, one is generated at runtime.")
+var strict_key_perms = flag.Bool("strict-key-perms", false, "Refuse to start if the -my-secret-key file can be read by anyone but its owner, rather than only warning.")
 //var our_public_key_path = flag.String("my-public-key", "", "the file containing the NaCl public key for this process to encrypt with. If you specify this, you MUST specify -my-private-key.")
 
 func read_key(path string, key []byte) (err error) {
@@ -26,14 +142,99 @@ func read_key(path string, key []byte) (err error) {
     return
   }
 
-  // TODO(sissel): check length of read
-  _, err = file.Read(key)
+  defer file.Close()
+  n, err := io.ReadFull(file, key)
+  if err == io.ErrUnexpectedEOF || err == io.EOF {
+    err = fmt.Errorf("%s holds %d bytes, not a %d byte key", path, n, len(key))
+  }
+  return
+}
+
+// A pool of servers, given as a list like -servers, optionally followed by
+// @ and a file holding the public key of that pool's servers, for a
+// collector whose key isn't -their-public-key.
+func pool_of(spec string) lumberjack.Pool {
+  var pool lumberjack.Pool
+  if at := strings.LastIndex(spec, "@"); at >= 0 {
+    pool.PublicKey = make([]byte, sodium.PUBLICKEYBYTES)
+    if err := read_key(spec[at + 1:], pool.PublicKey); err != nil {
+      log.Fatalf("Unable to read the public key for pool %s: %s\n", spec[:at], err)
+    }
+    spec = spec[:at]
+  }
+  pool.Servers = server_endpoints(spec)
+  return pool
+}
+
+// Turn 'host' and 'host:port' into 'tcp://host:port'
+func server_endpoints(servers string) []string {
+  server_list := strings.Split(servers, ",")
+  for i, server := range server_list {
+    if !strings.Contains(server, ":") {
+      server_list[i] = "tcp://" + server + ":5005"
+    } else {
+      server_list[i] = "tcp://" + server
+    }
+  }
+  return server_list
+}
+
+// On SIGINT or SIGTERM, log the exit summary, then exit as the signal
+// would have.
+func summary_on_signal() {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+  sig := <-signals
+  log.Printf("Exiting on %s: %s\n", sig, lumberjack.ExitSummary())
+  os.Exit(128 + int(sig.(syscall.Signal)))
+}
+
+// Writes -trace-timing records to the log.
+type trace_log struct{}
+
+func (trace_log) Write(data []byte) (int, error) {
+  log.Printf("Batch timing: %s", data)
+  return len(data), nil
+}
+
+// Split a comma-separated flag value, ignoring empty entries.
+func split_list(value string) (list []string) {
+  for _, item := range strings.Split(value, ",") {
+    if item != "" {
+      list = append(list, item)
+    }
+  }
+  return
+}
+
+// The first and last port of a -source-ports range, or 0 and 0 for none.
+func port_range(value string) (first int, last int) {
+  if value == "" {
+    return 0, 0
+  }
+  var extra string
+  if n, _ := fmt.Sscanf(value, "%d-%d%s", &first, &last, &extra); n != 2 ||
+     first < 1 || first > last || last > 65535 {
+    log.Fatalf("-source-ports must be a range of ports, such as 40000-40099, not %s\n", value)
+  }
   return
 }
 
 func main() {
   flag.Parse()
 
+  var bundle *lumberjack.Bundle
+  if *bundle_path != "" {
+    var err error
+    if bundle, err = lumberjack.LoadBundle(*bundle_path); err != nil {
+      log.Fatalf("Unable to load bundle: %s\n", err)
+    }
+    if err = bundle.Apply(flag.CommandLine); err != nil {
+      log.Fatalf("Unable to load bundle %s: %s\n", *bundle_path, err)
+    }
+    lumberjack.RegisterStatus("bundle", bundle.Redacted)
+  }
+
   if *cpuprofile != "" {
     f, err := os.Create(*cpuprofile)
     if err != nil {
@@ -47,54 +248,93 @@ func main() {
     }()
   }
 
-  if *their_public_key_path == "" {
+  if *their_public_key_path == "" && bundle == nil && *servers != "" {
     log.Fatalf("No -their-public-key flag given")
   }
 
-  // Turn 'host' and 'host:port' into 'tcp://host:port'
-  if *servers == "" {
+  if *servers == "" && *file_sink == "" {
     log.Fatalf("No servers specified, please provide the -servers setting\n")
   }
 
-  server_list := strings.Split(*servers, ",")
-  for i, server := range server_list {
-    if !strings.Contains(server, ":") {
-      server_list[i] = "tcp://" + server + ":5005"
-    } else {
-      server_list[i] = "tcp://" + server
-    }
+  var server_list []string
+  if *servers != "" {
+    server_list = server_endpoints(*servers)
   }
 
   log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+  if *log_file != "" {
+    log.SetOutput(&lumberjack.LogFile{Path: *log_file, MaxSize: *log_max_size,
+                                      MaxFiles: *log_max_files})
+  }
+  if *error_file == "-" {
+    lumberjack.SetErrorStream(os.Stdout)
+  } else if *error_file != "" {
+    lumberjack.SetErrorStream(&lumberjack.LogFile{Path: *error_file, MaxSize: *log_max_size,
+                                                  MaxFiles: *log_max_files})
+  }
+  if *exit_summary {
+    go summary_on_signal()
+  }
 
   // TODO(sissel): support flags for setting... stuff
+  if *publisher_buffer < 0 {
+    log.Fatalf("-publisher-buffer must be 0 or more batches, not %d\n", *publisher_buffer)
+  }
   event_chan := make(chan *lumberjack.FileEvent, 16)
-  publisher_chan := make(chan []*lumberjack.FileEvent, 1)
+  publisher_chan := make(chan []*lumberjack.FileEvent, *publisher_buffer)
   registrar_chan := make(chan []*lumberjack.FileEvent, 1)
 
   paths := flag.Args()
+  if len(paths) == 0 && bundle != nil {
+    paths = bundle.Paths
+  }
 
-  if len(paths) == 0 {
+  if len(paths) == 0 && *replay_path == "" {
     log.Fatalf("No paths given. What files do you want me to watch?\n")
   }
 
+  if *strict_paths {
+    errors := lumberjack.CheckPaths(paths)
+    for _, err := range errors {
+      log.Printf("Unreadable path: %s\n", err)
+    }
+    if len(errors) > 0 {
+      log.Fatalf("Refusing to start with unreadable paths (-strict-paths)\n")
+    }
+  }
+
   var public_key [sodium.PUBLICKEYBYTES]byte
+  var secret_key [sodium.SECRETKEYBYTES]byte
 
-  err := read_key(*their_public_key_path, public_key[:])
-  if err != nil {
-    log.Fatalf("Unable to read public key path (%s): %s\n",
-               *their_public_key_path, err)
+  if bundle != nil && *their_public_key_path == "" {
+    copy(public_key[:], bundle.TheirPublicKey)
+  } else if *their_public_key_path != "" {
+    err := read_key(*their_public_key_path, public_key[:])
+    if err != nil {
+      lumberjack.ReportError(lumberjack.ERR_KEY, "Unable to read the server's public key",
+                             map[string]interface{}{"path": *their_public_key_path,
+                                                    "error": err.Error()})
+      log.Fatalf("Unable to read public key path (%s): %s\n",
+                 *their_public_key_path, err)
+    }
   }
 
-  var secret_key [sodium.SECRETKEYBYTES]byte
-  if *our_secret_key_path  == "" {
+  if bundle != nil && bundle.MySecretKey != nil && *our_secret_key_path == "" {
+    copy(secret_key[:], bundle.MySecretKey)
+  } else if *our_secret_key_path  == "" {
     log.Printf("No secret key given; generating one.")
     _, secret_key = sodium.CryptoBoxKeypair()
   } else {
+    if err := lumberjack.CheckKeyPermissions(*our_secret_key_path, *strict_key_perms); err != nil {
+      log.Fatalf("Refusing to use the secret key: %s\n", err)
+    }
     err := read_key(*our_secret_key_path, secret_key[:])
     if err != nil {
       log.Printf("Unable to read secret key (%s): %s\n",
                  *our_secret_key_path, err)
+      lumberjack.ReportError(lumberjack.ERR_KEY, "Unable to read the secret key; generated one",
+                             map[string]interface{}{"path": *our_secret_key_path,
+                                                    "error": err.Error()})
       log.Printf("Generating a key pair now.\n")
       _, sk := sodium.CryptoBoxKeypair()
       copy(secret_key[:], sk[:])
@@ -110,14 +350,333 @@ func main() {
   // Finally, prospector uses the registrar information, on restart, to
   // determine where in each file to resume a harvester.
 
+  if *admin_addr != "" {
+    if *admin_debug {
+      lumberjack.RegisterChannel("event_chan", event_chan)
+      lumberjack.RegisterChannel("publisher_chan", publisher_chan)
+      lumberjack.RegisterChannel("registrar_chan", registrar_chan)
+      lumberjack.EnableDebug()
+    }
+    go lumberjack.ServeAdmin(*admin_addr)
+  }
+  if *memory_limit > 0 {
+    limit := lumberjack.MemoryLimit{Limit: *memory_limit}
+    go limit.Watch()
+  }
+  if *drop_log_interval > 0 {
+    go lumberjack.LogDrops(*drop_log_interval)
+  }
+
+  if *statsd_addr != "" {
+    _, err := lumberjack.StartStatsd(*statsd_addr, *statsd_interval)
+    if err != nil {
+      log.Fatalf("Unable to send metrics to statsd at %s: %s\n", *statsd_addr, err)
+    }
+  }
+
+  publisher := lumberjack.Publisher{
+    Servers: server_list,
+    PublicKey: public_key,
+    SecretKey: secret_key,
+    Timeout: *server_timeout,
+    MaxAttempts: *max_send_attempts,
+    DeadLetter: *dead_letter_path,
+    Preconnect: *preconnect,
+    Prewarm: *prewarm,
+    HealthInterval: *healthcheck_interval,
+    MaxEventAge: *max_event_age,
+    Identity: *identity,
+    SendPollRetries: *send_poll_retries,
+    CompressWorkers: *compress_workers,
+    Ordering: *ordering,
+    ReuseBuffers: *reuse_buffers,
+    CompressMinBytes: *compress_min_bytes,
+    MinCompressionGain: *min_compression_gain,
+    SizeHeader: *size_header,
+    VerifyCompression: *verify_compression,
+    Linger: *linger,
+    Immediate: *immediate,
+    ConnectLogInterval: *connect_log_interval,
+    ReconnectAlert: *reconnect_alert,
+    AlertHook: *reconnect_alert_hook,
+    PostShipHook: *post_ship_hook,
+    PostShipHookTimeout: *post_ship_hook_timeout,
+  }
+  publisher.SourcePortMin, publisher.SourcePortMax = port_range(*source_ports)
+  if publisher.SourcePortMin > 0 && !lumberjack.SourcePortsAvailable() {
+    log.Fatalf("-source-ports needs libzmq 4.1 or later, which this build isn't linked with\n")
+  }
+
+  if *min_compression_gain < 0 || *min_compression_gain >= 100 {
+    log.Fatalf("-min-compression-gain must be a percentage, from 0 to below 100\n")
+  }
+  switch *ordering {
+    case lumberjack.ORDERING_STRICT, lumberjack.ORDERING_RELAXED:
+    default:
+      log.Fatalf("Unknown -ordering: %s\n", *ordering)
+  }
+  if *ordering == lumberjack.ORDERING_RELAXED && *compress_workers <= 1 {
+    log.Printf("-ordering relaxed changes nothing without -compress-workers above 1\n")
+  }
+
+  for _, pool := range strings.Split(*also_servers, ";") {
+    if pool != "" {
+      publisher.Pools = append(publisher.Pools, pool_of(pool))
+    }
+  }
+  for _, route := range strings.Split(*route_servers, ";") {
+    if route == "" {
+      continue
+    }
+    pair := strings.SplitN(route, "=", 2)
+    if len(pair) != 2 || *route_field == "" {
+      log.Fatalf("Invalid -route-servers entry (expected values=servers, with -route-field): %s\n", route)
+    }
+    pool := pool_of(pair[1])
+    pool.Route = strings.Split(pair[0], "|")
+    publisher.Pools = append(publisher.Pools, pool)
+  }
+  publisher.RouteField = *route_field
+  for _, pool := range strings.Split(*best_effort_servers, ";") {
+    if pool != "" {
+      pool := pool_of(pool)
+      pool.BestEffort = true
+      publisher.Pools = append(publisher.Pools, pool)
+    }
+  }
+  if *pause_latency > 0 {
+    publisher.LatencyLimit = &lumberjack.LatencyLimit{High: *pause_latency, Low: *resume_latency,
+                                                      MaxPause: *max_latency_pause}
+  }
+  if err := publisher.CheckKeys(); err != nil {
+    log.Fatalf("Invalid pool keys: %s\n", err)
+  }
+  if *file_sink != "" {
+    publisher.FileSink = &lumberjack.FileSink{Path: *file_sink, Required: *file_sink_required,
+                                              MaxSize: *file_sink_max_size,
+                                              MaxFiles: *file_sink_max_files}
+  }
+
+  switch *compression_codec {
+    case "zlib", "gzip":
+    case "zstd":
+      if !lumberjack.ZstdAvailable() {
+        log.Fatalf("-compression-codec zstd needs a build with -tags zstd\n")
+      }
+    default:
+      log.Fatalf("Unknown compression codec: %s\n", *compression_codec)
+  }
+  if *compression_level_max > 0 {
+    if *compression_level_min < 1 || *compression_level_min > *compression_level_max ||
+       *compression_level_max > 9 {
+      log.Fatalf("Compression levels must be from 1 to 9, with -compression-level-min at most -compression-level-max\n")
+    }
+    publisher.Levels = &lumberjack.LevelTuner{Min: *compression_level_min,
+                                              Max: *compression_level_max,
+                                              Target: *compression_cpu_target}
+  }
+  publisher.Compression = *compression_codec
+  if *trace_timing && *trace_file != "" {
+    publisher.Trace = &lumberjack.LogFile{Path: *trace_file, MaxSize: *log_max_size,
+                                          MaxFiles: *log_max_files}
+  } else if *trace_timing {
+    publisher.Trace = trace_log{}
+  }
+  if *transport_compression {
+    publisher.Compression = "none"
+  }
+
+  switch *output_format {
+    case "", "gelf": publisher.OutputFormat = *output_format
+    default:
+      log.Fatalf("Unknown output format: %s\n", *output_format)
+  }
+  switch *serialization {
+    case "json", "protobuf": publisher.Serialization = *serialization
+    default:
+      log.Fatalf("Unknown serialization: %s\n", *serialization)
+  }
+  if *serialization == "protobuf" && *output_format == "gelf" {
+    log.Fatalf("GELF messages can only be serialized as json\n")
+  }
+
+  switch *endpoint_strategy {
+    case "random": publisher.Strategy = lumberjack.RandomEndpoint
+    case "latency": publisher.Strategy = lumberjack.LatencyAware
+    default:
+      log.Fatalf("Unknown endpoint strategy: %s\n", *endpoint_strategy)
+  }
+
+  if *replay_path != "" {
+    // Re-ship a dead letter file instead of harvesting.
+    go func() {
+      err := lumberjack.Replay(*replay_path, publisher_chan)
+      if err != nil {
+        log.Printf("Failed replaying %s: %s\n", *replay_path, err)
+      }
+      close(publisher_chan)
+    }()
+    publisher.Publish(publisher_chan, registrar_chan)
+    if *exit_summary {
+      log.Printf("Replay done: %s\n", lumberjack.ExitSummary())
+    }
+    return
+  }
+
   // Prospect the globs/paths given on the command line and launch harvesters
-  go lumberjack.Prospect(paths, event_chan)
+  prospector := lumberjack.Prospector{Paths: paths, HarvestDelay: *harvest_delay,
+                                      CatchUpRotations: *catch_up_rotations,
+                                      MaxHarvesters: *max_harvesters,
+                                      MaxHarvestersPerPath: *max_harvesters_per_path,
+                                      FollowDirSymlinks: *follow_dir_symlinks,
+                                      MaxTrackedFiles: *max_tracked_files,
+                                      ExcludeFiles: split_list(*exclude_files)}
+  prospector.Harvester.SkipBinary = *skip_binary
+  prospector.Harvester.KeepLineEnding = *keep_line_ending
+  prospector.Harvester.RotatedLinger = *rotated_linger
+  prospector.Harvester.SkipHeaderLines = *skip_header_lines
+  prospector.Harvester.StatRefresh = *stat_refresh
+  prospector.Harvester.OpenRetries = *open_retries
+  if *read_chunk_size < lumberjack.MinReadChunkSize {
+    log.Fatalf("-read-chunk-size must be at least %d bytes\n", lumberjack.MinReadChunkSize)
+  }
+  prospector.Harvester.ReadChunkSize = *read_chunk_size
+  prospector.Harvester.MaxEvents = *max_events_per_file
+  prospector.Harvester.PartialLineWait = *partial_line_wait
+  if *backfill_rate > 0 {
+    prospector.Harvester.Backfill = &lumberjack.Backfill{Rate: *backfill_rate,
+                                                         Distance: *backfill_distance}
+  }
+  prospector.Harvester.CaughtUpBehind = *caught_up_behind
+  prospector.Harvester.CaughtUpEvents = *caught_up_events
+  if *max_open_files > 0 {
+    prospector.Harvester.Files = &lumberjack.FileBudget{Max: *max_open_files}
+  }
+  switch *event_ids {
+    case lumberjack.ID_NONE, lumberjack.ID_DERIVED, lumberjack.ID_RANDOM:
+      prospector.Harvester.IDScheme = *event_ids
+    default:
+      log.Fatalf("Unknown -event-ids scheme: %s\n", *event_ids)
+  }
+  prospector.Harvester.FingerprintIdentity = *fingerprint_identity
+  prospector.Harvester.MtimeField = *mtime_field
+  if *since != "" {
+    cutoff, err := time.Parse(time.RFC3339, *since)
+    if err != nil {
+      log.Fatalf("Invalid -since time: %s\n", err)
+    }
+    pattern, err := regexp.Compile(*timestamp_pattern)
+    if err != nil {
+      log.Fatalf("Invalid -timestamp-pattern: %s\n", err)
+    }
+    if *since_unparsed != "ship" && *since_unparsed != "drop" {
+      log.Fatalf("Unknown -since-unparsed policy: %s\n", *since_unparsed)
+    }
+    prospector.Harvester.Since = &lumberjack.Since{Cutoff: cutoff, Pattern: pattern,
+                                                   Layout: *timestamp_layout,
+                                                   DropUnparsed: *since_unparsed == "drop"}
+  }
+  if *context_before > 0 {
+    pattern, err := regexp.Compile(*context_pattern)
+    if err != nil || *context_pattern == "" {
+      log.Fatalf("-context-before needs a valid -context-pattern: %v\n", err)
+    }
+    prospector.Harvester.Context = &lumberjack.ContextBefore{Lines: *context_before,
+                                                             Pattern: pattern,
+                                                             Field: *context_field}
+  }
+  if *ip_field != "" {
+    ip := *host_ip
+    if ip == "" && len(server_list) == 0 {
+      log.Fatalf("-ip-field needs -ip when there are no -servers\n")
+    } else if ip == "" {
+      var err error
+      ip, err = lumberjack.OutboundIP(server_list[0])
+      if err != nil {
+        log.Fatalf("Unable to find the IP address used to reach %s: %s\n",
+                   server_list[0], err)
+      }
+    }
+    prospector.Harvester.Fields = map[string]interface{}{*ip_field: ip}
+  }
+  var eof_chan chan bool
+  if *eof_flush_interval > 0 {
+    eof_chan = make(chan bool, 1)
+    prospector.Harvester.EOF = eof_chan
+  }
+  switch *codec {
+    case "":
+    case "json":
+      prospector.Harvester.Codec = &lumberjack.JSONCodec{
+        Include: split_list(*include_fields),
+        Exclude: split_list(*exclude_fields),
+        MaxDepth: *json_max_depth,
+        DepthPolicy: *json_depth_policy,
+      }
+      switch *json_depth_policy {
+        case lumberjack.DEPTH_TRUNCATE, lumberjack.DEPTH_FLATTEN, lumberjack.DEPTH_RAW:
+        default:
+          log.Fatalf("Unknown -json-depth-policy: %s\n", *json_depth_policy)
+      }
+    case "syslog":
+      switch *syslog_format {
+        case lumberjack.SYSLOG_AUTO, lumberjack.SYSLOG_RFC3164, lumberjack.SYSLOG_RFC5424:
+        default:
+          log.Fatalf("Unknown -syslog-format: %s\n", *syslog_format)
+      }
+      prospector.Harvester.Codec = &lumberjack.SyslogCodec{
+        Format: *syslog_format,
+        MarkMalformed: *syslog_mark_malformed,
+      }
+    default:
+      log.Fatalf("Unknown codec: %s\n", *codec)
+  }
+  go prospector.Prospect(event_chan)
+
+  if *liveness_interval > 0 {
+    liveness := lumberjack.Liveness{
+      Interval: *liveness_interval,
+      Node: *liveness_node,
+      Fields: make(map[string]interface{}),
+    }
+    for _, field := range split_list(*liveness_fields) {
+      pair := strings.SplitN(field, "=", 2)
+      if len(pair) != 2 {
+        log.Fatalf("Invalid -liveness-fields entry (expected name=value): %s\n", field)
+      }
+      liveness.Fields[pair[0]] = pair[1]
+    }
+    go liveness.Emit(event_chan)
+  }
 
   // Harvesters dump events into the spooler.
-  go lumberjack.Spool(event_chan, publisher_chan, *spool_size, *idle_timeout)
+  spooler := lumberjack.Spooler{
+    MaxSize: *spool_size,
+    IdleTimeout: *idle_timeout,
+    MaxEventAge: *max_event_age,
+    EOF: eof_chan,
+    MinFlushInterval: *eof_flush_interval,
+    BackpressureWarn: *backpressure_warn,
+    MaxPerSource: *max_per_source,
+  }
+  if *dedup_window > 0 {
+    spooler.Dedup = lumberjack.NewDeduper(*dedup_window, *dedup_max_age)
+  }
+  if *seen_cache != "" {
+    if *event_ids != lumberjack.ID_DERIVED {
+      log.Fatalf("-seen-cache needs -event-ids %s; other ids change across restarts\n", lumberjack.ID_DERIVED)
+    }
+    cache := &lumberjack.SeenCache{Path: *seen_cache, MaxEntries: *seen_cache_size,
+                                   MaxAge: *seen_cache_max_age}
+    if err := cache.Open(); err != nil {
+      log.Fatalf("Failed to open seen-cache %s: %s\n", *seen_cache, err)
+    }
+    spooler.Seen = cache
+    publisher.Seen = cache
+  }
+  go spooler.Spool(event_chan, publisher_chan)
 
-  lumberjack.Publish(publisher_chan, registrar_chan, server_list,
-                     public_key, secret_key, *server_timeout)
+  publisher.Publish(publisher_chan, registrar_chan)
 
   // TODO(sissel): registrar db path
   // TODO(sissel): registrar records last acknowledged positions in all files.
@@ -3,12 +3,9 @@ package main
 import (
   "log"
   zmq "github.com/alecthomas/gozmq"
-  "compress/zlib"
   "time"
   "sodium"
   lumberjack "liblumberjack"
-  "io"
-  "bytes"
   "encoding/json"
   "fmt"
 )
@@ -39,9 +36,6 @@ func main() {
     log.Fatalf("Failed to bind to %s.\n", endpoint)
   }
 
-  var buffer bytes.Buffer
-  var decompressed bytes.Buffer
-  tmp := make([]byte, 2048)
   count := 0
   start := time.Now()
 
@@ -57,23 +51,11 @@ func main() {
     plaintext := session.Open(nonce, ciphertext)
 
 
-    buffer.Truncate(0)
-    buffer.Write(plaintext)
-    zr, _ := zlib.NewReader(&buffer)
-    decompressed.Truncate(0)
-    for { 
-      n, err := zr.Read(tmp)
-        if n > 0 {
-          decompressed.Write(tmp[0:n])
-        }
-      if err == io.EOF {
-        break
-      }
-    }
-    zr.Close()
+    decompressed, err := lumberjack.DecodePayload(plaintext)
+    if err != nil { panic(fmt.Sprintf("DecodePayload: %s\n", err)) }
 
     var events []lumberjack.FileEvent
-    err = json.Unmarshal(decompressed.Bytes(), &events)
+    err = json.Unmarshal(decompressed, &events)
     if err != nil { panic("JSON Unmarshal failed") }
     count += len(events)
   }